@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"ark_deploy/internal/backup"
+	"ark_deploy/internal/config"
+	"ark_deploy/internal/storage"
+)
+
+// runExport implementa `ark-deploy export [-o archivo]`: escribe el backup en
+// JSON (stdout por defecto) sin levantar la API.
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	out := fs.String("o", "", "output file (default stdout)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	kv, closeStorage, ok := openStorageForCommand()
+	if !ok {
+		return 1
+	}
+	defer closeStorage()
+
+	snap, err := storage.Export(kv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "export failed:", err)
+		return 1
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(snap); err != nil {
+		fmt.Fprintln(os.Stderr, "export failed:", err)
+		return 1
+	}
+	return 0
+}
+
+// runImport implementa `ark-deploy import [-mode merge|replace] [-dry-run] archivo`.
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	mode := fs.String("mode", string(storage.RestoreMerge), "merge or replace")
+	dryRun := fs.Bool("dry-run", false, "validate and report without writing")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: import [-mode merge|replace] [-dry-run] <file>")
+		return 2
+	}
+
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var snap storage.Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid backup:", err)
+		return 1
+	}
+
+	kv, closeStorage, ok := openStorageForCommand()
+	if !ok {
+		return 1
+	}
+	defer closeStorage()
+
+	report, invalid, err := backup.Import(kv, snap, storage.RestoreMode(*mode), *dryRun)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "import failed:", err)
+		return 1
+	}
+	if len(invalid) > 0 {
+		fmt.Fprintln(os.Stderr, "invalid backup:")
+		for _, msg := range invalid {
+			fmt.Fprintln(os.Stderr, "  "+msg)
+		}
+		return 1
+	}
+
+	for _, c := range report.Counts {
+		fmt.Printf("%-9s created=%d updated=%d deleted=%d\n", c.Kind, c.Created, c.Updated, c.Deleted)
+	}
+	if report.DryRun {
+		fmt.Println("dry run: nothing was written")
+	}
+	return 0
+}
+
+func openStorageForCommand() (storage.KV, func(), bool) {
+	cfg, err := config.LoadStorage()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, false
+	}
+	kv, closeStorage, err := openStorage(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to open storage:", err)
+		return nil, nil, false
+	}
+	return kv, closeStorage, true
+}
@@ -1,37 +1,135 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 
 	"ark_deploy/internal/config"
+	"ark_deploy/internal/deployments"
+	"ark_deploy/internal/events"
+	"ark_deploy/internal/health"
+	"ark_deploy/internal/instances"
+	"ark_deploy/internal/jenkins"
+	"ark_deploy/internal/logarchive"
 	"ark_deploy/internal/redis"
 	"ark_deploy/internal/server"
 	"ark_deploy/internal/storage"
+	"ark_deploy/internal/webhooks"
 )
 
 func main() {
 	_ = godotenv.Load()
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			os.Exit(runMigrate(os.Args[2:]))
+		case "export":
+			os.Exit(runExport(os.Args[2:]))
+		case "import":
+			os.Exit(runImport(os.Args[2:]))
+		}
+	}
+
 	cfg, err := config.Load()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if err := redis.InitRedis(); err != nil {
-		log.Fatal("Failed to initialize Redis:", err)
+	kv, closeStorage, err := openStorage(cfg)
+	if err != nil {
+		log.Fatal("Failed to open storage:", err)
+	}
+	defer closeStorage()
+
+	// Los registros se llevan al esquema actual antes de armar los indices.
+	reports, err := storage.Migrate(kv, false)
+	if err != nil {
+		log.Fatal("Failed to migrate storage:", err)
+	}
+	rebuild := cfg.RebuildIndexes
+	for _, r := range reports {
+		if r.Migrated > 0 {
+			log.Printf("storage: migrated %d %s records to schema %d", r.Migrated, r.Kind, r.SchemaVersion)
+			rebuild = true
+		}
+	}
+
+	// Con Redis compartido otras replicas ya estan atendiendo: los indices
+	// solo se borran y rearman si faltan o se pide explicitamente.
+	rebuilt, err := storage.EnsureIndexes(kv, rebuild)
+	if err != nil {
+		log.Fatal("Failed to rebuild storage indexes:", err)
+	}
+	if rebuilt {
+		log.Printf("storage: rebuilt indexes")
+	}
+
+	productStore := storage.NewProductStore(kv)
+	instanceStore := storage.NewInstanceStore(kv)
+	routeStore := storage.NewRouteStore(kv)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bus := events.NewBus(kv, cfg.EventsMaxEntries)
+
+	checker := health.NewChecker(routeStore, instanceStore, productStore, cfg.HealthCheckInterval, cfg.HealthFailureThreshold).
+		WithEvents(bus)
+	go checker.Run(ctx)
+	go instances.RunLeaseJanitor(ctx, routeStore, 30*time.Second)
+	go storage.NewTrashStore(kv).RunPurger(ctx, cfg.TrashRetention, time.Hour)
+
+	logArchive, err := logarchive.Open(cfg.LogArchiveDir, cfg.LogArchiveMaxBytes)
+	if err != nil {
+		log.Fatal("Failed to open log archive:", err)
 	}
-	defer redis.CloseRedis()
+	jenkinsClient := jenkins.NewClient(cfg.JenkinsBaseURL, cfg.JenkinsUser, cfg.JenkinsAPIToken)
+	go logarchive.NewArchiver(logArchive, instanceStore, jenkinsClient, cfg.LogArchiveInterval).Run(ctx)
+	go deployments.NewBuildWatcher(kv, instanceStore, jenkinsClient, 30*time.Second).WithEvents(bus).Run(ctx)
 
-	productStore := storage.NewProductStore()
-	instanceStore := storage.NewInstanceStore()
+	// Cada replica consume con su hostname dentro del mismo grupo: cada evento
+	// genera sus entregas una sola vez. Lo que deja pendiente un hostname que
+	// ya no existe lo toma otra replica (Bus.Subscribe reclama lo inactivo).
+	consumer, _ := os.Hostname()
+	dispatcher := webhooks.NewDispatcher(storage.NewWebhookStore(kv)).
+		WithRetry(cfg.WebhookMaxAttempts, 0, 0).
+		WithAllowedNetworks(cfg.WebhookAllowedNetworks)
+	go bus.Subscribe(ctx, "webhooks", consumer, dispatcher.Enqueue, time.Second)
+	go dispatcher.Run(ctx, time.Second)
 
 	r := gin.Default()
-	server.RegisterRoutes(r, cfg, productStore, instanceStore)
+	// Sin proxies configurados la IP del cliente es la de la conexion y se
+	// ignora X-Forwarded-For: las politicas por IP o identidad de Tailscale no
+	// se pueden saltear mandando el header.
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatal("Invalid ARK_TRUSTED_PROXIES:", err)
+	}
+	ih := server.RegisterRoutes(r, cfg, kv, productStore, instanceStore, routeStore, logArchive, bus, dispatcher)
+	go ih.RunRouteReconciler(ctx, instanceStore, jenkinsClient, time.Minute)
 
 	if err := r.Run(":" + cfg.Port); err != nil {
 		log.Fatal(err)
 	}
 }
+
+// openStorage abre el backend elegido por ARK_STORAGE_BACKEND.
+func openStorage(cfg config.Config) (storage.KV, func(), error) {
+	if cfg.StorageBackend == "file" {
+		fileKV, err := storage.OpenFileKV(cfg.StoragePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		return fileKV, func() { fileKV.Close() }, nil
+	}
+
+	if err := redis.InitRedis(); err != nil {
+		return nil, nil, err
+	}
+	return storage.NewRedisKV(), func() { redis.CloseRedis() }, nil
+}
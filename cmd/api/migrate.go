@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"ark_deploy/internal/storage"
+)
+
+// runMigrate implementa `ark-deploy migrate [-dry-run]`: lleva los registros
+// guardados al esquema actual sin levantar la API.
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "only report records pending migration")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	kv, closeStorage, ok := openStorageForCommand()
+	if !ok {
+		return 1
+	}
+	defer closeStorage()
+
+	reports, err := storage.Migrate(kv, *dryRun)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "migration failed:", err)
+		return 1
+	}
+
+	verb := "migrated"
+	if *dryRun {
+		verb = "pending"
+	}
+	for _, r := range reports {
+		fmt.Printf("%-9s schema=%d scanned=%d %s=%d invalid=%d\n", r.Kind, r.SchemaVersion, r.Scanned, verb, r.Migrated, r.Invalid)
+	}
+	return 0
+}
@@ -0,0 +1,181 @@
+package audit
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"ark_deploy/internal/storage"
+	"ark_deploy/internal/tailscale"
+)
+
+// Auditoria de la API: el middleware registra cada llamada que cambia estado
+// (y las acciones de admin) con quien la hizo, desde donde y sobre que. Los
+// handlers que conocen el registro afectado llaman a Record con el antes y el
+// despues, y el middleware guarda solo los campos que cambiaron.
+
+// actions nombra las llamadas conocidas; el resto de las que cambian estado
+// bajo /api se registran como "<METHOD> <ruta>".
+var actions = map[string]string{
+	"POST /api/products":                "product.create",
+	"PUT /api/products/:id":             "product.update",
+	"DELETE /api/products/:id":          "product.delete",
+	"POST /api/products/:id/restore":    "product.restore",
+	"POST /api/deployments":             "deployment.create",
+	"DELETE /api/deployments/:id":       "deployment.delete",
+	"POST /api/deployments/:id/restore": "deployment.restore",
+	"PUT /api/ssh-users/:host":          "ssh_user.set",
+	"DELETE /api/ssh-users/:host":       "ssh_user.delete",
+	"POST /instances/register":          "route.register",
+	"DELETE /instances/:id":             "route.delete",
+	"POST /api/webhooks":                "webhook.create",
+	"PUT /api/webhooks/:id":             "webhook.update",
+	"DELETE /api/webhooks/:id":          "webhook.delete",
+	"GET /api/admin/export":             "admin.export",
+	"POST /api/admin/import":            "admin.import",
+}
+
+const changeKey = "audit.change"
+
+type change struct {
+	target string
+	before any
+	after  any
+}
+
+// Record asocia al request el registro afectado. before es nil al crear y
+// after es nil al borrar; target vacio usa los parametros de la ruta.
+func Record(c *gin.Context, target string, before, after any) {
+	c.Set(changeKey, change{target: target, before: before, after: after})
+}
+
+const skipKey = "audit.skip"
+
+// Skip evita la entrada de este request, p.ej. un heartbeat que no cambio nada.
+func Skip(c *gin.Context) {
+	c.Set(skipKey, true)
+}
+
+// Logger es donde se escriben las entradas; lo cumple storage.AuditLogStore.
+type Logger interface {
+	Append(e storage.AuditEntry) (string, error)
+}
+
+// Middleware registra las llamadas auditables al terminar el handler.
+// identities es opcional y agrega el usuario y dispositivo de Tailscale.
+func Middleware(logger Logger, identities tailscale.Identifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		action, ok := actionFor(c.Request.Method, c.FullPath())
+		if !ok || c.GetBool(skipKey) {
+			return
+		}
+
+		// ClientIP solo toma X-Forwarded-For de ARK_TRUSTED_PROXIES; el header
+		// crudo se guarda aparte como dato, sin usarlo para la identidad.
+		ip := c.ClientIP()
+		e := storage.AuditEntry{
+			Time:         time.Now().UTC(),
+			Actor:        ip,
+			ClientIP:     ip,
+			ForwardedFor: c.GetHeader("X-Forwarded-For"),
+			Action:       action,
+			Target:       paramsTarget(c),
+			Method:       c.Request.Method,
+			Path:         c.Request.URL.Path,
+			Status:       c.Writer.Status(),
+		}
+		if identities != nil {
+			if id, ok := identities.Identify(ip); ok && id.User != "" {
+				e.Actor = id.User
+				e.TailscaleUser = id.User
+				e.TailscaleDevice = id.Device
+			}
+		}
+
+		if v, ok := c.Get(changeKey); ok {
+			ch := v.(change)
+			if ch.target != "" {
+				e.Target = ch.target
+			}
+			e.Changes = Diff(ch.before, ch.after)
+		}
+
+		if _, err := logger.Append(e); err != nil {
+			log.Printf("audit: failed to record %s %s: %v", e.Action, e.Target, err)
+		}
+	}
+}
+
+func actionFor(method, fullPath string) (string, bool) {
+	if fullPath == "" {
+		return "", false
+	}
+	if action, ok := actions[method+" "+fullPath]; ok {
+		return action, true
+	}
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		if strings.HasPrefix(fullPath, "/api/") {
+			return method + " " + fullPath, true
+		}
+	}
+	return "", false
+}
+
+func paramsTarget(c *gin.Context) string {
+	values := make([]string, 0, len(c.Params))
+	for _, p := range c.Params {
+		values = append(values, p.Value)
+	}
+	return strings.Join(values, "/")
+}
+
+// Diff compara los campos de primer nivel del JSON de before y after y
+// devuelve los que cambiaron.
+func Diff(before, after any) map[string]storage.AuditChange {
+	b := asFields(before)
+	a := asFields(after)
+
+	out := map[string]storage.AuditChange{}
+	for k, bv := range b {
+		if av, ok := a[k]; !ok || !reflect.DeepEqual(bv, av) {
+			out[k] = storage.AuditChange{Before: bv, After: a[k]}
+		}
+	}
+	for k, av := range a {
+		if _, ok := b[k]; !ok {
+			out[k] = storage.AuditChange{After: av}
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+func asFields(v any) map[string]any {
+	if v == nil {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		// No es un objeto: se guarda entero bajo "value".
+		var raw any
+		if json.Unmarshal(data, &raw) == nil && raw != nil {
+			return map[string]any{"value": raw}
+		}
+		return nil
+	}
+	return fields
+}
@@ -0,0 +1,150 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"ark_deploy/internal/storage"
+	"ark_deploy/internal/tailscale"
+)
+
+type staticIdentities map[string]tailscale.Identity
+
+func (s staticIdentities) Identify(ip string) (tailscale.Identity, bool) {
+	id, ok := s[ip]
+	return id, ok
+}
+
+func setupAudit(t *testing.T) (*gin.Engine, *storage.AuditLogStore) {
+	t.Helper()
+	kv, err := storage.OpenFileKV(t.TempDir() + "/ark.db")
+	assert.NoError(t, err)
+	t.Cleanup(func() { kv.Close() })
+
+	store := storage.NewAuditLogStore(kv, 100)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	// Como en main sin ARK_TRUSTED_PROXIES.
+	_ = router.SetTrustedProxies(nil)
+	router.Use(Middleware(store, staticIdentities{
+		"100.64.0.7": {User: "alice@example.com", Device: "alice-laptop"},
+	}))
+
+	router.PUT("/api/products/:id", func(c *gin.Context) {
+		Record(c, "", gin.H{"name": "Shop", "web_port": 80}, gin.H{"name": "Shop v2", "web_port": 80})
+		c.JSON(http.StatusOK, gin.H{})
+	})
+	router.PUT("/api/deployments/:id/limits", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.POST("/instances/register", func(c *gin.Context) {
+		Skip(c)
+		c.Status(http.StatusOK)
+	})
+	router.GET("/api/products/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.POST("/instances/:id/*path", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	h := NewHandler(store)
+	router.GET("/api/audit", h.List)
+	router.GET("/api/audit/export", h.Export)
+	return router, store
+}
+
+func call(router *gin.Engine, method, path, ip string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.RemoteAddr = ip + ":40000"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestMiddleware_IgnoresSpoofedForwardedFor(t *testing.T) {
+	router, store := setupAudit(t)
+
+	// Un cliente fuera de la malla no puede hacerse pasar por alice.
+	req := httptest.NewRequest(http.MethodPut, "/api/deployments/abc123/limits", nil)
+	req.RemoteAddr = "10.0.0.9:40000"
+	req.Header.Set("X-Forwarded-For", "100.64.0.7")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	entries, _, err := store.List(storage.AuditQuery{})
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "10.0.0.9", entries[0].Actor)
+	assert.Equal(t, "10.0.0.9", entries[0].ClientIP)
+	assert.Empty(t, entries[0].TailscaleUser)
+	assert.Equal(t, "100.64.0.7", entries[0].ForwardedFor)
+}
+
+func TestMiddleware_RecordsMutatingCalls(t *testing.T) {
+	router, store := setupAudit(t)
+
+	call(router, http.MethodPut, "/api/products/shop", "100.64.0.7")
+	call(router, http.MethodPut, "/api/deployments/abc123/limits", "10.0.0.9")
+	// Lecturas, trafico del proxy y requests marcados con Skip no se auditan.
+	call(router, http.MethodPost, "/instances/register", "10.0.0.9")
+	call(router, http.MethodGet, "/api/products/shop", "10.0.0.9")
+	call(router, http.MethodPost, "/instances/abc123/login", "10.0.0.9")
+
+	entries, _, err := store.List(storage.AuditQuery{})
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	limits := entries[0]
+	assert.Equal(t, "PUT /api/deployments/:id/limits", limits.Action)
+	assert.Equal(t, "abc123", limits.Target)
+	assert.Equal(t, "10.0.0.9", limits.Actor)
+	assert.Empty(t, limits.TailscaleUser)
+
+	update := entries[1]
+	assert.Equal(t, "product.update", update.Action)
+	assert.Equal(t, "shop", update.Target)
+	assert.Equal(t, "alice@example.com", update.Actor)
+	assert.Equal(t, "alice-laptop", update.TailscaleDevice)
+	assert.Equal(t, "100.64.0.7", update.ClientIP)
+	assert.Equal(t, http.StatusOK, update.Status)
+	assert.Equal(t, map[string]storage.AuditChange{"name": {Before: "Shop", After: "Shop v2"}}, update.Changes)
+}
+
+func TestHandler_FiltersAndExports(t *testing.T) {
+	router, _ := setupAudit(t)
+	for i := 0; i < 3; i++ {
+		call(router, http.MethodPut, "/api/products/shop", "100.64.0.7")
+		call(router, http.MethodPut, "/api/deployments/abc123/limits", "10.0.0.9")
+	}
+
+	w := call(router, http.MethodGet, "/api/audit?action=product.&actor=alice@example.com&limit=2", "10.0.0.9")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var page struct {
+		Total      int                  `json:"total"`
+		Entries    []storage.AuditEntry `json:"entries"`
+		NextCursor string               `json:"next_cursor"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.Equal(t, 2, page.Total)
+	assert.NotEmpty(t, page.NextCursor)
+
+	w = call(router, http.MethodGet, "/api/audit?action=product.update&before="+page.NextCursor, "10.0.0.9")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.Equal(t, 1, page.Total)
+
+	assert.Equal(t, http.StatusBadRequest, call(router, http.MethodGet, "/api/audit?since=yesterday", "10.0.0.9").Code)
+
+	w = call(router, http.MethodGet, "/api/audit/export?target=abc123", "10.0.0.9")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	lines := 0
+	scanner := bufio.NewScanner(strings.NewReader(w.Body.String()))
+	for scanner.Scan() {
+		var e storage.AuditEntry
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		assert.Equal(t, "abc123", e.Target)
+		lines++
+	}
+	assert.Equal(t, 3, lines)
+}
@@ -0,0 +1,104 @@
+package audit
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"ark_deploy/internal/storage"
+)
+
+type Handler struct {
+	store *storage.AuditLogStore
+}
+
+func NewHandler(store *storage.AuditLogStore) *Handler {
+	return &Handler{store: store}
+}
+
+// parseQuery lee los filtros comunes: actor, action, target, since y until (RFC 3339).
+func parseQuery(c *gin.Context) (storage.AuditQuery, bool) {
+	q := storage.AuditQuery{
+		Actor:  strings.TrimSpace(c.Query("actor")),
+		Action: strings.TrimSpace(c.Query("action")),
+		Target: strings.TrimSpace(c.Query("target")),
+	}
+
+	for _, f := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		raw := strings.TrimSpace(c.Query(f.name))
+		if raw == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": f.name + " must be an RFC 3339 timestamp"})
+			return storage.AuditQuery{}, false
+		}
+		*f.dst = t
+	}
+	return q, true
+}
+
+// List devuelve la auditoria, lo mas nuevo primero; ?limit (1-1000, 100 por
+// defecto) y ?before=<next_cursor> paginan.
+func (h *Handler) List(c *gin.Context) {
+	q, ok := parseQuery(c)
+	if !ok {
+		return
+	}
+
+	q.Limit = 100
+	if raw := strings.TrimSpace(c.Query("limit")); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > 1000 {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": "limit must be between 1 and 1000"})
+			return
+		}
+		q.Limit = n
+	}
+	q.Before = strings.TrimSpace(c.Query("before"))
+
+	entries, next, err := h.store.List(q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+
+	resp := gin.H{"total": len(entries), "entries": entries}
+	if next != "" {
+		resp["next_cursor"] = next
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// Export descarga todas las entradas que cumplen los filtros en JSON Lines.
+func (h *Handler) Export(c *gin.Context) {
+	q, ok := parseQuery(c)
+	if !ok {
+		return
+	}
+
+	entries, _, err := h.store.List(q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", `attachment; filename="ark-audit-`+time.Now().UTC().Format("20060102T150405Z")+`.jsonl"`)
+	c.Status(http.StatusOK)
+
+	enc := json.NewEncoder(c.Writer)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package backup
+
+import (
+	"fmt"
+	"strings"
+
+	"ark_deploy/internal/instances"
+	"ark_deploy/internal/products"
+	"ark_deploy/internal/storage"
+	"ark_deploy/internal/webhooks"
+)
+
+// Export y import de todo el estado de ARK (ver storage.Snapshot). Antes de
+// escribir nada el backup se valida con las mismas reglas que la API.
+
+// Import valida el snapshot y, si no hay errores, lo restaura. Con errores de
+// validacion no escribe nada y los devuelve en invalid.
+func Import(kv storage.KV, snap storage.Snapshot, mode storage.RestoreMode, dryRun bool) (report storage.RestoreReport, invalid []string, err error) {
+	if mode != storage.RestoreMerge && mode != storage.RestoreReplace {
+		return storage.RestoreReport{}, nil, fmt.Errorf("mode must be merge or replace")
+	}
+	if err := storage.CheckSnapshot(snap); err != nil {
+		return storage.RestoreReport{}, []string{err.Error()}, nil
+	}
+
+	invalid, err = Validate(kv, snap, mode)
+	if err != nil || len(invalid) > 0 {
+		return storage.RestoreReport{}, invalid, err
+	}
+
+	report, err = storage.Restore(kv, snap, mode, dryRun)
+	return report, nil, err
+}
+
+// Validate devuelve un mensaje por registro invalido. Los destinos de los
+// aliases deben tener ruta en el backup o, en modo merge, en el estado actual.
+func Validate(kv storage.KV, snap storage.Snapshot, mode storage.RestoreMode) ([]string, error) {
+	var invalid []string
+	fail := func(kind, id string, err error) {
+		invalid = append(invalid, fmt.Sprintf("%s %q: %s", kind, id, err))
+	}
+
+	seen := map[string]bool{}
+	for _, p := range snap.Products {
+		id := strings.TrimSpace(p.ID)
+		if err := products.Validate(p); err != nil {
+			fail("product", id, err)
+		} else if seen[id] {
+			fail("product", id, fmt.Errorf("duplicated id"))
+		}
+		seen[id] = true
+	}
+
+	seen = map[string]bool{}
+	for _, i := range snap.Instances {
+		id := strings.TrimSpace(i.ID)
+		switch {
+		case id == "":
+			fail("instance", id, fmt.Errorf("id is required"))
+		case strings.TrimSpace(i.ProductID) == "":
+			fail("instance", id, fmt.Errorf("product_id is required"))
+		case seen[id]:
+			fail("instance", id, fmt.Errorf("duplicated id"))
+		}
+		seen[id] = true
+	}
+
+	routed := map[string]bool{}
+	for _, r := range snap.Routes {
+		id := strings.TrimSpace(r.InstanceID)
+		if err := instances.ValidateRoute(r); err != nil {
+			fail("route", id, err)
+		} else if routed[id] {
+			fail("route", id, fmt.Errorf("duplicated instance_id"))
+		}
+		routed[id] = true
+	}
+
+	routes := storage.NewRouteStore(kv)
+	seen = map[string]bool{}
+	for _, a := range snap.Aliases {
+		name := strings.ToLower(strings.TrimSpace(a.Name))
+		if err := instances.ValidateAlias(a); err != nil {
+			fail("alias", name, err)
+			continue
+		}
+		if seen[name] {
+			fail("alias", name, fmt.Errorf("duplicated name"))
+		}
+		seen[name] = true
+
+		for _, t := range a.Targets {
+			id := strings.TrimSpace(t.InstanceID)
+			if routed[id] {
+				continue
+			}
+			found := false
+			if mode == storage.RestoreMerge {
+				var err error
+				if _, found, err = routes.GetRouteRecord(id); err != nil {
+					return nil, err
+				}
+			}
+			if !found {
+				fail("alias", name, fmt.Errorf("instance %s has no route", id))
+			}
+		}
+	}
+
+	for host, id := range snap.Domains {
+		if strings.TrimSpace(host) == "" || strings.TrimSpace(id) == "" {
+			fail("domain", host, fmt.Errorf("host and instance id are required"))
+		}
+	}
+	for host, user := range snap.SSHUsers {
+		if strings.TrimSpace(host) == "" || strings.TrimSpace(user) == "" {
+			fail("ssh_user", host, fmt.Errorf("host and ssh_user are required"))
+		}
+	}
+
+	seen = map[string]bool{}
+	for _, w := range snap.Webhooks {
+		id := strings.TrimSpace(w.ID)
+		switch {
+		case id == "":
+			fail("webhook", id, fmt.Errorf("id is required"))
+		case strings.TrimSpace(w.Secret) == "":
+			fail("webhook", id, fmt.Errorf("secret is required"))
+		case seen[id]:
+			fail("webhook", id, fmt.Errorf("duplicated id"))
+		default:
+			if err := webhooks.Validate(w); err != nil {
+				fail("webhook", id, err)
+			}
+		}
+		seen[id] = true
+	}
+
+	return invalid, nil
+}
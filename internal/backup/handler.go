@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"ark_deploy/internal/audit"
+	"ark_deploy/internal/storage"
+)
+
+// maxImportBytes acota el cuerpo de /api/admin/import.
+const maxImportBytes = 64 << 20
+
+type Handler struct {
+	kv storage.KV
+}
+
+func NewHandler(kv storage.KV) *Handler {
+	return &Handler{kv: kv}
+}
+
+// Export descarga el backup como adjunto JSON.
+func (h *Handler) Export(c *gin.Context) {
+	snap, err := storage.Export(h.kv)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+
+	name := "ark-backup-" + snap.ExportedAt.Format("20060102T150405Z") + ".json"
+	c.Header("Content-Disposition", `attachment; filename="`+name+`"`)
+	c.JSON(http.StatusOK, snap)
+}
+
+// Import restaura un backup: ?mode=merge|replace (merge por defecto) y
+// ?dry_run=true para ver el reporte sin escribir.
+func (h *Handler) Import(c *gin.Context) {
+	mode := storage.RestoreMode(strings.ToLower(strings.TrimSpace(c.DefaultQuery("mode", string(storage.RestoreMerge)))))
+	if mode != storage.RestoreMerge && mode != storage.RestoreReplace {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "mode must be merge or replace"})
+		return
+	}
+	dryRun := false
+	if raw := strings.TrimSpace(c.Query("dry_run")); raw != "" {
+		v, err := strconv.ParseBool(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": "dry_run must be a boolean"})
+			return
+		}
+		dryRun = v
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBytes)
+	var snap storage.Snapshot
+	if err := c.ShouldBindJSON(&snap); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid backup: " + err.Error()})
+		return
+	}
+
+	report, invalid, err := Import(h.kv, snap, mode, dryRun)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+	if len(invalid) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid backup", "errors": invalid})
+		return
+	}
+
+	if !dryRun {
+		audit.Record(c, string(mode), nil, report)
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,130 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"ark_deploy/internal/storage"
+)
+
+func newTestRouter(t *testing.T) (*gin.Engine, storage.KV) {
+	t.Helper()
+	kv, err := storage.OpenFileKV(t.TempDir() + "/ark.db")
+	assert.NoError(t, err)
+	t.Cleanup(func() { kv.Close() })
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	h := NewHandler(kv)
+	router.GET("/admin/export", h.Export)
+	router.POST("/admin/import", h.Import)
+	return router, kv
+}
+
+func seed(t *testing.T, kv storage.KV) {
+	t.Helper()
+	assert.NoError(t, storage.NewProductStore(kv).Create(storage.Product{
+		ID:         "shop",
+		Name:       "Shop",
+		DeployJobs: map[string]string{"prod": "p", "dev": "d", "test": "t"},
+		DeleteJob:  "delete-shop",
+		Version:    1,
+	}))
+	assert.NoError(t, storage.NewInstanceStore(kv).Create(storage.Instance{ID: "abc123", ProductID: "shop", Status: "running"}))
+	assert.NoError(t, storage.NewRouteStore(kv).PutRoute("abc123", "10.0.0.5", 8080))
+	assert.NoError(t, storage.NewDomainStore(kv).Claim("shop.example.com", "abc123"))
+	assert.NoError(t, storage.NewAliasStore(kv).Create(storage.Alias{Name: "shop", Targets: []storage.AliasTarget{{InstanceID: "abc123", Weight: 100}}}))
+	assert.NoError(t, storage.NewSSHUserStore(kv).Set("host-1", "deploy"))
+}
+
+func postImport(router *gin.Engine, query string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/admin/import"+query, bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestExportImport_RoundTrip(t *testing.T) {
+	source, kv := newTestRouter(t)
+	seed(t, kv)
+
+	w := httptest.NewRecorder()
+	source.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/export", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "ark-backup-")
+	archive := w.Body.Bytes()
+
+	target, restored := newTestRouter(t)
+	assert.NoError(t, storage.NewSSHUserStore(restored).Set("stale-host", "old"))
+
+	// El dry run informa pero no escribe.
+	w = postImport(target, "?mode=replace&dry_run=true", archive)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var report storage.RestoreReport
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.True(t, report.DryRun)
+	assert.Contains(t, report.Counts, storage.RestoreCount{Kind: "ssh_user", Created: 1, Deleted: 1})
+	_, err := storage.NewProductStore(restored).GetByID("shop")
+	assert.Error(t, err)
+
+	w = postImport(target, "?mode=replace", archive)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	p, err := storage.NewProductStore(restored).GetByID("shop")
+	assert.NoError(t, err)
+	assert.Equal(t, "delete-shop", p.DeleteJob)
+	assert.Len(t, storage.NewProductStore(restored).GetAll(), 1)
+
+	page, err := storage.NewInstanceStore(restored).List(storage.InstanceQuery{ProductID: "shop"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, page.Total)
+
+	id, _, _, ok, _ := storage.NewRouteStore(restored).GetRouteByShortID("abc123")
+	assert.True(t, ok)
+	assert.Equal(t, "abc123", id)
+
+	owner, ok, _ := storage.NewDomainStore(restored).Resolve("shop.example.com")
+	assert.True(t, ok)
+	assert.Equal(t, "abc123", owner)
+
+	aliases, err := storage.NewAliasStore(restored).List()
+	assert.NoError(t, err)
+	assert.Len(t, aliases, 1)
+
+	users, _ := storage.NewSSHUserStore(restored).List()
+	assert.Equal(t, map[string]string{"host-1": "deploy"}, users)
+}
+
+func TestImport_RejectsInvalidBackup(t *testing.T) {
+	router, kv := newTestRouter(t)
+
+	snap, err := storage.Export(kv)
+	assert.NoError(t, err)
+	snap.Products = append(snap.Products, storage.Product{ID: "bad", Name: "Bad"})
+	snap.Routes = append(snap.Routes, storage.Route{InstanceID: "x1", TargetHost: "10.0.0.1", TargetPort: 70000})
+	snap.Aliases = append(snap.Aliases, storage.Alias{Name: "web", Targets: []storage.AliasTarget{{InstanceID: "missing", Weight: 100}}})
+	body, _ := json.Marshal(snap)
+
+	w := postImport(router, "", body)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var resp struct {
+		Errors []string `json:"errors"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Len(t, resp.Errors, 3)
+
+	// Nada se escribio.
+	assert.Empty(t, storage.NewProductStore(kv).GetAll())
+
+	snap.Format = 99
+	body, _ = json.Marshal(snap)
+	assert.Equal(t, http.StatusBadRequest, postImport(router, "", body).Code)
+	assert.Equal(t, http.StatusBadRequest, postImport(router, "?mode=overwrite", body).Code)
+}
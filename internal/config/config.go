@@ -3,9 +3,12 @@ package config
 import (
 	"errors"
 	"fmt"
+	"net"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Config struct {
@@ -19,6 +22,54 @@ type Config struct {
 	ARKPublicHost    string
 	DefaultSSHUser   string
 	SSHUserMap       map[string]string
+
+	HostRoutingDomain   string
+	FriendlyURLTemplate string
+
+	// TrustedProxies son las IPs/CIDR de los proxies de adelante (p.ej. el nginx
+	// del frontend). X-Forwarded-For solo se respeta si la conexion viene de uno.
+	TrustedProxies []string
+
+	// AdminToken habilita los endpoints de administracion (politica de acceso,
+	// export/import) fuera de la malla con el header X-ARK-Admin-Token.
+	AdminToken string
+
+	HealthCheckInterval    time.Duration
+	HealthFailureThreshold int
+
+	ProxyBreakerThreshold int
+	ProxyBreakerCooldown  time.Duration
+
+	AccessLogMaxEntries int
+
+	// AuditMaxEntries acota el stream de auditoria (las mas viejas se descartan).
+	AuditMaxEntries int
+
+	// EventsMaxEntries acota el stream del bus de eventos.
+	EventsMaxEntries int
+
+	// WebhookMaxAttempts es cuantas veces se intenta cada entrega de webhook.
+	WebhookMaxAttempts int
+
+	// WebhookAllowedNetworks son las redes internas (privadas, loopback, la
+	// malla) a las que si se pueden mandar webhooks.
+	WebhookAllowedNetworks []*net.IPNet
+
+	LogArchiveDir      string
+	LogArchiveInterval time.Duration
+	LogArchiveMaxBytes int64
+
+	// TrashRetention es cuanto quedan en la papelera los productos e instancias borrados.
+	TrashRetention time.Duration
+
+	// StorageBackend es "redis" (por defecto) o "file"; con "file" los datos
+	// van a StoragePath y no hace falta Redis.
+	StorageBackend string
+	StoragePath    string
+
+	// RebuildIndexes fuerza a reconstruir los indices al arrancar; sin el flag
+	// solo se reconstruyen si faltan.
+	RebuildIndexes bool
 }
 
 func Load() (Config, error) {
@@ -33,11 +84,29 @@ func Load() (Config, error) {
 		ARKPublicHost:    strings.TrimSpace(os.Getenv("ARK_PUBLIC_HOST")),
 		DefaultSSHUser:   strings.TrimSpace(os.Getenv("ARK_DEFAULT_SSH_USER")),
 		SSHUserMap:       parseSSHUserMap(strings.TrimSpace(os.Getenv("ARK_SSH_USER_MAP"))),
+
+		HostRoutingDomain:   normalizeDomain(os.Getenv("ARK_HOST_ROUTING_DOMAIN")),
+		FriendlyURLTemplate: strings.TrimSpace(os.Getenv("ARK_FRIENDLY_URL_TEMPLATE")),
+		TrustedProxies:      splitList(os.Getenv("ARK_TRUSTED_PROXIES")),
+		AdminToken:          strings.TrimSpace(os.Getenv("ARK_ADMIN_TOKEN")),
+
+		LogArchiveDir: strings.TrimSpace(os.Getenv("ARK_LOG_ARCHIVE_DIR")),
 	}
 
 	if cfg.Port == "" {
 		cfg.Port = "5050"
 	}
+	if cfg.LogArchiveDir == "" {
+		cfg.LogArchiveDir = "data/log-archive"
+	}
+
+	storageCfg, err := LoadStorage()
+	if err != nil {
+		return Config{}, err
+	}
+	cfg.StorageBackend = storageCfg.StorageBackend
+	cfg.StoragePath = storageCfg.StoragePath
+	cfg.RebuildIndexes = storageCfg.RebuildIndexes
 
 	var missing []string
 
@@ -67,7 +136,81 @@ func Load() (Config, error) {
 		return Config{}, errors.New("missing required env vars: " + strings.Join(missing, ", "))
 	}
 
-	var err error
+	healthInterval, err := envInt("ARK_HEALTH_CHECK_INTERVAL", 30)
+	if err != nil {
+		return Config{}, err
+	}
+	cfg.HealthCheckInterval = time.Duration(healthInterval) * time.Second
+
+	cfg.HealthFailureThreshold, err = envInt("ARK_HEALTH_FAILURE_THRESHOLD", 3)
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg.ProxyBreakerThreshold, err = envInt("ARK_PROXY_BREAKER_THRESHOLD", 5)
+	if err != nil {
+		return Config{}, err
+	}
+
+	breakerCooldown, err := envInt("ARK_PROXY_BREAKER_COOLDOWN", 30)
+	if err != nil {
+		return Config{}, err
+	}
+	cfg.ProxyBreakerCooldown = time.Duration(breakerCooldown) * time.Second
+
+	cfg.AccessLogMaxEntries, err = envInt("ARK_ACCESS_LOG_MAX_ENTRIES", 1000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg.AuditMaxEntries, err = envInt("ARK_AUDIT_MAX_ENTRIES", 100000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg.EventsMaxEntries, err = envInt("ARK_EVENTS_MAX_ENTRIES", 10000)
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg.WebhookMaxAttempts, err = envInt("ARK_WEBHOOK_MAX_ATTEMPTS", 6)
+	if err != nil {
+		return Config{}, err
+	}
+
+	archiveInterval, err := envInt("ARK_LOG_ARCHIVE_INTERVAL", 60)
+	if err != nil {
+		return Config{}, err
+	}
+	cfg.LogArchiveInterval = time.Duration(archiveInterval) * time.Second
+
+	archiveMaxMB, err := envInt("ARK_LOG_ARCHIVE_MAX_MB", 1024)
+	if err != nil {
+		return Config{}, err
+	}
+	cfg.LogArchiveMaxBytes = int64(archiveMaxMB) << 20
+
+	trashRetention, err := envInt("ARK_TRASH_RETENTION_HOURS", 168)
+	if err != nil {
+		return Config{}, err
+	}
+	cfg.TrashRetention = time.Duration(trashRetention) * time.Hour
+
+	for _, raw := range splitList(os.Getenv("ARK_WEBHOOK_ALLOWED_NETWORKS")) {
+		network, err := parseNetwork(raw)
+		if err != nil {
+			return Config{}, fmt.Errorf("ARK_WEBHOOK_ALLOWED_NETWORKS must be IPs or CIDRs, got: %q", raw)
+		}
+		cfg.WebhookAllowedNetworks = append(cfg.WebhookAllowedNetworks, network)
+	}
+
+	for _, proxy := range cfg.TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				return Config{}, fmt.Errorf("ARK_TRUSTED_PROXIES must be IPs or CIDRs, got: %q", proxy)
+			}
+		}
+	}
 
 	cfg.ARKPublicHost, err = normalizeBaseURL(cfg.ARKPublicHost, "ARK_PUBLIC_HOST")
 	if err != nil {
@@ -82,6 +225,48 @@ func Load() (Config, error) {
 	return cfg, nil
 }
 
+// LoadStorage lee solo la configuracion del almacenamiento; alcanza para
+// comandos como migrate que no hablan con Jenkins ni Tailscale.
+func LoadStorage() (Config, error) {
+	cfg := Config{
+		StorageBackend: strings.ToLower(strings.TrimSpace(os.Getenv("ARK_STORAGE_BACKEND"))),
+		StoragePath:    strings.TrimSpace(os.Getenv("ARK_STORAGE_PATH")),
+	}
+
+	if cfg.StorageBackend == "" {
+		cfg.StorageBackend = "redis"
+	}
+	if cfg.StoragePath == "" {
+		cfg.StoragePath = "data/ark.db"
+	}
+	if cfg.StorageBackend != "redis" && cfg.StorageBackend != "file" {
+		return Config{}, fmt.Errorf("ARK_STORAGE_BACKEND must be redis or file, got: %q", cfg.StorageBackend)
+	}
+
+	if raw := strings.TrimSpace(os.Getenv("ARK_REBUILD_INDEXES")); raw != "" {
+		rebuild, err := strconv.ParseBool(raw)
+		if err != nil {
+			return Config{}, fmt.Errorf("ARK_REBUILD_INDEXES must be true or false, got: %q", raw)
+		}
+		cfg.RebuildIndexes = rebuild
+	}
+
+	return cfg, nil
+}
+
+// parseNetwork acepta un CIDR o una IP suelta (como /32 o /128).
+func parseNetwork(raw string) (*net.IPNet, error) {
+	if ip := net.ParseIP(raw); ip != nil {
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(raw)
+	return network, err
+}
+
 func parseSSHUserMap(raw string) map[string]string {
 	m := make(map[string]string)
 	if raw == "" {
@@ -108,6 +293,40 @@ func parseSSHUserMap(raw string) map[string]string {
 	return m
 }
 
+// splitList separa una lista por comas descartando los vacios.
+func splitList(raw string) []string {
+	var out []string
+	for _, v := range strings.Split(raw, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// envInt lee un entero positivo de la variable indicada; vacia devuelve def.
+func envInt(name string, def int) (int, error) {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%s must be a positive integer, got: %q", name, raw)
+	}
+	return n, nil
+}
+
+// normalizeDomain deja el dominio comodin en minusculas y sin puntos ni esquema,
+// p.ej. "https://Apps.Example.com." -> "apps.example.com".
+func normalizeDomain(raw string) string {
+	d := strings.ToLower(strings.TrimSpace(raw))
+	d = strings.TrimPrefix(d, "http://")
+	d = strings.TrimPrefix(d, "https://")
+	d = strings.TrimPrefix(d, "*.")
+	return strings.Trim(d, "./")
+}
+
 func normalizeBaseURL(raw string, envName string) (string, error) {
 	raw = strings.TrimSpace(raw)
 	raw = strings.TrimRight(raw, "/")
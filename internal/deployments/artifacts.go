@@ -0,0 +1,148 @@
+package deployments
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"ark_deploy/internal/jenkins"
+)
+
+// Artefactos de los builds de la instancia. Los .txt chicos del pipeline
+// (puerto, contenedor, URL amigable, servicios) y el payload del callback se
+// incluyen leidos en la respuesta.
+
+var pipelineTextArtifacts = map[string]bool{
+	"target_port.txt":      true,
+	"target_container.txt": true,
+	"target_services.txt":  true,
+	"friendly_url.txt":     true,
+}
+
+type artifactView struct {
+	jenkins.Artifact
+	URL string `json:"url"`
+}
+
+type buildArtifacts struct {
+	Job             string            `json:"job"`
+	Build           string            `json:"build"`
+	Artifacts       []artifactView    `json:"artifacts"`
+	Values          map[string]string `json:"values,omitempty"`
+	CallbackPayload json.RawMessage   `json:"callback_payload,omitempty"`
+	Error           string            `json:"error,omitempty"`
+}
+
+func (h *Handler) Artifacts(c *gin.Context) {
+	instanceID := c.Param("id")
+
+	instance, err := h.instanceStore.GetByID(instanceID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "instance not found"})
+		return
+	}
+
+	jobs := make([]string, 0, len(instance.Builds))
+	for job := range instance.Builds {
+		jobs = append(jobs, job)
+	}
+	sort.Strings(jobs)
+
+	client := jenkins.NewClient(h.cfg.JenkinsBaseURL, h.cfg.JenkinsUser, h.cfg.JenkinsAPIToken)
+	builds := make([]buildArtifacts, 0, len(jobs))
+
+	for _, job := range jobs {
+		entry := buildArtifacts{Job: job, Build: instance.Builds[job], Artifacts: []artifactView{}}
+
+		n, err := strconv.Atoi(entry.Build)
+		if err != nil || n <= 0 {
+			entry.Error = "build number not resolved"
+			builds = append(builds, entry)
+			continue
+		}
+
+		list, err := client.ListArtifacts(job, n)
+		if err != nil {
+			entry.Error = err.Error()
+			builds = append(builds, entry)
+			continue
+		}
+
+		base := "/api/deployments/" + instance.ID + "/artifacts/" + job + "/" + entry.Build + "/"
+		for _, a := range list {
+			entry.Artifacts = append(entry.Artifacts, artifactView{Artifact: a, URL: base + a.RelativePath})
+
+			switch {
+			case a.FileName == jenkins.CallbackPayloadArtifact:
+				if b, err := client.GetArtifact(job, n, a.RelativePath); err == nil && json.Valid(b) {
+					entry.CallbackPayload = b
+				}
+			case pipelineTextArtifacts[a.FileName]:
+				if b, err := client.GetArtifact(job, n, a.RelativePath); err == nil {
+					if entry.Values == nil {
+						entry.Values = map[string]string{}
+					}
+					entry.Values[a.FileName] = strings.TrimSpace(string(b))
+				}
+			}
+		}
+		builds = append(builds, entry)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"instance_id": instance.ID,
+		"builds":      builds,
+	})
+}
+
+// DownloadArtifact devuelve un artefacto; solo de builds que pertenecen a la instancia.
+func (h *Handler) DownloadArtifact(c *gin.Context) {
+	instanceID := c.Param("id")
+	job := c.Param("job")
+	build := c.Param("build")
+
+	instance, err := h.instanceStore.GetByID(instanceID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "instance not found"})
+		return
+	}
+	if current, ok := instance.Builds[job]; !ok || current != build {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "build not found for instance"})
+		return
+	}
+
+	n, err := strconv.Atoi(build)
+	if err != nil || n <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid build number"})
+		return
+	}
+
+	rel := strings.TrimPrefix(c.Param("path"), "/")
+	if rel == "" || strings.Contains(rel, "..") {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid artifact path"})
+		return
+	}
+
+	client := jenkins.NewClient(h.cfg.JenkinsBaseURL, h.cfg.JenkinsUser, h.cfg.JenkinsAPIToken)
+	data, err := client.GetArtifact(job, n, rel)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"detail": err.Error()})
+		return
+	}
+
+	// Siempre como descarga y sin sniffing: un artefacto HTML o SVG servido
+	// inline correria en el origen de ARK.
+	contentType := mime.TypeByExtension(path.Ext(rel))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(rel)}))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Data(http.StatusOK, contentType, data)
+}
@@ -0,0 +1,147 @@
+package deployments
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"ark_deploy/internal/events"
+	"ark_deploy/internal/storage"
+)
+
+// BuildWatcher publica build.finished una sola vez por build, aparte del
+// archivo de logs. La marca build_finished:<job>:<build> se toma con SetNX en
+// el almacenamiento compartido: con varias replicas solo una publica, y el
+// evento no depende de que la consola se pueda bajar ni de que siga archivada.
+
+const maxBuildStatusFailures = 5
+
+type BuildStatusReader interface {
+	ReadBuildStatus(jobName string, buildNumber int) (bool, string, error)
+}
+
+type BuildInstanceLister interface {
+	GetAll() []storage.Instance
+}
+
+type BuildWatcher struct {
+	kv        storage.KV
+	instances BuildInstanceLister
+	builds    BuildStatusReader
+	interval  time.Duration
+	events    events.Publisher
+
+	// done son los builds ya marcados, para no volver a consultar Jenkins;
+	// failures cuenta errores por build y pasado el maximo se deja de intentar.
+	done     map[string]bool
+	failures map[string]int
+}
+
+func NewBuildWatcher(kv storage.KV, instances BuildInstanceLister, builds BuildStatusReader, interval time.Duration) *BuildWatcher {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	return &BuildWatcher{
+		kv:        kv,
+		instances: instances,
+		builds:    builds,
+		interval:  interval,
+		done:      make(map[string]bool),
+		failures:  make(map[string]int),
+	}
+}
+
+// WithEvents fija donde se publica build.finished.
+func (w *BuildWatcher) WithEvents(p events.Publisher) *BuildWatcher {
+	w.events = p
+	return w
+}
+
+func buildFinishedKey(job string, build string) string {
+	return "build_finished:" + job + ":" + build
+}
+
+// Run revisa los builds en cada tick hasta que se cancela el contexto.
+func (w *BuildWatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		w.CheckFinished(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckFinished publica build.finished por los builds que terminaron desde la
+// ultima pasada y devuelve cuantos publico.
+func (w *BuildWatcher) CheckFinished(ctx context.Context) int {
+	published := 0
+	// Solo se recuerdan los builds que siguen asignados a alguna instancia.
+	done := make(map[string]bool, len(w.done))
+
+	for _, inst := range w.instances.GetAll() {
+		for job, build := range inst.Builds {
+			if ctx.Err() != nil {
+				return published
+			}
+
+			build = strings.TrimSpace(build)
+			n, err := strconv.Atoi(build)
+			if err != nil || n <= 0 {
+				continue
+			}
+			key := buildFinishedKey(job, build)
+			if w.done[key] {
+				done[key] = true
+				continue
+			}
+			if w.failures[key] >= maxBuildStatusFailures {
+				continue
+			}
+
+			// Otra replica ya lo publico: no hace falta preguntarle a Jenkins.
+			if marked, err := w.kv.Exists(key); err == nil && marked {
+				done[key] = true
+				continue
+			}
+
+			building, result, err := w.builds.ReadBuildStatus(job, n)
+			if err != nil {
+				w.failures[key]++
+				log.Printf("build watcher: %s#%s: %v", job, build, err)
+				continue
+			}
+			if building {
+				continue
+			}
+			delete(w.failures, key)
+
+			first, err := w.kv.SetNX(key, result)
+			if err != nil {
+				log.Printf("build watcher: %s#%s: %v", job, build, err)
+				continue
+			}
+			done[key] = true
+			if !first {
+				continue
+			}
+
+			events.Publish(w.events, events.Event{
+				Type:       events.BuildFinished,
+				ProductID:  inst.ProductID,
+				InstanceID: inst.ID,
+				Data:       map[string]any{"job_name": job, "build_number": n, "result": result},
+			})
+			published++
+		}
+	}
+	w.done = done
+	return published
+}
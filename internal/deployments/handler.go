@@ -1,9 +1,9 @@
 package deployments
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -11,9 +11,13 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 
+	"ark_deploy/internal/audit"
 	"ark_deploy/internal/config"
+	"ark_deploy/internal/events"
+	"ark_deploy/internal/instances"
 	"ark_deploy/internal/jenkins"
 	"ark_deploy/internal/storage"
+	"ark_deploy/internal/tailscale"
 )
 //Mapea si existen productos de almacenamiento 
 
@@ -25,9 +29,35 @@ type ProductStore interface {
 
 type InstanceStore interface {
 	Create(i storage.Instance) error
-	GetAll() []storage.Instance
+	List(q storage.InstanceQuery) (storage.InstancePage, error)
 	GetByID(id string) (storage.Instance, error)
-	Delete(id string) error
+	// Delete manda la instancia a la papelera; Restore la devuelve.
+	Delete(id string, actor string) error
+	Restore(id string) (storage.Instance, error)
+}
+
+//Dominios propios de la instancia, se liberan al borrarla (opcional)
+
+type DomainStore interface {
+	ReleaseAll(instanceID string) error
+}
+
+//Logs archivados por ARK, sobreviven a la rotacion de builds de Jenkins (opcional)
+
+type LogArchive interface {
+	Get(job string, build string) (string, bool, error)
+}
+
+//Usuario SSH guardado por host, tiene prioridad sobre ARK_SSH_USER_MAP (opcional)
+
+type SSHUserStore interface {
+	Get(host string) (string, bool, error)
+}
+
+//Metricas del proxy por instancia, se descartan al borrarla (opcional)
+
+type MetricsForgetter interface {
+	Forget(instanceID string)
 }
 
 //Constructor 
@@ -36,6 +66,12 @@ type Handler struct {
 	cfg           config.Config
 	productStore  ProductStore
 	instanceStore InstanceStore
+	domainStore   DomainStore
+	logArchive    LogArchive
+	sshUsers      SSHUserStore
+	identities    tailscale.Identifier
+	events        events.Publisher
+	metrics       MetricsForgetter
 }
 
 func NewHandler(cfg config.Config, productStore ProductStore, instanceStore InstanceStore) *Handler {
@@ -46,6 +82,42 @@ func NewHandler(cfg config.Config, productStore ProductStore, instanceStore Inst
 	}
 }
 
+// WithDomainStore habilita la liberacion de dominios propios al borrar instancias.
+func (h *Handler) WithDomainStore(ds DomainStore) *Handler {
+	h.domainStore = ds
+	return h
+}
+
+// WithLogArchive hace que GetLogs sirva primero los logs archivados.
+func (h *Handler) WithLogArchive(la LogArchive) *Handler {
+	h.logArchive = la
+	return h
+}
+
+// WithSSHUserStore consulta el usuario SSH guardado para el host de destino.
+func (h *Handler) WithSSHUserStore(users SSHUserStore) *Handler {
+	h.sshUsers = users
+	return h
+}
+
+// WithIdentityResolver registra al usuario de Tailscale como autor de los borrados.
+func (h *Handler) WithIdentityResolver(r tailscale.Identifier) *Handler {
+	h.identities = r
+	return h
+}
+
+// WithEvents publica deployment.created, build.started e instance.deleted en el bus de eventos.
+func (h *Handler) WithEvents(p events.Publisher) *Handler {
+	h.events = p
+	return h
+}
+
+// WithMetrics descarta las metricas del proxy de las instancias borradas.
+func (h *Handler) WithMetrics(m MetricsForgetter) *Handler {
+	h.metrics = m
+	return h
+}
+
 //Definimos contrato del endpoint
 
 type CreateDeploymentRequest struct {
@@ -74,7 +146,7 @@ func (h *Handler) Create(c *gin.Context) {
 	req.Version = strings.TrimSpace(req.Version)
 	req.TargetHost = strings.TrimSpace(req.TargetHost)
 	req.SSHUser = strings.TrimSpace(req.SSHUser)
-	resolvedSSHUser := resolveSSHUser(req.SSHUser, req.TargetHost, h.cfg)
+	resolvedSSHUser := resolveSSHUser(req.SSHUser, req.TargetHost, h.cfg, h.sshUsers)
 	if resolvedSSHUser == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"detail": "ssh_user is required (request, ARK_SSH_USER_MAP, or ARK_DEFAULT_SSH_USER)"})
 		return
@@ -131,9 +203,6 @@ func (h *Handler) Create(c *gin.Context) {
 		product = p
 
 		jobName = strings.TrimSpace(product.DeployJobs[env])
-		if jobName == "" {
-			jobName = strings.TrimSpace(product.Jobs[env])
-		}
 		if jobName == "" {
 			c.JSON(http.StatusBadRequest, gin.H{"detail": fmt.Sprintf("no deploy job configured for product %s in environment %s", productID, env)})
 			return
@@ -158,6 +227,13 @@ func (h *Handler) Create(c *gin.Context) {
 		webPort = 80
 	}
 
+	//servicios expuestos en formato nombre:puerto para que el job resuelva cada puerto
+	exposed := product.ExposedServices()
+	services := make([]string, 0, len(exposed))
+	for _, svc := range exposed {
+		services = append(services, svc.Name+":"+strconv.Itoa(svc.Port))
+	}
+
 	instanceID := uuid.New().String()
 
 	publicBase := strings.TrimRight(h.cfg.ARKPublicHost, "/")
@@ -174,6 +250,7 @@ func (h *Handler) Create(c *gin.Context) {
 		"ARK_CALLBACK_URL": callbackURL,
 		"WEB_SERVICE":      webService,
 		"WEB_PORT":         strconv.Itoa(webPort),
+		"SERVICES":         strings.Join(services, ","),
 		"SIMULATE_FAIL":    boolToString(req.SimulateFail), //flag para pruebas no lo quito por temas de desarrollo
 	})
 	if err != nil {
@@ -196,6 +273,13 @@ func (h *Handler) Create(c *gin.Context) {
 		Environment: env,
 		Status:      "provisioning",
 		URL:         instanceURL,
+		FriendlyURL: instances.RenderFriendlyURL(h.cfg.FriendlyURLTemplate, instances.FriendlyURLVars{
+			PublicHost:  publicBase,
+			Domain:      h.cfg.HostRoutingDomain,
+			InstanceID:  instanceID,
+			ProductID:   productID,
+			Environment: env,
+		}),
 		Builds:      map[string]string{jobName: strconv.Itoa(buildNumber)},
 		CreatedAt:   time.Now(),
 	}
@@ -204,6 +288,26 @@ func (h *Handler) Create(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"detail": "failed to save instance: " + err.Error()})
 		return
 	}
+	audit.Record(c, instanceID, nil, instance)
+
+	events.Publish(h.events, events.Event{
+		Type:       events.DeploymentCreated,
+		ProductID:  productID,
+		InstanceID: instanceID,
+		Data: map[string]any{
+			"environment": env,
+			"target_host": req.TargetHost,
+			"job_name":    jobName,
+		},
+	})
+	if resolved {
+		events.Publish(h.events, events.Event{
+			Type:       events.BuildStarted,
+			ProductID:  productID,
+			InstanceID: instanceID,
+			Data:       map[string]any{"job_name": jobName, "build_number": buildNumber},
+		})
+	}
 
 	if resolved {
 		c.JSON(http.StatusAccepted, gin.H{
@@ -232,17 +336,53 @@ func (h *Handler) Create(c *gin.Context) {
 
 //Lista las instancias
 
+// List filtra por product, host, environment y status usando los indices del store.
+// Sin limit devuelve todas; con limit pagina con next_cursor.
 func (h *Handler) List(c *gin.Context) {
-	instances := h.instanceStore.GetAll()
+	q := storage.InstanceQuery{
+		ProductID:   strings.TrimSpace(c.Query("product")),
+		DeviceID:    strings.TrimSpace(c.Query("host")),
+		Environment: strings.TrimSpace(c.Query("environment")),
+		Status:      strings.TrimSpace(c.Query("status")),
+		Cursor:      strings.TrimSpace(c.Query("cursor")),
+	}
 
-	sort.Slice(instances, func(i, j int) bool {
-		return instances[i].CreatedAt.After(instances[j].CreatedAt)
-	})
+	switch c.DefaultQuery("sort", "-created_at") {
+	case "-created_at":
+	case "created_at":
+		q.Ascending = true
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "sort must be created_at or -created_at"})
+		return
+	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"total":     len(instances),
-		"instances": instances,
-	})
+	if raw := strings.TrimSpace(c.Query("limit")); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 || n > 1000 {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": "limit must be between 1 and 1000"})
+			return
+		}
+		q.Limit = n
+	}
+
+	page, err := h.instanceStore.List(q)
+	if err != nil {
+		if errors.Is(err, storage.ErrInvalidCursor) {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid cursor"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "failed to list instances: " + err.Error()})
+		return
+	}
+
+	resp := gin.H{
+		"total":     page.Total,
+		"instances": page.Instances,
+	}
+	if page.NextCursor != "" {
+		resp["next_cursor"] = page.NextCursor
+	}
+	c.JSON(http.StatusOK, resp)
 }
 
 func (h *Handler) Delete(c *gin.Context) {
@@ -254,17 +394,52 @@ func (h *Handler) Delete(c *gin.Context) {
 		return
 	}
 
-	if err := h.instanceStore.Delete(instanceID); err != nil {
+	// ClientIP ignora X-Forwarded-For salvo desde ARK_TRUSTED_PROXIES.
+	if err := h.instanceStore.Delete(instanceID, tailscale.Actor(h.identities, c.ClientIP())); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"detail": "failed to delete instance: " + err.Error()})
 		return
 	}
 
+	if h.domainStore != nil {
+		_ = h.domainStore.ReleaseAll(instanceID)
+	}
+	if h.metrics != nil {
+		h.metrics.Forget(instanceID)
+	}
+	audit.Record(c, instanceID, instance, nil)
+	events.Publish(h.events, events.Event{
+		Type:       events.InstanceDeleted,
+		ProductID:  instance.ProductID,
+		InstanceID: instanceID,
+		Data:       map[string]any{"device_id": instance.DeviceID, "environment": instance.Environment},
+	})
+
 	c.JSON(http.StatusOK, gin.H{
 		"message":     "instance deleted",
 		"instance_id": instanceID,
 		"device_id":   instance.DeviceID,
 	})
 }
+
+// Restore saca la instancia de la papelera. Los dominios propios se liberaron
+// al borrarla y hay que volver a asociarlos.
+func (h *Handler) Restore(c *gin.Context) {
+	instance, err := h.instanceStore.Restore(c.Param("id"))
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotInTrash):
+			c.JSON(http.StatusNotFound, gin.H{"detail": "instance not found in trash"})
+		case errors.Is(err, storage.ErrRestoreConflict):
+			c.JSON(http.StatusConflict, gin.H{"detail": "instance already exists"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		}
+		return
+	}
+
+	audit.Record(c, instance.ID, nil, instance)
+	c.JSON(http.StatusOK, instance)
+}
 //Logs del build 
 
 func (h *Handler) GetLogs(c *gin.Context) {
@@ -286,14 +461,25 @@ func (h *Handler) GetLogs(c *gin.Context) {
 
 	client := jenkins.NewClient(h.cfg.JenkinsBaseURL, h.cfg.JenkinsUser, h.cfg.JenkinsAPIToken)
 	logsMap := make(map[string]string)
+	sources := make(map[string]string)
 
 	for jobName, buildNumber := range instance.Builds {
+		//primero el archivo propio, Jenkins puede haber rotado el build
+		if h.logArchive != nil {
+			if log, ok, err := h.logArchive.Get(jobName, buildNumber); err == nil && ok {
+				logsMap[jobName] = log
+				sources[jobName] = "archive"
+				continue
+			}
+		}
+
 		log, err := client.GetBuildLog(jobName, buildNumber)
 		if err != nil {
 			logsMap[jobName] = fmt.Sprintf("Error fetching log: %v", err)
 		} else {
 			logsMap[jobName] = log
 		}
+		sources[jobName] = "jenkins"
 	}
 
 	//Contruccion de respuesta de logs con metadata
@@ -304,6 +490,29 @@ func (h *Handler) GetLogs(c *gin.Context) {
 		"product_id":  instance.ProductID,
 		"status":      instance.Status,
 		"logs":        logsMap,
+		"sources":     sources,
+	})
+}
+
+// Health devuelve el estado de salud y el historial de chequeos de la instancia.
+func (h *Handler) Health(c *gin.Context) {
+	instanceID := c.Param("id")
+
+	instance, err := h.instanceStore.GetByID(instanceID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "instance not found"})
+		return
+	}
+
+	health := instance.Health
+	if health == nil {
+		health = &storage.InstanceHealth{History: []storage.HealthCheck{}}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"instance_id": instance.ID,
+		"status":      instance.Status,
+		"health":      health,
 	})
 }
 
@@ -361,16 +570,15 @@ func boolToString(v bool) string {
 	return "false"
 }
 
-func resolveSSHUser(requestUser, targetHost string, cfg config.Config) string {
+func resolveSSHUser(requestUser, targetHost string, cfg config.Config, users SSHUserStore) string {
 	requestUser = strings.TrimSpace(requestUser)
 	if requestUser != "" {
 		return requestUser
 	}
 
 	targetHost = strings.TrimSpace(targetHost)
-	if targetHost != "" {
-		store := storage.NewSSHUserStore()
-		if user, ok, err := store.Get(targetHost); err == nil && ok && strings.TrimSpace(user) != "" {
+	if targetHost != "" && users != nil {
+		if user, ok, err := users.Get(targetHost); err == nil && ok && strings.TrimSpace(user) != "" {
 			return strings.TrimSpace(user)
 		}
 	}
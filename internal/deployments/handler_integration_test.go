@@ -1,10 +1,12 @@
 package deployments
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -12,12 +14,15 @@ import (
 	"github.com/gin-gonic/gin"
 
 	"ark_deploy/internal/config"
+	"ark_deploy/internal/events"
 	"ark_deploy/internal/storage"
 )
 
 type MockInstanceStore struct {
 	mu        sync.RWMutex
 	instances map[string]storage.Instance
+	trash     map[string]storage.Instance
+	deletedBy map[string]string
 }
 
 func NewMockInstanceStore() *MockInstanceStore {
@@ -60,18 +65,52 @@ func (s *MockInstanceStore) GetAll() []storage.Instance {
 	return result
 }
 
-func (s *MockInstanceStore) Delete(id string) error {
+func (s *MockInstanceStore) List(q storage.InstanceQuery) (storage.InstancePage, error) {
+	all := s.GetAll()
+	sort.Slice(all, func(i, j int) bool {
+		if q.Ascending {
+			return all[i].CreatedAt.Before(all[j].CreatedAt)
+		}
+		return all[i].CreatedAt.After(all[j].CreatedAt)
+	})
+	return storage.InstancePage{Instances: all, Total: len(all)}, nil
+}
+
+func (s *MockInstanceStore) Delete(id string, actor string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if _, exists := s.instances[id]; !exists {
+	i, exists := s.instances[id]
+	if !exists {
 		return errors.New("instance not found")
 	}
 
+	if s.trash == nil {
+		s.trash = make(map[string]storage.Instance)
+		s.deletedBy = make(map[string]string)
+	}
+	s.trash[id] = i
+	s.deletedBy[id] = actor
 	delete(s.instances, id)
 	return nil
 }
 
+func (s *MockInstanceStore) Restore(id string) (storage.Instance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ok := s.trash[id]
+	if !ok {
+		return storage.Instance{}, storage.ErrNotInTrash
+	}
+	if _, exists := s.instances[id]; exists {
+		return storage.Instance{}, storage.ErrRestoreConflict
+	}
+	s.instances[id] = i
+	delete(s.trash, id)
+	return i, nil
+}
+
 type MockProductStore struct {
 	mu       sync.RWMutex
 	products map[string]storage.Product
@@ -109,6 +148,8 @@ func (s *MockProductStore) GetByID(id string) (storage.Product, error) {
 func setupTestRouter(productStore ProductStore, instanceStore InstanceStore) *gin.Engine {
 	gin.SetMode(gin.TestMode)
 	r := gin.New()
+	// Como en main sin ARK_TRUSTED_PROXIES.
+	_ = r.SetTrustedProxies(nil)
 
 	cfg := config.Config{
 		JenkinsBaseURL:  "http://jenkins-test.local",
@@ -197,12 +238,18 @@ func TestDeploymentsDelete_Success(t *testing.T) {
 	router := setupTestRouter(productStore, instanceStore)
 
 	req, _ := http.NewRequest("DELETE", "/deployments/delete-test", nil)
+	req.RemoteAddr = "192.0.2.10:4321"
+	req.Header.Set("X-Forwarded-For", "100.64.0.7")
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Errorf("Expected status 200, got %d", w.Code)
 	}
+	// deleted_by sale del peer de la conexion, no del header falsificado.
+	if actor := instanceStore.deletedBy["delete-test"]; actor != "192.0.2.10" {
+		t.Errorf("Expected deleted_by from the connection peer, got %q", actor)
+	}
 
 	var response map[string]interface{}
 	json.Unmarshal(w.Body.Bytes(), &response)
@@ -229,4 +276,315 @@ func TestDeploymentsDelete_NotFound(t *testing.T) {
 	if w.Code != http.StatusNotFound {
 		t.Errorf("Expected status 404, got %d", w.Code)
 	}
-}
\ No newline at end of file
+}
+
+type mockLogArchive struct {
+	logs map[string]string
+}
+
+func (m *mockLogArchive) Get(job string, build string) (string, bool, error) {
+	log, ok := m.logs[job+"#"+build]
+	return log, ok, nil
+}
+
+func TestDeploymentsGetLogs_ArchiveFirst(t *testing.T) {
+	jenkinsSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("live log from jenkins"))
+	}))
+	defer jenkinsSrv.Close()
+
+	instanceStore := NewMockInstanceStore()
+	instanceStore.Create(storage.Instance{
+		ID:     "logs-test",
+		Status: "running",
+		Builds: map[string]string{"deploy-old": "3", "deploy-new": "9"},
+	})
+
+	cfg := config.Config{JenkinsBaseURL: jenkinsSrv.URL, JenkinsUser: "u", JenkinsAPIToken: "t"}
+	h := NewHandler(cfg, NewMockProductStore(), instanceStore).
+		WithLogArchive(&mockLogArchive{logs: map[string]string{"deploy-old#3": "archived log"}})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/deployments/:id/logs", h.GetLogs)
+
+	req, _ := http.NewRequest("GET", "/deployments/logs-test/logs", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	var response struct {
+		Logs    map[string]string `json:"logs"`
+		Sources map[string]string `json:"sources"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+
+	if response.Logs["deploy-old"] != "archived log" || response.Sources["deploy-old"] != "archive" {
+		t.Errorf("Expected archived log for deploy-old, got %q (%s)", response.Logs["deploy-old"], response.Sources["deploy-old"])
+	}
+	if response.Logs["deploy-new"] != "live log from jenkins" || response.Sources["deploy-new"] != "jenkins" {
+		t.Errorf("Expected jenkins fallback for deploy-new, got %q (%s)", response.Logs["deploy-new"], response.Sources["deploy-new"])
+	}
+}
+
+func TestDeploymentsBuildLogs_ArchiveFirst(t *testing.T) {
+	jenkinsHits := 0
+	jenkinsSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jenkinsHits++
+		w.Write([]byte("live log from jenkins"))
+	}))
+	defer jenkinsSrv.Close()
+
+	cfg := config.Config{JenkinsBaseURL: jenkinsSrv.URL, JenkinsUser: "u", JenkinsAPIToken: "t"}
+	h := NewHandler(cfg, NewMockProductStore(), NewMockInstanceStore()).
+		WithLogArchive(&mockLogArchive{logs: map[string]string{"deploy-old#3": "archived log"}})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/deployments/job/:job/build/:build/logs", h.BuildLogs)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/deployments/job/deploy-old/build/3/logs")
+	if w.Code != http.StatusOK || w.Body.String() != "archived log" || w.Header().Get(logSourceHeader) != "archive" {
+		t.Errorf("Expected archived log, got %d %q (%s)", w.Code, w.Body.String(), w.Header().Get(logSourceHeader))
+	}
+	if jenkinsHits != 0 {
+		t.Errorf("Expected Jenkins not to be called for an archived build, got %d hits", jenkinsHits)
+	}
+
+	w = get("/deployments/job/deploy-new/build/9/logs")
+	if w.Code != http.StatusOK || w.Body.String() != "live log from jenkins" || w.Header().Get(logSourceHeader) != "jenkins" {
+		t.Errorf("Expected jenkins fallback, got %d %q (%s)", w.Code, w.Body.String(), w.Header().Get(logSourceHeader))
+	}
+}
+
+func TestDeploymentsArtifacts_ListAndDownload(t *testing.T) {
+	jenkinsSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/job/deploy-web/7/api/json":
+			w.Write([]byte(`{"artifacts":[{"fileName":"target_port.txt","relativePath":"target_port.txt"},{"fileName":"deploy_callback_payload.json","relativePath":"deploy_callback_payload.json"}]}`))
+		case "/job/deploy-web/7/artifact/target_port.txt":
+			w.Write([]byte("32768\n"))
+		case "/job/deploy-web/7/artifact/report":
+			w.Write([]byte("<html><script>alert(1)</script></html>"))
+		case "/job/deploy-web/7/artifact/deploy_callback_payload.json":
+			w.Write([]byte(`{"instance_id":"art-test","target_port":32768}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer jenkinsSrv.Close()
+
+	instanceStore := NewMockInstanceStore()
+	instanceStore.Create(storage.Instance{ID: "art-test", Builds: map[string]string{"deploy-web": "7"}})
+
+	cfg := config.Config{JenkinsBaseURL: jenkinsSrv.URL, JenkinsUser: "u", JenkinsAPIToken: "t"}
+	h := NewHandler(cfg, NewMockProductStore(), instanceStore)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/deployments/:id/artifacts", h.Artifacts)
+	r.GET("/deployments/:id/artifacts/:job/:build/*path", h.DownloadArtifact)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/deployments/art-test/artifacts", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	var response struct {
+		Builds []struct {
+			Job             string            `json:"job"`
+			Artifacts       []json.RawMessage `json:"artifacts"`
+			Values          map[string]string `json:"values"`
+			CallbackPayload map[string]any    `json:"callback_payload"`
+		} `json:"builds"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+
+	if len(response.Builds) != 1 || len(response.Builds[0].Artifacts) != 2 {
+		t.Fatalf("Unexpected artifacts response: %s", w.Body.String())
+	}
+	if response.Builds[0].Values["target_port.txt"] != "32768" {
+		t.Errorf("Expected target_port.txt value, got %v", response.Builds[0].Values)
+	}
+	if response.Builds[0].CallbackPayload["instance_id"] != "art-test" {
+		t.Errorf("Expected callback payload, got %v", response.Builds[0].CallbackPayload)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/deployments/art-test/artifacts/deploy-web/7/target_port.txt", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "32768\n" {
+		t.Errorf("Expected artifact download, got %d %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Disposition") != `attachment; filename=target_port.txt` || w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("Expected artifact served as attachment, got %v", w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/deployments/art-test/artifacts/deploy-web/7/report", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/octet-stream" {
+		t.Errorf("Expected unknown artifact as octet-stream, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/deployments/art-test/artifacts/other-job/1/secret.txt", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a build of another instance, got %d", w.Code)
+	}
+}
+
+func TestDeploymentsList_FiltersAndPaginates(t *testing.T) {
+	kv, err := storage.OpenFileKV(t.TempDir() + "/ark.db")
+	if err != nil {
+		t.Fatalf("open kv: %v", err)
+	}
+	defer kv.Close()
+
+	instanceStore := storage.NewInstanceStore(kv)
+	base := time.Now().Add(-time.Hour)
+	for i, inst := range []storage.Instance{
+		{ID: "i-1", ProductID: "shop", DeviceID: "10.0.0.1", Environment: "prod", Status: "running"},
+		{ID: "i-2", ProductID: "shop", DeviceID: "10.0.0.2", Environment: "dev", Status: "running"},
+		{ID: "i-3", ProductID: "blog", DeviceID: "10.0.0.1", Environment: "prod", Status: "running"},
+		{ID: "i-4", ProductID: "shop", DeviceID: "10.0.0.1", Environment: "prod", Status: "provisioning"},
+	} {
+		inst.CreatedAt = base.Add(time.Duration(i) * time.Minute)
+		if err := instanceStore.Create(inst); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+	_ = instanceStore.UpdateStatus("i-4", "running")
+
+	router := setupTestRouter(NewMockProductStore(), instanceStore)
+	list := func(query string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deployments"+query, nil))
+		var resp map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+	ids := func(resp map[string]interface{}) []string {
+		out := []string{}
+		for _, item := range resp["instances"].([]interface{}) {
+			out = append(out, item.(map[string]interface{})["id"].(string))
+		}
+		return out
+	}
+
+	_, resp := list("?product=shop&environment=prod&status=running&limit=1")
+	if resp["total"].(float64) != 2 || len(ids(resp)) != 1 || ids(resp)[0] != "i-4" {
+		t.Fatalf("unexpected first page: %v", resp)
+	}
+	cursor, _ := resp["next_cursor"].(string)
+	if cursor == "" {
+		t.Fatalf("expected next_cursor")
+	}
+
+	_, resp = list("?product=shop&environment=prod&status=running&limit=1&cursor=" + cursor)
+	if got := ids(resp); len(got) != 1 || got[0] != "i-1" || resp["next_cursor"] != nil {
+		t.Fatalf("unexpected second page: %v", resp)
+	}
+
+	_, resp = list("?host=10.0.0.1&sort=created_at")
+	if got := ids(resp); len(got) != 3 || got[0] != "i-1" || got[2] != "i-4" {
+		t.Fatalf("unexpected host filter: %v", got)
+	}
+
+	for _, bad := range []string{"?sort=name", "?limit=0", "?cursor=%21%21"} {
+		if code, _ := list(bad); code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %s, got %d", bad, code)
+		}
+	}
+}
+
+type mockPublisher struct {
+	mu     sync.Mutex
+	events []events.Event
+}
+
+func (m *mockPublisher) Publish(e events.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, e)
+	return nil
+}
+
+type mockBuildStatus struct {
+	building map[string]bool
+	calls    map[string]int
+}
+
+func (m *mockBuildStatus) ReadBuildStatus(jobName string, buildNumber int) (bool, string, error) {
+	m.calls[jobName]++
+	building, ok := m.building[jobName]
+	if !ok {
+		return false, "", errors.New("status=404")
+	}
+	return building, "SUCCESS", nil
+}
+
+func TestBuildWatcher_PublishesFinishedOncePerBuild(t *testing.T) {
+	kv, err := storage.OpenFileKV(t.TempDir() + "/ark.db")
+	if err != nil {
+		t.Fatalf("open kv: %v", err)
+	}
+	defer kv.Close()
+
+	instanceStore := NewMockInstanceStore()
+	instanceStore.Create(storage.Instance{ID: "i-1", ProductID: "shop", Builds: map[string]string{"deploy-web": "7", "deploy-gone": "2"}})
+	src := &mockBuildStatus{building: map[string]bool{"deploy-web": true}, calls: map[string]int{}}
+
+	// Dos replicas sobre el mismo almacenamiento.
+	pubA, pubB := &mockPublisher{}, &mockPublisher{}
+	a := NewBuildWatcher(kv, instanceStore, src, time.Minute).WithEvents(pubA)
+	b := NewBuildWatcher(kv, instanceStore, src, time.Minute).WithEvents(pubB)
+	ctx := context.Background()
+
+	if n := a.CheckFinished(ctx); n != 0 {
+		t.Fatalf("expected no event while building, got %d", n)
+	}
+
+	src.building["deploy-web"] = false
+	if n := a.CheckFinished(ctx); n != 1 {
+		t.Fatalf("expected build.finished once finished, got %d", n)
+	}
+	e := pubA.events[0]
+	if e.Type != events.BuildFinished || e.InstanceID != "i-1" || e.Data["job_name"] != "deploy-web" || e.Data["build_number"] != 7 {
+		t.Fatalf("unexpected event: %+v", e)
+	}
+
+	calls := src.calls["deploy-web"]
+	if n := b.CheckFinished(ctx); n != 0 || len(pubB.events) != 0 {
+		t.Fatalf("the other replica must not publish again, got %d", n)
+	}
+	if n := a.CheckFinished(ctx); n != 0 {
+		t.Fatalf("expected no repeat on the next pass, got %d", n)
+	}
+	// Una replica nueva (o un build sacado del archivo) tampoco lo repite.
+	if n := NewBuildWatcher(kv, instanceStore, src, time.Minute).WithEvents(pubB).CheckFinished(ctx); n != 0 {
+		t.Fatalf("expected the shared marker to dedupe, got %d", n)
+	}
+	if src.calls["deploy-web"] != calls {
+		t.Fatalf("marked builds must not hit Jenkins again, got %d calls", src.calls["deploy-web"]-calls)
+	}
+
+	// Un build que Jenkins ya no conoce se deja de consultar.
+	c := NewBuildWatcher(kv, instanceStore, src, time.Minute)
+	src.calls["deploy-gone"] = 0
+	for i := 0; i < maxBuildStatusFailures+2; i++ {
+		c.CheckFinished(ctx)
+	}
+	if src.calls["deploy-gone"] != maxBuildStatusFailures {
+		t.Fatalf("expected %d status calls for a missing build, got %d", maxBuildStatusFailures, src.calls["deploy-gone"])
+	}
+}
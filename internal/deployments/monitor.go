@@ -9,6 +9,9 @@ import (
 	"ark_deploy/internal/jenkins"
 )
 
+// logSourceHeader indica si la consola salio del archivo o de Jenkins.
+const logSourceHeader = "X-ARK-Log-Source"
+
 func (h *Handler) BuildStatus(c *gin.Context) {
 	job := c.Param("job")
 	buildStr := c.Param("build")
@@ -49,6 +52,15 @@ func (h *Handler) BuildLogs(c *gin.Context) {
 		return
 	}
 
+	// Como en GetLogs, primero el archivo propio: Jenkins puede haber rotado el build.
+	if h.logArchive != nil {
+		if log, ok, err := h.logArchive.Get(job, strconv.Itoa(n)); err == nil && ok {
+			c.Header(logSourceHeader, "archive")
+			c.String(http.StatusOK, log)
+			return
+		}
+	}
+
 	client := jenkins.NewClient(h.cfg.JenkinsBaseURL, h.cfg.JenkinsUser, h.cfg.JenkinsAPIToken)
 
 	logs, err := client.ReadBuildLogs(job, n)
@@ -57,6 +69,7 @@ func (h *Handler) BuildLogs(c *gin.Context) {
 		return
 	}
 
+	c.Header(logSourceHeader, "jenkins")
 	c.String(http.StatusOK, logs)
 }
 
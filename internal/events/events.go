@@ -0,0 +1,246 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"ark_deploy/internal/storage"
+)
+
+// Bus de eventos de dominio: los handlers publican en un stream (events) y los
+// interesados (reconciliadores, notificaciones, metricas) leen con su propio
+// grupo de consumidores, asi cada grupo ve todos los eventos una vez y a su ritmo.
+
+const (
+	DeploymentCreated  = "deployment.created"
+	BuildStarted       = "build.started"
+	BuildFinished      = "build.finished"
+	InstanceRegistered = "instance.registered"
+	InstanceFailed     = "instance.failed"
+	InstanceRecovered  = "instance.recovered"
+	InstanceDeleted    = "instance.deleted"
+	RouteUpdated       = "route.updated"
+	RouteDeleted       = "route.deleted"
+	ProductCreated     = "product.created"
+	ProductUpdated     = "product.updated"
+	ProductDeleted     = "product.deleted"
+)
+
+// Types son todos los tipos que se publican.
+var Types = []string{
+	DeploymentCreated, BuildStarted, BuildFinished,
+	InstanceRegistered, InstanceFailed, InstanceRecovered, InstanceDeleted,
+	RouteUpdated, RouteDeleted,
+	ProductCreated, ProductUpdated, ProductDeleted,
+}
+
+const (
+	streamKey          = "events"
+	DefaultMaxEntries  = 10000
+	defaultMaxAttempts = 5
+	readBatch          = 100
+	// Lo pendiente de un consumidor que no confirma en este tiempo (p.ej. un
+	// contenedor que se reemplazo y cambio de hostname) lo toma otro.
+	defaultClaimIdle = 5 * time.Minute
+	claimEvery       = time.Minute
+)
+
+type Event struct {
+	ID         string         `json:"id,omitempty"`
+	Type       string         `json:"type"`
+	Time       time.Time      `json:"time"`
+	ProductID  string         `json:"product_id,omitempty"`
+	InstanceID string         `json:"instance_id,omitempty"`
+	Data       map[string]any `json:"data,omitempty"`
+}
+
+// Publisher es lo que necesitan los handlers; lo cumple Bus.
+type Publisher interface {
+	Publish(e Event) error
+}
+
+// Publish publica con p si no es nil y solo loguea si falla: un evento perdido
+// no debe romper la operacion que lo origino.
+func Publish(p Publisher, e Event) {
+	if p == nil {
+		return
+	}
+	if err := p.Publish(e); err != nil {
+		log.Printf("events: publish %s: %v", e.Type, err)
+	}
+}
+
+type Bus struct {
+	kv          storage.KV
+	maxEntries  int64
+	maxAttempts int
+	claimIdle   time.Duration
+}
+
+func NewBus(kv storage.KV, maxEntries int) *Bus {
+	if maxEntries <= 0 {
+		maxEntries = DefaultMaxEntries
+	}
+	return &Bus{kv: kv, maxEntries: int64(maxEntries), maxAttempts: defaultMaxAttempts, claimIdle: defaultClaimIdle}
+}
+
+// WithMaxAttempts fija cuantas veces se entrega un evento que falla antes de descartarlo.
+func (b *Bus) WithMaxAttempts(n int) *Bus {
+	if n > 0 {
+		b.maxAttempts = n
+	}
+	return b
+}
+
+// WithClaimIdle fija cuanto tiempo sin confirmar tiene que llevar un evento
+// pendiente de otro consumidor para que este lo tome.
+func (b *Bus) WithClaimIdle(d time.Duration) *Bus {
+	if d > 0 {
+		b.claimIdle = d
+	}
+	return b
+}
+
+func (b *Bus) Publish(e Event) error {
+	e.ID = ""
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = b.kv.XAdd(streamKey, string(data), b.maxEntries)
+	return err
+}
+
+// Since devuelve hasta limit eventos posteriores al id after ("" desde el mas
+// viejo que queda en el stream), en orden.
+func (b *Bus) Since(after string, limit int) ([]Event, error) {
+	entries, err := b.kv.XRange(streamKey, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	return decode(entries), nil
+}
+
+// latestID es el id del ultimo evento publicado ("" si no hay ninguno).
+func (b *Bus) latestID() (string, error) {
+	entries, err := b.kv.XRevRange(streamKey, "", 1)
+	if err != nil || len(entries) == 0 {
+		return "", err
+	}
+	return entries[0].ID, nil
+}
+
+// decode descarta las entradas que no son eventos validos.
+func decode(entries []storage.StreamEntry) []Event {
+	out := make([]Event, 0, len(entries))
+	for _, m := range entries {
+		var e Event
+		if err := json.Unmarshal([]byte(m.Value), &e); err != nil {
+			continue
+		}
+		e.ID = m.ID
+		out = append(out, e)
+	}
+	return out
+}
+
+// HandlerFunc procesa un evento; si devuelve error el evento se vuelve a
+// entregar en la proxima vuelta.
+type HandlerFunc func(e Event) error
+
+// Subscribe consume los eventos del grupo hasta que ctx termine, revisando el
+// stream cada every. Los eventos se procesan en orden: uno que falla frena a
+// los siguientes hasta que se procese o agote los intentos. Al arrancar y cada
+// claimEvery toma lo que otros consumidores del grupo dejaron pendiente.
+func (b *Bus) Subscribe(ctx context.Context, group, consumer string, handle HandlerFunc, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	s := &subscription{bus: b, group: group, consumer: consumer, handle: handle, attempts: make(map[string]int)}
+	var claimedAt time.Time
+	for {
+		if time.Since(claimedAt) >= claimEvery {
+			s.claim()
+			claimedAt = time.Now()
+		}
+		for s.poll() {
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type subscription struct {
+	bus      *Bus
+	group    string
+	consumer string
+	handle   HandlerFunc
+	attempts map[string]int
+}
+
+// claim pasa a este consumidor lo pendiente inactivo de los demas; el proximo
+// poll lo lee como propio.
+func (s *subscription) claim() {
+	n, err := s.bus.kv.XClaimIdle(streamKey, s.group, s.consumer, s.bus.claimIdle)
+	if err != nil {
+		log.Printf("events: claim %s: %v", s.group, err)
+		return
+	}
+	if n > 0 {
+		log.Printf("events: %s: %s claimed %d idle events", s.group, s.consumer, n)
+	}
+}
+
+// poll procesa una tanda e indica si conviene leer otra enseguida.
+func (s *subscription) poll() bool {
+	entries, err := s.bus.kv.XReadGroup(streamKey, s.group, s.consumer, readBatch)
+	if err != nil {
+		log.Printf("events: read %s: %v", s.group, err)
+		return false
+	}
+
+	for _, m := range entries {
+		if !s.process(m) {
+			return false
+		}
+		if err := s.bus.kv.XAck(streamKey, s.group, m.ID); err != nil {
+			log.Printf("events: ack %s %s: %v", s.group, m.ID, err)
+			return false
+		}
+	}
+	return len(entries) == readBatch
+}
+
+// process indica si el evento quedo resuelto (procesado o descartado).
+func (s *subscription) process(m storage.StreamEntry) bool {
+	var e Event
+	if err := json.Unmarshal([]byte(m.Value), &e); err != nil {
+		log.Printf("events: %s: dropping malformed event %s: %v", s.group, m.ID, err)
+		return true
+	}
+	e.ID = m.ID
+
+	err := s.handle(e)
+	if err == nil {
+		delete(s.attempts, m.ID)
+		return true
+	}
+
+	s.attempts[m.ID]++
+	if s.attempts[m.ID] >= s.bus.maxAttempts {
+		log.Printf("events: %s: dropping %s %s after %d attempts: %v", s.group, e.Type, m.ID, s.attempts[m.ID], err)
+		delete(s.attempts, m.ID)
+		return true
+	}
+	log.Printf("events: %s: %s %s failed (attempt %d): %v", s.group, e.Type, m.ID, s.attempts[m.ID], err)
+	return false
+}
@@ -0,0 +1,150 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ark_deploy/internal/storage"
+)
+
+func newTestBus(t *testing.T) *Bus {
+	t.Helper()
+	kv, err := storage.OpenFileKV(filepath.Join(t.TempDir(), "ark.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { kv.Close() })
+	return NewBus(kv, 100)
+}
+
+func newTestSubscription(b *Bus, group string, handle HandlerFunc) *subscription {
+	return &subscription{bus: b, group: group, consumer: "test", handle: handle, attempts: make(map[string]int)}
+}
+
+func TestBus_EachGroupSeesEveryEvent(t *testing.T) {
+	b := newTestBus(t)
+
+	var notifier, metrics []Event
+	n := newTestSubscription(b, "notifier", func(e Event) error { notifier = append(notifier, e); return nil })
+	m := newTestSubscription(b, "metrics", func(e Event) error { metrics = append(metrics, e); return nil })
+	// Los grupos se crean en la primera lectura.
+	n.poll()
+	m.poll()
+
+	_ = b.Publish(Event{Type: DeploymentCreated, ProductID: "shop", InstanceID: "i1"})
+	_ = b.Publish(Event{Type: InstanceRegistered, ProductID: "shop", InstanceID: "i1", Data: map[string]any{"backends": 1}})
+
+	n.poll()
+	m.poll()
+	n.poll()
+
+	if len(notifier) != 2 || len(metrics) != 2 {
+		t.Fatalf("expected both groups to get 2 events once, got %d and %d", len(notifier), len(metrics))
+	}
+	e := notifier[1]
+	if e.Type != InstanceRegistered || e.InstanceID != "i1" || e.ID == "" || e.Time.IsZero() {
+		t.Fatalf("unexpected event: %+v", e)
+	}
+	if e.Data["backends"] != float64(1) {
+		t.Fatalf("expected data to round-trip, got %+v", e.Data)
+	}
+}
+
+func TestBus_RetriesThenDrops(t *testing.T) {
+	b := newTestBus(t).WithMaxAttempts(2)
+
+	calls := map[string]int{}
+	s := newTestSubscription(b, "reconciler", func(e Event) error {
+		calls[e.Type]++
+		if e.Type == InstanceFailed {
+			return errors.New("boom")
+		}
+		return nil
+	})
+	s.poll()
+
+	_ = b.Publish(Event{Type: InstanceFailed, InstanceID: "i1"})
+	_ = b.Publish(Event{Type: InstanceDeleted, InstanceID: "i1"})
+
+	// El que falla frena al siguiente hasta agotar los intentos.
+	s.poll()
+	if calls[InstanceFailed] != 1 || calls[InstanceDeleted] != 0 {
+		t.Fatalf("expected processing to stop at the failing event, got %v", calls)
+	}
+	s.poll()
+	if calls[InstanceFailed] != 2 || calls[InstanceDeleted] != 1 {
+		t.Fatalf("expected failing event dropped after 2 attempts, got %v", calls)
+	}
+	s.poll()
+	if calls[InstanceFailed] != 2 || calls[InstanceDeleted] != 1 {
+		t.Fatalf("expected nothing left pending, got %v", calls)
+	}
+}
+
+func TestBus_SubscribeStopsWithContext(t *testing.T) {
+	b := newTestBus(t)
+
+	got := make(chan Event, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		b.Subscribe(ctx, "g", "c", func(e Event) error {
+			select {
+			case got <- e:
+			default:
+			}
+			return nil
+		}, 10*time.Millisecond)
+		close(done)
+	}()
+
+	// Hasta que el grupo exista los eventos nuevos no se le entregan.
+	deadline := time.After(2 * time.Second)
+	for {
+		_ = b.Publish(Event{Type: ProductUpdated, ProductID: "shop"})
+		select {
+		case e := <-got:
+			if e.Type != ProductUpdated {
+				t.Fatalf("unexpected event: %+v", e)
+			}
+			cancel()
+			<-done
+			return
+		case <-time.After(20 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("subscriber never received an event")
+		}
+	}
+}
+
+func TestBus_ClaimsEventsLeftByAGoneConsumer(t *testing.T) {
+	b := newTestBus(t).WithClaimIdle(time.Millisecond)
+
+	// Un contenedor anterior (otro hostname) recibio el evento y murio sin confirmarlo.
+	gone := &subscription{bus: b, group: "notifier", consumer: "old-host", handle: func(Event) error { return errors.New("boom") }, attempts: make(map[string]int)}
+	gone.poll()
+	_ = b.Publish(Event{Type: InstanceFailed, InstanceID: "i1"})
+	gone.poll()
+
+	var got []Event
+	s := newTestSubscription(b, "notifier", func(e Event) error { got = append(got, e); return nil })
+	s.poll()
+	if len(got) != 0 {
+		t.Fatalf("another consumer's pending event must not be read before claiming, got %+v", got)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	s.claim()
+	s.poll()
+	if len(got) != 1 || got[0].Type != InstanceFailed {
+		t.Fatalf("expected the idle event processed by the new consumer, got %+v", got)
+	}
+	s.claim()
+	s.poll()
+	if len(got) != 1 {
+		t.Fatalf("claimed event must be acked once, got %+v", got)
+	}
+}
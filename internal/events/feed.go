@@ -0,0 +1,148 @@
+package events
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Feed reparte en vivo los eventos del stream a los clientes conectados de esta
+// replica. Como lee el stream compartido (no un pub/sub local), cualquier
+// replica ve los eventos de todas. Solo lee mientras haya suscriptores.
+
+const (
+	feedBatch  = 500
+	feedBuffer = 256
+)
+
+// Filter elige los eventos de un suscriptor; los campos vacios no filtran.
+// Type acepta un prefijo terminado en "." (p.ej. "instance.").
+type Filter struct {
+	ProductID  string
+	InstanceID string
+	Type       string
+}
+
+func (f Filter) Matches(e Event) bool {
+	if f.ProductID != "" && e.ProductID != f.ProductID {
+		return false
+	}
+	if f.InstanceID != "" && e.InstanceID != f.InstanceID {
+		return false
+	}
+	if f.Type != "" {
+		if strings.HasSuffix(f.Type, ".") {
+			return strings.HasPrefix(e.Type, f.Type)
+		}
+		return e.Type == f.Type
+	}
+	return true
+}
+
+type Feed struct {
+	bus   *Bus
+	every time.Duration
+
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+	stop chan struct{}
+}
+
+func NewFeed(bus *Bus, every time.Duration) *Feed {
+	if every <= 0 {
+		every = time.Second
+	}
+	return &Feed{bus: bus, every: every, subs: make(map[chan Event]struct{})}
+}
+
+// Subscribe devuelve un canal con los eventos publicados desde ahora y la
+// funcion para darse de baja. Si el cliente no consume a tiempo el canal se
+// cierra y le toca reconectar (con Last-Event-ID no pierde nada).
+func (f *Feed) Subscribe() (<-chan Event, func(), error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.stop == nil {
+		last, err := f.bus.latestID()
+		if err != nil {
+			return nil, nil, err
+		}
+		f.stop = make(chan struct{})
+		go f.tail(f.stop, last)
+	}
+
+	ch := make(chan Event, feedBuffer)
+	f.subs[ch] = struct{}{}
+
+	cancel := func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.dropLocked(ch)
+	}
+	return ch, cancel, nil
+}
+
+// dropLocked saca al suscriptor y, si era el ultimo, frena la lectura.
+func (f *Feed) dropLocked(ch chan Event) {
+	if _, ok := f.subs[ch]; !ok {
+		return
+	}
+	delete(f.subs, ch)
+	close(ch)
+	if len(f.subs) == 0 && f.stop != nil {
+		close(f.stop)
+		f.stop = nil
+	}
+}
+
+func (f *Feed) tail(stop chan struct{}, last string) {
+	ticker := time.NewTicker(f.every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		for {
+			batch, err := f.bus.Since(last, feedBatch)
+			if err != nil {
+				log.Printf("events: feed: %v", err)
+				break
+			}
+			if len(batch) == 0 {
+				break
+			}
+			last = batch[len(batch)-1].ID
+			if !f.broadcast(stop, batch) {
+				return
+			}
+			if len(batch) < feedBatch {
+				break
+			}
+		}
+	}
+}
+
+// broadcast indica si la lectura sigue vigente.
+func (f *Feed) broadcast(stop chan struct{}, batch []Event) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.stop != stop {
+		return false
+	}
+	for _, e := range batch {
+		for ch := range f.subs {
+			select {
+			case ch <- e:
+			default:
+				f.dropLocked(ch)
+			}
+		}
+	}
+	return f.stop == stop
+}
@@ -0,0 +1,128 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"ark_deploy/internal/storage"
+)
+
+const (
+	defaultKeepAlive = 15 * time.Second
+	// retryMillis es lo que espera el navegador antes de reconectar.
+	retryMillis = 3000
+)
+
+type Handler struct {
+	bus       *Bus
+	feed      *Feed
+	keepAlive time.Duration
+}
+
+func NewHandler(bus *Bus, feed *Feed) *Handler {
+	return &Handler{bus: bus, feed: feed, keepAlive: defaultKeepAlive}
+}
+
+// Stream es GET /api/events/stream: Server-Sent Events con la actividad de la
+// plataforma. ?product, ?instance y ?type (exacto o prefijo terminado en ".")
+// filtran. Con Last-Event-ID (o ?last_event_id) primero se reenvia lo publicado
+// despues de ese evento.
+func (h *Handler) Stream(c *gin.Context) {
+	filter := Filter{
+		ProductID:  strings.TrimSpace(c.Query("product")),
+		InstanceID: strings.TrimSpace(c.Query("instance")),
+		Type:       strings.TrimSpace(c.Query("type")),
+	}
+
+	lastID := strings.TrimSpace(c.GetHeader("Last-Event-ID"))
+	if lastID == "" {
+		lastID = strings.TrimSpace(c.Query("last_event_id"))
+	}
+	if lastID != "" && !storage.ValidStreamID(lastID) {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid Last-Event-ID"})
+		return
+	}
+
+	// Suscribirse antes de leer lo atrasado: lo que llegue mientras tanto queda
+	// en el canal y se descarta si ya se mando.
+	live, cancel, err := h.feed.Subscribe()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"detail": err.Error()})
+		return
+	}
+	defer cancel()
+
+	w := c.Writer
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", retryMillis)
+
+	if lastID != "" {
+		for {
+			batch, err := h.bus.Since(lastID, feedBatch)
+			if err != nil {
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", jsonString(err.Error()))
+				w.Flush()
+				return
+			}
+			for _, e := range batch {
+				lastID = e.ID
+				if filter.Matches(e) {
+					writeEvent(w, e)
+				}
+			}
+			if len(batch) < feedBatch {
+				break
+			}
+		}
+	}
+	w.Flush()
+
+	keepAlive := time.NewTicker(h.keepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case e, ok := <-live:
+			if !ok {
+				return
+			}
+			if lastID != "" && !storage.StreamIDLess(lastID, e.ID) {
+				continue
+			}
+			lastID = e.ID
+			if !filter.Matches(e) {
+				continue
+			}
+			writeEvent(w, e)
+			w.Flush()
+		case <-keepAlive.C:
+			io.WriteString(w, ": keep-alive\n\n")
+			w.Flush()
+		}
+	}
+}
+
+func writeEvent(w io.Writer, e Event) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+}
+
+func jsonString(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
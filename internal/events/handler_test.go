@@ -0,0 +1,140 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sseEvent es un mensaje SSE ya parseado.
+type sseEvent struct {
+	id    string
+	name  string
+	event Event
+}
+
+func startStream(t *testing.T, b *Bus, query string, lastEventID string) (<-chan sseEvent, func()) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	h := NewHandler(b, NewFeed(b, 10*time.Millisecond))
+	r := gin.New()
+	r.GET("/api/events/stream", h.Stream)
+	srv := httptest.NewServer(r)
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/events/stream"+query, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+
+	out := make(chan sseEvent, 16)
+	go func() {
+		defer close(out)
+		sc := bufio.NewScanner(resp.Body)
+		var cur sseEvent
+		for sc.Scan() {
+			line := sc.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				cur.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				cur.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				_ = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &cur.event)
+			case line == "" && cur.id != "":
+				out <- cur
+				cur = sseEvent{}
+			}
+		}
+	}()
+
+	return out, func() {
+		resp.Body.Close()
+		srv.Close()
+	}
+}
+
+func next(t *testing.T, ch <-chan sseEvent) sseEvent {
+	t.Helper()
+	select {
+	case e, ok := <-ch:
+		if !ok {
+			t.Fatalf("stream closed")
+		}
+		return e
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for an event")
+	}
+	return sseEvent{}
+}
+
+func TestStream_ResumesFromLastEventIDAndFilters(t *testing.T) {
+	b := newTestBus(t)
+
+	_ = b.Publish(Event{Type: DeploymentCreated, ProductID: "shop", InstanceID: "i1"})
+	seen, _ := b.Since("", 10)
+	_ = b.Publish(Event{Type: InstanceRegistered, ProductID: "blog", InstanceID: "i2"})
+	_ = b.Publish(Event{Type: InstanceRegistered, ProductID: "shop", InstanceID: "i1"})
+
+	stream, stop := startStream(t, b, "?product=shop", seen[0].ID)
+	defer stop()
+
+	// Lo atrasado: solo lo posterior al ultimo id visto y del producto pedido.
+	got := next(t, stream)
+	if got.name != InstanceRegistered || got.event.InstanceID != "i1" || got.id == seen[0].ID {
+		t.Fatalf("unexpected replayed event: %+v", got)
+	}
+
+	// En vivo.
+	_ = b.Publish(Event{Type: ProductUpdated, ProductID: "blog"})
+	_ = b.Publish(Event{Type: ProductUpdated, ProductID: "shop"})
+	live := next(t, stream)
+	if live.name != ProductUpdated || live.event.ProductID != "shop" {
+		t.Fatalf("unexpected live event: %+v", live)
+	}
+	if live.id == got.id {
+		t.Fatalf("event sent twice: %+v", live)
+	}
+}
+
+func TestStream_LiveOnlyWithoutLastEventID(t *testing.T) {
+	b := newTestBus(t)
+	_ = b.Publish(Event{Type: DeploymentCreated, InstanceID: "old"})
+
+	stream, stop := startStream(t, b, "?type=instance.", "")
+	defer stop()
+
+	_ = b.Publish(Event{Type: RouteUpdated, InstanceID: "i1"})
+	_ = b.Publish(Event{Type: InstanceFailed, InstanceID: "i1"})
+	got := next(t, stream)
+	if got.name != InstanceFailed {
+		t.Fatalf("expected only new instance.* events, got %+v", got)
+	}
+}
+
+func TestStream_RejectsInvalidLastEventID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	b := newTestBus(t)
+	r := gin.New()
+	r.GET("/api/events/stream", NewHandler(b, NewFeed(b, time.Second)).Stream)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/events/stream?last_event_id=nope", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+}
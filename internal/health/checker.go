@@ -0,0 +1,323 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ark_deploy/internal/events"
+	"ark_deploy/internal/storage"
+)
+
+// Health checks activos: cada ruta registrada se sondea periodicamente con el
+// path, status esperado e intervalo definidos en el producto. Se prueba cada
+// backend vivo y la instancia esta sana si alguno responde bien. El resultado
+// queda en el historial de la instancia y su estado alterna entre running y
+// unhealthy.
+
+const (
+	StatusRunning   = "running"
+	StatusUnhealthy = "unhealthy"
+
+	defaultPath  = "/"
+	tickInterval = 5 * time.Second
+	probeTimeout = 5 * time.Second
+	maxParallel  = 8
+)
+
+type RouteLister interface {
+	ListRoutes() ([]storage.Route, error)
+}
+
+type InstanceStore interface {
+	GetByID(id string) (storage.Instance, error)
+	RecordHealth(id string, check storage.HealthCheck, next func(status string, failures int) string) (string, error)
+}
+
+type ProductStore interface {
+	GetByID(id string) (storage.Product, error)
+}
+
+type Checker struct {
+	routes           RouteLister
+	instances        InstanceStore
+	products         ProductStore
+	httpc            *http.Client
+	defaultInterval  time.Duration
+	failureThreshold int
+	events           events.Publisher
+	now              func() time.Time
+
+	mu      sync.Mutex
+	lastRun map[string]time.Time
+}
+
+func NewChecker(routes RouteLister, instances InstanceStore, products ProductStore, defaultInterval time.Duration, failureThreshold int) *Checker {
+	if defaultInterval <= 0 {
+		defaultInterval = 30 * time.Second
+	}
+	if failureThreshold <= 0 {
+		failureThreshold = 3
+	}
+	return &Checker{
+		routes:           routes,
+		instances:        instances,
+		products:         products,
+		httpc:            &http.Client{Timeout: probeTimeout},
+		defaultInterval:  defaultInterval,
+		failureThreshold: failureThreshold,
+		now:              time.Now,
+		lastRun:          make(map[string]time.Time),
+	}
+}
+
+// WithEvents publica instance.failed cuando una instancia pasa a unhealthy e
+// instance.recovered cuando vuelve a running.
+func (c *Checker) WithEvents(p events.Publisher) *Checker {
+	c.events = p
+	return c
+}
+
+// Run ejecuta los chequeos pendientes en cada tick hasta que se cancela el contexto.
+func (c *Checker) Run(ctx context.Context) {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		c.CheckDue(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckDue sondea las rutas cuyo intervalo ya vencio.
+func (c *Checker) CheckDue(ctx context.Context) {
+	routes, err := c.routes.ListRoutes()
+	if err != nil {
+		log.Printf("health: list routes: %v", err)
+		return
+	}
+
+	c.prune(routes)
+
+	sem := make(chan struct{}, maxParallel)
+	var wg sync.WaitGroup
+
+	for _, route := range routes {
+		// Una ruta sin backends vivos no tiene a quien sondear.
+		backends := route.LiveBackends(c.now())
+		if len(backends) == 0 {
+			continue
+		}
+
+		instance, err := c.instances.GetByID(route.InstanceID)
+		if err != nil {
+			continue
+		}
+
+		spec := c.specFor(instance.ProductID)
+		if !c.due(route.InstanceID, spec.interval) {
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(backends []storage.Backend, instance storage.Instance) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			c.checkRoute(ctx, backends, instance, spec)
+		}(backends, instance)
+	}
+
+	wg.Wait()
+}
+
+type probeSpec struct {
+	path           string
+	expectedStatus int
+	interval       time.Duration
+}
+
+func (c *Checker) specFor(productID string) probeSpec {
+	spec := probeSpec{path: defaultPath, interval: c.defaultInterval}
+
+	p, err := c.products.GetByID(productID)
+	if err != nil {
+		return spec
+	}
+	if path := strings.TrimSpace(p.HealthPath); path != "" {
+		spec.path = path
+	}
+	spec.expectedStatus = p.HealthExpectedStatus
+	if p.HealthIntervalSeconds > 0 {
+		spec.interval = time.Duration(p.HealthIntervalSeconds) * time.Second
+	}
+	return spec
+}
+
+func (c *Checker) due(instanceID string, interval time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if last, ok := c.lastRun[instanceID]; ok && now.Sub(last) < interval {
+		return false
+	}
+	c.lastRun[instanceID] = now
+	return true
+}
+
+// prune olvida las instancias cuya ruta ya no existe.
+func (c *Checker) prune(routes []storage.Route) {
+	live := make(map[string]bool, len(routes))
+	for _, r := range routes {
+		live[r.InstanceID] = true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id := range c.lastRun {
+		if !live[id] {
+			delete(c.lastRun, id)
+		}
+	}
+}
+
+func (c *Checker) checkRoute(ctx context.Context, backends []storage.Backend, instance storage.Instance, spec probeSpec) {
+	check := c.probeBackends(ctx, backends, spec)
+
+	// El estado se decide sobre el registro guardado, no sobre la copia leida
+	// antes del sondeo: un cambio concurrente (p.ej. un redeploy) no se pisa.
+	failures := 0
+	status, err := c.instances.RecordHealth(instance.ID, check, func(current string, n int) string {
+		failures = n
+		return nextStatus(current, check.Healthy, n, c.failureThreshold)
+	})
+	if err != nil {
+		log.Printf("health: record %s: %v", instance.ID, err)
+		return
+	}
+
+	switch status {
+	case StatusUnhealthy:
+		events.Publish(c.events, events.Event{
+			Type:       events.InstanceFailed,
+			ProductID:  instance.ProductID,
+			InstanceID: instance.ID,
+			Data: map[string]any{
+				"failures":    failures,
+				"status_code": check.StatusCode,
+				"error":       check.Error,
+			},
+		})
+	case StatusRunning:
+		events.Publish(c.events, events.Event{
+			Type:       events.InstanceRecovered,
+			ProductID:  instance.ProductID,
+			InstanceID: instance.ID,
+			Data:       map[string]any{"latency_ms": check.LatencyMs},
+		})
+	}
+}
+
+// probeBackends sondea los backends en paralelo. El chequeo es sano si alguno
+// responde bien (el proxy saltea los caidos); status y latencia son los del
+// primero sano, o los del primero si fallan todos.
+func (c *Checker) probeBackends(ctx context.Context, backends []storage.Backend, spec probeSpec) storage.HealthCheck {
+	checks := make([]storage.HealthCheck, len(backends))
+	var wg sync.WaitGroup
+	for i, b := range backends {
+		wg.Add(1)
+		go func(i int, b storage.Backend) {
+			defer wg.Done()
+			checks[i] = c.probe(ctx, b.Host, b.Port, spec)
+		}(i, b)
+	}
+	wg.Wait()
+
+	summary := checks[0]
+	var failed []string
+	for i, check := range checks {
+		if check.Healthy && !summary.Healthy {
+			summary = check
+		}
+		if !check.Healthy {
+			failed = append(failed, backends[i].Key()+": "+check.Error)
+		}
+	}
+	if len(backends) == 1 {
+		return summary
+	}
+
+	summary.Error = ""
+	if !summary.Healthy {
+		summary.Error = strings.Join(failed, "; ")
+	}
+	summary.Backends = make([]storage.BackendCheck, len(checks))
+	for i, check := range checks {
+		summary.Backends[i] = storage.BackendCheck{
+			Backend:    backends[i].Key(),
+			Healthy:    check.Healthy,
+			StatusCode: check.StatusCode,
+			LatencyMs:  check.LatencyMs,
+			Error:      check.Error,
+		}
+	}
+	return summary
+}
+
+// nextStatus solo alterna entre running y unhealthy; provisioning, failed u
+// otros estados no se tocan.
+func nextStatus(current string, healthy bool, failures int, threshold int) string {
+	switch {
+	case current == StatusUnhealthy && healthy:
+		return StatusRunning
+	case current == StatusRunning && !healthy && failures >= threshold:
+		return StatusUnhealthy
+	default:
+		return ""
+	}
+}
+
+func (c *Checker) probe(ctx context.Context, host string, port int, spec probeSpec) storage.HealthCheck {
+	started := c.now()
+	check := storage.HealthCheck{CheckedAt: started.UTC()}
+
+	target := "http://" + net.JoinHostPort(host, strconv.Itoa(port)) + spec.path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	req.Header.Set("User-Agent", "ark_deploy-healthcheck/1.0")
+
+	resp, err := c.httpc.Do(req)
+	check.LatencyMs = time.Since(started).Milliseconds()
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	defer resp.Body.Close()
+
+	check.StatusCode = resp.StatusCode
+	if spec.expectedStatus != 0 {
+		check.Healthy = resp.StatusCode == spec.expectedStatus
+	} else {
+		check.Healthy = resp.StatusCode >= 200 && resp.StatusCode < 400
+	}
+	if !check.Healthy {
+		check.Error = fmt.Sprintf("unexpected status %d", resp.StatusCode)
+	}
+
+	return check
+}
@@ -0,0 +1,254 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ark_deploy/internal/events"
+	"ark_deploy/internal/storage"
+)
+
+type mockRoutes struct {
+	routes []storage.Route
+}
+
+func (m *mockRoutes) ListRoutes() ([]storage.Route, error) {
+	return m.routes, nil
+}
+
+type mockInstances struct {
+	mu        sync.Mutex
+	instances map[string]storage.Instance
+}
+
+func (m *mockInstances) GetByID(id string) (storage.Instance, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i, ok := m.instances[id]
+	if !ok {
+		return storage.Instance{}, errors.New("instance not found")
+	}
+	return i, nil
+}
+
+func (m *mockInstances) RecordHealth(id string, check storage.HealthCheck, next func(string, int) string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.instances[id]
+	if i.Health == nil {
+		i.Health = &storage.InstanceHealth{}
+	}
+	i.Health.Healthy = check.Healthy
+	if check.Healthy {
+		i.Health.ConsecutiveFailures = 0
+	} else {
+		i.Health.ConsecutiveFailures++
+	}
+	i.Health.History = append(i.Health.History, check)
+	status := next(i.Status, i.Health.ConsecutiveFailures)
+	if status != "" {
+		i.Status = status
+	}
+	m.instances[id] = i
+	return status, nil
+}
+
+type mockProducts struct {
+	products map[string]storage.Product
+}
+
+func (m *mockProducts) GetByID(id string) (storage.Product, error) {
+	p, ok := m.products[id]
+	if !ok {
+		return storage.Product{}, errors.New("product not found")
+	}
+	return p, nil
+}
+
+type mockPublisher struct {
+	mu     sync.Mutex
+	events []events.Event
+}
+
+func (m *mockPublisher) Publish(e events.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, e)
+	return nil
+}
+
+func TestChecker_FlipsStatusOnFailuresAndRecovery(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(false)
+
+	var lastPath atomic.Value
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastPath.Store(r.URL.Path)
+		if healthy.Load() {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	instances := &mockInstances{instances: map[string]storage.Instance{
+		"i-1": {ID: "i-1", ProductID: "shop", Status: StatusRunning},
+	}}
+	products := &mockProducts{products: map[string]storage.Product{
+		"shop": {ID: "shop", HealthPath: "/healthz", HealthExpectedStatus: http.StatusNoContent, HealthIntervalSeconds: 10},
+	}}
+	routes := &mockRoutes{routes: []storage.Route{{InstanceID: "i-1", TargetHost: u.Hostname(), TargetPort: port}}}
+
+	published := &mockPublisher{}
+	checker := NewChecker(routes, instances, products, time.Minute, 2).WithEvents(published)
+	clock := time.Now()
+	checker.now = func() time.Time { return clock }
+
+	run := func() storage.Instance {
+		checker.CheckDue(context.Background())
+		clock = clock.Add(11 * time.Second)
+		i, _ := instances.GetByID("i-1")
+		return i
+	}
+
+	if i := run(); i.Status != StatusRunning || i.Health.ConsecutiveFailures != 1 {
+		t.Fatalf("expected running after first failure, got %s (%+v)", i.Status, i.Health)
+	}
+	if lastPath.Load() != "/healthz" {
+		t.Fatalf("expected product health path, got %v", lastPath.Load())
+	}
+	if i := run(); i.Status != StatusUnhealthy {
+		t.Fatalf("expected unhealthy after threshold, got %s", i.Status)
+	}
+	if len(published.events) != 1 || published.events[0].Type != events.InstanceFailed || published.events[0].ProductID != "shop" {
+		t.Fatalf("expected one instance.failed event, got %+v", published.events)
+	}
+
+	healthy.Store(true)
+	i := run()
+	if i.Status != StatusRunning || !i.Health.Healthy {
+		t.Fatalf("expected running after recovery, got %s", i.Status)
+	}
+	if len(i.Health.History) != 3 {
+		t.Fatalf("expected 3 checks in history, got %d", len(i.Health.History))
+	}
+	if len(published.events) != 2 || published.events[1].Type != events.InstanceRecovered {
+		t.Fatalf("expected instance.recovered after recovery, got %+v", published.events)
+	}
+}
+
+func TestChecker_RespectsIntervalAndSkipsProvisioning(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	instances := &mockInstances{instances: map[string]storage.Instance{
+		"i-1": {ID: "i-1", ProductID: "shop", Status: "provisioning"},
+	}}
+	routes := &mockRoutes{routes: []storage.Route{{InstanceID: "i-1", TargetHost: u.Hostname(), TargetPort: port}}}
+
+	checker := NewChecker(routes, instances, &mockProducts{}, 30*time.Second, 1)
+	checker.CheckDue(context.Background())
+	checker.CheckDue(context.Background())
+
+	if hits.Load() != 1 {
+		t.Fatalf("expected a single probe within the interval, got %d", hits.Load())
+	}
+	if i, _ := instances.GetByID("i-1"); i.Status != "provisioning" {
+		t.Fatalf("status must not change outside running/unhealthy, got %s", i.Status)
+	}
+}
+
+func TestChecker_ProbesEveryLiveBackend(t *testing.T) {
+	var upHits, downHits atomic.Int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upHits.Add(1)
+	}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downHits.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer down.Close()
+
+	backend := func(raw string) storage.Backend {
+		u, _ := url.Parse(raw)
+		port, _ := strconv.Atoi(u.Port())
+		return storage.Backend{Host: u.Hostname(), Port: port}
+	}
+	expired := time.Now().Add(-time.Minute)
+	gone := backend(up.URL)
+	gone.Port = 1
+	gone.ExpiresAt = &expired
+
+	instances := &mockInstances{instances: map[string]storage.Instance{
+		"i-1": {ID: "i-1", ProductID: "shop", Status: StatusRunning},
+		"i-2": {ID: "i-2", ProductID: "shop", Status: StatusRunning},
+	}}
+	routes := &mockRoutes{routes: []storage.Route{
+		// El ultimo registrado (TargetHost/TargetPort) es el caido.
+		{InstanceID: "i-1", TargetHost: backend(down.URL).Host, TargetPort: backend(down.URL).Port,
+			Backends: []storage.Backend{backend(up.URL), gone, backend(down.URL)}},
+		// Sin backends: no se sondea http://:0.
+		{InstanceID: "i-2"},
+	}}
+
+	checker := NewChecker(routes, instances, &mockProducts{}, time.Minute, 1)
+	checker.CheckDue(context.Background())
+
+	if upHits.Load() != 1 || downHits.Load() != 1 {
+		t.Fatalf("expected each live backend probed once, got up=%d down=%d", upHits.Load(), downHits.Load())
+	}
+	i, _ := instances.GetByID("i-1")
+	last := i.Health.History[0]
+	if i.Status != StatusRunning || !last.Healthy || len(last.Backends) != 2 || last.Backends[1].Healthy {
+		t.Fatalf("expected healthy instance with per-backend results, got %s %+v", i.Status, last)
+	}
+	if i, _ := instances.GetByID("i-2"); i.Health != nil {
+		t.Fatalf("a route without backends must not be probed, got %+v", i.Health)
+	}
+}
+
+func TestChecker_DecidesStatusOnStoredRecord(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	instances := &mockInstances{instances: map[string]storage.Instance{
+		"i-1": {ID: "i-1", ProductID: "shop", Status: StatusRunning},
+	}}
+	routes := &mockRoutes{routes: []storage.Route{{InstanceID: "i-1", TargetHost: u.Hostname(), TargetPort: port}}}
+	published := &mockPublisher{}
+	checker := NewChecker(routes, instances, &mockProducts{}, time.Minute, 1).WithEvents(published)
+
+	// Un redeploy paso la instancia a provisioning mientras se sondeaba.
+	instance, _ := instances.GetByID("i-1")
+	instances.instances["i-1"] = storage.Instance{ID: "i-1", ProductID: "shop", Status: "provisioning"}
+	checker.checkRoute(context.Background(), []storage.Backend{{Host: u.Hostname(), Port: port}}, instance, checker.specFor("shop"))
+
+	if i, _ := instances.GetByID("i-1"); i.Status != "provisioning" || len(published.events) != 0 {
+		t.Fatalf("a stale snapshot must not overwrite the stored status, got %s (%d events)", i.Status, len(published.events))
+	}
+}
@@ -0,0 +1,449 @@
+package instances
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+
+	"ark_deploy/internal/audit"
+	"ark_deploy/internal/storage"
+)
+
+// Control de acceso por instancia: el proxy valida la politica antes de reenviar.
+// Sin politica (o modo public) la instancia queda abierta como hasta ahora.
+
+const (
+	accessTokenParam  = "ark_token"
+	accessTokenHeader = "X-ARK-Access-Token"
+	accessCookiePref  = "ark_access_"
+
+	// basicAuthTTL es cuanto se recuerda un usuario/clave ya verificado, para no
+	// correr bcrypt en cada request (cada asset de la pagina trae las credenciales).
+	basicAuthTTL        = 5 * time.Minute
+	basicAuthMaxEntries = 1024
+)
+
+// basicAuthCache guarda hashes de credenciales verificadas. La clave incluye el
+// hash de la politica, asi que cambiar la clave invalida lo cacheado.
+type basicAuthCache struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+	now     func() time.Time
+}
+
+func newBasicAuthCache() *basicAuthCache {
+	return &basicAuthCache{entries: make(map[string]time.Time), now: time.Now}
+}
+
+func basicAuthKey(p *storage.AccessPolicy, user string, pass string) string {
+	sum := sha256.Sum256([]byte(p.PasswordHash + "\x00" + user + "\x00" + pass))
+	return hex.EncodeToString(sum[:])
+}
+
+func (b *basicAuthCache) verified(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	expires, ok := b.entries[key]
+	return ok && b.now().Before(expires)
+}
+
+func (b *basicAuthCache) remember(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if len(b.entries) >= basicAuthMaxEntries {
+		for k, expires := range b.entries {
+			if !now.Before(expires) {
+				delete(b.entries, k)
+			}
+		}
+		if len(b.entries) >= basicAuthMaxEntries {
+			b.entries = make(map[string]time.Time)
+		}
+	}
+	b.entries[key] = now.Add(basicAuthTTL)
+}
+
+// WithAdminGuard protege los endpoints de la politica de acceso: comparten
+// listener con el proxy publico y sin guardia cualquiera la dejaria publica.
+func (h *Handler) WithAdminGuard(guard gin.HandlerFunc) *Handler {
+	h.adminGuard = guard
+	return h
+}
+
+func (h *Handler) admin() gin.HandlerFunc {
+	if h.adminGuard == nil {
+		return func(*gin.Context) {}
+	}
+	return h.adminGuard
+}
+
+type accessPolicyReq struct {
+	Mode        string   `json:"mode" binding:"required"`
+	Username    string   `json:"username"`
+	Password    string   `json:"password"`
+	AllowUsers  []string `json:"allow_users"`
+	AllowTags   []string `json:"allow_tags"`
+	RotateToken bool     `json:"rotate_token"`
+}
+
+// accessPolicyView es la politica sin secretos.
+type accessPolicyView struct {
+	Mode       string    `json:"mode"`
+	Username   string    `json:"username,omitempty"`
+	HasToken   bool      `json:"has_token,omitempty"`
+	AllowUsers []string  `json:"allow_users,omitempty"`
+	AllowTags  []string  `json:"allow_tags,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at,omitempty"`
+}
+
+func viewAccessPolicy(p *storage.AccessPolicy) accessPolicyView {
+	if p == nil {
+		return accessPolicyView{Mode: storage.AccessPublic}
+	}
+	return accessPolicyView{
+		Mode:       p.Mode,
+		Username:   p.Username,
+		HasToken:   p.TokenHash != "",
+		AllowUsers: p.AllowUsers,
+		AllowTags:  p.AllowTags,
+		UpdatedAt:  p.UpdatedAt,
+	}
+}
+
+func (h *Handler) getAccessPolicy(c *gin.Context) {
+	id, ok := h.requireInstance(c)
+	if !ok {
+		return
+	}
+
+	route, found, err := h.store.GetRouteRecord(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "instance route not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"instance_id": id,
+		"access":      viewAccessPolicy(route.Access),
+	})
+}
+
+func (h *Handler) putAccessPolicy(c *gin.Context) {
+	id, ok := h.requireInstance(c)
+	if !ok {
+		return
+	}
+
+	var req accessPolicyReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+
+	route, found, err := h.store.GetRouteRecord(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "instance route not found"})
+		return
+	}
+
+	policy, token, err := buildAccessPolicy(req, route.Access)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+
+	if err := h.store.SetAccessPolicy(id, policy); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+	// Sin hashes: se audita la vista de la politica.
+	audit.Record(c, id, gin.H{"access": viewAccessPolicy(route.Access)}, gin.H{"access": viewAccessPolicy(policy)})
+
+	resp := gin.H{
+		"instance_id": id,
+		"access":      viewAccessPolicy(policy),
+	}
+	if token != "" {
+		resp["token"] = token
+		if shareURL := h.shareURL(id, token); shareURL != "" {
+			resp["share_url"] = shareURL
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// buildAccessPolicy valida el request y conserva los secretos vigentes cuando
+// no se envian nuevos. Devuelve el token en claro solo si se genero uno.
+func buildAccessPolicy(req accessPolicyReq, current *storage.AccessPolicy) (*storage.AccessPolicy, string, error) {
+	mode := strings.ToLower(strings.TrimSpace(req.Mode))
+	if current == nil || current.Mode != mode {
+		current = nil
+	}
+
+	p := &storage.AccessPolicy{Mode: mode, UpdatedAt: time.Now().UTC()}
+
+	switch mode {
+	case storage.AccessPublic:
+		return nil, "", nil
+
+	case storage.AccessBasicAuth:
+		p.Username = strings.TrimSpace(req.Username)
+		if p.Username == "" || strings.Contains(p.Username, ":") {
+			return nil, "", errors.New("basic_auth requires a username without ':'")
+		}
+		switch {
+		case req.Password != "":
+			if len(req.Password) < 8 {
+				return nil, "", errors.New("password must be at least 8 characters")
+			}
+			hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+			if err != nil {
+				return nil, "", err
+			}
+			p.PasswordHash = string(hash)
+		case current != nil && current.Username == p.Username && current.PasswordHash != "":
+			p.PasswordHash = current.PasswordHash
+		default:
+			return nil, "", errors.New("basic_auth requires a password")
+		}
+		return p, "", nil
+
+	case storage.AccessLinkToken:
+		if current != nil && current.TokenHash != "" && !req.RotateToken {
+			p.TokenHash = current.TokenHash
+			return p, "", nil
+		}
+		token, err := newAccessToken()
+		if err != nil {
+			return nil, "", err
+		}
+		p.TokenHash = hashAccessToken(token)
+		return p, token, nil
+
+	case storage.AccessTailscale:
+		p.AllowUsers = trimNonEmpty(req.AllowUsers)
+		p.AllowTags = trimNonEmpty(req.AllowTags)
+		if len(p.AllowUsers) == 0 && len(p.AllowTags) == 0 {
+			return nil, "", errors.New("tailscale mode requires allow_users or allow_tags")
+		}
+		for _, tag := range p.AllowTags {
+			if !strings.HasPrefix(tag, "tag:") {
+				return nil, "", errors.New("allow_tags entries must start with tag:")
+			}
+		}
+		return p, "", nil
+	}
+
+	return nil, "", errors.New("mode must be public, basic_auth, link_token or tailscale")
+}
+
+// authorize aplica la politica; si la request no pasa ya quedo respondida.
+// cookiePath es el prefijo por el que se llego a la instancia.
+func (h *Handler) authorize(c *gin.Context, id string, cookiePath string, p *storage.AccessPolicy) bool {
+	if p == nil || p.Mode == "" || p.Mode == storage.AccessPublic {
+		return true
+	}
+
+	switch p.Mode {
+	case storage.AccessBasicAuth:
+		user, pass, ok := c.Request.BasicAuth()
+		if ok && subtle.ConstantTimeCompare([]byte(user), []byte(p.Username)) == 1 && h.checkPassword(p, user, pass) {
+			c.Request.Header.Del("Authorization")
+			return true
+		}
+		c.Header("WWW-Authenticate", `Basic realm="ARK instance `+shortOf(id)+`", charset="UTF-8"`)
+		h.renderProxyError(c, http.StatusUnauthorized, "", "authentication required")
+		return false
+
+	case storage.AccessLinkToken:
+		if h.authorizeToken(c, id, cookiePath, p) {
+			return true
+		}
+		h.renderProxyError(c, http.StatusForbidden, "", "access denied")
+		return false
+
+	case storage.AccessTailscale:
+		if h.identities != nil {
+			if identity, ok := h.identities.Identify(c.ClientIP()); ok && identityAllowed(identity.User, identity.Tags, p) {
+				return true
+			}
+		}
+		h.renderProxyError(c, http.StatusForbidden, "", "access denied")
+		return false
+	}
+
+	h.renderProxyError(c, http.StatusForbidden, "", "access denied")
+	return false
+}
+
+// checkPassword verifica con bcrypt solo la primera vez; despues usa el cache.
+func (h *Handler) checkPassword(p *storage.AccessPolicy, user string, pass string) bool {
+	key := basicAuthKey(p, user, pass)
+	if h.basicAuth.verified(key) {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(p.PasswordHash), []byte(pass)) != nil {
+		return false
+	}
+	h.basicAuth.remember(key)
+	return true
+}
+
+// authorizeToken acepta el token por query (?ark_token=), header o cookie.
+// El token de la query se cambia por una cookie limitada al prefijo de la
+// instancia, asi el navegador no se la manda a las demas del mismo host.
+func (h *Handler) authorizeToken(c *gin.Context, id string, cookiePath string, p *storage.AccessPolicy) bool {
+	cookieName := accessCookiePref + shortOf(id)
+
+	q := c.Request.URL.Query()
+	if token := q.Get(accessTokenParam); token != "" {
+		q.Del(accessTokenParam)
+		c.Request.URL.RawQuery = q.Encode()
+		if tokenMatches(token, p.TokenHash) {
+			http.SetCookie(c.Writer, &http.Cookie{
+				Name:     cookieName,
+				Value:    token,
+				Path:     cookiePath,
+				HttpOnly: true,
+				Secure:   c.Request.TLS != nil || strings.EqualFold(c.GetHeader("X-Forwarded-Proto"), "https"),
+				SameSite: http.SameSiteLaxMode,
+			})
+			return true
+		}
+		return false
+	}
+
+	if token := c.GetHeader(accessTokenHeader); token != "" {
+		c.Request.Header.Del(accessTokenHeader)
+		return tokenMatches(token, p.TokenHash)
+	}
+
+	if cookie, err := c.Request.Cookie(cookieName); err == nil {
+		return tokenMatches(cookie.Value, p.TokenHash)
+	}
+
+	return false
+}
+
+// accessCookiePath devuelve el prefijo por el que se llego a la instancia
+// (/instances/<id>/, /instances/by-short/<short>/, /aliases/<name>/); por
+// subdominio o dominio propio el path llega entero y queda "/".
+func accessCookiePath(requestPath string, origPath string) string {
+	prefix, ok := strings.CutSuffix(requestPath, origPath)
+	if !ok || prefix == "" {
+		return "/"
+	}
+	return strings.TrimSuffix(prefix, "/") + "/"
+}
+
+// stripAccessCookies saca las cookies ark_access_* de la request: son tokens
+// de acceso y el upstream no tiene por que verlos.
+func stripAccessCookies(r *http.Request) {
+	values := r.Header.Values("Cookie")
+	if len(values) == 0 {
+		return
+	}
+
+	kept := make([]string, 0, len(values))
+	for _, line := range values {
+		for _, part := range strings.Split(line, ";") {
+			part = strings.TrimSpace(part)
+			name, _, _ := strings.Cut(part, "=")
+			if part == "" || strings.HasPrefix(strings.TrimSpace(name), accessCookiePref) {
+				continue
+			}
+			kept = append(kept, part)
+		}
+	}
+
+	r.Header.Del("Cookie")
+	if len(kept) > 0 {
+		r.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
+
+func identityAllowed(user string, tags []string, p *storage.AccessPolicy) bool {
+	for _, u := range p.AllowUsers {
+		if strings.EqualFold(u, user) {
+			return true
+		}
+	}
+	for _, want := range p.AllowTags {
+		for _, tag := range tags {
+			if strings.EqualFold(want, tag) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (h *Handler) shareURL(id string, token string) string {
+	if h.instanceStore == nil {
+		return ""
+	}
+	instance, err := h.instanceStore.GetByID(id)
+	if err != nil {
+		return ""
+	}
+	base := instance.FriendlyURL
+	if base == "" {
+		base = instance.URL
+	}
+	if base == "" {
+		return ""
+	}
+	sep := "?"
+	if strings.Contains(base, "?") {
+		sep = "&"
+	}
+	return base + sep + accessTokenParam + "=" + token
+}
+
+func newAccessToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func tokenMatches(token string, hash string) bool {
+	if token == "" || hash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashAccessToken(token)), []byte(hash)) == 1
+}
+
+func trimNonEmpty(values []string) []string {
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,317 @@
+package instances
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"ark_deploy/internal/storage"
+)
+
+// Aliases de servicio: /aliases/<name>/ es una URL estable que reparte el trafico
+// entre instancias segun pesos (blue/green, canary). Cada destino se resuelve con
+// la ruta de la instancia, asi aplican sus limites, acceso, backends y mirroring.
+
+const (
+	aliasCookiePref = "ark_alias_"
+	maxAliasTargets = 10
+)
+
+type AliasStore interface {
+	Get(name string) (storage.Alias, bool, error)
+	List() ([]storage.Alias, error)
+	Create(a storage.Alias) error
+	Update(a storage.Alias) error
+	Delete(name string) error
+}
+
+// WithAliasStore habilita los aliases de servicio.
+func (h *Handler) WithAliasStore(as AliasStore) *Handler {
+	h.aliases = as
+	return h
+}
+
+func (h *Handler) proxyAlias(c *gin.Context) {
+	name := strings.ToLower(strings.TrimSpace(c.Param("name")))
+	if h.aliases == nil {
+		h.renderProxyError(c, http.StatusNotFound, "", "alias not found")
+		return
+	}
+
+	alias, found, err := h.aliases.Get(name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+	if !found {
+		h.renderProxyError(c, http.StatusNotFound, "", "alias not found")
+		return
+	}
+
+	candidates := make([]storage.AliasTarget, 0, len(alias.Targets))
+	for _, t := range alias.Targets {
+		if t.Weight > 0 {
+			candidates = append(candidates, t)
+		}
+	}
+
+	// El sorteo deja alternativas por si el elegido no tiene ruta; la cookie
+	// de afinidad adelanta la instancia que ya atendio al cliente.
+	candidates = shuffleByWeight(candidates)
+	cookieName := aliasCookiePref + name
+	if alias.Sticky {
+		if cookie, err := c.Request.Cookie(cookieName); err == nil {
+			for i, t := range candidates {
+				if t.InstanceID == cookie.Value {
+					candidates = append([]storage.AliasTarget{t}, append(candidates[:i:i], candidates[i+1:]...)...)
+					break
+				}
+			}
+		}
+	}
+
+	// Si la instancia elegida ya no tiene ruta se prueba con la siguiente.
+	for _, t := range candidates {
+		route, ok, err := h.store.GetRouteRecord(t.InstanceID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+			return
+		}
+		if !ok {
+			continue
+		}
+
+		if alias.Sticky {
+			http.SetCookie(c.Writer, &http.Cookie{
+				Name:     cookieName,
+				Value:    t.InstanceID,
+				Path:     "/aliases/" + name,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		c.Header("X-ARK-Instance", t.InstanceID)
+		h.serveRoute(c, route, "", c.Param("path"))
+		return
+	}
+
+	c.Header("Retry-After", "30")
+	h.renderProxyError(c, http.StatusServiceUnavailable, "", "alias has no available instances")
+}
+
+// shuffleByWeight ordena los destinos por sorteo ponderado: el primero es el
+// elegido y el resto queda como alternativa.
+func shuffleByWeight(targets []storage.AliasTarget) []storage.AliasTarget {
+	pending := append([]storage.AliasTarget(nil), targets...)
+	out := make([]storage.AliasTarget, 0, len(pending))
+	for len(pending) > 0 {
+		total := 0
+		for _, t := range pending {
+			total += t.Weight
+		}
+		n := rand.Intn(total)
+		for i, t := range pending {
+			if n < t.Weight {
+				out = append(out, t)
+				pending = append(pending[:i], pending[i+1:]...)
+				break
+			}
+			n -= t.Weight
+		}
+	}
+	return out
+}
+
+type aliasReq struct {
+	Name    string                `json:"name"`
+	Targets []storage.AliasTarget `json:"targets" binding:"required"`
+	Sticky  bool                  `json:"sticky"`
+}
+
+// validateAlias normaliza los destinos y exige que cada instancia tenga ruta.
+func (h *Handler) validateAlias(req aliasReq) ([]storage.AliasTarget, error) {
+	targets, err := normalizeAliasTargets(req.Targets)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range targets {
+		if _, found, err := h.store.GetRouteRecord(t.InstanceID); err != nil {
+			return nil, err
+		} else if !found {
+			return nil, errors.New("instance " + t.InstanceID + " has no route")
+		}
+	}
+	return targets, nil
+}
+
+// ValidateAlias aplica a un alias guardado las reglas de createAlias, salvo que
+// las instancias tengan ruta (eso depende del resto del estado).
+func ValidateAlias(a storage.Alias) error {
+	if !serviceNamePattern.MatchString(strings.ToLower(strings.TrimSpace(a.Name))) {
+		return errors.New("name must be a valid DNS label")
+	}
+	_, err := normalizeAliasTargets(a.Targets)
+	return err
+}
+
+func normalizeAliasTargets(in []storage.AliasTarget) ([]storage.AliasTarget, error) {
+	if len(in) == 0 || len(in) > maxAliasTargets {
+		return nil, errors.New("targets must have between 1 and 10 instances")
+	}
+
+	seen := map[string]bool{}
+	targets := make([]storage.AliasTarget, 0, len(in))
+	total := 0
+	for _, t := range in {
+		id := strings.TrimSpace(t.InstanceID)
+		if id == "" {
+			return nil, errors.New("target instance_id is required")
+		}
+		if seen[id] {
+			return nil, errors.New("duplicated target " + id)
+		}
+		seen[id] = true
+		if t.Weight < 0 || t.Weight > 100 {
+			return nil, errors.New("weight must be between 0 and 100")
+		}
+		total += t.Weight
+		targets = append(targets, storage.AliasTarget{InstanceID: id, Weight: t.Weight})
+	}
+	if total == 0 {
+		return nil, errors.New("at least one target must have weight > 0")
+	}
+	return targets, nil
+}
+
+func (h *Handler) listAliases(c *gin.Context) {
+	if h.aliases == nil {
+		c.JSON(http.StatusOK, gin.H{"total": 0, "aliases": []storage.Alias{}})
+		return
+	}
+
+	aliases, err := h.aliases.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"total": len(aliases), "aliases": aliases})
+}
+
+func (h *Handler) getAlias(c *gin.Context) {
+	if h.aliases == nil {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "alias not found"})
+		return
+	}
+
+	alias, found, err := h.aliases.Get(strings.ToLower(strings.TrimSpace(c.Param("name"))))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "alias not found"})
+		return
+	}
+	c.JSON(http.StatusOK, alias)
+}
+
+func (h *Handler) createAlias(c *gin.Context) {
+	if h.aliases == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"detail": "aliases are not enabled"})
+		return
+	}
+
+	var req aliasReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+
+	name := strings.ToLower(strings.TrimSpace(req.Name))
+	if !serviceNamePattern.MatchString(name) {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "name must be a valid DNS label"})
+		return
+	}
+	targets, err := h.validateAlias(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+
+	now := time.Now().UTC()
+	alias := storage.Alias{Name: name, Targets: targets, Sticky: req.Sticky, CreatedAt: now, UpdatedAt: now}
+	if err := h.aliases.Create(alias); err != nil {
+		if errors.Is(err, storage.ErrAliasExists) {
+			c.JSON(http.StatusConflict, gin.H{"detail": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, alias)
+}
+
+// updateAlias reemplaza destinos y pesos de una vez (cutover blue/green o canary).
+func (h *Handler) updateAlias(c *gin.Context) {
+	if h.aliases == nil {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "alias not found"})
+		return
+	}
+
+	name := strings.ToLower(strings.TrimSpace(c.Param("name")))
+	current, found, err := h.aliases.Get(name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "alias not found"})
+		return
+	}
+
+	var req aliasReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+	targets, err := h.validateAlias(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+
+	current.Targets = targets
+	current.Sticky = req.Sticky
+	current.UpdatedAt = time.Now().UTC()
+	if err := h.aliases.Update(current); err != nil {
+		if errors.Is(err, storage.ErrAliasNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"detail": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, current)
+}
+
+func (h *Handler) deleteAlias(c *gin.Context) {
+	if h.aliases == nil {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "alias not found"})
+		return
+	}
+
+	name := strings.ToLower(strings.TrimSpace(c.Param("name")))
+	if err := h.aliases.Delete(name); err != nil {
+		if errors.Is(err, storage.ErrAliasNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"detail": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "alias deleted"})
+}
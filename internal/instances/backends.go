@@ -0,0 +1,337 @@
+package instances
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"ark_deploy/internal/audit"
+	"ark_deploy/internal/events"
+	"ark_deploy/internal/storage"
+)
+
+// Replicas: una instancia puede tener varios backends registrados. El proxy
+// reparte entre los que tienen lease vigente y circuit breaker disponible,
+// con round-robin o least-connections y afinidad opcional por cookie.
+
+const backendCookiePref = "ark_backend_"
+
+type balancer struct {
+	mu       sync.Mutex
+	next     map[string]uint64
+	inflight map[string]int
+}
+
+func newBalancer() *balancer {
+	return &balancer{
+		next:     make(map[string]uint64),
+		inflight: make(map[string]int),
+	}
+}
+
+// pick elige el indice del candidato segun el modo de balanceo.
+func (b *balancer) pick(id string, mode string, keys []string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if mode == storage.BalanceLeastConn {
+		best := 0
+		for i, key := range keys {
+			if b.inflight[key] < b.inflight[keys[best]] {
+				best = i
+			}
+		}
+		return best
+	}
+
+	n := b.next[id]
+	b.next[id] = n + 1
+	return int(n % uint64(len(keys)))
+}
+
+// track cuenta la request en curso hacia el backend; devuelve la liberacion.
+func (b *balancer) track(key string) func() {
+	b.mu.Lock()
+	b.inflight[key]++
+	b.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if b.inflight[key]--; b.inflight[key] <= 0 {
+				delete(b.inflight, key)
+			}
+		})
+	}
+}
+
+func (b *balancer) inFlight(key string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.inflight[key]
+}
+
+// backendBreakerKey separa el circuit breaker por backend y servicio.
+func backendBreakerKey(id string, b storage.Backend, service string) string {
+	key := id + "@" + b.Key()
+	if service != "" {
+		key += "/" + service
+	}
+	return key
+}
+
+// backendToken es el valor de la cookie de afinidad; no expone host ni puerto.
+func backendToken(b storage.Backend) string {
+	sum := sha256.Sum256([]byte(b.Key()))
+	return hex.EncodeToString(sum[:6])
+}
+
+// hasBackend indica si la ruta ya tenia el backend host:port.
+func hasBackend(r storage.Route, key string) bool {
+	for _, b := range r.Backends {
+		if b.Key() == key {
+			return true
+		}
+	}
+	return false
+}
+
+type pickedBackend struct {
+	backend    storage.Backend
+	port       int
+	breakerKey string
+}
+
+// pickBackend elige el backend para la request. Si no hay ninguno disponible
+// ya respondio (503) y devuelve ok=false.
+func (h *Handler) pickBackend(c *gin.Context, route storage.Route, service string) (pickedBackend, bool) {
+	id := route.InstanceID
+	live := route.LiveBackends(time.Now())
+
+	candidates := make([]pickedBackend, 0, len(live))
+	var retryAfter time.Duration
+	for _, b := range live {
+		port, ok := b.ServicePort(service, route.DefaultService)
+		if !ok || port <= 0 || port > 65535 {
+			continue
+		}
+		key := backendBreakerKey(id, b, service)
+		if !h.breaker.Available(key) {
+			if wait := h.breaker.RetryAfter(key); retryAfter == 0 || wait < retryAfter {
+				retryAfter = wait
+			}
+			continue
+		}
+		candidates = append(candidates, pickedBackend{backend: b, port: port, breakerKey: key})
+	}
+
+	if len(candidates) == 0 {
+		if retryAfter > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			h.renderProxyError(c, http.StatusServiceUnavailable, id, "upstream unavailable (circuit open)")
+			return pickedBackend{}, false
+		}
+		c.Header("Retry-After", "30")
+		h.renderProxyError(c, http.StatusServiceUnavailable, id, "no live backends")
+		return pickedBackend{}, false
+	}
+
+	cookieName := backendCookiePref + shortOf(id)
+	if route.Sticky {
+		if cookie, err := c.Request.Cookie(cookieName); err == nil {
+			for _, cand := range candidates {
+				if backendToken(cand.backend) == cookie.Value && h.breaker.Allow(cand.breakerKey) {
+					return cand, true
+				}
+			}
+		}
+	}
+
+	keys := make([]string, len(candidates))
+	for i, cand := range candidates {
+		keys[i] = cand.breakerKey
+	}
+	start := h.balancer.pick(id, route.Balancing, keys)
+
+	// El breaker puede negar el half-open si otra request ya esta probando.
+	for i := range candidates {
+		cand := candidates[(start+i)%len(candidates)]
+		if !h.breaker.Allow(cand.breakerKey) {
+			continue
+		}
+		if route.Sticky {
+			http.SetCookie(c.Writer, &http.Cookie{
+				Name:     cookieName,
+				Value:    backendToken(cand.backend),
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		return cand, true
+	}
+
+	c.Header("Retry-After", "1")
+	h.renderProxyError(c, http.StatusServiceUnavailable, id, "upstream unavailable (circuit open)")
+	return pickedBackend{}, false
+}
+
+type backendView struct {
+	storage.Backend
+	Key      string `json:"key"`
+	Expired  bool   `json:"expired"`
+	Circuit  string `json:"circuit"`
+	InFlight int    `json:"in_flight"`
+}
+
+func (h *Handler) listBackends(c *gin.Context) {
+	id, ok := h.requireInstance(c)
+	if !ok {
+		return
+	}
+
+	route, found, err := h.store.GetRouteRecord(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "instance route not found"})
+		return
+	}
+
+	now := time.Now()
+	backends := route.Backends
+	if len(backends) == 0 {
+		backends = route.LiveBackends(now)
+	}
+
+	views := make([]backendView, 0, len(backends))
+	for _, b := range backends {
+		key := backendBreakerKey(id, b, "")
+		views = append(views, backendView{
+			Backend:  b,
+			Key:      b.Key(),
+			Expired:  b.Expired(now),
+			Circuit:  h.breaker.State(key),
+			InFlight: h.balancer.inFlight(key),
+		})
+	}
+
+	balancing := route.Balancing
+	if balancing == "" {
+		balancing = storage.BalanceRoundRobin
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"instance_id": id,
+		"balancing":   balancing,
+		"sticky":      route.Sticky,
+		"total":       len(views),
+		"backends":    views,
+	})
+}
+
+func (h *Handler) removeBackend(c *gin.Context) {
+	id, ok := h.requireInstance(c)
+	if !ok {
+		return
+	}
+
+	key := strings.TrimSpace(c.Param("backend"))
+	if err := h.store.RemoveBackend(id, key); err != nil {
+		switch {
+		case errors.Is(err, storage.ErrRouteNotFound), errors.Is(err, storage.ErrBackendNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"detail": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		}
+		return
+	}
+	h.publish(events.RouteUpdated, id, map[string]any{"change": "backend_removed", "backend": key})
+
+	h.listBackends(c)
+}
+
+type balancingReq struct {
+	Mode   string `json:"mode"`
+	Sticky bool   `json:"sticky"`
+}
+
+func (h *Handler) putBalancing(c *gin.Context) {
+	id, ok := h.requireInstance(c)
+	if !ok {
+		return
+	}
+
+	var req balancingReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+
+	mode := strings.ToLower(strings.TrimSpace(req.Mode))
+	if mode == "" {
+		mode = storage.BalanceRoundRobin
+	}
+	if mode != storage.BalanceRoundRobin && mode != storage.BalanceLeastConn {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "mode must be round_robin or least_conn"})
+		return
+	}
+
+	before, _, _ := h.store.GetRouteRecord(id)
+	if err := h.store.SetBalancing(id, mode, req.Sticky); err != nil {
+		if errors.Is(err, storage.ErrRouteNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"detail": "instance route not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+	audit.Record(c, id, gin.H{"balancing": before.Balancing, "sticky": before.Sticky}, gin.H{"balancing": mode, "sticky": req.Sticky})
+	h.publish(events.RouteUpdated, id, map[string]any{"change": "balancing", "mode": mode, "sticky": req.Sticky})
+
+	h.listBackends(c)
+}
+
+// BackendPruner descarta los backends cuyo lease vencio.
+type BackendPruner interface {
+	PruneExpiredBackends() (int, error)
+}
+
+// RunLeaseJanitor elimina periodicamente los backends que dejaron de renovar
+// su lease. El proxy ya los ignora al vencer; esto solo limpia el store.
+func RunLeaseJanitor(ctx context.Context, pruner BackendPruner, every time.Duration) {
+	if every <= 0 {
+		every = 30 * time.Second
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := pruner.PruneExpiredBackends()
+			if err != nil {
+				log.Printf("backend lease janitor: %v", err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("backend lease janitor: dropped %d expired backends", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package instances
+
+import (
+	"sync"
+	"time"
+)
+
+// Circuit breaker por instancia: tras N fallos seguidos del upstream se abre y
+// el proxy responde sin contactar al host. Pasado el cooldown deja pasar una sola
+// request de prueba (half-open); si responde bien se cierra, si no vuelve a abrirse.
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+type breakerEntry struct {
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+	entries   map[string]*breakerEntry
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		threshold = 5
+	}
+	if cooldown <= 0 {
+		cooldown = 30 * time.Second
+	}
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+		entries:   make(map[string]*breakerEntry),
+	}
+}
+
+func (b *circuitBreaker) entry(id string) *breakerEntry {
+	e, ok := b.entries[id]
+	if !ok {
+		e = &breakerEntry{state: breakerClosed}
+		b.entries[id] = e
+	}
+	return e
+}
+
+// Allow indica si la request puede ir al upstream.
+func (b *circuitBreaker) Allow(id string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e := b.entry(id)
+	switch e.state {
+	case breakerOpen:
+		if b.now().Sub(e.openedAt) < b.cooldown {
+			return false
+		}
+		e.state = breakerHalfOpen
+		e.probing = true
+		return true
+	case breakerHalfOpen:
+		if e.probing {
+			return false
+		}
+		e.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// Available indica, sin cambiar el estado, si Allow podria dejar pasar la request.
+func (b *circuitBreaker) Available(id string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.entries[id]
+	if !ok {
+		return true
+	}
+	switch e.state {
+	case breakerOpen:
+		return b.now().Sub(e.openedAt) >= b.cooldown
+	case breakerHalfOpen:
+		return !e.probing
+	default:
+		return true
+	}
+}
+
+func (b *circuitBreaker) Success(id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.entries, id)
+}
+
+// Release libera la prueba half-open sin veredicto (p.ej. el cliente corto la
+// conexion): no dice nada de la salud del upstream.
+func (b *circuitBreaker) Release(id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if e, ok := b.entries[id]; ok {
+		e.probing = false
+	}
+}
+
+func (b *circuitBreaker) Failure(id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e := b.entry(id)
+	e.failures++
+	e.probing = false
+	if e.state == breakerHalfOpen || e.failures >= b.threshold {
+		e.state = breakerOpen
+		e.openedAt = b.now()
+	}
+}
+
+// RetryAfter devuelve cuanto falta para el proximo intento half-open.
+func (b *circuitBreaker) RetryAfter(id string) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.entries[id]
+	if !ok || e.state != breakerOpen {
+		return 0
+	}
+	wait := b.cooldown - b.now().Sub(e.openedAt)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+func (b *circuitBreaker) State(id string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if e, ok := b.entries[id]; ok {
+		return e.state
+	}
+	return breakerClosed
+}
@@ -0,0 +1,188 @@
+package instances
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"ark_deploy/internal/storage"
+)
+
+// Dominios propios: el cliente apunta su DNS a ARK y el proxy enruta por el header Host.
+
+type DomainStore interface {
+	Claim(host string, instanceID string) error
+	Resolve(host string) (string, bool, error)
+	ListByInstance(instanceID string) ([]string, error)
+	Release(host string, instanceID string) error
+}
+
+var hostnamePattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}$`)
+
+// WithDomainStore habilita el ruteo por dominio propio.
+func (h *Handler) WithDomainStore(ds DomainStore) *Handler {
+	h.domains = ds
+	return h
+}
+
+type addDomainsReq struct {
+	Domains []string `json:"domains" binding:"required"`
+}
+
+func (h *Handler) addDomains(c *gin.Context) {
+	id, ok := h.requireInstance(c)
+	if !ok {
+		return
+	}
+	if h.domains == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"detail": "custom domains are not enabled"})
+		return
+	}
+
+	var req addDomainsReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+	if len(req.Domains) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "domains is required"})
+		return
+	}
+
+	hosts := make([]string, 0, len(req.Domains))
+	// owned son los que la instancia ya tenia: si algo falla no se liberan.
+	owned := make(map[string]bool)
+	for _, raw := range req.Domains {
+		host, err := h.validateCustomDomain(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+			return
+		}
+		owner, found, err := h.domains.Resolve(host)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+			return
+		}
+		if found && owner != id {
+			c.JSON(http.StatusConflict, gin.H{"detail": "domain " + host + " is already claimed by another instance"})
+			return
+		}
+		owned[host] = found
+		hosts = append(hosts, host)
+	}
+
+	claimed := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if err := h.domains.Claim(host, id); err != nil {
+			for _, done := range claimed {
+				_ = h.domains.Release(done, id)
+			}
+			if errors.Is(err, storage.ErrDomainTaken) {
+				c.JSON(http.StatusConflict, gin.H{"detail": "domain " + host + " is already claimed by another instance"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+			return
+		}
+		if !owned[host] {
+			claimed = append(claimed, host)
+		}
+	}
+
+	h.respondDomains(c, id)
+}
+
+func (h *Handler) listDomains(c *gin.Context) {
+	id, ok := h.requireInstance(c)
+	if !ok {
+		return
+	}
+	if h.domains == nil {
+		c.JSON(http.StatusOK, gin.H{"instance_id": id, "total": 0, "domains": []string{}})
+		return
+	}
+	h.respondDomains(c, id)
+}
+
+func (h *Handler) removeDomain(c *gin.Context) {
+	id, ok := h.requireInstance(c)
+	if !ok {
+		return
+	}
+	if h.domains == nil {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "domain not found"})
+		return
+	}
+
+	host := strings.ToLower(strings.TrimSpace(c.Param("host")))
+	if err := h.domains.Release(host, id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"detail": err.Error()})
+		return
+	}
+
+	h.respondDomains(c, id)
+}
+
+func (h *Handler) respondDomains(c *gin.Context, id string) {
+	hosts, err := h.domains.ListByInstance(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"instance_id": id,
+		"total":       len(hosts),
+		"domains":     hosts,
+	})
+}
+
+// requireInstance valida que el :id exista en el store de instancias.
+func (h *Handler) requireInstance(c *gin.Context) (string, bool) {
+	id := strings.TrimSpace(c.Param("id"))
+	if id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "instance id is required"})
+		return "", false
+	}
+	if h.instanceStore != nil {
+		if _, err := h.instanceStore.GetByID(id); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"detail": "instance not found"})
+			return "", false
+		}
+	}
+	return id, true
+}
+
+// validateCustomDomain normaliza el host y rechaza los que colisionan con ARK.
+func (h *Handler) validateCustomDomain(raw string) (string, error) {
+	host := normalizeHost(raw)
+	if !hostnamePattern.MatchString(host) {
+		return "", errors.New("invalid domain: " + strings.TrimSpace(raw))
+	}
+
+	if pub, err := url.Parse(h.opts.PublicHost); err == nil && pub.Hostname() != "" {
+		if host == strings.ToLower(pub.Hostname()) {
+			return "", errors.New("domain " + host + " is reserved for ARK")
+		}
+	}
+
+	if d := strings.ToLower(strings.TrimSpace(h.opts.HostRoutingDomain)); d != "" {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return "", errors.New("domain " + host + " is reserved for ARK host routing")
+		}
+	}
+
+	return host, nil
+}
+
+func normalizeHost(raw string) string {
+	host := strings.ToLower(strings.TrimSpace(raw))
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(host, ".")
+}
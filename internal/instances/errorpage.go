@@ -0,0 +1,126 @@
+package instances
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Paginas de error del proxy: los navegadores (Accept: text/html) reciben una
+// pagina con el estado de la instancia; los clientes de API siguen recibiendo JSON.
+
+var errorPageTmpl = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html lang="es">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}} · ARK</title>
+<style>
+  body { margin: 0; min-height: 100vh; display: flex; align-items: center; justify-content: center;
+         font-family: system-ui, -apple-system, "Segoe UI", sans-serif; background: #0f172a; color: #e2e8f0; }
+  main { max-width: 32rem; padding: 2.5rem; border-radius: 1rem; background: #1e293b; box-shadow: 0 10px 40px rgba(0,0,0,.35); }
+  .brand { font-weight: 700; letter-spacing: .2em; color: #38bdf8; font-size: .8rem; }
+  h1 { margin: .75rem 0 .5rem; font-size: 1.5rem; }
+  p { line-height: 1.5; color: #cbd5e1; }
+  .badge { display: inline-block; padding: .2rem .6rem; border-radius: 999px; font-size: .75rem; background: {{.Color}}; color: #0f172a; font-weight: 600; }
+  .meta { margin-top: 1.5rem; font-size: .75rem; color: #64748b; }
+</style>
+</head>
+<body>
+<main>
+  <div class="brand">ARK DEPLOY</div>
+  <h1>{{.Title}}</h1>
+  {{if .Status}}<span class="badge">{{.Status}}</span>{{end}}
+  <p>{{.Message}}</p>
+  {{if .Until}}<p>Disponible nuevamente: {{.Until}}</p>{{end}}
+  <div class="meta">{{if .InstanceID}}Instancia {{.InstanceID}} · {{end}}HTTP {{.Code}}</div>
+</main>
+</body>
+</html>
+`))
+
+type errorPage struct {
+	Code       int
+	Title      string
+	Message    string
+	Status     string
+	Color      string
+	InstanceID string
+	Until      string
+}
+
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(strings.ToLower(r.Header.Get("Accept")), "text/html")
+}
+
+// renderProxyError responde el error del proxy en JSON o HTML segun el cliente.
+func (h *Handler) renderProxyError(c *gin.Context, code int, instanceID string, detail string) {
+	if !wantsHTML(c.Request) {
+		c.AbortWithStatusJSON(code, gin.H{"detail": detail})
+		return
+	}
+
+	status := ""
+	if h.instanceStore != nil && instanceID != "" {
+		if instance, err := h.instanceStore.GetByID(instanceID); err == nil {
+			status = instance.Status
+		}
+	}
+
+	page := errorPageFor(code, status)
+	page.InstanceID = shortOf(instanceID)
+	writeErrorPage(c, page)
+}
+
+func writeErrorPage(c *gin.Context, page errorPage) {
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Header("Cache-Control", "no-store")
+	c.Status(page.Code)
+	_ = errorPageTmpl.Execute(c.Writer, page)
+	c.Abort()
+}
+
+func shortOf(instanceID string) string {
+	if len(instanceID) > 8 {
+		return instanceID[:8]
+	}
+	return instanceID
+}
+
+func errorPageFor(code int, status string) errorPage {
+	page := errorPage{Code: code, Status: status, Color: "#94a3b8"}
+
+	switch status {
+	case "provisioning":
+		page.Title = "La instancia se está desplegando"
+		page.Message = "El despliegue todavía está en curso. Esta página estará disponible en unos minutos."
+		page.Color = "#facc15"
+	case "failed":
+		page.Title = "El despliegue falló"
+		page.Message = "La instancia no pudo desplegarse. Contacta al administrador de la plataforma."
+		page.Color = "#f87171"
+	case "unhealthy":
+		page.Title = "La instancia no responde"
+		page.Message = "Detectamos problemas de salud en la aplicación. Estamos reintentando automáticamente."
+		page.Color = "#fb923c"
+	default:
+		switch code {
+		case http.StatusUnauthorized:
+			page.Title = "Acceso restringido"
+			page.Message = "Esta instancia requiere credenciales para acceder."
+		case http.StatusForbidden:
+			page.Title = "Acceso denegado"
+			page.Message = "No tienes permiso para acceder a esta instancia. Solicita un enlace de acceso al administrador."
+		case http.StatusNotFound:
+			page.Title = "Instancia no encontrada"
+			page.Message = "No existe una instancia publicada en esta dirección."
+		default:
+			page.Title = "Servicio no disponible"
+			page.Message = "La aplicación no está respondiendo en este momento. Intenta nuevamente en unos segundos."
+		}
+	}
+
+	return page
+}
@@ -1,42 +1,111 @@
 package instances
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+
+	"ark_deploy/internal/audit"
+	"ark_deploy/internal/events"
+	"ark_deploy/internal/metrics"
+	"ark_deploy/internal/storage"
 )
 
 //Mapeamos las rutas de las instancias guardadas en el store y las urls de acceso para cada instancia proxieamos las peticiones a la url de destino
 
 type RouteStore interface {
-	GetRoute(instanceID string) (host string, port int, ok bool, err error)
+	GetRouteRecord(instanceID string) (storage.Route, bool, error)
 	GetRouteByShortID(shortID string) (instanceID string, host string, port int, ok bool, err error)
-	PutRoute(instanceID string, host string, port int) error
+	RegisterBackend(instanceID string, b storage.Backend, defaultService string, lease time.Duration) (storage.Route, error)
+	RemoveBackend(instanceID string, key string) error
+	SetBalancing(instanceID string, mode string, sticky bool) error
+	SetMaintenance(instanceID string, m *storage.Maintenance) error
+	SetAccessPolicy(instanceID string, p *storage.AccessPolicy) error
+	SetLimits(instanceID string, l *storage.RateLimit) error
+	SetMirror(instanceID string, m *storage.MirrorRule) error
 	DeleteRoute(instanceID string) error
 }
 //Opcional
 
 type InstanceStore interface {
+	GetByID(id string) (storage.Instance, error)
 	UpdateAccessURLs(id string, localURL string, friendlyURL string, status string) error
 }
 
+// Options agrupa la configuracion opcional del proxy.
+type Options struct {
+	PublicHost          string
+	HostRoutingDomain   string
+	FriendlyURLTemplate string
+	BreakerThreshold    int
+	BreakerCooldown     time.Duration
+}
+
 type Handler struct {
 	store         RouteStore
 	instanceStore InstanceStore
+	domains       DomainStore
+	identities    IdentityResolver
+	products      ProductStore
+	aliases       AliasStore
+	metrics       *metrics.Registry
+	accessLog     AccessLogStore
+	logQueue      chan accessLogItem
+	opts          Options
+	breaker       *circuitBreaker
+	limiter       *rateLimiter
+	balancer      *balancer
+	mirror        *mirrorer
+	basicAuth     *basicAuthCache
+	events        events.Publisher
+	adminGuard    gin.HandlerFunc
 }
 
 func NewHandler(store RouteStore, instanceStore InstanceStore) *Handler {
 	return &Handler{
 		store:         store,
 		instanceStore: instanceStore,
+		breaker:       newCircuitBreaker(0, 0),
+		limiter:       newRateLimiter(),
+		balancer:      newBalancer(),
+		mirror:        newMirrorer(),
+		basicAuth:     newBasicAuthCache(),
+	}
+}
+
+// WithOptions aplica la configuracion opcional y devuelve el mismo handler.
+func (h *Handler) WithOptions(opts Options) *Handler {
+	h.opts = opts
+	h.breaker = newCircuitBreaker(opts.BreakerThreshold, opts.BreakerCooldown)
+	return h
+}
+
+// WithEvents publica los registros y cambios de rutas en el bus de eventos.
+func (h *Handler) WithEvents(p events.Publisher) *Handler {
+	h.events = p
+	return h
+}
+
+// publish publica un evento de la instancia con su producto, si se conoce.
+func (h *Handler) publish(eventType string, id string, data map[string]any) {
+	if h.events == nil {
+		return
+	}
+	e := events.Event{Type: eventType, InstanceID: id, Data: data}
+	if h.instanceStore != nil {
+		if instance, err := h.instanceStore.GetByID(id); err == nil {
+			e.ProductID = instance.ProductID
+		}
 	}
+	events.Publish(h.events, e)
 }
 // Defimos los campos requeridos para registrar la instancia 
 type RegisterReq struct {
@@ -44,9 +113,22 @@ type RegisterReq struct {
 	TargetHost    string `json:"target_host" binding:"required"`
 	TargetPort    int    `json:"target_port" binding:"required"`
 	ContainerName string `json:"container_name"`
+	WebService    string `json:"web_service"`
 	WebPort       string `json:"web_port"`
 	LocalURL      string `json:"local_url"`
 	FriendlyURL   string `json:"friendly_url"`
+
+	Services []RegisterService `json:"services"`
+
+	// LeaseSeconds > 0 registra el backend con lease: debe volver a registrarse
+	// (heartbeat) antes de que venza o se descarta. 0 = sin vencimiento.
+	LeaseSeconds int `json:"lease_seconds"`
+}
+
+// RegisterService es el puerto publicado de cada servicio expuesto del compose.
+type RegisterService struct {
+	Name       string `json:"name"`
+	TargetPort int    `json:"target_port"`
 }
 
 //Definimos las rutas 
@@ -55,7 +137,43 @@ func (h *Handler) RegisterRoutes(r gin.IRoutes) {
 	r.DELETE("/instances/:id", h.delete)
 	r.Any("/instances/by-short/:short/*path", h.proxyByShort)
 	r.Any("/instances/:id/*path", h.proxy)
+	r.Any("/aliases/:name/*path", h.proxyAlias)
+}
+// RegisterAPIRoutes registra los endpoints de administracion bajo /api.
+func (h *Handler) RegisterAPIRoutes(api gin.IRoutes) {
+	api.GET("/deployments/:id/domains", h.listDomains)
+	api.POST("/deployments/:id/domains", h.addDomains)
+	api.DELETE("/deployments/:id/domains/:host", h.removeDomain)
+
+	api.GET("/deployments/:id/maintenance", h.getMaintenance)
+	api.POST("/deployments/:id/maintenance", h.startMaintenance)
+	api.DELETE("/deployments/:id/maintenance", h.stopMaintenance)
+
+	api.GET("/deployments/:id/access", h.admin(), h.getAccessPolicy)
+	api.PUT("/deployments/:id/access", h.admin(), h.putAccessPolicy)
+
+	api.GET("/deployments/:id/backends", h.listBackends)
+	api.DELETE("/deployments/:id/backends/:backend", h.removeBackend)
+	api.PUT("/deployments/:id/balancing", h.putBalancing)
+
+	api.GET("/deployments/:id/limits", h.getLimits)
+	api.PUT("/deployments/:id/limits", h.putLimits)
+	api.DELETE("/deployments/:id/limits", h.deleteLimits)
+
+	api.GET("/deployments/:id/mirror", h.getMirror)
+	api.PUT("/deployments/:id/mirror", h.putMirror)
+	api.DELETE("/deployments/:id/mirror", h.deleteMirror)
+
+	api.GET("/aliases", h.listAliases)
+	api.POST("/aliases", h.createAlias)
+	api.GET("/aliases/:name", h.getAlias)
+	api.PUT("/aliases/:name", h.updateAlias)
+	api.DELETE("/aliases/:name", h.deleteAlias)
+
+	api.GET("/deployments/:id/metrics", h.instanceMetrics)
+	api.GET("/deployments/:id/access-log", h.accessLogEntries)
 }
+
 //Implementamos el handler y parsemos el json para validar campos
 func (h *Handler) register(c *gin.Context) {
 	var req RegisterReq
@@ -64,42 +182,183 @@ func (h *Handler) register(c *gin.Context) {
 		return
 	}
 
+	before, hadRoute, _ := h.store.GetRouteRecord(strings.TrimSpace(req.InstanceID))
+	route, req, err := h.applyRegistration(req)
+	if err != nil {
+		var invalid registrationError
+		if errors.As(err, &invalid) {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+	switch {
+	case hadRoute && audit.Diff(routeAuditFields(before), routeAuditFields(route)) == nil:
+		// Heartbeat del lease: no cambio nada y llenaria la auditoria.
+		audit.Skip(c)
+	case hadRoute:
+		audit.Record(c, req.InstanceID, routeAuditFields(before), routeAuditFields(route))
+	default:
+		audit.Record(c, req.InstanceID, nil, routeAuditFields(route))
+	}
+
+	var leaseExpires *time.Time
+	for _, b := range route.Backends {
+		if b.Host == req.TargetHost && b.Port == req.TargetPort {
+			leaseExpires = b.ExpiresAt
+		}
+	}
+
+	upstreamURL := fmt.Sprintf("http://%s:%d/", req.TargetHost, req.TargetPort)
+	reachable := checkUpstreamReachable(upstreamURL, 2*time.Second)
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":             "ok",
+		"upstream_reachable": reachable,
+		"upstream_url":       upstreamURL,
+		"local_url":          req.LocalURL,
+		"friendly_url":       req.FriendlyURL,
+		"backends":           len(route.Backends),
+		"lease_expires_at":   leaseExpires,
+	})
+}
+
+// registrationError es un payload de registro invalido (400).
+type registrationError string
+
+func (e registrationError) Error() string { return string(e) }
+
+// applyRegistration valida el payload del callback, registra el backend y marca
+// la instancia como running. Lo usan el callback de Jenkins y el reconciler.
+func (h *Handler) applyRegistration(req RegisterReq) (storage.Route, RegisterReq, error) {
 	req.InstanceID = strings.TrimSpace(req.InstanceID)
 	req.TargetHost = strings.TrimSpace(req.TargetHost)
 	req.LocalURL = strings.TrimSpace(req.LocalURL)
 	req.FriendlyURL = strings.TrimSpace(req.FriendlyURL)
 
 	if req.InstanceID == "" || req.TargetHost == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"detail": "instance_id and target_host are required"})
-		return
+		return storage.Route{}, req, registrationError("instance_id and target_host are required")
 	}
 
 	if req.TargetPort <= 0 || req.TargetPort > 65535 {
-		c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid target_port"})
-		return
+		return storage.Route{}, req, registrationError("invalid target_port")
 	}
 
-	if err := h.store.PutRoute(req.InstanceID, req.TargetHost, req.TargetPort); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
-		return
+	defaultService := strings.ToLower(strings.TrimSpace(req.WebService))
+	if defaultService == "" {
+		defaultService = "web"
+	}
+	services := make(map[string]int, len(req.Services))
+	for _, svc := range req.Services {
+		name := strings.ToLower(strings.TrimSpace(svc.Name))
+		if !serviceNamePattern.MatchString(name) {
+			return storage.Route{}, req, registrationError("invalid service name: " + svc.Name)
+		}
+		if svc.TargetPort <= 0 || svc.TargetPort > 65535 {
+			return storage.Route{}, req, registrationError("invalid target_port for service " + name)
+		}
+		services[name] = svc.TargetPort
+	}
+	if len(services) == 0 {
+		services = nil
+	}
+
+	if req.LeaseSeconds < 0 {
+		return storage.Route{}, req, registrationError("lease_seconds must be >= 0")
+	}
+
+	backend := storage.Backend{
+		Host:     req.TargetHost,
+		Port:     req.TargetPort,
+		Services: services,
+	}
+	prev, _, _ := h.store.GetRouteRecord(req.InstanceID)
+	route, err := h.store.RegisterBackend(req.InstanceID, backend, defaultService, time.Duration(req.LeaseSeconds)*time.Second)
+	if err != nil {
+		return storage.Route{}, req, err
 	}
 
 	if h.instanceStore != nil {
+		if strings.TrimSpace(h.opts.FriendlyURLTemplate) != "" {
+			if instance, err := h.instanceStore.GetByID(req.InstanceID); err == nil {
+				req.FriendlyURL = RenderFriendlyURL(h.opts.FriendlyURLTemplate, FriendlyURLVars{
+					PublicHost:  h.opts.PublicHost,
+					Domain:      h.opts.HostRoutingDomain,
+					InstanceID:  instance.ID,
+					ProductID:   instance.ProductID,
+					Environment: instance.Environment,
+				})
+			}
+		}
 		_ = h.instanceStore.UpdateAccessURLs(req.InstanceID, req.LocalURL, req.FriendlyURL, "running")
 	}
 
-	upstreamURL := fmt.Sprintf("http://%s:%d/", req.TargetHost, req.TargetPort)
-	reachable := checkUpstreamReachable(upstreamURL, 2*time.Second)
+	// Los heartbeats de lease re-registran el mismo backend: solo se avisa el primero.
+	if !hasBackend(prev, backend.Key()) {
+		h.publish(events.InstanceRegistered, req.InstanceID, map[string]any{
+			"backend":      backend.Key(),
+			"backends":     len(route.Backends),
+			"local_url":    req.LocalURL,
+			"friendly_url": req.FriendlyURL,
+		})
+	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"status":             "ok",
-		"upstream_reachable": reachable,
-		"upstream_url":       upstreamURL,
-		"local_url":          req.LocalURL,
-		"friendly_url":       req.FriendlyURL,
-	})
+	return route, req, nil
+}
+
+// ValidateRoute aplica a una ruta guardada las mismas reglas que el registro
+// (host, puertos y nombres de servicio) y las de limites y balanceo. La usa la
+// importacion de backups.
+func ValidateRoute(r storage.Route) error {
+	if strings.TrimSpace(r.InstanceID) == "" {
+		return registrationError("instance_id is required")
+	}
+	if r.TargetHost != "" || r.TargetPort != 0 {
+		if strings.TrimSpace(r.TargetHost) == "" {
+			return registrationError("target_host is required")
+		}
+		if r.TargetPort <= 0 || r.TargetPort > 65535 {
+			return registrationError("invalid target_port")
+		}
+	}
+	if err := validateServicePorts(r.Services); err != nil {
+		return err
+	}
+
+	for _, b := range r.Backends {
+		if strings.TrimSpace(b.Host) == "" {
+			return registrationError("backend host is required")
+		}
+		if b.Port <= 0 || b.Port > 65535 {
+			return registrationError("invalid port for backend " + b.Host)
+		}
+		if err := validateServicePorts(b.Services); err != nil {
+			return err
+		}
+	}
+
+	if r.Balancing != "" && r.Balancing != storage.BalanceRoundRobin && r.Balancing != storage.BalanceLeastConn {
+		return registrationError("balancing must be round_robin or least_conn")
+	}
+	if err := r.Limits.Validate(); err != nil {
+		return registrationError("limits: " + err.Error())
+	}
+	return nil
+}
+
+func validateServicePorts(services map[string]int) error {
+	for name, port := range services {
+		if !serviceNamePattern.MatchString(name) {
+			return registrationError("invalid service name: " + name)
+		}
+		if port <= 0 || port > 65535 {
+			return registrationError("invalid target_port for service " + name)
+		}
+	}
+	return nil
 }
-//En desarrollo aun no es totalmente funcional 
+//En desarrollo aun no es totalmente funcional
 
 func (h *Handler) delete(c *gin.Context) {
 	id := strings.TrimSpace(c.Param("id"))
@@ -108,14 +367,37 @@ func (h *Handler) delete(c *gin.Context) {
 		return
 	}
 
+	before, hadRoute, _ := h.store.GetRouteRecord(id)
 	if err := h.store.DeleteRoute(id); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
 		return
 	}
+	if h.metrics != nil {
+		h.metrics.Forget(id)
+	}
+	if hadRoute {
+		audit.Record(c, id, routeAuditFields(before), nil)
+		h.publish(events.RouteDeleted, id, nil)
+	}
 
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
 
+// routeAuditFields resume la ruta para la auditoria, sin la politica de acceso
+// (tiene hashes de secretos).
+func routeAuditFields(r storage.Route) gin.H {
+	backends := make([]string, 0, len(r.Backends))
+	for _, b := range r.Backends {
+		backends = append(backends, b.Key())
+	}
+	return gin.H{
+		"target_host": r.TargetHost,
+		"target_port": r.TargetPort,
+		"services":    r.Services,
+		"backends":    backends,
+	}
+}
+
 // Reverse proxy por instance_id.
 // La ruta (instance_id -> target_host:target_port) ya fue registrada por Jenkins en /instances/register.
 // Aquí solo resolvemos el destino y reenviamos la request al contenedor.
@@ -127,69 +409,171 @@ func (h *Handler) proxy(c *gin.Context) {
 		return
 	}
 
-	host, port, ok, err := h.store.GetRoute(id)
+	h.proxyInstance(c, id, "", c.Param("path"))
+}
+
+// proxyInstance resuelve la ruta del instance_id y reenvia la request.
+// service vacio usa el servicio por defecto o el prefijo del path.
+func (h *Handler) proxyInstance(c *gin.Context, id string, service string, origPath string) {
+	route, ok, err := h.store.GetRouteRecord(id)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
 		return
 	}
 	if !ok {
-		c.JSON(http.StatusNotFound, gin.H{"detail": "instance not found"})
-		return
-	}
-	if port <= 0 || port > 65535 {
-		c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid target_port"})
+		h.routeMissing(c, id)
 		return
 	}
 
-	origPath := c.Param("path")
-	if origPath == "" {
-		origPath = "/"
-	}
-
-	h.proxyTo(c, host, port, origPath)
+	h.serveRoute(c, route, service, origPath)
 }
 
 func (h *Handler) proxyByShort(c *gin.Context) {
 	shortID := strings.TrimSpace(strings.ToLower(c.Param("short")))
-	if !regexp.MustCompile(`^[a-f0-9]{8}$`).MatchString(shortID) {
+	if !shortIDPattern.MatchString(shortID) {
 		c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid short id"})
 		return
 	}
 
-	_, host, port, ok, err := h.store.GetRouteByShortID(shortID)
+	h.proxyShortID(c, shortID, "", c.Param("path"))
+}
+
+// proxyShortID resuelve el short id a su instancia y reenvia la request.
+func (h *Handler) proxyShortID(c *gin.Context, shortID string, service string, origPath string) {
+	id, _, _, ok, err := h.store.GetRouteByShortID(shortID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
 		return
 	}
 	if !ok {
-		c.JSON(http.StatusNotFound, gin.H{"detail": "instance not found"})
+		h.renderProxyError(c, http.StatusNotFound, "", "instance not found")
 		return
 	}
-	if port <= 0 || port > 65535 {
-		c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid target_port"})
-		return
+
+	h.proxyInstance(c, id, service, origPath)
+}
+
+// routeMissing distingue una instancia inexistente de una que aun no registro su ruta.
+func (h *Handler) routeMissing(c *gin.Context, id string) {
+	if h.instanceStore != nil {
+		if _, err := h.instanceStore.GetByID(id); err == nil {
+			c.Header("Retry-After", "30")
+			h.renderProxyError(c, http.StatusServiceUnavailable, id, "instance not ready")
+			return
+		}
 	}
+	h.renderProxyError(c, http.StatusNotFound, id, "instance not found")
+}
 
-	origPath := c.Param("path")
+// serveRoute aplica rate limits, control de acceso, mantenimiento y circuit breaker antes de reenviar.
+// Si la ruta tiene mirroring, despues copia la request a la instancia shadow.
+func (h *Handler) serveRoute(c *gin.Context, route storage.Route, service string, origPath string) {
+	id := route.InstanceID
 	if origPath == "" {
 		origPath = "/"
 	}
 
-	h.proxyTo(c, host, port, origPath)
+	defer h.observe(c, id, c.Request.Host, origPath, time.Now())
+
+	release, ok := h.enforceLimits(c, route)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if !h.authorize(c, id, accessCookiePath(c.Request.URL.Path, origPath), route.Access) {
+		return
+	}
+	stripAccessCookies(c.Request)
+
+	if route.Maintenance.Active(time.Now()) && !h.maintenanceBypass(c, route.Maintenance) {
+		h.renderMaintenance(c, id, route.Maintenance)
+		return
+	}
+
+	name, upstreamPath, ok := selectService(route, service, origPath)
+	if !ok {
+		h.renderProxyError(c, http.StatusNotFound, id, "service "+service+" not found")
+		return
+	}
+
+	picked, ok := h.pickBackend(c, route, name)
+	if !ok {
+		return
+	}
+	done := h.balancer.track(picked.breakerKey)
+	defer done()
+
+	shadow := h.prepareMirror(c, id, route.Mirror, name, upstreamPath)
+	started := time.Now()
+	h.proxyTo(c, id, picked.breakerKey, picked.backend.Host, picked.port, upstreamPath)
+	if shadow != nil {
+		h.sendShadow(shadow, c.Writer.Status(), time.Since(started))
+	}
 }
 
-func (h *Handler) proxyTo(c *gin.Context, host string, port int, origPath string) {
+// selectService resuelve el servicio pedido por host (service) o por el primer
+// segmento del path (/instances/<id>/<service>/...) y devuelve el path sin ese
+// prefijo. "" es el servicio por defecto, que no se toma del path para no
+// romper apps con rutas como /web/.
+func selectService(route storage.Route, service string, origPath string) (name string, path string, ok bool) {
+	if service != "" {
+		if service == route.DefaultService {
+			return "", origPath, true
+		}
+		if _, found := route.Services[service]; !found {
+			return "", "", false
+		}
+		return service, origPath, true
+	}
+
+	if len(route.Services) > 0 {
+		trimmed := strings.TrimPrefix(origPath, "/")
+		first, rest, _ := strings.Cut(trimmed, "/")
+		if first != "" && first != route.DefaultService {
+			if _, found := route.Services[first]; found {
+				return first, "/" + rest, true
+			}
+		}
+	}
+
+	return "", origPath, true
+}
+
+func (h *Handler) proxyTo(c *gin.Context, id string, breakerKey string, host string, port int, origPath string) {
 	target, err := url.Parse("http://" + host + ":" + strconv.Itoa(port))
 	if err != nil {
+		h.breaker.Release(breakerKey)
 		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
 		return
 	}
 
 	rp := httputil.NewSingleHostReverseProxy(target)
+	rp.ModifyResponse = func(resp *http.Response) error {
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			h.breaker.Failure(breakerKey)
+		default:
+			h.breaker.Success(breakerKey)
+		}
+		return nil
+	}
 	rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, e error) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadGateway)
-		_, _ = w.Write([]byte(`{"detail":"upstream unreachable"}`))
+		var tooLarge *http.MaxBytesError
+		// El body excedido es del cliente: se libera la prueba sin veredicto.
+		if errors.As(e, &tooLarge) {
+			h.breaker.Release(breakerKey)
+			h.renderProxyError(c, http.StatusRequestEntityTooLarge, id, "request body too large")
+			return
+		}
+		// El cliente se fue: no es un fallo del upstream.
+		if errors.Is(e, context.Canceled) {
+			h.breaker.Release(breakerKey)
+			c.Status(statusClientClosedRequest)
+			return
+		}
+		h.breaker.Failure(breakerKey)
+		h.renderProxyError(c, http.StatusBadGateway, id, "upstream unreachable")
 	}
 
 	c.Request.URL.Path = singleJoiningSlash(target.Path, origPath)
@@ -197,6 +581,9 @@ func (h *Handler) proxyTo(c *gin.Context, host string, port int, origPath string
 	rp.ServeHTTP(c.Writer, c.Request)
 }
 
+// statusClientClosedRequest es el 499 de nginx: el cliente corto antes de la respuesta.
+const statusClientClosedRequest = 499
+
 func singleJoiningSlash(a, b string) string {
 	aslash := strings.HasSuffix(a, "/")
 	bslash := strings.HasPrefix(b, "/")
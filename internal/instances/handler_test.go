@@ -2,20 +2,30 @@ package instances
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+
+	"ark_deploy/internal/audit"
+	"ark_deploy/internal/metrics"
+	"ark_deploy/internal/storage"
+	"ark_deploy/internal/tailscale"
 )
 
 type mockRouteStore struct {
-	routes map[string]struct {
-		host string
-		port int
-	}
+	routes map[string]storage.Route
 	putErr error
 	getErr error
 	delErr error
@@ -23,22 +33,16 @@ type mockRouteStore struct {
 
 func newMockRouteStore() *mockRouteStore {
 	return &mockRouteStore{
-		routes: map[string]struct {
-			host string
-			port int
-		}{},
+		routes: map[string]storage.Route{},
 	}
 }
 
-func (m *mockRouteStore) GetRoute(instanceID string) (string, int, bool, error) {
+func (m *mockRouteStore) GetRouteRecord(instanceID string) (storage.Route, bool, error) {
 	if m.getErr != nil {
-		return "", 0, false, m.getErr
+		return storage.Route{}, false, m.getErr
 	}
 	v, ok := m.routes[instanceID]
-	if !ok {
-		return "", 0, false, nil
-	}
-	return v.host, v.port, true, nil
+	return v, ok, nil
 }
 
 func (m *mockRouteStore) GetRouteByShortID(shortID string) (string, string, int, bool, error) {
@@ -47,7 +51,7 @@ func (m *mockRouteStore) GetRouteByShortID(shortID string) (string, string, int,
 	}
 	for id, v := range m.routes {
 		if len(id) >= len(shortID) && id[:len(shortID)] == shortID {
-			return id, v.host, v.port, true, nil
+			return id, v.TargetHost, v.TargetPort, true, nil
 		}
 	}
 	return "", "", 0, false, nil
@@ -57,10 +61,86 @@ func (m *mockRouteStore) PutRoute(instanceID string, host string, port int) erro
 	if m.putErr != nil {
 		return m.putErr
 	}
-	m.routes[instanceID] = struct {
-		host string
-		port int
-	}{host: host, port: port}
+	r := m.routes[instanceID]
+	r.InstanceID = instanceID
+	r.TargetHost = host
+	r.TargetPort = port
+	m.routes[instanceID] = r
+	return nil
+}
+
+func (m *mockRouteStore) SetMaintenance(instanceID string, mt *storage.Maintenance) error {
+	r, ok := m.routes[instanceID]
+	if !ok {
+		return storage.ErrRouteNotFound
+	}
+	r.Maintenance = mt
+	m.routes[instanceID] = r
+	return nil
+}
+
+func (m *mockRouteStore) SetAccessPolicy(instanceID string, p *storage.AccessPolicy) error {
+	r, ok := m.routes[instanceID]
+	if !ok {
+		return storage.ErrRouteNotFound
+	}
+	r.Access = p
+	m.routes[instanceID] = r
+	return nil
+}
+
+func (m *mockRouteStore) SetLimits(instanceID string, l *storage.RateLimit) error {
+	r, ok := m.routes[instanceID]
+	if !ok {
+		return storage.ErrRouteNotFound
+	}
+	r.Limits = l
+	m.routes[instanceID] = r
+	return nil
+}
+
+func (m *mockRouteStore) SetMirror(instanceID string, mr *storage.MirrorRule) error {
+	r, ok := m.routes[instanceID]
+	if !ok {
+		return storage.ErrRouteNotFound
+	}
+	r.Mirror = mr
+	m.routes[instanceID] = r
+	return nil
+}
+
+func (m *mockRouteStore) RegisterBackend(instanceID string, b storage.Backend, defaultService string, lease time.Duration) (storage.Route, error) {
+	if m.putErr != nil {
+		return storage.Route{}, m.putErr
+	}
+	r := m.routes[instanceID]
+	r.InstanceID = instanceID
+	r.DefaultService = defaultService
+	r.UpsertBackend(b, lease, time.Now())
+	m.routes[instanceID] = r
+	return r, nil
+}
+
+func (m *mockRouteStore) RemoveBackend(instanceID string, key string) error {
+	r, ok := m.routes[instanceID]
+	if !ok {
+		return storage.ErrRouteNotFound
+	}
+	if !r.RemoveBackend(key) {
+		return storage.ErrBackendNotFound
+	}
+	m.routes[instanceID] = r
+	return nil
+}
+
+func (m *mockRouteStore) SetBalancing(instanceID string, mode string, sticky bool) error {
+	r, ok := m.routes[instanceID]
+	if !ok {
+		return storage.ErrRouteNotFound
+	}
+	r.Balancing = mode
+	r.Sticky = sticky
+	m.routes[instanceID] = r
 	return nil
 }
 
@@ -137,3 +217,1654 @@ func TestDeleteRoute_Error(t *testing.T) {
 		t.Fatalf("expected 500, got %d", w.Code)
 	}
 }
+
+func TestHostRouting_ProxiesBySubdomain(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("path=" + r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	store := newMockRouteStore()
+	_ = store.PutRoute("abcdef12-0000-0000-0000-000000000000", u.Hostname(), port)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	h := NewHandler(store, nil).WithOptions(Options{HostRoutingDomain: "apps.example.com"})
+	r.Use(h.HostRouting())
+	h.RegisterRoutes(r)
+
+	ark := httptest.NewServer(r)
+	defer ark.Close()
+
+	get := func(host string) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, ark.URL+"/dashboard", nil)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	for _, host := range []string{"abcdef12.apps.example.com", "vault-prod-abcdef12.apps.example.com:443"} {
+		code, body := get(host)
+		if code != http.StatusOK || body != "path=/dashboard" {
+			t.Fatalf("host %s: expected proxied root path, got %d body=%s", host, code, body)
+		}
+	}
+
+	if code, _ := get("0000aaaa.apps.example.com"); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown short id, got %d", code)
+	}
+}
+
+func TestShortIDFromHost(t *testing.T) {
+	cases := map[string]struct {
+		ok      bool
+		service string
+	}{
+		"abcdef12.apps.example.com":          {ok: true},
+		"shop-dev-abcdef12.apps.example.com": {ok: true},
+		"api.abcdef12.apps.example.com":      {ok: true, service: "api"},
+		"apps.example.com":                   {ok: false},
+		"abcdef12.other.com":                 {ok: false},
+		"a.b.abcdef12.apps.example.com":      {ok: false},
+		"api_x.abcdef12.apps.example.com":    {ok: false},
+		"not-hex.apps.example.com":           {ok: false},
+	}
+	for host, want := range cases {
+		short, service, ok := shortIDFromHost(host, "apps.example.com")
+		if ok != want.ok || service != want.service || (ok && short != "abcdef12") {
+			t.Errorf("%s: expected ok=%v service=%q, got ok=%v short=%q service=%q", host, want.ok, want.service, ok, short, service)
+		}
+	}
+}
+
+func TestRenderFriendlyURL(t *testing.T) {
+	vars := FriendlyURLVars{
+		PublicHost:  "https://ark.example.com/",
+		Domain:      "apps.example.com",
+		InstanceID:  "ABCDEF12-3456",
+		ProductID:   "vault_go",
+		Environment: "prod",
+	}
+
+	if got := RenderFriendlyURL("", vars); got != "https://ark.example.com/instances/by-short/abcdef12/" {
+		t.Fatalf("unexpected default url: %s", got)
+	}
+	if got := RenderFriendlyURL("https://{product}-{env}-{short}.{domain}/", vars); got != "https://vault-go-prod-abcdef12.apps.example.com/" {
+		t.Fatalf("unexpected templated url: %s", got)
+	}
+}
+
+type mockInstanceStore struct {
+	instances map[string]storage.Instance
+}
+
+func (m *mockInstanceStore) GetByID(id string) (storage.Instance, error) {
+	i, ok := m.instances[id]
+	if !ok {
+		return storage.Instance{}, errors.New("instance not found")
+	}
+	return i, nil
+}
+
+func (m *mockInstanceStore) UpdateAccessURLs(id string, localURL string, friendlyURL string, status string) error {
+	i, ok := m.instances[id]
+	if !ok {
+		return errors.New("instance not found")
+	}
+	i.LocalURL = localURL
+	i.FriendlyURL = friendlyURL
+	if status != "" {
+		i.Status = status
+	}
+	m.instances[id] = i
+	return nil
+}
+
+type mockDomainStore struct {
+	owners    map[string]string
+	failClaim string
+}
+
+func (m *mockDomainStore) Claim(host string, instanceID string) error {
+	if host == m.failClaim {
+		return errors.New("storage unavailable")
+	}
+	if owner, ok := m.owners[host]; ok && owner != instanceID {
+		return storage.ErrDomainTaken
+	}
+	m.owners[host] = instanceID
+	return nil
+}
+
+func (m *mockDomainStore) Resolve(host string) (string, bool, error) {
+	id, ok := m.owners[host]
+	return id, ok, nil
+}
+
+func (m *mockDomainStore) ListByInstance(instanceID string) ([]string, error) {
+	out := []string{}
+	for host, id := range m.owners {
+		if id == instanceID {
+			out = append(out, host)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func (m *mockDomainStore) Release(host string, instanceID string) error {
+	if m.owners[host] != instanceID {
+		return errors.New("domain not found")
+	}
+	delete(m.owners, host)
+	return nil
+}
+
+func TestCustomDomains_ClaimListRemove(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	instStore := &mockInstanceStore{instances: map[string]storage.Instance{
+		"i-1": {ID: "i-1"},
+		"i-2": {ID: "i-2"},
+	}}
+	domains := &mockDomainStore{owners: map[string]string{}}
+
+	r := gin.New()
+	h := NewHandler(newMockRouteStore(), instStore).
+		WithOptions(Options{PublicHost: "https://ark.example.com", HostRoutingDomain: "apps.example.com"}).
+		WithDomainStore(domains)
+	h.RegisterAPIRoutes(r)
+
+	post := func(id string, hosts ...string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]any{"domains": hosts})
+		req := httptest.NewRequest(http.MethodPost, "/deployments/"+id+"/domains", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post("i-1", "Shop.Client.com", "www.client.com"); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d body=%s", w.Code, w.Body.String())
+	}
+	if domains.owners["shop.client.com"] != "i-1" {
+		t.Fatalf("expected normalized host to be claimed, got %v", domains.owners)
+	}
+
+	if w := post("i-2", "shop.client.com"); w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for claimed host, got %d", w.Code)
+	}
+	if w := post("i-2", "ark.example.com"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for ARK host, got %d", w.Code)
+	}
+	if w := post("i-2", "abcdef12.apps.example.com"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for wildcard subdomain, got %d", w.Code)
+	}
+	if w := post("missing", "other.client.com"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown instance, got %d", w.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/deployments/i-1/domains/www.client.com", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 on delete, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/deployments/i-1/domains", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	var resp struct {
+		Domains []string `json:"domains"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Domains) != 1 || resp.Domains[0] != "shop.client.com" {
+		t.Fatalf("unexpected domains: %v", resp.Domains)
+	}
+
+	// Si un claim falla solo se deshace lo que se tomo en esta request.
+	domains.failClaim = "broken.client.com"
+	if w := post("i-1", "shop.client.com", "new.client.com", "broken.client.com"); w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500 when a claim fails, got %d", w.Code)
+	}
+	if domains.owners["shop.client.com"] != "i-1" {
+		t.Fatalf("rollback must keep domains the instance already had, got %v", domains.owners)
+	}
+	if _, ok := domains.owners["new.client.com"]; ok {
+		t.Fatalf("rollback must release domains claimed by the failed request, got %v", domains.owners)
+	}
+}
+
+func TestHostRouting_CustomDomain(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("custom " + r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	store := newMockRouteStore()
+	_ = store.PutRoute("i-1", u.Hostname(), port)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	h := NewHandler(store, nil).WithDomainStore(&mockDomainStore{owners: map[string]string{"shop.client.com": "i-1"}})
+	r.Use(h.HostRouting())
+	h.RegisterRoutes(r)
+
+	ark := httptest.NewServer(r)
+	defer ark.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, ark.URL+"/cart", nil)
+	req.Host = "shop.client.com"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK || string(b) != "custom /cart" {
+		t.Fatalf("unexpected response %d %s", resp.StatusCode, string(b))
+	}
+}
+
+func TestCircuitBreaker_OpensAndProbesHalfOpen(t *testing.T) {
+	b := newCircuitBreaker(2, 10*time.Second)
+	clock := time.Now()
+	b.now = func() time.Time { return clock }
+
+	b.Failure("i-1")
+	if !b.Allow("i-1") {
+		t.Fatalf("breaker must stay closed below threshold")
+	}
+	b.Failure("i-1")
+	if b.Allow("i-1") || b.State("i-1") != breakerOpen {
+		t.Fatalf("breaker must open at threshold")
+	}
+
+	clock = clock.Add(11 * time.Second)
+	if !b.Allow("i-1") {
+		t.Fatalf("breaker must allow one half-open probe after cooldown")
+	}
+	if b.Allow("i-1") {
+		t.Fatalf("breaker must allow a single probe while half-open")
+	}
+	b.Failure("i-1")
+	if b.State("i-1") != breakerOpen {
+		t.Fatalf("failed probe must reopen the breaker")
+	}
+
+	clock = clock.Add(11 * time.Second)
+	_ = b.Allow("i-1")
+	b.Success("i-1")
+	if b.State("i-1") != breakerClosed || !b.Allow("i-1") {
+		t.Fatalf("successful probe must close the breaker")
+	}
+}
+
+func TestProxy_ClientCancelDoesNotTripBreaker(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-r.Context().Done()
+			return
+		}
+		_, _ = w.Write([]byte("app"))
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	store := newMockRouteStore()
+	_ = store.PutRoute("i-1", u.Hostname(), port)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	h := NewHandler(store, nil).WithOptions(Options{BreakerThreshold: 2, BreakerCooldown: time.Minute})
+	h.RegisterRoutes(r)
+
+	ark := httptest.NewServer(r)
+	defer ark.Close()
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ark.URL+"/instances/i-1/slow", nil)
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := http.Get(ark.URL + "/instances/i-1/")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("client disconnects must not open the circuit, got %d", resp.StatusCode)
+	}
+}
+
+func TestProxy_TooLargeProbeReleasesBreaker(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.ReadAll(r.Body)
+		_, _ = w.Write([]byte("app"))
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	store := newMockRouteStore()
+	_ = store.PutRoute("i-1", u.Hostname(), port)
+	_ = store.SetLimits("i-1", &storage.RateLimit{MaxBodyBytes: 16})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	h := NewHandler(store, nil).WithOptions(Options{BreakerThreshold: 1, BreakerCooldown: time.Minute})
+	h.RegisterRoutes(r)
+	clock := time.Now()
+	h.breaker.now = func() time.Time { return clock }
+
+	ark := httptest.NewServer(r)
+	defer ark.Close()
+
+	// Circuito abierto y vencido: la proxima request es la prueba half-open.
+	key := backendBreakerKey("i-1", storage.Backend{Host: u.Hostname(), Port: port}, "")
+	h.breaker.Failure(key)
+	clock = clock.Add(2 * time.Minute)
+
+	// Sin Content-Length el limite salta recien al copiar el body al upstream.
+	body := io.MultiReader(strings.NewReader(strings.Repeat("x", 64)))
+	req, _ := http.NewRequest(http.MethodPost, ark.URL+"/instances/i-1/", body)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(ark.URL + "/instances/i-1/")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || h.breaker.State(key) != breakerClosed {
+		t.Fatalf("a 413 probe must not leave the backend stuck half-open, got %d %s", resp.StatusCode, h.breaker.State(key))
+	}
+}
+
+func TestProxy_UpstreamDown_ErrorPagesAndCircuit(t *testing.T) {
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	u, _ := url.Parse(dead.URL)
+	port, _ := strconv.Atoi(u.Port())
+	dead.Close()
+
+	store := newMockRouteStore()
+	_ = store.PutRoute("i-1", u.Hostname(), port)
+	instStore := &mockInstanceStore{instances: map[string]storage.Instance{"i-1": {ID: "i-1", Status: "unhealthy"}}}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	h := NewHandler(store, instStore).WithOptions(Options{BreakerThreshold: 2, BreakerCooldown: time.Minute})
+	h.RegisterRoutes(r)
+
+	ark := httptest.NewServer(r)
+	defer ark.Close()
+
+	get := func(accept string) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodGet, ark.URL+"/instances/i-1/", nil)
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+
+	resp, body := get("application/json")
+	if resp.StatusCode != http.StatusBadGateway || !strings.Contains(body, "upstream unreachable") {
+		t.Fatalf("expected JSON 502, got %d %s", resp.StatusCode, body)
+	}
+
+	resp, body = get("text/html,application/xhtml+xml")
+	if resp.StatusCode != http.StatusBadGateway || !strings.Contains(resp.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("expected HTML 502, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if !strings.Contains(body, "La instancia no responde") {
+		t.Fatalf("expected unhealthy page, got %s", body)
+	}
+
+	resp, _ = get("application/json")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected open circuit 503 with Retry-After, got %d", resp.StatusCode)
+	}
+}
+
+type staticIdentities map[string]tailscale.Identity
+
+func (s staticIdentities) Identify(ip string) (tailscale.Identity, bool) {
+	id, ok := s[ip]
+	return id, ok
+}
+
+func TestMaintenance_BlocksUnlessAllowed(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("app"))
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	store := newMockRouteStore()
+	_ = store.PutRoute("i-1", u.Hostname(), port)
+	instStore := &mockInstanceStore{instances: map[string]storage.Instance{"i-1": {ID: "i-1", Status: "running"}}}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	// Como en main sin ARK_TRUSTED_PROXIES.
+	_ = r.SetTrustedProxies(nil)
+	h := NewHandler(store, instStore)
+	h.RegisterRoutes(r)
+	h.RegisterAPIRoutes(r.Group("/api"))
+
+	ark := httptest.NewServer(r)
+	defer ark.Close()
+
+	call := func(method, path string, body string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, ark.URL+path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		// Un X-Forwarded-For inventado no debe contar como IP del cliente.
+		req.Header.Set("X-Forwarded-For", "10.1.2.3")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+
+	until := time.Now().Add(90 * time.Second).UTC().Format(time.RFC3339)
+	resp, body := call(http.MethodPost, "/api/deployments/i-1/maintenance", `{"message":"upgrade","until":"`+until+`","allow_ips":["10.0.0.0/8"]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", resp.StatusCode, body)
+	}
+
+	resp, body = call(http.MethodGet, "/instances/i-1/", "")
+	if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(body, "upgrade") {
+		t.Fatalf("expected maintenance 503, got %d %s", resp.StatusCode, body)
+	}
+	if ra, _ := strconv.Atoi(resp.Header.Get("Retry-After")); ra < 80 || ra > 91 {
+		t.Fatalf("expected Retry-After close to the end time, got %q", resp.Header.Get("Retry-After"))
+	}
+
+	store.routes["i-1"].Maintenance.AllowIPs = []string{"127.0.0.1"}
+	if resp, body = call(http.MethodGet, "/instances/i-1/", ""); resp.StatusCode != http.StatusOK || body != "app" {
+		t.Fatalf("allowed ip must reach upstream, got %d %s", resp.StatusCode, body)
+	}
+
+	store.routes["i-1"].Maintenance.AllowIPs = nil
+	store.routes["i-1"].Maintenance.AllowUsers = []string{"ops@example.com"}
+	h.WithIdentityResolver(staticIdentities{"127.0.0.1": {User: "OPS@example.com"}})
+	if resp, _ = call(http.MethodGet, "/instances/i-1/", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("allowed tailscale user must reach upstream, got %d", resp.StatusCode)
+	}
+
+	h.WithIdentityResolver(nil)
+	if resp, _ = call(http.MethodDelete, "/api/deployments/i-1/maintenance", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 on delete, got %d", resp.StatusCode)
+	}
+	if resp, _ = call(http.MethodGet, "/instances/i-1/", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected upstream after maintenance ends, got %d", resp.StatusCode)
+	}
+}
+
+func TestAccessPolicies_EnforcedByProxy(t *testing.T) {
+	var gotQuery, gotAuth, gotCookie string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.RawQuery
+		gotAuth = r.Header.Get("Authorization")
+		gotCookie = r.Header.Get("Cookie")
+		_, _ = w.Write([]byte("app"))
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	const id = "abcdef12-aaaa-bbbb-cccc-000000000000"
+	store := newMockRouteStore()
+	_ = store.PutRoute(id, u.Hostname(), port)
+	instStore := &mockInstanceStore{instances: map[string]storage.Instance{id: {ID: id, URL: "http://ark.local/instances/" + id + "/"}}}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	h := NewHandler(store, instStore)
+	h.RegisterRoutes(r)
+	h.RegisterAPIRoutes(r.Group("/api"))
+
+	ark := httptest.NewServer(r)
+	defer ark.Close()
+
+	client := &http.Client{}
+	do := func(req *http.Request) *http.Response {
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	put := func(body string) map[string]any {
+		req, _ := http.NewRequest(http.MethodPut, ark.URL+"/api/deployments/"+id+"/access", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200 on policy update, got %d", resp.StatusCode)
+		}
+		out := map[string]any{}
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		return out
+	}
+
+	put(`{"mode":"basic_auth","username":"client","password":"s3cret-pass"}`)
+	if store.routes[id].Access.PasswordHash == "" || strings.Contains(store.routes[id].Access.PasswordHash, "s3cret") {
+		t.Fatalf("password must be stored hashed")
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, ark.URL+"/instances/by-short/abcdef12/", nil)
+	if resp := do(req); resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Fatalf("expected 401 with challenge via short id, got %d", resp.StatusCode)
+	}
+	req, _ = http.NewRequest(http.MethodGet, ark.URL+"/instances/"+id+"/", nil)
+	req.SetBasicAuth("client", "s3cret-pass")
+	if resp := do(req); resp.StatusCode != http.StatusOK || gotAuth != "" {
+		t.Fatalf("expected 200 without forwarding credentials, got %d auth=%q", resp.StatusCode, gotAuth)
+	}
+
+	out := put(`{"mode":"link_token"}`)
+	token, _ := out["token"].(string)
+	if token == "" || !strings.Contains(out["share_url"].(string), "ark_token="+token) {
+		t.Fatalf("expected generated token and share url, got %v", out)
+	}
+	if again := put(`{"mode":"link_token"}`); again["token"] != nil {
+		t.Fatalf("token must not be regenerated without rotate_token")
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, ark.URL+"/instances/"+id+"/page?ark_token=wrong", nil)
+	if resp := do(req); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for wrong token, got %d", resp.StatusCode)
+	}
+	req, _ = http.NewRequest(http.MethodGet, ark.URL+"/instances/"+id+"/page?x=1&ark_token="+token, nil)
+	resp := do(req)
+	if resp.StatusCode != http.StatusOK || gotQuery != "x=1" {
+		t.Fatalf("expected 200 with token stripped, got %d query=%q", resp.StatusCode, gotQuery)
+	}
+	cookies := resp.Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "ark_access_abcdef12" {
+		t.Fatalf("expected access cookie, got %v", cookies)
+	}
+	// La cookie queda en el prefijo de la instancia: otra instancia del mismo host no la recibe.
+	if cookies[0].Path != "/instances/"+id+"/" {
+		t.Fatalf("expected cookie scoped to the instance, got path %q", cookies[0].Path)
+	}
+	req, _ = http.NewRequest(http.MethodGet, ark.URL+"/instances/"+id+"/next", nil)
+	req.AddCookie(cookies[0])
+	req.AddCookie(&http.Cookie{Name: "session", Value: "app"})
+	if resp := do(req); resp.StatusCode != http.StatusOK || gotCookie != "session=app" {
+		t.Fatalf("expected cookie to grant access without reaching the upstream, got %d cookie=%q", resp.StatusCode, gotCookie)
+	}
+	req, _ = http.NewRequest(http.MethodGet, ark.URL+"/instances/by-short/abcdef12/?ark_token="+token, nil)
+	if resp := do(req); len(resp.Cookies()) != 1 || resp.Cookies()[0].Path != "/instances/by-short/abcdef12/" {
+		t.Fatalf("expected cookie scoped to the short prefix, got %v", resp.Cookies())
+	}
+
+	put(`{"mode":"tailscale","allow_tags":["tag:client-acme"]}`)
+	req, _ = http.NewRequest(http.MethodGet, ark.URL+"/instances/"+id+"/", nil)
+	if resp := do(req); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 without tailscale identity, got %d", resp.StatusCode)
+	}
+	h.WithIdentityResolver(staticIdentities{"127.0.0.1": {User: "bob@acme.com", Tags: []string{"tag:client-acme"}}})
+	if resp := do(req); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected tagged device to pass, got %d", resp.StatusCode)
+	}
+
+	put(`{"mode":"public"}`)
+	if store.routes[id].Access != nil {
+		t.Fatalf("public mode must clear the policy")
+	}
+}
+
+func TestAccessPolicies_RequireAdminGuard(t *testing.T) {
+	store := newMockRouteStore()
+	_ = store.PutRoute("i-1", "10.0.0.1", 8080)
+	_ = store.SetAccessPolicy("i-1", &storage.AccessPolicy{Mode: storage.AccessLinkToken, TokenHash: "x"})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	deny := func(c *gin.Context) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"detail": "admin access required"})
+	}
+	h := NewHandler(store, nil).WithAdminGuard(deny)
+	h.RegisterAPIRoutes(r.Group("/api"))
+
+	for _, method := range []string{http.MethodGet, http.MethodPut} {
+		req := httptest.NewRequest(method, "/api/deployments/i-1/access", strings.NewReader(`{"mode":"public"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("%s access must go through the admin guard, got %d", method, w.Code)
+		}
+	}
+	if store.routes["i-1"].Access == nil {
+		t.Fatalf("the policy must not change without admin access")
+	}
+}
+
+func TestAccessPolicies_IgnoreSpoofedForwardedFor(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("app"))
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	store := newMockRouteStore()
+	_ = store.PutRoute("i-1", u.Hostname(), port)
+	_ = store.SetAccessPolicy("i-1", &storage.AccessPolicy{Mode: storage.AccessTailscale, AllowUsers: []string{"ops@example.com"}})
+
+	gin.SetMode(gin.TestMode)
+	h := NewHandler(store, nil).WithIdentityResolver(staticIdentities{"100.64.0.5": {User: "ops@example.com"}})
+	call := func(trusted []string) int {
+		r := gin.New()
+		if err := r.SetTrustedProxies(trusted); err != nil {
+			t.Fatalf("trusted proxies: %v", err)
+		}
+		h.RegisterRoutes(r)
+		ark := httptest.NewServer(r)
+		defer ark.Close()
+
+		req, _ := http.NewRequest(http.MethodGet, ark.URL+"/instances/i-1/", nil)
+		req.Header.Set("X-Forwarded-For", "100.64.0.5")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Como en main sin ARK_TRUSTED_PROXIES: el header no cuenta.
+	if code := call(nil); code != http.StatusForbidden {
+		t.Fatalf("spoofed X-Forwarded-For must be rejected, got %d", code)
+	}
+	if code := call([]string{"127.0.0.1"}); code != http.StatusOK {
+		t.Fatalf("X-Forwarded-For from a trusted proxy must be honored, got %d", code)
+	}
+}
+
+func TestBasicAuth_CachesVerifiedCredentials(t *testing.T) {
+	h := NewHandler(newMockRouteStore(), nil)
+	now := time.Now()
+	h.basicAuth.now = func() time.Time { return now }
+
+	policy, _, err := buildAccessPolicy(accessPolicyReq{Mode: "basic_auth", Username: "client", Password: "s3cret-pass"}, nil)
+	if err != nil {
+		t.Fatalf("build policy: %v", err)
+	}
+
+	if h.checkPassword(policy, "client", "wrong-pass") || len(h.basicAuth.entries) != 0 {
+		t.Fatalf("wrong password must fail and not be cached")
+	}
+	if !h.checkPassword(policy, "client", "s3cret-pass") || !h.basicAuth.verified(basicAuthKey(policy, "client", "s3cret-pass")) {
+		t.Fatalf("verified credentials must be cached")
+	}
+
+	rotated, _, _ := buildAccessPolicy(accessPolicyReq{Mode: "basic_auth", Username: "client", Password: "other-pass"}, nil)
+	if h.basicAuth.verified(basicAuthKey(rotated, "client", "s3cret-pass")) {
+		t.Fatalf("changing the password must invalidate the cache")
+	}
+
+	now = now.Add(basicAuthTTL)
+	if h.basicAuth.verified(basicAuthKey(policy, "client", "s3cret-pass")) {
+		t.Fatalf("cached credentials must expire")
+	}
+}
+
+type mockAccessLog struct {
+	mu      sync.Mutex
+	entries map[string][]storage.AccessLogEntry
+}
+
+func (m *mockAccessLog) Append(instanceID string, e storage.AccessLogEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e.ID = strconv.Itoa(len(m.entries[instanceID]) + 1)
+	m.entries[instanceID] = append(m.entries[instanceID], e)
+	return nil
+}
+
+func (m *mockAccessLog) List(instanceID string, limit int, before string) ([]storage.AccessLogEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []storage.AccessLogEntry{}
+	all := m.entries[instanceID]
+	for i := len(all) - 1; i >= 0 && len(out) < limit; i-- {
+		if before != "" && all[i].ID >= before {
+			continue
+		}
+		out = append(out, all[i])
+	}
+	return out, nil
+}
+
+func (m *mockAccessLog) count(instanceID string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.entries[instanceID])
+}
+
+func TestProxy_RecordsMetricsAndAccessLog(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	store := newMockRouteStore()
+	_ = store.PutRoute("i-1", u.Hostname(), port)
+	instStore := &mockInstanceStore{instances: map[string]storage.Instance{"i-1": {ID: "i-1", Status: "running"}}}
+	accessLog := &mockAccessLog{entries: map[string][]storage.AccessLogEntry{}}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	h := NewHandler(store, instStore).WithMetrics(metrics.NewRegistry()).WithAccessLog(accessLog)
+	h.RegisterRoutes(r)
+	h.RegisterAPIRoutes(r.Group("/api"))
+
+	ark := httptest.NewServer(r)
+	defer ark.Close()
+
+	get := func(path string) (*http.Response, []byte) {
+		resp, err := http.Get(ark.URL + path)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, b
+	}
+
+	get("/instances/i-1/ok?page=2")
+	get("/instances/i-1/missing")
+
+	resp, body := get("/api/deployments/i-1/metrics")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", resp.StatusCode, body)
+	}
+	var snap metrics.InstanceMetrics
+	_ = json.Unmarshal(body, &snap)
+	if snap.Requests != 2 || snap.StatusClasses["2xx"] != 1 || snap.StatusClasses["4xx"] != 1 || snap.BytesOut < 5 {
+		t.Fatalf("unexpected metrics: %+v", snap)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for accessLog.count("i-1") < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp, body = get("/api/deployments/i-1/access-log?limit=1")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", resp.StatusCode, body)
+	}
+	var page struct {
+		Entries    []storage.AccessLogEntry `json:"entries"`
+		NextBefore string                   `json:"next_before"`
+	}
+	_ = json.Unmarshal(body, &page)
+	if len(page.Entries) != 1 || page.NextBefore == "" {
+		t.Fatalf("expected one entry and a cursor, got %s", body)
+	}
+
+	resp, body = get("/api/deployments/i-1/access-log?before=" + page.NextBefore)
+	_ = json.Unmarshal(body, &page)
+	if len(page.Entries) != 1 {
+		t.Fatalf("expected the older entry, got %s", body)
+	}
+	e := page.Entries[0]
+	if e.Path != "/ok" || e.Query != "page=2" || e.Status != http.StatusOK || e.Method != http.MethodGet || e.BytesOut != 5 {
+		t.Fatalf("unexpected entry: %+v", e)
+	}
+
+	if resp, _ = get("/api/deployments/i-1/access-log?limit=0"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid limit, got %d", resp.StatusCode)
+	}
+	if resp, _ = get("/api/deployments/nope/metrics"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown instance, got %d", resp.StatusCode)
+	}
+
+	// Borrar la ruta descarta las series de la instancia.
+	req, _ := http.NewRequest(http.MethodDelete, ark.URL+"/instances/i-1", nil)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("delete route failed: %v", err)
+	}
+	_, body = get("/api/deployments/i-1/metrics")
+	_ = json.Unmarshal(body, &snap)
+	if snap.Requests != 0 {
+		t.Fatalf("metrics must be forgotten after delete, got %+v", snap)
+	}
+}
+
+type mockProductStore map[string]storage.Product
+
+func (m mockProductStore) GetByID(id string) (storage.Product, error) {
+	p, ok := m[id]
+	if !ok {
+		return storage.Product{}, errors.New("product not found")
+	}
+	return p, nil
+}
+
+func TestTokenBucket_RefillsAtRate(t *testing.T) {
+	l := newRateLimiter()
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+	limits := storage.RateLimit{RequestsPerSecond: 2, Burst: 2}
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("i-1", "1.1.1.1", limits); !ok {
+			t.Fatalf("request %d should fit in the burst", i)
+		}
+	}
+	ok, wait := l.allow("i-1", "1.1.1.1", limits)
+	if ok || wait <= 0 || wait > 500*time.Millisecond {
+		t.Fatalf("expected to be limited with a short wait, got ok=%v wait=%v", ok, wait)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.allow("i-1", "1.1.1.1", limits); !ok {
+		t.Fatalf("expected a token after refill")
+	}
+
+	perIP := storage.RateLimit{PerIPRequestsPerSecond: 1}
+	if ok, _ := l.allow("i-2", "1.1.1.1", perIP); !ok {
+		t.Fatalf("first request from ip should pass")
+	}
+	if ok, _ := l.allow("i-2", "1.1.1.1", perIP); ok {
+		t.Fatalf("second request from same ip should be limited")
+	}
+	if ok, _ := l.allow("i-2", "2.2.2.2", perIP); !ok {
+		t.Fatalf("other ip has its own bucket")
+	}
+
+	// Los buckets ya rellenados y los limites de producto vencidos se descartan.
+	l.products["i-3"] = cachedLimits{expires: now}
+	now = now.Add(2 * time.Minute)
+	l.sweep(now)
+	if len(l.buckets) != 0 || len(l.products) != 0 {
+		t.Fatalf("expected idle state to be evicted, got %d buckets and %d products", len(l.buckets), len(l.products))
+	}
+}
+
+func TestRateLimiter_FloodingIPDoesNotDrainInstance(t *testing.T) {
+	l := newRateLimiter()
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+	limits := storage.RateLimit{RequestsPerSecond: 1, Burst: 5, PerIPRequestsPerSecond: 1, PerIPBurst: 1}
+
+	// La IP que ya paso su limite no consume el cupo de la instancia.
+	for i := 0; i < 50; i++ {
+		_, _ = l.allow("i-1", "1.1.1.1", limits)
+	}
+	for _, ip := range []string{"2.2.2.2", "3.3.3.3", "4.4.4.4", "5.5.5.5"} {
+		if ok, _ := l.allow("i-1", ip, limits); !ok {
+			t.Fatalf("%s must not be limited by another ip's flood", ip)
+		}
+	}
+
+	// Si el cupo de la instancia se agota, la IP recupera el token que tomo.
+	if ok, _ := l.allow("i-1", "6.6.6.6", limits); ok {
+		t.Fatalf("the instance bucket should be empty")
+	}
+	now = now.Add(time.Second)
+	if ok, _ := l.allow("i-1", "6.6.6.6", limits); !ok {
+		t.Fatalf("an ip rejected by the instance limit must keep its own token")
+	}
+}
+
+func TestRateLimits_EnforcedByProxy(t *testing.T) {
+	block := make(chan struct{})
+	started := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-block
+		}
+		_, _ = io.Copy(io.Discard, r.Body)
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	store := newMockRouteStore()
+	_ = store.PutRoute("i-1", u.Hostname(), port)
+	instStore := &mockInstanceStore{instances: map[string]storage.Instance{"i-1": {ID: "i-1", ProductID: "shop", Status: "running"}}}
+	products := mockProductStore{"shop": {ID: "shop", RateLimit: &storage.RateLimit{RequestsPerSecond: 1, Burst: 2, MaxBodyBytes: 16}}}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	// Como en main sin ARK_TRUSTED_PROXIES.
+	_ = r.SetTrustedProxies(nil)
+	h := NewHandler(store, instStore).WithProductStore(products)
+	h.RegisterRoutes(r)
+	h.RegisterAPIRoutes(r.Group("/api"))
+
+	ark := httptest.NewServer(r)
+	defer ark.Close()
+
+	call := func(method, path string, body string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, ark.URL+path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+
+	if resp, body := call(http.MethodPost, "/instances/i-1/", strings.Repeat("x", 32)); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 from product default, got %d %s", resp.StatusCode, body)
+	}
+
+	call(http.MethodGet, "/instances/i-1/", "")
+	call(http.MethodGet, "/instances/i-1/", "")
+	resp, _ := call(http.MethodGet, "/instances/i-1/", "")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected 429 with Retry-After, got %d %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	// El override de la instancia reemplaza la tasa y agrega concurrencia.
+	resp, body := call(http.MethodPut, "/api/deployments/i-1/limits", `{"requests_per_second":100,"burst":100,"max_concurrent":1}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", resp.StatusCode, body)
+	}
+	var view limitsView
+	_ = json.Unmarshal([]byte(body), &view)
+	if view.Effective.RequestsPerSecond != 100 || view.Effective.MaxBodyBytes != 16 || view.Product == nil {
+		t.Fatalf("unexpected effective limits: %s", body)
+	}
+
+	done := make(chan int)
+	go func() {
+		resp, _ := call(http.MethodGet, "/instances/i-1/slow", "")
+		done <- resp.StatusCode
+	}()
+	<-started
+	if resp, _ = call(http.MethodGet, "/instances/i-1/", ""); resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 while the slot is taken, got %d", resp.StatusCode)
+	}
+	close(block)
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("slow request should succeed, got %d", code)
+	}
+	if resp, _ = call(http.MethodGet, "/instances/i-1/", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("slot must be released, got %d", resp.StatusCode)
+	}
+
+	// El limite por IP usa la IP de la conexion: rotar X-Forwarded-For no lo saltea.
+	call(http.MethodPut, "/api/deployments/i-1/limits", `{"requests_per_second":100,"burst":100,"per_ip_requests_per_second":0.01,"per_ip_burst":1}`)
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req, _ := http.NewRequest(http.MethodGet, ark.URL+"/instances/i-1/", nil)
+		req.Header.Set("X-Forwarded-For", "198.51.100."+strconv.Itoa(i+1))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("request %d with spoofed X-Forwarded-For: expected %d, got %d", i, want, resp.StatusCode)
+		}
+	}
+
+	if resp, _ = call(http.MethodPut, "/api/deployments/i-1/limits", `{"burst":5}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for burst without rate, got %d", resp.StatusCode)
+	}
+	if resp, _ = call(http.MethodDelete, "/api/deployments/i-1/limits", ""); resp.StatusCode != http.StatusOK || store.routes["i-1"].Limits != nil {
+		t.Fatalf("expected override removed, got %d", resp.StatusCode)
+	}
+}
+
+func TestServices_RoutedByPathAndHost(t *testing.T) {
+	newUpstream := func(name string) (*httptest.Server, int) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(name + " " + r.URL.Path))
+		}))
+		u, _ := url.Parse(srv.URL)
+		port, _ := strconv.Atoi(u.Port())
+		return srv, port
+	}
+	web, webPort := newUpstream("web")
+	defer web.Close()
+	api, apiPort := newUpstream("api")
+	defer api.Close()
+
+	store := newMockRouteStore()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	h := NewHandler(store, nil).WithOptions(Options{HostRoutingDomain: "apps.example.com"})
+	r.Use(h.HostRouting())
+	h.RegisterRoutes(r)
+
+	ark := httptest.NewServer(r)
+	defer ark.Close()
+
+	payload, _ := json.Marshal(RegisterReq{
+		InstanceID: "abcdef12-0000",
+		TargetHost: "127.0.0.1",
+		TargetPort: webPort,
+		WebService: "web",
+		Services: []RegisterService{
+			{Name: "web", TargetPort: webPort},
+			{Name: "API", TargetPort: apiPort},
+		},
+	})
+	resp, err := http.Post(ark.URL+"/instances/register", "application/json", bytes.NewReader(payload))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("register failed: %v %v", err, resp)
+	}
+	resp.Body.Close()
+	if got := store.routes["abcdef12-0000"].Services["api"]; got != apiPort {
+		t.Fatalf("expected api service stored, got %d", got)
+	}
+
+	get := func(host, path string) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, ark.URL+path, nil)
+		if host != "" {
+			req.Host = host
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	cases := []struct {
+		host, path, want string
+	}{
+		{"", "/instances/abcdef12-0000/home", "web /home"},
+		{"", "/instances/abcdef12-0000/api/users", "api /users"},
+		{"", "/instances/abcdef12-0000/web/assets", "web /web/assets"},
+		{"", "/instances/by-short/abcdef12/api/", "api /"},
+		{"api.abcdef12.apps.example.com", "/users", "api /users"},
+		{"web.abcdef12.apps.example.com", "/api/users", "web /api/users"},
+		{"abcdef12.apps.example.com", "/", "web /"},
+	}
+	for _, tc := range cases {
+		code, body := get(tc.host, tc.path)
+		if code != http.StatusOK || body != tc.want {
+			t.Errorf("%s%s: expected %q, got %d %q", tc.host, tc.path, tc.want, code, body)
+		}
+	}
+
+	if code, _ := get("admin.abcdef12.apps.example.com", "/"); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown service, got %d", code)
+	}
+}
+
+func TestBackends_BalancedStickyAndLeased(t *testing.T) {
+	newUpstream := func(name string) (*httptest.Server, int) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(name))
+		}))
+		u, _ := url.Parse(srv.URL)
+		port, _ := strconv.Atoi(u.Port())
+		return srv, port
+	}
+	a, portA := newUpstream("a")
+	defer a.Close()
+	b, portB := newUpstream("b")
+
+	store := newMockRouteStore()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	h := NewHandler(store, nil).WithOptions(Options{BreakerThreshold: 1, BreakerCooldown: time.Minute})
+	h.RegisterRoutes(r)
+	h.RegisterAPIRoutes(r.Group("/api"))
+
+	ark := httptest.NewServer(r)
+	defer ark.Close()
+
+	call := func(method, path string, body string, cookies ...*http.Cookie) (*http.Response, string) {
+		req, _ := http.NewRequest(method, ark.URL+path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		for _, ck := range cookies {
+			req.AddCookie(ck)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		out, _ := io.ReadAll(resp.Body)
+		return resp, string(out)
+	}
+
+	register := func(port int, lease int) {
+		payload := `{"instance_id":"i-1","target_host":"127.0.0.1","target_port":` + strconv.Itoa(port) + `,"lease_seconds":` + strconv.Itoa(lease) + `}`
+		if resp, body := call(http.MethodPost, "/instances/register", payload); resp.StatusCode != http.StatusOK {
+			t.Fatalf("register failed: %d %s", resp.StatusCode, body)
+		}
+	}
+	register(portA, 0)
+	register(portB, 60)
+
+	seen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		_, body := call(http.MethodGet, "/instances/i-1/", "")
+		seen[body]++
+	}
+	if seen["a"] != 2 || seen["b"] != 2 {
+		t.Fatalf("expected round robin across both backends, got %v", seen)
+	}
+
+	if resp, _ := call(http.MethodPut, "/api/deployments/i-1/balancing", `{"mode":"random"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown mode, got %d", resp.StatusCode)
+	}
+	if resp, body := call(http.MethodPut, "/api/deployments/i-1/balancing", `{"mode":"least_conn","sticky":true}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", resp.StatusCode, body)
+	}
+
+	resp, first := call(http.MethodGet, "/instances/i-1/", "")
+	var sticky *http.Cookie
+	for _, ck := range resp.Cookies() {
+		if strings.HasPrefix(ck.Name, backendCookiePref) {
+			sticky = ck
+		}
+	}
+	if sticky == nil {
+		t.Fatalf("expected affinity cookie")
+	}
+	for i := 0; i < 3; i++ {
+		if _, body := call(http.MethodGet, "/instances/i-1/", "", sticky); body != first {
+			t.Fatalf("sticky request moved from %s to %s", first, body)
+		}
+	}
+
+	// Backend caido: el breaker lo saca y las requests van al otro.
+	b.Close()
+	for i := 0; i < 4; i++ {
+		call(http.MethodGet, "/instances/i-1/", "")
+	}
+	for i := 0; i < 3; i++ {
+		if resp, body := call(http.MethodGet, "/instances/i-1/", ""); resp.StatusCode != http.StatusOK || body != "a" {
+			t.Fatalf("expected healthy backend a, got %d %s", resp.StatusCode, body)
+		}
+	}
+
+	// Lease vencido: el backend deja de recibir trafico aunque siga guardado.
+	route := store.routes["i-1"]
+	expired := time.Now().Add(-time.Second)
+	for i := range route.Backends {
+		route.Backends[i].ExpiresAt = &expired
+	}
+	store.routes["i-1"] = route
+	if resp, body := call(http.MethodGet, "/instances/i-1/", ""); resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(body, "no live backends") {
+		t.Fatalf("expected 503 without live backends, got %d %s", resp.StatusCode, body)
+	}
+
+	if resp, body := call(http.MethodGet, "/api/deployments/i-1/backends", ""); resp.StatusCode != http.StatusOK || !strings.Contains(body, `"expired":true`) {
+		t.Fatalf("expected backends listing, got %d %s", resp.StatusCode, body)
+	}
+	if resp, _ := call(http.MethodDelete, "/api/deployments/i-1/backends/127.0.0.1:"+strconv.Itoa(portA), ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected backend removed, got %d", resp.StatusCode)
+	}
+	if resp, _ := call(http.MethodDelete, "/api/deployments/i-1/backends/127.0.0.1:1", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown backend, got %d", resp.StatusCode)
+	}
+}
+
+func TestMirror_CopiesToShadowAndComparesStatus(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write([]byte("primary:" + string(body)))
+	}))
+	defer primary.Close()
+
+	type shadowHit struct {
+		path, body, header string
+		leaked             bool
+		trace              string
+	}
+	hits := make(chan shadowHit, 4)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		leaked := r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" || r.Header.Get(accessTokenHeader) != ""
+		hits <- shadowHit{path: r.URL.Path, body: string(body), header: r.Header.Get(shadowHeader), leaked: leaked, trace: r.Header.Get("X-Trace")}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+
+	store := newMockRouteStore()
+	for id, srv := range map[string]*httptest.Server{"i-1": primary, "i-2": shadow} {
+		u, _ := url.Parse(srv.URL)
+		port, _ := strconv.Atoi(u.Port())
+		_ = store.PutRoute(id, u.Hostname(), port)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	h := NewHandler(store, nil)
+	h.RegisterRoutes(r)
+	h.RegisterAPIRoutes(r.Group("/api"))
+
+	ark := httptest.NewServer(r)
+	defer ark.Close()
+
+	call := func(method, path string, body string, header ...string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, ark.URL+path, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		out, _ := io.ReadAll(resp.Body)
+		return resp, string(out)
+	}
+
+	if resp, _ := call(http.MethodPut, "/api/deployments/i-1/mirror", `{"target_instance_id":"i-1","percent":50}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 mirroring to itself, got %d", resp.StatusCode)
+	}
+	if resp, _ := call(http.MethodPut, "/api/deployments/i-1/mirror", `{"target_instance_id":"i-2","percent":0}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for percent 0, got %d", resp.StatusCode)
+	}
+	if resp, body := call(http.MethodPut, "/api/deployments/i-1/mirror", `{"target_instance_id":"i-2","percent":100,"max_body_bytes":8,"mirror_writes":true}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", resp.StatusCode, body)
+	}
+
+	resp, body := call(http.MethodPost, "/instances/i-1/api/items?x=1", "hello",
+		"Authorization", "Bearer secret", "Cookie", "session=abc", "X-Trace", "t-1")
+	if resp.StatusCode != http.StatusOK || body != "primary:hello" {
+		t.Fatalf("primary response changed by mirroring: %d %q", resp.StatusCode, body)
+	}
+
+	select {
+	case hit := <-hits:
+		if hit.path != "/api/items" || hit.body != "hello" || hit.header != "1" || hit.leaked || hit.trace != "t-1" {
+			t.Fatalf("unexpected shadow request: %+v", hit)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("shadow request not received")
+	}
+
+	// Un body mayor al limite no se copia, pero la primaria lo recibe completo.
+	if _, body := call(http.MethodPost, "/instances/i-1/", "too large for the mirror"); body != "primary:too large for the mirror" {
+		t.Fatalf("primary body truncated: %q", body)
+	}
+
+	var view struct {
+		Stats MirrorStats `json:"stats"`
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, out := call(http.MethodGet, "/api/deployments/i-1/mirror", "")
+		_ = json.Unmarshal([]byte(out), &view)
+		if view.Stats.Mirrored == 1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if view.Stats.Mirrored != 1 || view.Stats.Skipped != 1 || view.Stats.StatusMismatches != 1 || view.Stats.Mismatches["200->500"] != 1 {
+		t.Fatalf("unexpected mirror stats: %+v", view.Stats)
+	}
+
+	// Sin mirror_writes solo se copian las lecturas.
+	if resp, body := call(http.MethodPut, "/api/deployments/i-1/mirror", `{"target_instance_id":"i-2","percent":100}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", resp.StatusCode, body)
+	}
+	call(http.MethodPost, "/instances/i-1/api/items", "write")
+	call(http.MethodGet, "/instances/i-1/api/items", "")
+	select {
+	case hit := <-hits:
+		if hit.path != "/api/items" || hit.body != "" {
+			t.Fatalf("expected only the read to be mirrored, got %+v", hit)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("shadow request not received")
+	}
+	select {
+	case hit := <-hits:
+		t.Fatalf("unexpected extra shadow request: %+v", hit)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if resp, _ := call(http.MethodDelete, "/api/deployments/i-1/mirror", ""); resp.StatusCode != http.StatusOK || store.routes["i-1"].Mirror != nil {
+		t.Fatalf("expected mirror removed, got %d", resp.StatusCode)
+	}
+	call(http.MethodGet, "/instances/i-1/", "")
+	select {
+	case hit := <-hits:
+		t.Fatalf("unexpected shadow request after delete: %+v", hit)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMirror_RejectsShadowFromOtherProduct(t *testing.T) {
+	store := newMockRouteStore()
+	_ = store.PutRoute("i-1", "127.0.0.1", 9001)
+	instances := &mockInstanceStore{instances: map[string]storage.Instance{
+		"i-1": {ID: "i-1", ProductID: "shop"},
+		"i-2": {ID: "i-2", ProductID: "shop"},
+		"i-3": {ID: "i-3", ProductID: "billing"},
+	}}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	NewHandler(store, instances).RegisterAPIRoutes(r.Group("/api"))
+
+	put := func(target string) int {
+		req := httptest.NewRequest(http.MethodPut, "/api/deployments/i-1/mirror", strings.NewReader(`{"target_instance_id":"`+target+`","percent":10}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := put("i-3"); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a shadow of another product, got %d", code)
+	}
+	if code := put("i-2"); code != http.StatusOK {
+		t.Fatalf("expected 200 for a shadow of the same product, got %d", code)
+	}
+}
+
+type mockAliasStore struct {
+	aliases map[string]storage.Alias
+}
+
+func (m *mockAliasStore) Get(name string) (storage.Alias, bool, error) {
+	a, ok := m.aliases[name]
+	return a, ok, nil
+}
+
+func (m *mockAliasStore) List() ([]storage.Alias, error) {
+	out := []storage.Alias{}
+	for _, a := range m.aliases {
+		out = append(out, a)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+func (m *mockAliasStore) Create(a storage.Alias) error {
+	if _, ok := m.aliases[a.Name]; ok {
+		return storage.ErrAliasExists
+	}
+	m.aliases[a.Name] = a
+	return nil
+}
+
+func (m *mockAliasStore) Update(a storage.Alias) error {
+	if _, ok := m.aliases[a.Name]; !ok {
+		return storage.ErrAliasNotFound
+	}
+	m.aliases[a.Name] = a
+	return nil
+}
+
+func (m *mockAliasStore) Delete(name string) error {
+	if _, ok := m.aliases[name]; !ok {
+		return storage.ErrAliasNotFound
+	}
+	delete(m.aliases, name)
+	return nil
+}
+
+func TestAliases_WeightedCutoverAndSticky(t *testing.T) {
+	store := newMockRouteStore()
+	for _, name := range []string{"blue", "green"} {
+		name := name
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(name + ":" + r.URL.Path))
+		}))
+		defer srv.Close()
+		u, _ := url.Parse(srv.URL)
+		port, _ := strconv.Atoi(u.Port())
+		_ = store.PutRoute(name, u.Hostname(), port)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	h := NewHandler(store, nil).WithAliasStore(&mockAliasStore{aliases: map[string]storage.Alias{}})
+	h.RegisterRoutes(r)
+	h.RegisterAPIRoutes(r.Group("/api"))
+
+	ark := httptest.NewServer(r)
+	defer ark.Close()
+
+	call := func(method, path string, body string, cookies ...*http.Cookie) (*http.Response, string) {
+		req, _ := http.NewRequest(method, ark.URL+path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		for _, ck := range cookies {
+			req.AddCookie(ck)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		out, _ := io.ReadAll(resp.Body)
+		return resp, string(out)
+	}
+
+	if resp, _ := call(http.MethodPost, "/api/aliases", `{"name":"shop","targets":[{"instance_id":"blue","weight":0}]}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 without weight, got %d", resp.StatusCode)
+	}
+	if resp, _ := call(http.MethodPost, "/api/aliases", `{"name":"shop","targets":[{"instance_id":"nope","weight":10}]}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for instance without route, got %d", resp.StatusCode)
+	}
+	if resp, body := call(http.MethodPost, "/api/aliases", `{"name":"shop","targets":[{"instance_id":"blue","weight":100},{"instance_id":"green","weight":0}]}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d %s", resp.StatusCode, body)
+	}
+	if resp, _ := call(http.MethodPost, "/api/aliases", `{"name":"shop","targets":[{"instance_id":"blue","weight":100}]}`); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 for duplicated alias, got %d", resp.StatusCode)
+	}
+
+	for i := 0; i < 5; i++ {
+		if resp, body := call(http.MethodGet, "/aliases/shop/cart", ""); body != "blue:/cart" || resp.Header.Get("X-ARK-Instance") != "blue" {
+			t.Fatalf("expected blue, got %q", body)
+		}
+	}
+
+	// Cutover: la URL del alias no cambia.
+	if resp, body := call(http.MethodPut, "/api/aliases/shop", `{"targets":[{"instance_id":"blue","weight":0},{"instance_id":"green","weight":100}]}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", resp.StatusCode, body)
+	}
+	if _, body := call(http.MethodGet, "/aliases/shop/cart", ""); body != "green:/cart" {
+		t.Fatalf("expected green after cutover, got %q", body)
+	}
+
+	if resp, _ := call(http.MethodPut, "/api/aliases/shop", `{"sticky":true,"targets":[{"instance_id":"blue","weight":50},{"instance_id":"green","weight":50}]}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	resp, first := call(http.MethodGet, "/aliases/shop/", "")
+	var sticky *http.Cookie
+	for _, ck := range resp.Cookies() {
+		if ck.Name == aliasCookiePref+"shop" {
+			sticky = ck
+		}
+	}
+	if sticky == nil {
+		t.Fatalf("expected alias affinity cookie")
+	}
+	for i := 0; i < 10; i++ {
+		if _, body := call(http.MethodGet, "/aliases/shop/", "", sticky); body != first {
+			t.Fatalf("sticky client moved from %q to %q", first, body)
+		}
+	}
+
+	if resp, _ := call(http.MethodDelete, "/api/aliases/shop", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 on delete, got %d", resp.StatusCode)
+	}
+	if resp, _ := call(http.MethodGet, "/aliases/shop/", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 after delete, got %d", resp.StatusCode)
+	}
+}
+
+type mockInstanceList []storage.Instance
+
+func (m mockInstanceList) GetAll() []storage.Instance { return m }
+
+type mockArtifacts struct {
+	result    string
+	artifacts map[string][]byte
+	fetches   int
+}
+
+func (m *mockArtifacts) ReadBuildStatus(jobName string, buildNumber int) (bool, string, error) {
+	return false, m.result, nil
+}
+
+func (m *mockArtifacts) GetArtifact(jobName string, buildNumber int, relativePath string) ([]byte, error) {
+	m.fetches++
+	b, ok := m.artifacts[jobName+"#"+strconv.Itoa(buildNumber)+"/"+relativePath]
+	if !ok {
+		return nil, errors.New("status=404")
+	}
+	return b, nil
+}
+
+func TestReconcileRoutes_RecoversFromCallbackArtifact(t *testing.T) {
+	store := newMockRouteStore()
+	instStore := &mockInstanceStore{instances: map[string]storage.Instance{
+		"lost":    {ID: "lost", Status: "provisioning", Builds: map[string]string{"deploy": "12"}},
+		"failed":  {ID: "failed", Status: "provisioning", Builds: map[string]string{"deploy-f": "3"}},
+		"running": {ID: "running", Status: "running", Builds: map[string]string{"deploy": "11"}},
+	}}
+	list := mockInstanceList{instStore.instances["lost"], instStore.instances["failed"], instStore.instances["running"]}
+
+	src := &mockArtifacts{result: "SUCCESS", artifacts: map[string][]byte{
+		"deploy#12/deploy_callback_payload.json": []byte(`{"instance_id":"lost","target_host":"10.0.0.5","target_port":32768,"web_service":"web","services":[{"name":"api","target_port":32769}],"local_url":"http://localhost:32768/"}`),
+	}}
+
+	h := NewHandler(store, instStore)
+	tried := map[string]bool{}
+	if n := h.ReconcileRoutes(list, src, tried); n != 1 {
+		t.Fatalf("expected 1 recovered route, got %d", n)
+	}
+
+	route, ok := store.routes["lost"]
+	if !ok {
+		t.Fatalf("expected route recovered for lost instance")
+	}
+	backends := route.LiveBackends(time.Now())
+	if len(backends) != 1 || backends[0].Host != "10.0.0.5" || backends[0].Port != 32768 || backends[0].Services["api"] != 32769 {
+		t.Fatalf("unexpected recovered route: %+v", route)
+	}
+	if got := instStore.instances["lost"]; got.Status != "running" || got.LocalURL != "http://localhost:32768/" {
+		t.Fatalf("expected instance marked running, got %+v", got)
+	}
+	if _, ok := store.routes["running"]; ok {
+		t.Fatalf("running instances must not be reconciled")
+	}
+
+	// Los builds ya revisados no se vuelven a consultar.
+	fetches := src.fetches
+	h.ReconcileRoutes(list, src, tried)
+	if src.fetches != fetches {
+		t.Fatalf("expected no new artifact fetches, got %d", src.fetches-fetches)
+	}
+}
+
+func TestAudit_SkipsHeartbeatsAndDiffsRouteSettings(t *testing.T) {
+	kv, err := storage.OpenFileKV(t.TempDir() + "/ark.db")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { kv.Close() })
+	auditStore := storage.NewAuditLogStore(kv, 100)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(audit.Middleware(auditStore, nil))
+	h := NewHandler(storage.NewRouteStore(kv), nil)
+	h.RegisterRoutes(r)
+	h.RegisterAPIRoutes(r.Group("/api"))
+
+	call := func(method, path, body string) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s: expected 200, got %d %s", method, path, w.Code, w.Body.String())
+		}
+	}
+
+	register := `{"instance_id":"i-1","target_host":"127.0.0.1","target_port":1,"lease_seconds":30}`
+	call(http.MethodPost, "/instances/register", register)
+	// Los heartbeats del lease no cambian la ruta y no se auditan.
+	call(http.MethodPost, "/instances/register", register)
+	call(http.MethodPost, "/instances/register", register)
+	call(http.MethodPut, "/api/deployments/i-1/limits", `{"requests_per_second":5}`)
+	call(http.MethodPost, "/api/deployments/i-1/maintenance", `{"message":"upgrade"}`)
+
+	entries, _, err := auditStore.List(storage.AuditQuery{})
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("expected register, limits and maintenance entries, got %d (%v)", len(entries), err)
+	}
+	limits := entries[1].Changes["limits"]
+	if entries[1].Target != "i-1" || limits.Before != nil || limits.After.(map[string]any)["requests_per_second"] != float64(5) {
+		t.Fatalf("expected the limits diff, got %+v", entries[1])
+	}
+	if maintenance := entries[0].Changes["maintenance"]; maintenance.After.(map[string]any)["message"] != "upgrade" {
+		t.Fatalf("expected the maintenance diff, got %+v", entries[0])
+	}
+}
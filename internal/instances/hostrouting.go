@@ -0,0 +1,129 @@
+package instances
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Ruteo por host: <short>.apps.example.com o <product>-<env>-<short>.apps.example.com.
+// <service>.<short>.apps.example.com apunta a otro servicio expuesto de la instancia.
+// La app queda montada en la raiz del dominio, sin prefijo /instances/<id>.
+
+var shortIDPattern = regexp.MustCompile(`^[a-f0-9]{8}$`)
+
+var serviceNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// DefaultFriendlyURLTemplate replica la URL amigable que arma el pipeline de Jenkins.
+const DefaultFriendlyURLTemplate = "{public}/instances/by-short/{short}/"
+
+// FriendlyURLVars son los valores disponibles para la plantilla de URL amigable.
+type FriendlyURLVars struct {
+	PublicHost  string
+	Domain      string
+	InstanceID  string
+	ProductID   string
+	Environment string
+}
+
+// RenderFriendlyURL reemplaza {public}, {domain}, {id}, {short}, {product} y {env} en la plantilla.
+// Si la plantilla esta vacia se usa DefaultFriendlyURLTemplate.
+func RenderFriendlyURL(tmpl string, v FriendlyURLVars) string {
+	tmpl = strings.TrimSpace(tmpl)
+	if tmpl == "" {
+		tmpl = DefaultFriendlyURLTemplate
+	}
+
+	id := strings.ToLower(strings.TrimSpace(v.InstanceID))
+	short := id
+	if len(short) > 8 {
+		short = short[:8]
+	}
+
+	r := strings.NewReplacer(
+		"{public}", strings.TrimRight(strings.TrimSpace(v.PublicHost), "/"),
+		"{domain}", strings.TrimSpace(v.Domain),
+		"{id}", id,
+		"{short}", short,
+		"{product}", dnsLabel(v.ProductID),
+		"{env}", dnsLabel(v.Environment),
+	)
+	return r.Replace(tmpl)
+}
+
+// HostRouting devuelve el middleware que atiende las requests por header Host:
+// primero los dominios propios de cada instancia y luego los subdominios del
+// dominio comodin configurado. Debe registrarse antes que las rutas.
+func (h *Handler) HostRouting() gin.HandlerFunc {
+	domain := strings.ToLower(strings.TrimSpace(h.opts.HostRoutingDomain))
+
+	return func(c *gin.Context) {
+		if h.domains != nil {
+			if id, found, err := h.domains.Resolve(normalizeHost(c.Request.Host)); err == nil && found {
+				h.proxyInstance(c, id, "", c.Request.URL.Path)
+				c.Abort()
+				return
+			}
+		}
+
+		if domain == "" {
+			c.Next()
+			return
+		}
+
+		shortID, service, ok := shortIDFromHost(c.Request.Host, domain)
+		if !ok {
+			c.Next()
+			return
+		}
+
+		h.proxyShortID(c, shortID, service, c.Request.URL.Path)
+		c.Abort()
+	}
+}
+
+// shortIDFromHost extrae el short id (8 hex) y el servicio opcional del host.
+// Acepta "<short>", "<product>-<env>-<short>" y "<service>.<short>"; cualquier otro host no aplica.
+func shortIDFromHost(rawHost string, domain string) (shortID string, service string, ok bool) {
+	host := normalizeHost(rawHost)
+
+	suffix := "." + domain
+	if !strings.HasSuffix(host, suffix) {
+		return "", "", false
+	}
+
+	label := strings.TrimSuffix(host, suffix)
+	if label == "" {
+		return "", "", false
+	}
+
+	if svc, rest, found := strings.Cut(label, "."); found {
+		if !serviceNamePattern.MatchString(svc) || strings.Contains(rest, ".") {
+			return "", "", false
+		}
+		service, label = svc, rest
+	}
+
+	if i := strings.LastIndex(label, "-"); i >= 0 {
+		label = label[i+1:]
+	}
+	if !shortIDPattern.MatchString(label) {
+		return "", "", false
+	}
+
+	return label, service, true
+}
+
+func dnsLabel(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	var b strings.Builder
+	for _, r := range s {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('-')
+		}
+	}
+	return strings.Trim(b.String(), "-")
+}
@@ -0,0 +1,228 @@
+package instances
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"ark_deploy/internal/audit"
+	"ark_deploy/internal/events"
+	"ark_deploy/internal/storage"
+	"ark_deploy/internal/tailscale"
+)
+
+// Modo mantenimiento: el flag se guarda junto a la ruta, asi que sobrevive a reinicios.
+
+// defaultMaintenanceRetry se usa en Retry-After cuando la ventana no tiene fin.
+const defaultMaintenanceRetry = 5 * time.Minute
+
+// IdentityResolver resuelve la IP del cliente a su identidad de Tailscale.
+type IdentityResolver interface {
+	Identify(ip string) (tailscale.Identity, bool)
+}
+
+// WithIdentityResolver habilita las listas de usuarios de Tailscale.
+func (h *Handler) WithIdentityResolver(r IdentityResolver) *Handler {
+	h.identities = r
+	return h
+}
+
+type maintenanceReq struct {
+	Message    string     `json:"message"`
+	Until      *time.Time `json:"until"`
+	AllowIPs   []string   `json:"allow_ips"`
+	AllowUsers []string   `json:"allow_users"`
+}
+
+func (h *Handler) getMaintenance(c *gin.Context) {
+	id, ok := h.requireInstance(c)
+	if !ok {
+		return
+	}
+
+	route, found, err := h.store.GetRouteRecord(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "instance route not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"instance_id": id,
+		"active":      route.Maintenance.Active(time.Now()),
+		"maintenance": route.Maintenance,
+	})
+}
+
+func (h *Handler) startMaintenance(c *gin.Context) {
+	id, ok := h.requireInstance(c)
+	if !ok {
+		return
+	}
+
+	var req maintenanceReq
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	if req.Until != nil && !req.Until.After(now) {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "until must be in the future"})
+		return
+	}
+
+	allowIPs := make([]string, 0, len(req.AllowIPs))
+	for _, raw := range req.AllowIPs {
+		v := strings.TrimSpace(raw)
+		if v == "" {
+			continue
+		}
+		if net.ParseIP(v) == nil {
+			if _, _, err := net.ParseCIDR(v); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"detail": "invalid allow_ips entry: " + v})
+				return
+			}
+		}
+		allowIPs = append(allowIPs, v)
+	}
+
+	allowUsers := make([]string, 0, len(req.AllowUsers))
+	for _, raw := range req.AllowUsers {
+		if v := strings.TrimSpace(raw); v != "" {
+			allowUsers = append(allowUsers, v)
+		}
+	}
+
+	m := &storage.Maintenance{
+		Message:    strings.TrimSpace(req.Message),
+		StartedAt:  now,
+		Until:      req.Until,
+		AllowIPs:   allowIPs,
+		AllowUsers: allowUsers,
+	}
+
+	before, _, _ := h.store.GetRouteRecord(id)
+	if err := h.store.SetMaintenance(id, m); err != nil {
+		if errors.Is(err, storage.ErrRouteNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"detail": "instance route not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+
+	audit.Record(c, id, gin.H{"maintenance": before.Maintenance}, gin.H{"maintenance": m})
+	h.publish(events.RouteUpdated, id, map[string]any{"change": "maintenance_started", "until": m.Until})
+
+	c.JSON(http.StatusOK, gin.H{
+		"instance_id": id,
+		"active":      true,
+		"maintenance": m,
+	})
+}
+
+func (h *Handler) stopMaintenance(c *gin.Context) {
+	id, ok := h.requireInstance(c)
+	if !ok {
+		return
+	}
+
+	before, _, _ := h.store.GetRouteRecord(id)
+	if err := h.store.SetMaintenance(id, nil); err != nil {
+		if errors.Is(err, storage.ErrRouteNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"detail": "instance route not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+
+	audit.Record(c, id, gin.H{"maintenance": before.Maintenance}, gin.H{"maintenance": nil})
+	h.publish(events.RouteUpdated, id, map[string]any{"change": "maintenance_stopped"})
+
+	c.JSON(http.StatusOK, gin.H{"instance_id": id, "active": false})
+}
+
+// maintenanceBypass indica si el cliente esta en la lista de IPs o usuarios permitidos.
+// La IP es la de la conexion salvo que venga de un proxy de confianza (ver
+// ARK_TRUSTED_PROXIES), asi X-Forwarded-For no alcanza para saltear la pagina.
+func (h *Handler) maintenanceBypass(c *gin.Context, m *storage.Maintenance) bool {
+	ip := c.ClientIP()
+	clientIP := net.ParseIP(ip)
+	if clientIP != nil {
+		for _, allowed := range m.AllowIPs {
+			if ipMatches(clientIP, allowed) {
+				return true
+			}
+		}
+	}
+
+	if len(m.AllowUsers) == 0 || h.identities == nil {
+		return false
+	}
+	identity, ok := h.identities.Identify(ip)
+	if !ok {
+		return false
+	}
+	for _, u := range m.AllowUsers {
+		if strings.EqualFold(strings.TrimSpace(u), identity.User) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Handler) renderMaintenance(c *gin.Context, id string, m *storage.Maintenance) {
+	retry := defaultMaintenanceRetry
+	if m.Until != nil {
+		retry = time.Until(*m.Until)
+	}
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+
+	if !wantsHTML(c.Request) {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+			"detail":  "instance under maintenance",
+			"message": m.Message,
+			"until":   m.Until,
+		})
+		return
+	}
+
+	page := errorPage{
+		Code:       http.StatusServiceUnavailable,
+		Title:      "Instancia en mantenimiento",
+		Message:    m.Message,
+		Status:     "maintenance",
+		Color:      "#38bdf8",
+		InstanceID: shortOf(id),
+	}
+	if page.Message == "" {
+		page.Message = "Estamos realizando tareas de mantenimiento. Vuelve a intentarlo más tarde."
+	}
+	if m.Until != nil {
+		page.Until = m.Until.UTC().Format("2006-01-02 15:04 MST")
+	}
+	writeErrorPage(c, page)
+}
+
+func ipMatches(ip net.IP, allowed string) bool {
+	allowed = strings.TrimSpace(allowed)
+	if strings.Contains(allowed, "/") {
+		_, network, err := net.ParseCIDR(allowed)
+		return err == nil && network.Contains(ip)
+	}
+	other := net.ParseIP(allowed)
+	return other != nil && other.Equal(ip)
+}
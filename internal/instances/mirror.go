@@ -0,0 +1,440 @@
+package instances
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"ark_deploy/internal/audit"
+	"ark_deploy/internal/storage"
+)
+
+// Mirroring: un porcentaje de las requests servidas se copia de forma asincrona
+// a una instancia shadow. Su respuesta se descarta; solo se comparan status y
+// latencia contra la primaria.
+
+const (
+	defaultMirrorMaxBody = 64 << 10
+	maxMirrorMaxBody     = 10 << 20
+	mirrorTimeout        = 10 * time.Second
+	mirrorMaxInFlight    = 16
+	mirrorSampleHistory  = 50
+
+	// shadowHeader marca las requests copiadas para que la app pueda ignorarlas.
+	shadowHeader = "X-ARK-Shadow"
+)
+
+// mirrorStripHeaders son credenciales y headers hop-by-hop que no llegan al shadow.
+var mirrorStripHeaders = []string{
+	"Authorization",
+	"Cookie",
+	accessTokenHeader,
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// mirrorHeader copia los headers de la request sin credenciales ni hop-by-hop.
+func mirrorHeader(in http.Header) http.Header {
+	out := in.Clone()
+	for _, v := range in.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				out.Del(name)
+			}
+		}
+	}
+	for _, name := range mirrorStripHeaders {
+		out.Del(name)
+	}
+	return out
+}
+
+// idempotentMethod indica si copiar la request no duplica escrituras en el shadow.
+func idempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// MirrorSample es una request copiada con el resultado de ambas instancias.
+type MirrorSample struct {
+	Time          time.Time `json:"time"`
+	Method        string    `json:"method"`
+	Path          string    `json:"path"`
+	PrimaryStatus int       `json:"primary_status"`
+	ShadowStatus  int       `json:"shadow_status,omitempty"`
+	PrimaryMs     float64   `json:"primary_ms"`
+	ShadowMs      float64   `json:"shadow_ms,omitempty"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// MirrorStats acumula las diferencias entre primaria y shadow.
+type MirrorStats struct {
+	Mirrored         int64            `json:"mirrored"`
+	Skipped          int64            `json:"skipped"`
+	ShadowErrors     int64            `json:"shadow_errors"`
+	StatusMatches    int64            `json:"status_matches"`
+	StatusMismatches int64            `json:"status_mismatches"`
+	Mismatches       map[string]int64 `json:"mismatches"`
+	PrimaryMsSum     float64          `json:"primary_ms_sum"`
+	ShadowMsSum      float64          `json:"shadow_ms_sum"`
+	AvgLatencyDiffMs float64          `json:"avg_latency_diff_ms"`
+	Recent           []MirrorSample   `json:"recent"`
+
+	// primaryCompared suma la latencia primaria solo de las copias que respondieron.
+	primaryCompared float64
+}
+
+type mirrorer struct {
+	mu       sync.Mutex
+	stats    map[string]*MirrorStats
+	inflight chan struct{}
+	client   *http.Client
+	sample   func() float64
+}
+
+func newMirrorer() *mirrorer {
+	return &mirrorer{
+		stats:    make(map[string]*MirrorStats),
+		inflight: make(chan struct{}, mirrorMaxInFlight),
+		client:   &http.Client{Timeout: mirrorTimeout},
+		sample:   func() float64 { return rand.Float64() * 100 },
+	}
+}
+
+func (m *mirrorer) entry(id string) *MirrorStats {
+	s, ok := m.stats[id]
+	if !ok {
+		s = &MirrorStats{Mismatches: map[string]int64{}, Recent: []MirrorSample{}}
+		m.stats[id] = s
+	}
+	return s
+}
+
+func (m *mirrorer) skip(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entry(id).Skipped++
+}
+
+func (m *mirrorer) record(id string, sample MirrorSample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.entry(id)
+	s.Mirrored++
+	s.PrimaryMsSum += sample.PrimaryMs
+	if sample.Error != "" {
+		s.ShadowErrors++
+	} else {
+		s.ShadowMsSum += sample.ShadowMs
+		s.primaryCompared += sample.PrimaryMs
+		if sample.ShadowStatus == sample.PrimaryStatus {
+			s.StatusMatches++
+		} else {
+			s.StatusMismatches++
+			s.Mismatches[strconv.Itoa(sample.PrimaryStatus)+"->"+strconv.Itoa(sample.ShadowStatus)]++
+		}
+	}
+	if compared := s.Mirrored - s.ShadowErrors; compared > 0 {
+		s.AvgLatencyDiffMs = (s.ShadowMsSum - s.primaryCompared) / float64(compared)
+	}
+
+	s.Recent = append(s.Recent, sample)
+	if len(s.Recent) > mirrorSampleHistory {
+		s.Recent = s.Recent[len(s.Recent)-mirrorSampleHistory:]
+	}
+}
+
+func (m *mirrorer) snapshot(id string) MirrorStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := *m.entry(id)
+	s.Mismatches = make(map[string]int64, len(m.stats[id].Mismatches))
+	for k, v := range m.stats[id].Mismatches {
+		s.Mismatches[k] = v
+	}
+	s.Recent = append([]MirrorSample(nil), m.stats[id].Recent...)
+	return s
+}
+
+func (m *mirrorer) reset(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.stats, id)
+}
+
+// shadowRequest es la copia de la request tomada antes de reenviarla a la primaria.
+type shadowRequest struct {
+	rule    storage.MirrorRule
+	source  string
+	service string
+	method  string
+	path    string
+	query   string
+	header  http.Header
+	body    []byte
+}
+
+// prepareMirror decide si la request se copia y guarda su body (hasta el limite)
+// sin consumir el de la primaria.
+func (h *Handler) prepareMirror(c *gin.Context, id string, rule *storage.MirrorRule, service string, path string) *shadowRequest {
+	// Una request que ya es copia no se vuelve a copiar.
+	if rule == nil || rule.TargetInstanceID == "" || c.GetHeader(shadowHeader) != "" {
+		return nil
+	}
+	// Por defecto solo se copian lecturas; repetir escrituras las duplica.
+	if !rule.MirrorWrites && !idempotentMethod(c.Request.Method) {
+		return nil
+	}
+	if h.mirror.sample() >= rule.Percent {
+		return nil
+	}
+
+	limit := rule.MaxBodyBytes
+	if limit <= 0 {
+		limit = defaultMirrorMaxBody
+	}
+	if c.Request.ContentLength > limit {
+		h.mirror.skip(id)
+		return nil
+	}
+
+	var body []byte
+	if c.Request.Body != nil && c.Request.Body != http.NoBody {
+		buf, err := io.ReadAll(io.LimitReader(c.Request.Body, limit+1))
+		rest := c.Request.Body
+		c.Request.Body = readCloser{io.MultiReader(bytes.NewReader(buf), rest), rest}
+		if err != nil || int64(len(buf)) > limit {
+			h.mirror.skip(id)
+			return nil
+		}
+		body = buf
+	}
+
+	return &shadowRequest{
+		rule:    *rule,
+		source:  id,
+		service: service,
+		method:  c.Request.Method,
+		path:    path,
+		query:   c.Request.URL.RawQuery,
+		header:  mirrorHeader(c.Request.Header),
+		body:    body,
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// sendShadow envia la copia en segundo plano; si hay demasiadas en curso se descarta.
+func (h *Handler) sendShadow(s *shadowRequest, primaryStatus int, primaryLatency time.Duration) {
+	select {
+	case h.mirror.inflight <- struct{}{}:
+	default:
+		h.mirror.skip(s.source)
+		return
+	}
+
+	go func() {
+		defer func() { <-h.mirror.inflight }()
+
+		sample := MirrorSample{
+			Time:          time.Now().UTC(),
+			Method:        s.method,
+			Path:          s.path,
+			PrimaryStatus: primaryStatus,
+			PrimaryMs:     float64(primaryLatency.Microseconds()) / 1000,
+		}
+
+		status, latency, err := h.replay(s)
+		if err != nil {
+			sample.Error = err.Error()
+		} else {
+			sample.ShadowStatus = status
+			sample.ShadowMs = float64(latency.Microseconds()) / 1000
+		}
+		h.mirror.record(s.source, sample)
+	}()
+}
+
+func (h *Handler) replay(s *shadowRequest) (int, time.Duration, error) {
+	route, found, err := h.store.GetRouteRecord(s.rule.TargetInstanceID)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !found {
+		return 0, 0, errors.New("shadow route not found")
+	}
+
+	var target string
+	for _, b := range route.LiveBackends(time.Now()) {
+		if port, ok := b.ServicePort(s.service, route.DefaultService); ok {
+			target = "http://" + (storage.Backend{Host: b.Host, Port: port}).Key()
+			break
+		}
+	}
+	if target == "" {
+		return 0, 0, errors.New("shadow has no live backends")
+	}
+
+	u := target + singleJoiningSlash("", s.path)
+	if s.query != "" {
+		u += "?" + s.query
+	}
+	req, err := http.NewRequest(s.method, u, bytes.NewReader(s.body))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header = s.header
+	req.Header.Set(shadowHeader, "1")
+	req.ContentLength = int64(len(s.body))
+
+	start := time.Now()
+	resp, err := h.mirror.client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, time.Since(start), nil
+}
+
+type mirrorReq struct {
+	TargetInstanceID string  `json:"target_instance_id" binding:"required"`
+	Percent          float64 `json:"percent"`
+	MaxBodyBytes     int64   `json:"max_body_bytes"`
+	MirrorWrites     bool    `json:"mirror_writes"`
+}
+
+func (h *Handler) getMirror(c *gin.Context) {
+	id, ok := h.requireInstance(c)
+	if !ok {
+		return
+	}
+
+	route, found, err := h.store.GetRouteRecord(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "instance route not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"instance_id": id,
+		"mirror":      route.Mirror,
+		"stats":       h.mirror.snapshot(id),
+	})
+}
+
+func (h *Handler) putMirror(c *gin.Context) {
+	id, ok := h.requireInstance(c)
+	if !ok {
+		return
+	}
+
+	var req mirrorReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+
+	if req.TargetInstanceID == id {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "target_instance_id must be a different instance"})
+		return
+	}
+	if h.instanceStore != nil {
+		target, err := h.instanceStore.GetByID(req.TargetInstanceID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": "target instance not found"})
+			return
+		}
+		// El shadow recibe trafico real, asi que debe ser del mismo producto.
+		primary, err := h.instanceStore.GetByID(id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+			return
+		}
+		if target.ProductID != primary.ProductID {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": "target instance must belong to the same product"})
+			return
+		}
+	}
+	if req.Percent <= 0 || req.Percent > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "percent must be greater than 0 and at most 100"})
+		return
+	}
+	if req.MaxBodyBytes < 0 || req.MaxBodyBytes > maxMirrorMaxBody {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "max_body_bytes must be between 0 and 10485760"})
+		return
+	}
+	if req.MaxBodyBytes == 0 {
+		req.MaxBodyBytes = defaultMirrorMaxBody
+	}
+
+	rule := &storage.MirrorRule{
+		TargetInstanceID: req.TargetInstanceID,
+		Percent:          req.Percent,
+		MaxBodyBytes:     req.MaxBodyBytes,
+		MirrorWrites:     req.MirrorWrites,
+		CreatedAt:        time.Now().UTC(),
+	}
+	before, _, _ := h.store.GetRouteRecord(id)
+	if err := h.store.SetMirror(id, rule); err != nil {
+		if errors.Is(err, storage.ErrRouteNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"detail": "instance route not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+	h.mirror.reset(id)
+	audit.Record(c, id, gin.H{"mirror": before.Mirror}, gin.H{"mirror": rule})
+
+	c.JSON(http.StatusOK, gin.H{"instance_id": id, "mirror": rule})
+}
+
+func (h *Handler) deleteMirror(c *gin.Context) {
+	id, ok := h.requireInstance(c)
+	if !ok {
+		return
+	}
+
+	before, _, _ := h.store.GetRouteRecord(id)
+	if err := h.store.SetMirror(id, nil); err != nil {
+		if errors.Is(err, storage.ErrRouteNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"detail": "instance route not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+
+	stats := h.mirror.snapshot(id)
+	h.mirror.reset(id)
+	audit.Record(c, id, gin.H{"mirror": before.Mirror}, gin.H{"mirror": nil})
+	c.JSON(http.StatusOK, gin.H{"instance_id": id, "mirror": nil, "stats": stats})
+}
@@ -0,0 +1,148 @@
+package instances
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"ark_deploy/internal/metrics"
+	"ark_deploy/internal/storage"
+)
+
+// Metricas y access log de cada request que pasa por el proxy.
+
+type AccessLogStore interface {
+	Append(instanceID string, e storage.AccessLogEntry) error
+	List(instanceID string, limit int, before string) ([]storage.AccessLogEntry, error)
+}
+
+// WithMetrics habilita las metricas por instancia.
+func (h *Handler) WithMetrics(reg *metrics.Registry) *Handler {
+	h.metrics = reg
+	return h
+}
+
+// accessLogQueueSize acota las entradas pendientes de escribir: con el store
+// lento o caido se descartan en vez de acumular goroutines.
+const accessLogQueueSize = 1024
+
+type accessLogItem struct {
+	instanceID string
+	entry      storage.AccessLogEntry
+}
+
+// WithAccessLog habilita el access log por instancia. Un solo worker escribe
+// las entradas en orden.
+func (h *Handler) WithAccessLog(store AccessLogStore) *Handler {
+	h.accessLog = store
+	h.logQueue = make(chan accessLogItem, accessLogQueueSize)
+	go writeAccessLog(store, h.logQueue)
+	return h
+}
+
+func writeAccessLog(store AccessLogStore, queue <-chan accessLogItem) {
+	for item := range queue {
+		if err := store.Append(item.instanceID, item.entry); err != nil {
+			log.Printf("access log %s: %v", item.instanceID, err)
+		}
+	}
+}
+
+// observe registra la request ya respondida; se llama con defer desde serveRoute.
+// host y path son los publicos, antes de reescribirlos hacia el upstream.
+func (h *Handler) observe(c *gin.Context, id string, host string, path string, started time.Time) {
+	if h.metrics == nil && h.accessLog == nil {
+		return
+	}
+
+	elapsed := time.Since(started)
+	status := c.Writer.Status()
+	bytesOut := int64(c.Writer.Size())
+	if bytesOut < 0 {
+		bytesOut = 0
+	}
+	bytesIn := c.Request.ContentLength
+	if bytesIn < 0 {
+		bytesIn = 0
+	}
+
+	if h.metrics != nil {
+		h.metrics.Observe(id, status, bytesIn, bytesOut, elapsed)
+	}
+
+	if h.accessLog != nil {
+		entry := storage.AccessLogEntry{
+			Time:       started.UTC(),
+			Method:     c.Request.Method,
+			Host:       host,
+			Path:       path,
+			Query:      c.Request.URL.RawQuery,
+			Status:     status,
+			BytesIn:    bytesIn,
+			BytesOut:   bytesOut,
+			DurationMs: float64(elapsed.Microseconds()) / 1000,
+			ClientIP:   c.ClientIP(),
+			UserAgent:  c.Request.UserAgent(),
+			Referer:    c.Request.Referer(),
+		}
+		select {
+		case h.logQueue <- accessLogItem{instanceID: id, entry: entry}:
+		default:
+			// Cola llena: se pierde la entrada, no la request.
+		}
+	}
+}
+
+func (h *Handler) instanceMetrics(c *gin.Context) {
+	id, ok := h.requireInstance(c)
+	if !ok {
+		return
+	}
+	if h.metrics == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"detail": "metrics are not enabled"})
+		return
+	}
+	c.JSON(http.StatusOK, h.metrics.Snapshot(id))
+}
+
+func (h *Handler) accessLogEntries(c *gin.Context) {
+	id, ok := h.requireInstance(c)
+	if !ok {
+		return
+	}
+	if h.accessLog == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"detail": "access log is not enabled"})
+		return
+	}
+
+	limit := 100
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 || n > 1000 {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": "limit must be between 1 and 1000"})
+			return
+		}
+		limit = n
+	}
+
+	entries, err := h.accessLog.List(id, limit, c.Query("before"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+
+	next := ""
+	if len(entries) == limit {
+		next = entries[len(entries)-1].ID
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"instance_id": id,
+		"total":       len(entries),
+		"entries":     entries,
+		"next_before": next,
+	})
+}
@@ -0,0 +1,332 @@
+package instances
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"ark_deploy/internal/audit"
+	"ark_deploy/internal/storage"
+)
+
+// Rate limiting del proxy: token bucket por instancia y por IP de origen,
+// tamaño maximo del body y requests concurrentes hacia el upstream.
+// Los defaults vienen del producto y la ruta puede sobreescribirlos.
+
+// productLimitsTTL es cuanto se cachean los limites del producto por instancia.
+const productLimitsTTL = 30 * time.Second
+
+// maxBuckets acota los buckets en memoria. Pasado el limite no se crean
+// buckets por IP nuevos (sigue valiendo el de la instancia) hasta el proximo sweep.
+const maxBuckets = 100000
+
+type ProductStore interface {
+	GetByID(id string) (storage.Product, error)
+}
+
+// WithProductStore habilita los limites por defecto definidos en el producto.
+func (h *Handler) WithProductStore(ps ProductStore) *Handler {
+	h.products = ps
+	return h
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// take consume un token; si no hay devuelve cuanto esperar.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := (1 - b.tokens) / b.rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// refund devuelve el token tomado cuando otro limite rechazo la request.
+func (b *tokenBucket) refund() {
+	b.tokens = math.Min(b.burst, b.tokens+1)
+}
+
+type cachedLimits struct {
+	limits  storage.RateLimit
+	expires time.Time
+}
+
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	inflight  map[string]int
+	products  map[string]cachedLimits
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets:  make(map[string]*tokenBucket),
+		inflight: make(map[string]int),
+		products: make(map[string]cachedLimits),
+		now:      time.Now,
+	}
+}
+
+// allow aplica el bucket de la IP y despues el de la instancia: una IP que ya
+// paso su limite no consume el cupo compartido por los demas clientes.
+func (l *rateLimiter) allow(id string, ip string, limits storage.RateLimit) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	var perIP *tokenBucket
+	if limits.PerIPRequestsPerSecond > 0 && ip != "" {
+		key := id + "|" + ip
+		tracked := true
+		if _, ok := l.buckets[key]; !ok && len(l.buckets) >= maxBuckets {
+			l.lastSweep = time.Time{}
+			l.sweep(now)
+			tracked = len(l.buckets) < maxBuckets
+		}
+		if tracked {
+			perIP = l.bucket(key, limits.PerIPRequestsPerSecond, limits.PerIPBurst, now)
+			if ok, wait := perIP.take(now); !ok {
+				return false, wait
+			}
+		}
+	}
+	if limits.RequestsPerSecond > 0 {
+		if ok, wait := l.bucket(id, limits.RequestsPerSecond, limits.Burst, now).take(now); !ok {
+			if perIP != nil {
+				perIP.refund()
+			}
+			return false, wait
+		}
+	}
+	return true, 0
+}
+
+// bucket devuelve el bucket de la clave; si cambio la configuracion lo reinicia.
+func (l *rateLimiter) bucket(key string, rate float64, burst int, now time.Time) *tokenBucket {
+	b := float64(burst)
+	if b < 1 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	tb, ok := l.buckets[key]
+	if !ok || tb.rate != rate || tb.burst != b {
+		tb = &tokenBucket{rate: rate, burst: b, tokens: b, last: now}
+		l.buckets[key] = tb
+	}
+	return tb
+}
+
+// sweep descarta, como mucho una vez por minuto, los buckets que ya se
+// rellenaron (equivalen a uno nuevo) y los limites de producto vencidos.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst {
+			delete(l.buckets, key)
+		}
+	}
+	for id, cached := range l.products {
+		if !now.Before(cached.expires) {
+			delete(l.products, id)
+		}
+	}
+}
+
+// acquire reserva un slot de concurrencia; release debe llamarse al terminar.
+func (l *rateLimiter) acquire(id string, max int) (release func(), ok bool) {
+	if max <= 0 {
+		return func() {}, true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.inflight[id] >= max {
+		return nil, false
+	}
+	l.inflight[id]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.inflight[id]--; l.inflight[id] <= 0 {
+				delete(l.inflight, id)
+			}
+		})
+	}, true
+}
+
+// effectiveLimits combina los defaults del producto con el override de la ruta.
+func (h *Handler) effectiveLimits(route storage.Route) storage.RateLimit {
+	return h.productLimits(route.InstanceID).Merge(route.Limits)
+}
+
+func (h *Handler) productLimits(id string) storage.RateLimit {
+	if h.products == nil || h.instanceStore == nil {
+		return storage.RateLimit{}
+	}
+
+	l := h.limiter
+	now := l.now()
+	l.mu.Lock()
+	cached, ok := l.products[id]
+	l.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.limits
+	}
+
+	var limits storage.RateLimit
+	if instance, err := h.instanceStore.GetByID(id); err == nil {
+		if product, err := h.products.GetByID(instance.ProductID); err == nil && product.RateLimit != nil {
+			limits = *product.RateLimit
+		}
+	}
+
+	l.mu.Lock()
+	l.products[id] = cachedLimits{limits: limits, expires: now.Add(productLimitsTTL)}
+	l.mu.Unlock()
+	return limits
+}
+
+// enforceLimits aplica los limites de la ruta; si la request no pasa ya quedo
+// respondida. release libera el slot de concurrencia.
+func (h *Handler) enforceLimits(c *gin.Context, route storage.Route) (release func(), ok bool) {
+	id := route.InstanceID
+	limits := h.effectiveLimits(route)
+
+	if limits.MaxBodyBytes > 0 {
+		if c.Request.ContentLength > limits.MaxBodyBytes {
+			h.renderProxyError(c, http.StatusRequestEntityTooLarge, id, "request body too large")
+			return nil, false
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limits.MaxBodyBytes)
+	}
+
+	if allowed, wait := h.limiter.allow(id, c.ClientIP(), limits); !allowed {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		h.renderProxyError(c, http.StatusTooManyRequests, id, "rate limit exceeded")
+		return nil, false
+	}
+
+	release, ok = h.limiter.acquire(id, limits.MaxConcurrent)
+	if !ok {
+		c.Header("Retry-After", "1")
+		h.renderProxyError(c, http.StatusTooManyRequests, id, "too many concurrent requests")
+		return nil, false
+	}
+	return release, true
+}
+
+type limitsView struct {
+	InstanceID string             `json:"instance_id"`
+	Product    *storage.RateLimit `json:"product,omitempty"`
+	Override   *storage.RateLimit `json:"override,omitempty"`
+	Effective  storage.RateLimit  `json:"effective"`
+}
+
+func (h *Handler) respondLimits(c *gin.Context, route storage.Route) {
+	product := h.productLimits(route.InstanceID)
+	view := limitsView{
+		InstanceID: route.InstanceID,
+		Override:   route.Limits,
+		Effective:  product.Merge(route.Limits),
+	}
+	if !product.IsZero() {
+		view.Product = &product
+	}
+	c.JSON(http.StatusOK, view)
+}
+
+func (h *Handler) getLimits(c *gin.Context) {
+	id, ok := h.requireInstance(c)
+	if !ok {
+		return
+	}
+
+	route, found, err := h.store.GetRouteRecord(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "instance route not found"})
+		return
+	}
+
+	h.respondLimits(c, route)
+}
+
+func (h *Handler) putLimits(c *gin.Context) {
+	id, ok := h.requireInstance(c)
+	if !ok {
+		return
+	}
+
+	var req storage.RateLimit
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+	if err := req.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+
+	var override *storage.RateLimit
+	if !req.IsZero() {
+		override = &req
+	}
+	h.saveLimits(c, id, override)
+}
+
+func (h *Handler) deleteLimits(c *gin.Context) {
+	id, ok := h.requireInstance(c)
+	if !ok {
+		return
+	}
+	h.saveLimits(c, id, nil)
+}
+
+func (h *Handler) saveLimits(c *gin.Context, id string, override *storage.RateLimit) {
+	before, _, _ := h.store.GetRouteRecord(id)
+	if err := h.store.SetLimits(id, override); err != nil {
+		if errors.Is(err, storage.ErrRouteNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"detail": "instance route not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+
+	audit.Record(c, id, gin.H{"limits": before.Limits}, gin.H{"limits": override})
+
+	route, _, err := h.store.GetRouteRecord(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+	h.respondLimits(c, route)
+}
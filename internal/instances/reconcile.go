@@ -0,0 +1,105 @@
+package instances
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"ark_deploy/internal/jenkins"
+	"ark_deploy/internal/storage"
+)
+
+// Reconciler de rutas: si el build de una instancia termino bien pero el callback
+// a /instances/register nunca llego, la ruta se recupera del payload que el
+// pipeline archiva como artefacto (deploy_callback_payload.json).
+
+type ArtifactSource interface {
+	ReadBuildStatus(jobName string, buildNumber int) (bool, string, error)
+	GetArtifact(jobName string, buildNumber int, relativePath string) ([]byte, error)
+}
+
+type InstanceLister interface {
+	GetAll() []storage.Instance
+}
+
+// ReconcileRoutes registra las rutas perdidas y devuelve cuantas recupero.
+// tried evita volver a consultar builds que ya se revisaron sin exito definitivo.
+func (h *Handler) ReconcileRoutes(instances InstanceLister, source ArtifactSource, tried map[string]bool) int {
+	recovered := 0
+	for _, inst := range instances.GetAll() {
+		// El callback pasa la instancia a running; si sigue provisioning no llego.
+		if inst.Status != "provisioning" {
+			continue
+		}
+		if _, found, err := h.store.GetRouteRecord(inst.ID); err != nil || found {
+			continue
+		}
+
+		for job, build := range inst.Builds {
+			key := inst.ID + "|" + job + "#" + build
+			if tried[key] {
+				continue
+			}
+			n, err := strconv.Atoi(strings.TrimSpace(build))
+			if err != nil || n <= 0 {
+				continue
+			}
+
+			building, result, err := source.ReadBuildStatus(job, n)
+			if err != nil || building {
+				continue
+			}
+			tried[key] = true
+			if result != "SUCCESS" {
+				continue
+			}
+
+			raw, err := source.GetArtifact(job, n, jenkins.CallbackPayloadArtifact)
+			if err != nil {
+				log.Printf("route reconciler: %s %s#%d: %v", inst.ID, job, n, err)
+				continue
+			}
+
+			var req RegisterReq
+			if err := json.Unmarshal(raw, &req); err != nil {
+				log.Printf("route reconciler: %s %s#%d: invalid payload: %v", inst.ID, job, n, err)
+				continue
+			}
+			if strings.TrimSpace(req.InstanceID) != inst.ID {
+				log.Printf("route reconciler: %s %s#%d: payload belongs to %q", inst.ID, job, n, req.InstanceID)
+				continue
+			}
+
+			if _, _, err := h.applyRegistration(req); err != nil {
+				log.Printf("route reconciler: %s %s#%d: %v", inst.ID, job, n, err)
+				continue
+			}
+			log.Printf("route reconciler: recovered route for %s from %s#%d", inst.ID, job, n)
+			recovered++
+			break
+		}
+	}
+	return recovered
+}
+
+// RunRouteReconciler revisa periodicamente las instancias sin ruta.
+func (h *Handler) RunRouteReconciler(ctx context.Context, instances InstanceLister, source ArtifactSource, every time.Duration) {
+	if every <= 0 {
+		every = time.Minute
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	tried := make(map[string]bool)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.ReconcileRoutes(instances, source, tried)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package jenkins
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Artefactos archivados por el pipeline (target_port.txt, deploy_callback_payload.json, ...).
+
+// CallbackPayloadArtifact es el payload que el pipeline envia a /api/instances/register.
+const CallbackPayloadArtifact = "deploy_callback_payload.json"
+
+// maxArtifactSize limita lo que se descarga; los artefactos del pipeline son chicos.
+const maxArtifactSize = 1 << 20
+
+type Artifact struct {
+	FileName     string `json:"file_name"`
+	RelativePath string `json:"relative_path"`
+}
+
+// ListArtifacts devuelve los artefactos archivados del build.
+func (c *Client) ListArtifacts(jobName string, buildNumber int) ([]Artifact, error) {
+	u := fmt.Sprintf("%s/job/%s/%d/api/json?tree=artifacts[fileName,relativePath]",
+		c.baseURL,
+		url.PathEscape(jobName),
+		buildNumber,
+	)
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(c.user, c.token)
+
+	resp, err := c.httpc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("artifacts api failed: status=%d body=%s", resp.StatusCode, string(b))
+	}
+
+	var data struct {
+		Artifacts []struct {
+			FileName     string `json:"fileName"`
+			RelativePath string `json:"relativePath"`
+		} `json:"artifacts"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+
+	out := make([]Artifact, 0, len(data.Artifacts))
+	for _, a := range data.Artifacts {
+		out = append(out, Artifact{FileName: a.FileName, RelativePath: a.RelativePath})
+	}
+	return out, nil
+}
+
+// GetArtifact descarga un artefacto del build por su ruta relativa.
+func (c *Client) GetArtifact(jobName string, buildNumber int, relativePath string) ([]byte, error) {
+	relativePath = strings.TrimLeft(relativePath, "/")
+	if relativePath == "" || strings.Contains(relativePath, "..") {
+		return nil, fmt.Errorf("invalid artifact path: %q", relativePath)
+	}
+
+	parts := strings.Split(relativePath, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+
+	u := fmt.Sprintf("%s/job/%s/%d/artifact/%s",
+		c.baseURL,
+		url.PathEscape(jobName),
+		buildNumber,
+		strings.Join(parts, "/"),
+	)
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(c.user, c.token)
+
+	resp, err := c.httpc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("artifact download failed: status=%d body=%s", resp.StatusCode, string(b))
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxArtifactSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxArtifactSize {
+		return nil, fmt.Errorf("artifact %s exceeds %d bytes", relativePath, maxArtifactSize)
+	}
+	return b, nil
+}
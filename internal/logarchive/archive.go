@@ -0,0 +1,577 @@
+package logarchive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// Archivo local de logs de builds: cada consola terminada se guarda comprimida
+// (builds/<job>/<build>.log.gz) y sus palabras entran a un indice invertido
+// palabra -> builds. La busqueda usa el indice para descartar builds y solo
+// descomprime los candidatos para devolver las lineas. Con un tamaño maximo
+// se descartan los builds mas viejos al superarlo. El indice se persiste por
+// tandas con Flush; un build que no llego a persistirse se vuelve a archivar.
+
+const (
+	indexFile     = "index.gob.gz"
+	minTokenLen   = 2
+	maxTokenLen   = 64
+	maxLineLength = 500
+
+	DefaultSearchLimit = 100
+	MaxSearchLimit     = 1000
+)
+
+var ErrEmptyQuery = errors.New("query must contain at least one word of 2 or more characters")
+
+// Doc es un build archivado.
+type Doc struct {
+	ID          int       `json:"-"`
+	InstanceID  string    `json:"instance_id"`
+	ProductID   string    `json:"product_id"`
+	Environment string    `json:"environment"`
+	Job         string    `json:"job"`
+	Build       string    `json:"build"`
+	Result      string    `json:"result"`
+	Lines       int       `json:"lines"`
+	Bytes       int64     `json:"bytes"`
+	StoredBytes int64     `json:"stored_bytes"`
+	ArchivedAt  time.Time `json:"archived_at"`
+}
+
+func docKey(job string, build string) string {
+	return job + "#" + build
+}
+
+// Query filtra la busqueda; Text es obligatorio, el resto opcional.
+type Query struct {
+	Text       string
+	ProductID  string
+	InstanceID string
+	Job        string
+	Since      time.Time
+	Limit      int
+}
+
+// Match es una linea que contiene todas las palabras buscadas.
+type Match struct {
+	Doc
+	LineNumber int    `json:"line_number"`
+	Line       string `json:"line"`
+}
+
+type indexData struct {
+	NextID   int
+	Docs     map[int]Doc
+	Postings map[string][]int
+}
+
+type Archive struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.RWMutex
+	index indexData
+	byKey map[string]int
+	total int64
+
+	// dirty indica cambios del indice sin persistir; saveMu serializa Flush.
+	dirty  atomic.Bool
+	saveMu sync.Mutex
+}
+
+// Open carga (o crea) el archivo en dir. maxBytes limita el espacio comprimido
+// en disco; 0 = sin limite.
+func Open(dir string, maxBytes int64) (*Archive, error) {
+	if strings.TrimSpace(dir) == "" {
+		return nil, errors.New("log archive dir is required")
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "builds"), 0o755); err != nil {
+		return nil, err
+	}
+
+	a := &Archive{
+		dir:      dir,
+		maxBytes: maxBytes,
+		index:    indexData{NextID: 1, Docs: map[int]Doc{}, Postings: map[string][]int{}},
+		byKey:    map[string]int{},
+	}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *Archive) load() error {
+	f, err := os.Open(filepath.Join(a.dir, indexFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("log archive index: %w", err)
+	}
+	defer zr.Close()
+
+	var data indexData
+	if err := gob.NewDecoder(zr).Decode(&data); err != nil {
+		return fmt.Errorf("log archive index: %w", err)
+	}
+	if data.Docs == nil {
+		data.Docs = map[int]Doc{}
+	}
+	if data.Postings == nil {
+		data.Postings = map[string][]int{}
+	}
+	a.index = data
+	for id, d := range data.Docs {
+		a.byKey[docKey(d.Job, d.Build)] = id
+		a.total += d.StoredBytes
+		a.migrateLegacyPath(d)
+	}
+	return nil
+}
+
+// migrateLegacyPath mueve los logs guardados con el nombre anterior, que
+// reemplazaba los caracteres raros por '_' y podia colisionar.
+func (a *Archive) migrateLegacyPath(d Doc) {
+	path := a.logPath(d.Job, d.Build)
+	if _, err := os.Stat(path); err == nil {
+		return
+	}
+	legacy := filepath.Join(a.dir, "builds", legacySafeName(d.Job), legacySafeName(d.Build)+".log.gz")
+	if _, err := os.Stat(legacy); err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err == nil {
+		_ = os.Rename(legacy, path)
+	}
+}
+
+// Flush persiste el indice si cambio desde la ultima vez. Las busquedas siguen
+// mientras se escribe; solo se frenan los Add.
+func (a *Archive) Flush() error {
+	a.saveMu.Lock()
+	defer a.saveMu.Unlock()
+
+	if !a.dirty.Swap(false) {
+		return nil
+	}
+	a.mu.RLock()
+	err := a.save()
+	a.mu.RUnlock()
+	if err != nil {
+		a.dirty.Store(true)
+	}
+	return err
+}
+
+// save reescribe el indice de forma atomica (tmp + rename). Requiere mu tomado.
+func (a *Archive) save() error {
+	tmp, err := os.CreateTemp(a.dir, indexFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	zw := gzip.NewWriter(tmp)
+	if err := gob.NewEncoder(zw).Encode(a.index); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(a.dir, indexFile))
+}
+
+func (a *Archive) logPath(job string, build string) string {
+	return filepath.Join(a.dir, "builds", safeName(job), safeName(build)+".log.gz")
+}
+
+// Has indica si el build ya fue archivado.
+func (a *Archive) Has(job string, build string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	_, ok := a.byKey[docKey(job, build)]
+	return ok
+}
+
+// Add comprime el log del build y lo indexa. Archivar dos veces el mismo build
+// no hace nada. La compresion y el tokenizado se hacen fuera del lock; el
+// indice queda en memoria hasta el proximo Flush.
+func (a *Archive) Add(doc Doc, log string) error {
+	if doc.Job == "" || doc.Build == "" {
+		return errors.New("job and build are required")
+	}
+	if a.Has(doc.Job, doc.Build) {
+		return nil
+	}
+
+	path := a.logPath(doc.Job, doc.Build)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, stored, err := writeGzipTemp(filepath.Dir(path), log)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	tokens := tokenize(log)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Otro Add del mismo build pudo ganar mientras se comprimia.
+	if _, ok := a.byKey[docKey(doc.Job, doc.Build)]; ok {
+		return nil
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	doc.ID = a.index.NextID
+	doc.Bytes = int64(len(log))
+	doc.StoredBytes = stored
+	doc.Lines = strings.Count(log, "\n")
+	if log != "" && !strings.HasSuffix(log, "\n") {
+		doc.Lines++
+	}
+	if doc.ArchivedAt.IsZero() {
+		doc.ArchivedAt = time.Now().UTC()
+	}
+
+	a.index.NextID++
+	a.index.Docs[doc.ID] = doc
+	a.byKey[docKey(doc.Job, doc.Build)] = doc.ID
+	for token := range tokens {
+		a.index.Postings[token] = append(a.index.Postings[token], doc.ID)
+	}
+	a.total += stored
+
+	a.enforceRetentionLocked(doc.ID)
+	a.dirty.Store(true)
+	return nil
+}
+
+// Get devuelve la consola archivada del build.
+func (a *Archive) Get(job string, build string) (string, bool, error) {
+	if !a.Has(job, build) {
+		return "", false, nil
+	}
+
+	content, err := readGzip(a.logPath(job, build))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return content, true, nil
+}
+
+// enforceRetentionLocked descarta los builds mas viejos hasta entrar en maxBytes.
+// El build recien agregado nunca se descarta.
+func (a *Archive) enforceRetentionLocked(keep int) {
+	if a.maxBytes <= 0 || a.total <= a.maxBytes {
+		return
+	}
+
+	docs := make([]Doc, 0, len(a.index.Docs))
+	for _, d := range a.index.Docs {
+		if d.ID != keep {
+			docs = append(docs, d)
+		}
+	}
+	sort.Slice(docs, func(i, j int) bool {
+		if !docs[i].ArchivedAt.Equal(docs[j].ArchivedAt) {
+			return docs[i].ArchivedAt.Before(docs[j].ArchivedAt)
+		}
+		return docs[i].ID < docs[j].ID
+	})
+
+	for _, d := range docs {
+		if a.total <= a.maxBytes {
+			return
+		}
+		a.removeLocked(d)
+	}
+}
+
+// removeLocked borra el log del disco y lo saca del indice.
+func (a *Archive) removeLocked(d Doc) {
+	path := a.logPath(d.Job, d.Build)
+	if content, err := readGzip(path); err == nil {
+		for token := range tokenize(content) {
+			a.index.Postings[token] = removeID(a.index.Postings[token], d.ID)
+			if len(a.index.Postings[token]) == 0 {
+				delete(a.index.Postings, token)
+			}
+		}
+	} else {
+		for token, ids := range a.index.Postings {
+			if ids = removeID(ids, d.ID); len(ids) == 0 {
+				delete(a.index.Postings, token)
+			} else {
+				a.index.Postings[token] = ids
+			}
+		}
+	}
+	_ = os.Remove(path)
+
+	delete(a.index.Docs, d.ID)
+	delete(a.byKey, docKey(d.Job, d.Build))
+	a.total -= d.StoredBytes
+}
+
+func removeID(ids []int, id int) []int {
+	for i, v := range ids {
+		if v == id {
+			return append(ids[:i], ids[i+1:]...)
+		}
+	}
+	return ids
+}
+
+// Search devuelve las lineas que contienen todas las palabras de q.Text, de los
+// builds mas nuevos a los mas viejos. more indica que se corto por el limite.
+// Si q.Text va entre comillas ademas se exige la frase exacta.
+func (a *Archive) Search(q Query) (matches []Match, more bool, err error) {
+	text := strings.TrimSpace(q.Text)
+	var phrase string
+	if len(text) > 1 && strings.HasPrefix(text, `"`) && strings.HasSuffix(text, `"`) {
+		phrase = strings.ToLower(strings.Trim(text, `"`))
+	}
+	terms := tokenize(text)
+	if len(terms) == 0 {
+		return nil, false, ErrEmptyQuery
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultSearchLimit
+	}
+	if limit > MaxSearchLimit {
+		limit = MaxSearchLimit
+	}
+
+	candidates := a.candidates(terms, q)
+
+	matches = []Match{}
+	for _, doc := range candidates {
+		found, err := a.scan(doc, terms, phrase, limit-len(matches)+1)
+		if err != nil {
+			return nil, false, err
+		}
+		matches = append(matches, found...)
+		if len(matches) > limit {
+			return matches[:limit], true, nil
+		}
+	}
+	return matches, false, nil
+}
+
+// candidates intersecta las listas del indice y aplica los filtros de metadata.
+func (a *Archive) candidates(terms map[string]struct{}, q Query) []Doc {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	var ids map[int]struct{}
+	for term := range terms {
+		postings := a.index.Postings[term]
+		next := make(map[int]struct{}, len(postings))
+		for _, id := range postings {
+			if ids == nil {
+				next[id] = struct{}{}
+			} else if _, ok := ids[id]; ok {
+				next[id] = struct{}{}
+			}
+		}
+		ids = next
+		if len(ids) == 0 {
+			return nil
+		}
+	}
+
+	docs := make([]Doc, 0, len(ids))
+	for id := range ids {
+		d := a.index.Docs[id]
+		if q.ProductID != "" && d.ProductID != q.ProductID {
+			continue
+		}
+		if q.InstanceID != "" && d.InstanceID != q.InstanceID {
+			continue
+		}
+		if q.Job != "" && d.Job != q.Job {
+			continue
+		}
+		if !q.Since.IsZero() && d.ArchivedAt.Before(q.Since) {
+			continue
+		}
+		docs = append(docs, d)
+	}
+
+	sort.Slice(docs, func(i, j int) bool {
+		if !docs[i].ArchivedAt.Equal(docs[j].ArchivedAt) {
+			return docs[i].ArchivedAt.After(docs[j].ArchivedAt)
+		}
+		return docs[i].ID > docs[j].ID
+	})
+	return docs
+}
+
+// scan descomprime el log del build y devuelve hasta max lineas que coinciden.
+func (a *Archive) scan(doc Doc, terms map[string]struct{}, phrase string, max int) ([]Match, error) {
+	f, err := os.Open(a.logPath(doc.Job, doc.Build))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var out []Match
+	sc := bufio.NewScanner(zr)
+	sc.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	n := 0
+	for sc.Scan() && len(out) < max {
+		n++
+		line := sc.Text()
+		if phrase != "" && !strings.Contains(strings.ToLower(line), phrase) {
+			continue
+		}
+		words := tokenize(line)
+		hit := true
+		for term := range terms {
+			if _, ok := words[term]; !ok {
+				hit = false
+				break
+			}
+		}
+		if !hit {
+			continue
+		}
+		if len(line) > maxLineLength {
+			line = line[:maxLineLength]
+		}
+		out = append(out, Match{Doc: doc, LineNumber: n, Line: line})
+	}
+	return out, sc.Err()
+}
+
+// tokenize separa en palabras (letras, digitos y _) en minusculas.
+func tokenize(s string) map[string]struct{} {
+	out := map[string]struct{}{}
+	for _, w := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	}) {
+		if len(w) >= minTokenLen && len(w) <= maxTokenLen {
+			out[w] = struct{}{}
+		}
+	}
+	return out
+}
+
+// writeGzipTemp guarda content comprimido en un temporal de dir y devuelve su
+// ruta y el tamaño en disco.
+func writeGzipTemp(dir string, content string) (string, int64, error) {
+	f, err := os.CreateTemp(dir, ".tmp-*.log.gz")
+	if err != nil {
+		return "", 0, err
+	}
+	fail := func(err error) (string, int64, error) {
+		f.Close()
+		os.Remove(f.Name())
+		return "", 0, err
+	}
+	zw := gzip.NewWriter(f)
+	if _, err := zw.Write([]byte(content)); err != nil {
+		return fail(err)
+	}
+	if err := zw.Close(); err != nil {
+		return fail(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return fail(err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", 0, err
+	}
+	return f.Name(), info.Size(), nil
+}
+
+func readGzip(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return "", err
+	}
+	defer zr.Close()
+
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// safeName escapa job o build sin perdida: deja letras ASCII, digitos, '-' y
+// '_' y pasa el resto a %XX. Asi no escapan del directorio ni colisionan
+// nombres distintos como "a/b" y "a_b".
+func safeName(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// legacySafeName es el nombre que usaban las versiones anteriores.
+func legacySafeName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, strings.Trim(s, "."))
+}
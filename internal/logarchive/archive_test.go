@@ -0,0 +1,265 @@
+package logarchive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"ark_deploy/internal/storage"
+)
+
+type mockInstances struct {
+	instances []storage.Instance
+}
+
+func (m *mockInstances) GetAll() []storage.Instance {
+	return m.instances
+}
+
+type mockBuilds struct {
+	building map[string]bool
+	logs     map[string]string
+	fetches  map[string]int
+}
+
+func (m *mockBuilds) ReadBuildStatus(jobName string, buildNumber int) (bool, string, error) {
+	return m.building[jobName], "SUCCESS", nil
+}
+
+func (m *mockBuilds) GetBuildLog(jobName string, buildNumber string) (string, error) {
+	m.fetches[jobName]++
+	log, ok := m.logs[jobName]
+	if !ok {
+		return "", errors.New("status=404")
+	}
+	return log, nil
+}
+
+func TestArchiver_ArchivesFinishedBuildsOnce(t *testing.T) {
+	archive, err := Open(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	src := &mockBuilds{
+		building: map[string]bool{"deploy-web": false, "deploy-api": true},
+		logs: map[string]string{
+			"deploy-web": "pulling image\nERROR: connection refused to registry\ndone\n",
+			"deploy-api": "still running\n",
+		},
+		fetches: map[string]int{},
+	}
+	insts := &mockInstances{instances: []storage.Instance{
+		{ID: "i-1", ProductID: "shop", Environment: "prod", Builds: map[string]string{"deploy-web": "7"}},
+		{ID: "i-2", ProductID: "api", Environment: "dev", Builds: map[string]string{"deploy-api": "3", "deploy-old": "0"}},
+	}}
+
+	a := NewArchiver(archive, insts, src, time.Minute)
+	if n := a.ArchiveFinished(context.Background()); n != 1 {
+		t.Fatalf("expected 1 archived build, got %d", n)
+	}
+	if n := a.ArchiveFinished(context.Background()); n != 0 {
+		t.Fatalf("expected no new builds, got %d", n)
+	}
+	if src.fetches["deploy-web"] != 1 || src.fetches["deploy-api"] != 0 {
+		t.Fatalf("unexpected fetches: %v", src.fetches)
+	}
+
+	src.building["deploy-api"] = false
+	if n := a.ArchiveFinished(context.Background()); n != 1 {
+		t.Fatalf("expected api build archived once finished, got %d", n)
+	}
+}
+
+func TestArchive_SearchFiltersAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	archive, err := Open(dir, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	old := time.Now().Add(-10 * 24 * time.Hour)
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	must(archive.Add(Doc{InstanceID: "i-1", ProductID: "shop", Job: "deploy-shop", Build: "1", ArchivedAt: old},
+		"step 1\nError: connection refused\n"))
+	must(archive.Add(Doc{InstanceID: "i-2", ProductID: "shop", Job: "deploy-shop", Build: "2"},
+		"step 1\nrefused? no: connection ok\nERROR connection refused again\n"))
+	must(archive.Add(Doc{InstanceID: "i-3", ProductID: "blog", Job: "deploy-blog", Build: "1"},
+		"error: connection refused\n"))
+
+	matches, more, err := archive.Search(Query{Text: "connection refused"})
+	if err != nil || more {
+		t.Fatalf("search: %v more=%v", err, more)
+	}
+	// Todas las lineas con ambas palabras, builds nuevos primero.
+	if len(matches) != 4 || matches[len(matches)-1].InstanceID != "i-1" {
+		t.Fatalf("unexpected matches: %+v", matches)
+	}
+
+	matches, _, _ = archive.Search(Query{Text: `"connection refused"`, ProductID: "shop", Since: time.Now().Add(-7 * 24 * time.Hour)})
+	if len(matches) != 1 || matches[0].InstanceID != "i-2" || matches[0].LineNumber != 3 {
+		t.Fatalf("unexpected filtered matches: %+v", matches)
+	}
+
+	matches, more, _ = archive.Search(Query{Text: "connection", Limit: 2})
+	if len(matches) != 2 || !more {
+		t.Fatalf("expected limit to truncate, got %d more=%v", len(matches), more)
+	}
+
+	if _, _, err := archive.Search(Query{Text: "a !"}); !errors.Is(err, ErrEmptyQuery) {
+		t.Fatalf("expected ErrEmptyQuery, got %v", err)
+	}
+
+	if err := archive.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	reopened, err := Open(dir, 0)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if !reopened.Has("deploy-blog", "1") {
+		t.Fatalf("expected index to survive reopen")
+	}
+	if matches, _, _ := reopened.Search(Query{Text: "refused", InstanceID: "i-3"}); len(matches) != 1 {
+		t.Fatalf("unexpected matches after reopen: %+v", matches)
+	}
+}
+
+func TestHandler_Search(t *testing.T) {
+	archive, err := Open(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	_ = archive.Add(Doc{InstanceID: "i-1", ProductID: "shop", Job: "deploy-shop", Build: "4"}, "ERROR: disk full\n")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/logs/search", NewHandler(archive).Search)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	if w := get("/api/logs/search"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without q, got %d", w.Code)
+	}
+	if w := get("/api/logs/search?q=disk&since=yesterday"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid since, got %d", w.Code)
+	}
+
+	w := get("/api/logs/search?q=disk+full&product=shop&since=7d")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Total   int     `json:"total"`
+		Matches []Match `json:"matches"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Total != 1 || resp.Matches[0].Job != "deploy-shop" || resp.Matches[0].Build != "4" || resp.Matches[0].Line != "ERROR: disk full" {
+		t.Fatalf("unexpected response: %s", w.Body.String())
+	}
+}
+
+func TestArchive_RetentionDropsOldestBuilds(t *testing.T) {
+	dir := t.TempDir()
+	archive, err := Open(dir, 1)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	base := time.Now().Add(-time.Hour)
+	for i, build := range []string{"1", "2", "3"} {
+		doc := Doc{InstanceID: "i-1", Job: "deploy", Build: build, ArchivedAt: base.Add(time.Duration(i) * time.Minute)}
+		if err := archive.Add(doc, "build "+build+" failed with timeout\n"); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	// Con un limite menor a un build solo queda el ultimo.
+	if archive.Has("deploy", "1") || archive.Has("deploy", "2") || !archive.Has("deploy", "3") {
+		t.Fatalf("expected only the newest build to be kept")
+	}
+	if matches, _, _ := archive.Search(Query{Text: "timeout"}); len(matches) != 1 || matches[0].Build != "3" {
+		t.Fatalf("expected evicted builds out of the index, got %+v", matches)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "builds", "deploy", "1.log.gz")); !os.IsNotExist(err) {
+		t.Fatalf("expected evicted log removed from disk, got %v", err)
+	}
+
+	log, ok, err := archive.Get("deploy", "3")
+	if err != nil || !ok || log != "build 3 failed with timeout\n" {
+		t.Fatalf("unexpected archived log: %q ok=%v err=%v", log, ok, err)
+	}
+	if _, ok, _ := archive.Get("deploy", "1"); ok {
+		t.Fatalf("expected evicted build to be missing")
+	}
+}
+
+func TestArchive_NamesDoNotCollide(t *testing.T) {
+	dir := t.TempDir()
+	archive, err := Open(dir, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := archive.Add(Doc{Job: "team/deploy", Build: "1"}, "nested job\n"); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := archive.Add(Doc{Job: "team_deploy", Build: "1"}, "flat job\n"); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := archive.Add(Doc{Job: "..", Build: "../1"}, "dots\n"); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	for job, want := range map[string]string{"team/deploy": "nested job\n", "team_deploy": "flat job\n"} {
+		if log, ok, _ := archive.Get(job, "1"); !ok || log != want {
+			t.Fatalf("%s: expected %q, got %q ok=%v", job, want, log, ok)
+		}
+	}
+	if log, ok, _ := archive.Get("..", "../1"); !ok || log != "dots\n" {
+		t.Fatalf("unexpected log for dotted names: %q ok=%v", log, ok)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "1.log.gz")); !os.IsNotExist(err) {
+		t.Fatalf("log escaped the archive dir: %v", err)
+	}
+
+	// Un log guardado con el nombre anterior se mueve al abrir.
+	legacy := filepath.Join(dir, "builds", "old_job", "2.log.gz")
+	_ = os.MkdirAll(filepath.Dir(legacy), 0o755)
+	tmp, _, err := writeGzipTemp(filepath.Dir(legacy), "legacy\n")
+	if err != nil {
+		t.Fatalf("write legacy: %v", err)
+	}
+	_ = os.Rename(tmp, legacy)
+	archive.mu.Lock()
+	archive.index.Docs[99] = Doc{ID: 99, Job: "old/job", Build: "2"}
+	archive.mu.Unlock()
+	archive.dirty.Store(true)
+	if err := archive.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	reopened, err := Open(dir, 0)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if log, ok, _ := reopened.Get("old/job", "2"); !ok || log != "legacy\n" {
+		t.Fatalf("expected legacy log migrated, got %q ok=%v", log, ok)
+	}
+}
@@ -0,0 +1,132 @@
+package logarchive
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"ark_deploy/internal/storage"
+)
+
+// El archiver recorre los builds de cada instancia y, cuando Jenkins informa que
+// terminaron, baja la consola una sola vez y la archiva.
+
+const maxFetchFailures = 5
+
+type BuildSource interface {
+	ReadBuildStatus(jobName string, buildNumber int) (bool, string, error)
+	GetBuildLog(jobName string, buildNumber string) (string, error)
+}
+
+type InstanceLister interface {
+	GetAll() []storage.Instance
+}
+
+type Archiver struct {
+	archive   *Archive
+	instances InstanceLister
+	builds    BuildSource
+	interval  time.Duration
+
+	// failures cuenta errores por build; pasado el maximo se deja de intentar
+	// (por ejemplo builds borrados de Jenkins).
+	failures map[string]int
+}
+
+func NewArchiver(archive *Archive, instances InstanceLister, builds BuildSource, interval time.Duration) *Archiver {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	return &Archiver{
+		archive:   archive,
+		instances: instances,
+		builds:    builds,
+		interval:  interval,
+		failures:  make(map[string]int),
+	}
+}
+
+// Run archiva los builds terminados en cada tick hasta que se cancela el contexto.
+func (a *Archiver) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for {
+		if n := a.ArchiveFinished(ctx); n > 0 {
+			log.Printf("log archive: archived %d builds", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ArchiveFinished archiva los builds terminados que aun no estan en el archivo.
+func (a *Archiver) ArchiveFinished(ctx context.Context) int {
+	// El indice se persiste una vez por pasada y no por cada build.
+	defer func() {
+		if err := a.archive.Flush(); err != nil {
+			log.Printf("log archive: saving index: %v", err)
+		}
+	}()
+
+	archived := 0
+	for _, inst := range a.instances.GetAll() {
+		for job, build := range inst.Builds {
+			if ctx.Err() != nil {
+				return archived
+			}
+
+			build = strings.TrimSpace(build)
+			n, err := strconv.Atoi(build)
+			if err != nil || n <= 0 {
+				continue
+			}
+			key := docKey(job, build)
+			if a.failures[key] >= maxFetchFailures || a.archive.Has(job, build) {
+				continue
+			}
+
+			building, result, err := a.builds.ReadBuildStatus(job, n)
+			if err != nil {
+				a.fail(key, err)
+				continue
+			}
+			if building {
+				continue
+			}
+
+			console, err := a.builds.GetBuildLog(job, build)
+			if err != nil {
+				a.fail(key, err)
+				continue
+			}
+
+			err = a.archive.Add(Doc{
+				InstanceID:  inst.ID,
+				ProductID:   inst.ProductID,
+				Environment: inst.Environment,
+				Job:         job,
+				Build:       build,
+				Result:      result,
+			}, console)
+			if err != nil {
+				a.fail(key, err)
+				continue
+			}
+			delete(a.failures, key)
+			archived++
+		}
+	}
+	return archived
+}
+
+func (a *Archiver) fail(key string, err error) {
+	a.failures[key]++
+	log.Printf("log archive: %s: %v", key, err)
+}
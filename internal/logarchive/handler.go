@@ -0,0 +1,84 @@
+package logarchive
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	archive *Archive
+}
+
+func NewHandler(archive *Archive) *Handler {
+	return &Handler{archive: archive}
+}
+
+// Search atiende GET /api/logs/search?q=...&product=...&instance=...&job=...&since=...&limit=...
+// since acepta RFC3339, una duracion de Go ("36h") o dias ("7d").
+func (h *Handler) Search(c *gin.Context) {
+	q := Query{
+		Text:       c.Query("q"),
+		ProductID:  strings.TrimSpace(c.Query("product")),
+		InstanceID: strings.TrimSpace(c.Query("instance")),
+		Job:        strings.TrimSpace(c.Query("job")),
+	}
+	if strings.TrimSpace(q.Text) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "q is required"})
+		return
+	}
+
+	if raw := strings.TrimSpace(c.Query("since")); raw != "" {
+		since, err := parseSince(raw, time.Now())
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+			return
+		}
+		q.Since = since
+	}
+
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > MaxSearchLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": "limit must be between 1 and 1000"})
+			return
+		}
+		q.Limit = n
+	}
+
+	matches, more, err := h.archive.Search(q)
+	if err != nil {
+		if errors.Is(err, ErrEmptyQuery) {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"query":     q.Text,
+		"total":     len(matches),
+		"truncated": more,
+		"matches":   matches,
+	})
+}
+
+func parseSince(raw string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	if days, ok := strings.CutSuffix(raw, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n > 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, errors.New("since must be RFC3339, a duration like 36h, or days like 7d")
+}
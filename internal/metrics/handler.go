@@ -0,0 +1,21 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Handler expone el registry en /metrics. labels resuelve product/environment
+// de cada instancia al momento del scrape.
+func Handler(reg *Registry, labels func() map[string]Labels) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var l map[string]Labels
+		if labels != nil {
+			l = labels()
+		}
+		c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		c.Status(http.StatusOK)
+		_ = reg.WritePrometheus(c.Writer, l)
+	}
+}
@@ -0,0 +1,204 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metricas del proxy por instancia: requests por clase de status, bytes y
+// histograma de latencia. Se exponen en formato texto de Prometheus.
+
+// LatencyBuckets son los limites (segundos) del histograma de latencia.
+var LatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var statusClasses = []string{"1xx", "2xx", "3xx", "4xx", "5xx"}
+
+// InstanceMetrics es la foto de las metricas de una instancia.
+type InstanceMetrics struct {
+	InstanceID     string           `json:"instance_id"`
+	Requests       int64            `json:"requests"`
+	StatusClasses  map[string]int64 `json:"status_classes"`
+	BytesIn        int64            `json:"bytes_in"`
+	BytesOut       int64            `json:"bytes_out"`
+	LatencySum     float64          `json:"latency_seconds_sum"`
+	LatencyBuckets map[string]int64 `json:"latency_buckets"`
+	LastRequestAt  *time.Time       `json:"last_request_at,omitempty"`
+}
+
+type series struct {
+	requests    int64
+	classes     [5]int64
+	bytesIn     int64
+	bytesOut    int64
+	latencySum  float64
+	buckets     []int64
+	lastRequest time.Time
+}
+
+type Registry struct {
+	mu        sync.Mutex
+	instances map[string]*series
+}
+
+func NewRegistry() *Registry {
+	return &Registry{instances: make(map[string]*series)}
+}
+
+// Observe registra una request proxied hacia la instancia.
+func (r *Registry) Observe(instanceID string, status int, bytesIn int64, bytesOut int64, d time.Duration) {
+	if instanceID == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.instances[instanceID]
+	if !ok {
+		s = &series{buckets: make([]int64, len(LatencyBuckets))}
+		r.instances[instanceID] = s
+	}
+
+	s.requests++
+	if class := status/100 - 1; class >= 0 && class < len(s.classes) {
+		s.classes[class]++
+	}
+	if bytesIn > 0 {
+		s.bytesIn += bytesIn
+	}
+	if bytesOut > 0 {
+		s.bytesOut += bytesOut
+	}
+
+	secs := d.Seconds()
+	s.latencySum += secs
+	for i, le := range LatencyBuckets {
+		if secs <= le {
+			s.buckets[i]++
+		}
+	}
+	s.lastRequest = time.Now().UTC()
+}
+
+// Snapshot devuelve las metricas acumuladas de la instancia.
+func (r *Registry) Snapshot(instanceID string) InstanceMetrics {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := InstanceMetrics{
+		InstanceID:     instanceID,
+		StatusClasses:  make(map[string]int64, len(statusClasses)),
+		LatencyBuckets: make(map[string]int64, len(LatencyBuckets)+1),
+	}
+	for _, c := range statusClasses {
+		out.StatusClasses[c] = 0
+	}
+
+	s, ok := r.instances[instanceID]
+	if !ok {
+		return out
+	}
+
+	out.Requests = s.requests
+	for i, c := range statusClasses {
+		out.StatusClasses[c] = s.classes[i]
+	}
+	out.BytesIn = s.bytesIn
+	out.BytesOut = s.bytesOut
+	out.LatencySum = s.latencySum
+	for i, le := range LatencyBuckets {
+		out.LatencyBuckets[formatFloat(le)] = s.buckets[i]
+	}
+	out.LatencyBuckets["+Inf"] = s.requests
+	last := s.lastRequest
+	out.LastRequestAt = &last
+
+	return out
+}
+
+// Forget descarta las metricas de una instancia eliminada.
+func (r *Registry) Forget(instanceID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.instances, instanceID)
+}
+
+// Labels son las etiquetas extra (product, environment) de cada instancia.
+type Labels struct {
+	Product     string
+	Environment string
+}
+
+// WritePrometheus escribe todas las series en formato de exposicion de texto.
+func (r *Registry) WritePrometheus(w io.Writer, labels map[string]Labels) error {
+	r.mu.Lock()
+	ids := make([]string, 0, len(r.instances))
+	snap := make(map[string]series, len(r.instances))
+	for id, s := range r.instances {
+		ids = append(ids, id)
+		cp := *s
+		cp.buckets = append([]int64(nil), s.buckets...)
+		snap[id] = cp
+	}
+	r.mu.Unlock()
+	sort.Strings(ids)
+
+	var b strings.Builder
+
+	b.WriteString("# HELP ark_instance_requests_total Requests proxied to the instance by status class.\n")
+	b.WriteString("# TYPE ark_instance_requests_total counter\n")
+	for _, id := range ids {
+		s := snap[id]
+		base := labelSet(id, labels[id])
+		for i, c := range statusClasses {
+			fmt.Fprintf(&b, "ark_instance_requests_total{%s,status_class=%q} %d\n", base, c, s.classes[i])
+		}
+	}
+
+	b.WriteString("# HELP ark_instance_request_bytes_total Request body bytes received for the instance.\n")
+	b.WriteString("# TYPE ark_instance_request_bytes_total counter\n")
+	for _, id := range ids {
+		fmt.Fprintf(&b, "ark_instance_request_bytes_total{%s} %d\n", labelSet(id, labels[id]), snap[id].bytesIn)
+	}
+
+	b.WriteString("# HELP ark_instance_response_bytes_total Response body bytes sent for the instance.\n")
+	b.WriteString("# TYPE ark_instance_response_bytes_total counter\n")
+	for _, id := range ids {
+		fmt.Fprintf(&b, "ark_instance_response_bytes_total{%s} %d\n", labelSet(id, labels[id]), snap[id].bytesOut)
+	}
+
+	b.WriteString("# HELP ark_instance_request_duration_seconds Proxy request latency for the instance.\n")
+	b.WriteString("# TYPE ark_instance_request_duration_seconds histogram\n")
+	for _, id := range ids {
+		s := snap[id]
+		base := labelSet(id, labels[id])
+		for i, le := range LatencyBuckets {
+			fmt.Fprintf(&b, "ark_instance_request_duration_seconds_bucket{%s,le=%q} %d\n", base, formatFloat(le), s.buckets[i])
+		}
+		fmt.Fprintf(&b, "ark_instance_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", base, s.requests)
+		fmt.Fprintf(&b, "ark_instance_request_duration_seconds_sum{%s} %s\n", base, formatFloat(s.latencySum))
+		fmt.Fprintf(&b, "ark_instance_request_duration_seconds_count{%s} %d\n", base, s.requests)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func labelSet(id string, l Labels) string {
+	return fmt.Sprintf(`instance="%s",product="%s",environment="%s"`, escapeLabel(id), escapeLabel(l.Product), escapeLabel(l.Environment))
+}
+
+func escapeLabel(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return strings.ReplaceAll(v, `"`, `\"`)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistry_ObserveAndSnapshot(t *testing.T) {
+	reg := NewRegistry()
+	reg.Observe("i-1", 200, 10, 100, 20*time.Millisecond)
+	reg.Observe("i-1", 502, 0, 30, 2*time.Second)
+	reg.Observe("i-2", 404, 0, 5, time.Millisecond)
+
+	snap := reg.Snapshot("i-1")
+	if snap.Requests != 2 || snap.BytesIn != 10 || snap.BytesOut != 130 {
+		t.Fatalf("unexpected totals: %+v", snap)
+	}
+	if snap.StatusClasses["2xx"] != 1 || snap.StatusClasses["5xx"] != 1 || snap.StatusClasses["4xx"] != 0 {
+		t.Fatalf("unexpected status classes: %+v", snap.StatusClasses)
+	}
+	if snap.LatencyBuckets["0.025"] != 1 || snap.LatencyBuckets["2.5"] != 2 || snap.LatencyBuckets["+Inf"] != 2 {
+		t.Fatalf("unexpected buckets: %+v", snap.LatencyBuckets)
+	}
+	if snap.LastRequestAt == nil {
+		t.Fatalf("expected last_request_at")
+	}
+
+	if empty := reg.Snapshot("missing"); empty.Requests != 0 || empty.LastRequestAt != nil {
+		t.Fatalf("expected empty snapshot, got %+v", empty)
+	}
+
+	reg.Forget("i-2")
+	if reg.Snapshot("i-2").Requests != 0 {
+		t.Fatalf("expected i-2 to be forgotten")
+	}
+}
+
+func TestRegistry_WritePrometheus(t *testing.T) {
+	reg := NewRegistry()
+	reg.Observe("i-1", 201, 0, 12, 30*time.Millisecond)
+
+	var b strings.Builder
+	if err := reg.WritePrometheus(&b, map[string]Labels{"i-1": {Product: "shop", Environment: "dev"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out := b.String()
+
+	for _, want := range []string{
+		"# TYPE ark_instance_requests_total counter",
+		`ark_instance_requests_total{instance="i-1",product="shop",environment="dev",status_class="2xx"} 1`,
+		`ark_instance_response_bytes_total{instance="i-1",product="shop",environment="dev"} 12`,
+		`ark_instance_request_duration_seconds_bucket{instance="i-1",product="shop",environment="dev",le="0.05"} 1`,
+		`ark_instance_request_duration_seconds_bucket{instance="i-1",product="shop",environment="dev",le="0.025"} 0`,
+		`ark_instance_request_duration_seconds_count{instance="i-1",product="shop",environment="dev"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing %q in:\n%s", want, out)
+		}
+	}
+}
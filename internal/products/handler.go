@@ -2,13 +2,19 @@ package products
 
 
 import (
+	"errors"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 
+	"ark_deploy/internal/audit"
+	"ark_deploy/internal/events"
 	"ark_deploy/internal/storage"
+	"ark_deploy/internal/tailscale"
 )
 
 
@@ -18,13 +24,23 @@ type Store interface {
 	Create(p storage.Product) error
 	GetAll() []storage.Product
 	GetByID(id string) (storage.Product, error)
-	Update(id string, p storage.Product) error
-	Delete(id string) error
+	Update(id string, p storage.Product) (storage.Product, error)
+	// Delete manda el producto a la papelera; Restore lo devuelve.
+	Delete(id string, actor string) error
+	Restore(id string) (storage.Product, error)
+}
+
+// InstanceLister permite saber si un producto tiene instancias antes de borrarlo (opcional).
+type InstanceLister interface {
+	List(q storage.InstanceQuery) (storage.InstancePage, error)
 }
 
 // Utiliza un Store para acceder a los datos.
 type Handler struct {
-	store Store
+	store      Store
+	instances  InstanceLister
+	identities tailscale.Identifier
+	events     events.Publisher
 }
 
 // NewHandler crea un nuevo Handler de productos con el store proporcionado.
@@ -36,6 +52,24 @@ func NewHandler(store Store) *Handler {
 	return &Handler{store: store}
 }
 
+// WithInstanceLister bloquea el borrado de productos con instancias (salvo force).
+func (h *Handler) WithInstanceLister(l InstanceLister) *Handler {
+	h.instances = l
+	return h
+}
+
+// WithIdentityResolver registra al usuario de Tailscale como autor de los borrados.
+func (h *Handler) WithIdentityResolver(r tailscale.Identifier) *Handler {
+	h.identities = r
+	return h
+}
+
+// WithEvents publica los cambios de productos en el bus de eventos.
+func (h *Handler) WithEvents(p events.Publisher) *Handler {
+	h.events = p
+	return h
+}
+
 //  representa el payload para crear un producto.
 type CreateProductRequest struct {
 	ID          string            `json:"id" binding:"required"`
@@ -46,6 +80,11 @@ type CreateProductRequest struct {
 	DeleteJob   string            `json:"delete_job" binding:"required"`
 	WebService  string            `json:"web_service"`
 	WebPort     int               `json:"web_port"`
+	HealthPath            string `json:"health_path"`
+	HealthExpectedStatus  int    `json:"health_expected_status"`
+	HealthIntervalSeconds int    `json:"health_interval_seconds"`
+	RateLimit             *storage.RateLimit `json:"rate_limit"`
+	Services              []storage.ExposedService `json:"services"`
 }
 
 
@@ -57,10 +96,28 @@ func (h *Handler) Create(c *gin.Context) {
 		return
 	}
 
+	services, webPort, err := normalizeServices(req.WebService, req.WebPort, req.Services)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+	req.WebPort = webPort
+
 	if err := validateProductFields(req.ID, req.Name, req.DeployJobs, req.DeleteJob, req.WebService, req.WebPort); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
 		return
 	}
+	if err := validateHealthCheck(req.HealthPath, req.HealthExpectedStatus, req.HealthIntervalSeconds); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+	if err := req.RateLimit.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "rate_limit: " + err.Error()})
+		return
+	}
+	if req.RateLimit.IsZero() {
+		req.RateLimit = nil
+	}
 
 	product := storage.Product{
 		ID:          strings.TrimSpace(req.ID),
@@ -71,6 +128,15 @@ func (h *Handler) Create(c *gin.Context) {
 		DeleteJob:   strings.TrimSpace(req.DeleteJob),
 		WebService:  strings.TrimSpace(req.WebService),
 		WebPort:     req.WebPort,
+
+		HealthPath:            strings.TrimSpace(req.HealthPath),
+		HealthExpectedStatus:  req.HealthExpectedStatus,
+		HealthIntervalSeconds: req.HealthIntervalSeconds,
+		RateLimit:             req.RateLimit,
+		Services:              services,
+
+		// Los productos nuevos arrancan en la version 1.
+		Version: 1,
 	}
 
 	if err := h.store.Create(product); err != nil {
@@ -78,6 +144,9 @@ func (h *Handler) Create(c *gin.Context) {
 		return
 	}
 
+	audit.Record(c, product.ID, nil, product)
+	events.Publish(h.events, events.Event{Type: events.ProductCreated, ProductID: product.ID, Data: map[string]any{"name": product.Name}})
+	c.Header("ETag", etag(product.Version))
 	c.JSON(http.StatusCreated, product)
 }
 
@@ -99,6 +168,7 @@ func (h *Handler) Get(c *gin.Context) {
 		return
 	}
 
+	c.Header("ETag", etag(product.Version))
 	c.JSON(http.StatusOK, product)
 }
 
@@ -111,6 +181,11 @@ type UpdateProductRequest struct {
 	DeleteJob   string            `json:"delete_job" binding:"required"`
 	WebService  string            `json:"web_service"`
 	WebPort     int               `json:"web_port"`
+	HealthPath            string `json:"health_path"`
+	HealthExpectedStatus  int    `json:"health_expected_status"`
+	HealthIntervalSeconds int    `json:"health_interval_seconds"`
+	RateLimit             *storage.RateLimit `json:"rate_limit"`
+	Services              []storage.ExposedService `json:"services"`
 }
 
 
@@ -123,12 +198,27 @@ func (h *Handler) Update(c *gin.Context) {
 		return
 	}
 
+	// Con If-Match solo se actualiza si nadie escribio desde que el cliente leyo.
+	expected, ok := ifMatchVersion(c.GetHeader("If-Match"), existing.Version)
+	if !ok {
+		c.Header("ETag", etag(existing.Version))
+		c.JSON(http.StatusPreconditionFailed, gin.H{"detail": "product was modified; reload and retry"})
+		return
+	}
+
 	var req UpdateProductRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
 		return
 	}
 
+	services, webPort, err := normalizeServices(req.WebService, req.WebPort, req.Services)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+	req.WebPort = webPort
+
 	currentWebPort := existing.WebPort
 	if currentWebPort == 0 {
 		currentWebPort = 80
@@ -143,6 +233,17 @@ func (h *Handler) Update(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
 		return
 	}
+	if err := validateHealthCheck(req.HealthPath, req.HealthExpectedStatus, req.HealthIntervalSeconds); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+	if err := req.RateLimit.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "rate_limit: " + err.Error()})
+		return
+	}
+	if req.RateLimit.IsZero() {
+		req.RateLimit = nil
+	}
 
 	product := storage.Product{
 		ID:          id,
@@ -153,28 +254,103 @@ func (h *Handler) Update(c *gin.Context) {
 		DeleteJob:   strings.TrimSpace(req.DeleteJob),
 		WebService:  strings.TrimSpace(req.WebService),
 		WebPort:     req.WebPort,
+
+		HealthPath:            strings.TrimSpace(req.HealthPath),
+		HealthExpectedStatus:  req.HealthExpectedStatus,
+		HealthIntervalSeconds: req.HealthIntervalSeconds,
+		RateLimit:             req.RateLimit,
+		Services:              services,
+		Version:               expected,
 	}
 
-	if err := h.store.Update(id, product); err != nil {
+	product, err = h.store.Update(id, product)
+	if err != nil {
+		if errors.Is(err, storage.ErrVersionConflict) {
+			c.JSON(http.StatusPreconditionFailed, gin.H{"detail": "product was modified; reload and retry"})
+			return
+		}
 		c.JSON(http.StatusNotFound, gin.H{"detail": err.Error()})
 		return
 	}
 
+	audit.Record(c, id, existing, product)
+	events.Publish(h.events, events.Event{
+		Type:      events.ProductUpdated,
+		ProductID: id,
+		Data:      map[string]any{"changed": changedFields(existing, product), "version": product.Version},
+	})
+	c.Header("ETag", etag(product.Version))
 	c.JSON(http.StatusOK, product)
 }
 
-// Delete elimina un producto por su ID.
+// changedFields lista los campos que cambio la actualizacion.
+func changedFields(before, after storage.Product) []string {
+	fields := make([]string, 0)
+	for k := range audit.Diff(before, after) {
+		if k != "version" {
+			fields = append(fields, k)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// Delete manda un producto a la papelera. Si todavia tiene instancias
+// responde 409, salvo con ?force=true.
 func (h *Handler) Delete(c *gin.Context) {
 	id := strings.TrimSpace(c.Param("id"))
 
-	if err := h.store.Delete(id); err != nil {
+	force, _ := strconv.ParseBool(c.Query("force"))
+	if h.instances != nil && !force {
+		page, err := h.instances.List(storage.InstanceQuery{ProductID: id, Limit: 1})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+			return
+		}
+		if page.Total > 0 {
+			c.JSON(http.StatusConflict, gin.H{
+				"detail":    "product has live instances; delete them first or use force=true",
+				"instances": page.Total,
+			})
+			return
+		}
+	}
+
+	before, _ := h.store.GetByID(id)
+	// ClientIP ignora X-Forwarded-For salvo desde ARK_TRUSTED_PROXIES.
+	if err := h.store.Delete(id, tailscale.Actor(h.identities, c.ClientIP())); err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"detail": err.Error()})
 		return
 	}
+	audit.Record(c, id, before, nil)
+	events.Publish(h.events, events.Event{Type: events.ProductDeleted, ProductID: id, Data: map[string]any{"force": force}})
 
 	c.JSON(http.StatusOK, gin.H{"message": "product deleted"})
 }
 
+// Restore saca un producto de la papelera.
+func (h *Handler) Restore(c *gin.Context) {
+	id := strings.TrimSpace(c.Param("id"))
+
+	product, err := h.store.Restore(id)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotInTrash) {
+			c.JSON(http.StatusNotFound, gin.H{"detail": "product not found in trash"})
+			return
+		}
+		if errors.Is(err, storage.ErrRestoreConflict) {
+			c.JSON(http.StatusConflict, gin.H{"detail": "product already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+
+	audit.Record(c, id, nil, product)
+	c.Header("ETag", etag(product.Version))
+	c.JSON(http.StatusOK, product)
+}
+
 // Retorna un error si algún campo es inválido.
 func validateProductFields(id, name string, deployJobs map[string]string, deleteJob, webService string, webPort int) error {
 	if strings.TrimSpace(id) == "" {
@@ -221,6 +397,64 @@ func validateProductFields(id, name string, deployJobs map[string]string, delete
 	return nil
 }
 
+// normalizeServices valida los servicios expuestos. El web_service debe estar
+// entre ellos y su puerto pasa a ser el web_port del producto.
+func normalizeServices(webService string, webPort int, services []storage.ExposedService) ([]storage.ExposedService, int, error) {
+	if len(services) == 0 {
+		return nil, webPort, nil
+	}
+
+	ws := strings.TrimSpace(webService)
+	if ws == "" {
+		ws = "web"
+	}
+
+	out := make([]storage.ExposedService, 0, len(services))
+	seen := make(map[string]bool, len(services))
+	port := 0
+	for _, svc := range services {
+		name := strings.ToLower(strings.TrimSpace(svc.Name))
+		if !isSafeServiceName(name) || strings.Contains(name, "_") {
+			return nil, 0, errString("services contains invalid name: " + svc.Name)
+		}
+		if seen[name] {
+			return nil, 0, errString("services contains duplicate name: " + name)
+		}
+		if svc.Port < 1 || svc.Port > 65535 {
+			return nil, 0, errString("services port must be between 1 and 65535: " + name)
+		}
+		seen[name] = true
+		if name == ws {
+			port = svc.Port
+		}
+		out = append(out, storage.ExposedService{Name: name, Port: svc.Port})
+	}
+
+	if port == 0 {
+		return nil, 0, errString("web_service must be one of services")
+	}
+	if webPort != 0 && webPort != port {
+		return nil, 0, errString("web_port must match the port of web_service in services")
+	}
+
+	return out, port, nil
+}
+
+// validateHealthCheck valida la configuracion del health check activo; todos los campos son opcionales.
+func validateHealthCheck(path string, expectedStatus int, intervalSeconds int) error {
+	p := strings.TrimSpace(path)
+	if p != "" && (!strings.HasPrefix(p, "/") || strings.ContainsAny(p, " \\\n\r\t")) {
+		return errString("health_path must be an absolute path")
+	}
+	if expectedStatus != 0 && (expectedStatus < 100 || expectedStatus > 599) {
+		return errString("health_expected_status must be between 100 and 599")
+	}
+	if intervalSeconds != 0 && (intervalSeconds < 5 || intervalSeconds > 3600) {
+		return errString("health_interval_seconds must be between 5 and 3600")
+	}
+	return nil
+}
+
 func normalizeDeployJobs(m map[string]string) map[string]string {
 	out := make(map[string]string, len(m))
 	for k, v := range m {
@@ -263,7 +497,47 @@ func isSafeJenkinsJobName(s string) bool {
 	return true
 }
 
+// etag es la version del producto como entity tag fuerte.
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// ifMatchVersion interpreta If-Match contra la version actual. Devuelve la
+// version que debe tener el producto al escribir (0 = sin condicion) y false
+// si ninguna de las etiquetas coincide.
+func ifMatchVersion(header string, current int64) (int64, bool) {
+	header = strings.TrimSpace(header)
+	if header == "" || header == "*" {
+		return 0, true
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimSpace(tag) == etag(current) {
+			return current, true
+		}
+	}
+	return 0, false
+}
+
 type errString string
 
 
 func (e errString) Error() string { return string(e) }
+
+// Validate aplica a un producto guardado las mismas reglas que Create. La usa
+// la importacion de backups.
+func Validate(p storage.Product) error {
+	if _, _, err := normalizeServices(p.WebService, p.WebPort, p.Services); err != nil {
+		return err
+	}
+	if err := validateProductFields(p.ID, p.Name, p.DeployJobs, p.DeleteJob, p.WebService, p.WebPort); err != nil {
+		return err
+	}
+	if err := validateHealthCheck(p.HealthPath, p.HealthExpectedStatus, p.HealthIntervalSeconds); err != nil {
+		return err
+	}
+	if err := p.RateLimit.Validate(); err != nil {
+		return errString("rate_limit: " + err.Error())
+	}
+	return nil
+}
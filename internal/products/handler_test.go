@@ -17,10 +17,11 @@ import (
 type mockProductStore struct {
 	mu       sync.RWMutex
 	products map[string]storage.Product
+	trash    map[string]storage.Product
 }
 
 func newMockProductStore() *mockProductStore {
-	return &mockProductStore{products: make(map[string]storage.Product)}
+	return &mockProductStore{products: make(map[string]storage.Product), trash: make(map[string]storage.Product)}
 }
 
 func (s *mockProductStore) Create(p storage.Product) error {
@@ -56,29 +57,52 @@ func (s *mockProductStore) GetByID(id string) (storage.Product, error) {
 	return p, nil
 }
 
-func (s *mockProductStore) Update(id string, p storage.Product) error {
+func (s *mockProductStore) Update(id string, p storage.Product) (storage.Product, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if _, exists := s.products[id]; !exists {
-		return assert.AnError
+	current, exists := s.products[id]
+	if !exists {
+		return storage.Product{}, assert.AnError
+	}
+	if p.Version != 0 && p.Version != current.Version {
+		return storage.Product{}, storage.ErrVersionConflict
 	}
 	p.ID = id
+	p.Version = current.Version + 1
 	s.products[id] = p
-	return nil
+	return p, nil
 }
 
-func (s *mockProductStore) Delete(id string) error {
+func (s *mockProductStore) Delete(id string, actor string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if _, exists := s.products[id]; !exists {
+	p, exists := s.products[id]
+	if !exists {
 		return assert.AnError
 	}
+	s.trash[id] = p
 	delete(s.products, id)
 	return nil
 }
 
+func (s *mockProductStore) Restore(id string) (storage.Product, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.trash[id]
+	if !ok {
+		return storage.Product{}, storage.ErrNotInTrash
+	}
+	if _, exists := s.products[id]; exists {
+		return storage.Product{}, storage.ErrRestoreConflict
+	}
+	s.products[id] = p
+	delete(s.trash, id)
+	return p, nil
+}
+
 func setupTest() (*gin.Engine, *Handler) {
 	gin.SetMode(gin.TestMode)
 	store := newMockProductStore()
@@ -399,3 +423,174 @@ func TestDeleteProduct(t *testing.T) {
 	_, err := handler.store.GetByID("task-manager")
 	assert.Error(t, err)
 }
+
+func TestDeleteProduct_TrashAndRestore(t *testing.T) {
+	kv, err := storage.OpenFileKV(t.TempDir() + "/ark.db")
+	assert.NoError(t, err)
+	defer kv.Close()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	// Como en main sin ARK_TRUSTED_PROXIES.
+	_ = router.SetTrustedProxies(nil)
+	instances := storage.NewInstanceStore(kv)
+	handler := NewHandler(storage.NewProductStore(kv)).WithInstanceLister(instances)
+	router.DELETE("/products/:id", handler.Delete)
+	router.POST("/products/:id/restore", handler.Restore)
+
+	assert.NoError(t, handler.store.Create(storage.Product{ID: "shop", Name: "Shop"}))
+	assert.NoError(t, instances.Create(storage.Instance{ID: "abc123", ProductID: "shop", Status: "running"}))
+
+	send := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		// Un X-Forwarded-For falsificado no cambia quien figura como autor.
+		req.Header.Set("X-Forwarded-For", "100.64.0.7")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Con instancias vivas el borrado se bloquea salvo force.
+	assert.Equal(t, http.StatusConflict, send(http.MethodDelete, "/products/shop").Code)
+	assert.Equal(t, http.StatusOK, send(http.MethodDelete, "/products/shop?force=true").Code)
+	_, err = handler.store.GetByID("shop")
+	assert.Error(t, err)
+
+	trash, err := storage.NewTrashStore(kv).List(storage.TrashProduct)
+	assert.NoError(t, err)
+	assert.Len(t, trash, 1)
+	assert.Equal(t, "192.0.2.1", trash[0].DeletedBy)
+
+	w := send(http.MethodPost, "/products/shop/restore")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"1"`, w.Header().Get("ETag"))
+	assert.Len(t, handler.store.GetAll(), 1)
+
+	assert.Equal(t, http.StatusNotFound, send(http.MethodPost, "/products/shop/restore").Code)
+}
+
+func TestCreateProduct_RateLimit(t *testing.T) {
+	router, handler := setupTest()
+	router.POST("/products", handler.Create)
+
+	payload := CreateProductRequest{
+		ID:         "shop",
+		Name:       "Shop",
+		DeployJobs: map[string]string{"prod": "deploy-shop-prod", "dev": "deploy-shop-dev", "test": "deploy-shop-test"},
+		DeleteJob:  "delete-shop",
+		RateLimit:  &storage.RateLimit{Burst: 10},
+	}
+	body, _ := json.Marshal(payload)
+	req := httptest.NewRequest(http.MethodPost, "/products", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	payload.RateLimit = &storage.RateLimit{RequestsPerSecond: 5, Burst: 10, MaxBodyBytes: 1 << 20}
+	body, _ = json.Marshal(payload)
+	req = httptest.NewRequest(http.MethodPost, "/products", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	stored, err := handler.store.GetByID("shop")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 5.0, stored.RateLimit.RequestsPerSecond)
+	assert.Equal(t, int64(1<<20), stored.RateLimit.MaxBodyBytes)
+}
+
+func TestCreateProduct_Services(t *testing.T) {
+	router, handler := setupTest()
+	router.POST("/products", handler.Create)
+
+	post := func(p CreateProductRequest) int {
+		body, _ := json.Marshal(p)
+		req := httptest.NewRequest(http.MethodPost, "/products", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	payload := CreateProductRequest{
+		ID:         "vault_go",
+		Name:       "Vault",
+		DeployJobs: map[string]string{"prod": "deploy-vault-prod", "dev": "deploy-vault-dev", "test": "deploy-vault-test"},
+		DeleteJob:  "delete-vault",
+		Services:   []storage.ExposedService{{Name: "api", Port: 8080}, {Name: "admin", Port: 9000}},
+	}
+	assert.Equal(t, http.StatusBadRequest, post(payload), "web_service must be listed")
+
+	payload.Services = []storage.ExposedService{{Name: "web", Port: 80}, {Name: "web", Port: 8080}}
+	assert.Equal(t, http.StatusBadRequest, post(payload), "duplicate names")
+
+	payload.Services = []storage.ExposedService{{Name: "Web", Port: 3000}, {Name: "api", Port: 8080}}
+	assert.Equal(t, http.StatusCreated, post(payload))
+
+	stored, err := handler.store.GetByID("vault_go")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 3000, stored.WebPort)
+	assert.Equal(t, "web", stored.Services[0].Name)
+}
+
+func TestUpdateProduct_IfMatch(t *testing.T) {
+	kv, err := storage.OpenFileKV(t.TempDir() + "/ark.db")
+	assert.NoError(t, err)
+	defer kv.Close()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	handler := NewHandler(storage.NewProductStore(kv))
+	router.GET("/products/:id", handler.Get)
+	router.PUT("/products/:id", handler.Update)
+
+	assert.NoError(t, handler.store.Create(storage.Product{
+		ID:         "shop",
+		Name:       "Shop",
+		DeployJobs: map[string]string{"prod": "p", "dev": "d", "test": "t"},
+		DeleteJob:  "delete-shop",
+	}))
+
+	put := func(name, ifMatch string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(UpdateProductRequest{
+			Name:       name,
+			DeployJobs: map[string]string{"prod": "p", "dev": "d", "test": "t"},
+			DeleteJob:  "delete-shop",
+		})
+		req := httptest.NewRequest(http.MethodPut, "/products/shop", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/products/shop", nil))
+	assert.Equal(t, `"1"`, w.Header().Get("ETag"))
+
+	// Dos admins leyeron la version 1: el primero gana, el segundo recibe 412.
+	w = put("Shop A", `"1"`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"2"`, w.Header().Get("ETag"))
+
+	w = put("Shop B", `"1"`)
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	assert.Equal(t, `"2"`, w.Header().Get("ETag"))
+
+	current, _ := handler.store.GetByID("shop")
+	assert.Equal(t, "Shop A", current.Name)
+
+	// Sin If-Match la escritura es incondicional.
+	w = put("Shop C", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"3"`, w.Header().Get("ETag"))
+}
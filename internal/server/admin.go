@@ -0,0 +1,39 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"ark_deploy/internal/tailscale"
+)
+
+const adminTokenHeader = "X-ARK-Admin-Token"
+
+type identityResolver interface {
+	Identify(ip string) (tailscale.Identity, bool)
+}
+
+// AdminGuard protege los endpoints de administracion que comparten listener con
+// el proxy publico: pasan los dispositivos de la malla o quien mande
+// ARK_ADMIN_TOKEN. Sin token configurado solo queda la malla.
+func AdminGuard(token string, identities identityResolver) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if got := c.GetHeader(adminTokenHeader); token != "" && got != "" {
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"detail": "invalid admin token"})
+			return
+		}
+
+		if identities != nil {
+			if _, ok := identities.Identify(c.ClientIP()); ok {
+				return
+			}
+		}
+
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"detail": "admin access required"})
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"ark_deploy/internal/tailscale"
+)
+
+type staticIdentities map[string]tailscale.Identity
+
+func (s staticIdentities) Identify(ip string) (tailscale.Identity, bool) {
+	id, ok := s[ip]
+	return id, ok
+}
+
+func TestAdminGuard_TailnetOrToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	// Como en main sin ARK_TRUSTED_PROXIES.
+	_ = r.SetTrustedProxies(nil)
+	identities := staticIdentities{"100.64.0.5": {User: "ops@acme.com"}}
+	r.GET("/api/admin/export", AdminGuard("s3cret", identities), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	call := func(remote string, header map[string]string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/admin/export", nil)
+		req.RemoteAddr = remote + ":1234"
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := call("203.0.113.7", nil); code != http.StatusForbidden {
+		t.Fatalf("expected 403 from the internet without token, got %d", code)
+	}
+	if code := call("203.0.113.7", map[string]string{"X-Forwarded-For": "100.64.0.5"}); code != http.StatusForbidden {
+		t.Fatalf("a spoofed X-Forwarded-For must not pass as a tailnet device, got %d", code)
+	}
+	if code := call("203.0.113.7", map[string]string{adminTokenHeader: "wrong"}); code != http.StatusForbidden {
+		t.Fatalf("expected 403 with a wrong token, got %d", code)
+	}
+	if code := call("203.0.113.7", map[string]string{adminTokenHeader: "s3cret"}); code != http.StatusOK {
+		t.Fatalf("expected 200 with the admin token, got %d", code)
+	}
+	if code := call("100.64.0.5", nil); code != http.StatusOK {
+		t.Fatalf("expected 200 from a tailnet device, got %d", code)
+	}
+
+	// Sin token configurado el header no sirve de nada.
+	r = gin.New()
+	_ = r.SetTrustedProxies(nil)
+	r.GET("/api/admin/export", AdminGuard("", identities), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	if code := call("203.0.113.7", map[string]string{adminTokenHeader: ""}); code != http.StatusForbidden {
+		t.Fatalf("expected 403 without a configured token, got %d", code)
+	}
+}
@@ -2,54 +2,145 @@ package server
 
 import (
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
+	"ark_deploy/internal/audit"
+	"ark_deploy/internal/backup"
 	"ark_deploy/internal/config"
 	"ark_deploy/internal/deployments"
+	"ark_deploy/internal/events"
 	"ark_deploy/internal/instances"
+	"ark_deploy/internal/logarchive"
+	"ark_deploy/internal/metrics"
 	"ark_deploy/internal/products"
 	"ark_deploy/internal/sshusers"
 	"ark_deploy/internal/storage"
 	"ark_deploy/internal/tailscale"
+	"ark_deploy/internal/trash"
+	"ark_deploy/internal/webhooks"
 )
 
-func RegisterRoutes(r *gin.Engine, cfg config.Config, productStore *storage.ProductStore, instanceStore *storage.InstanceStore) {
+// RegisterRoutes registra todas las rutas y devuelve el handler de instancias
+// para arrancar sus procesos en segundo plano.
+func RegisterRoutes(r *gin.Engine, cfg config.Config, kv storage.KV, productStore *storage.ProductStore, instanceStore *storage.InstanceStore, routeStore *storage.RouteStore, logArchive *logarchive.Archive, bus *events.Bus, dispatcher *webhooks.Dispatcher) *instances.Handler {
+	domainStore := storage.NewDomainStore(kv)
+	proxyMetrics := metrics.NewRegistry()
+	tsClient := tailscale.NewClient(cfg.TailscaleAPIKey, cfg.TailscaleTailnet)
+	identities := tailscale.NewIdentityResolver(tsClient, time.Minute)
+	auditStore := storage.NewAuditLogStore(kv, cfg.AuditMaxEntries)
+	r.Use(audit.Middleware(auditStore, identities))
+	adminGuard := AdminGuard(cfg.AdminToken, identities)
+
+	ih := instances.NewHandler(routeStore, instanceStore).WithOptions(instances.Options{
+		PublicHost:          cfg.ARKPublicHost,
+		HostRoutingDomain:   cfg.HostRoutingDomain,
+		FriendlyURLTemplate: cfg.FriendlyURLTemplate,
+		BreakerThreshold:    cfg.ProxyBreakerThreshold,
+		BreakerCooldown:     cfg.ProxyBreakerCooldown,
+	}).WithDomainStore(domainStore).WithProductStore(productStore).WithIdentityResolver(identities).
+		WithMetrics(proxyMetrics).WithAccessLog(storage.NewAccessLogStore(kv, cfg.AccessLogMaxEntries)).
+		WithAliasStore(storage.NewAliasStore(kv)).WithEvents(bus).WithAdminGuard(adminGuard)
+	// Los middlewares van antes de cualquier ruta: gin solo los aplica a las que
+	// se registran despues, y <short>.<dominio>/health es del upstream.
+	r.Use(ih.HostRouting())
 	r.GET("/health", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"status": "ok"})
 	})
-
-	routeStore := storage.NewRouteStore()
-	ih := instances.NewHandler(routeStore, instanceStore)
 	ih.RegisterRoutes(r)
+	r.GET("/metrics", metrics.Handler(proxyMetrics, instanceLabels(instanceStore)))
 
 	api := r.Group("/api")
+	ih.RegisterAPIRoutes(api)
 
-	ph := products.NewHandler(productStore)
+	ph := products.NewHandler(productStore).WithInstanceLister(instanceStore).WithIdentityResolver(identities).WithEvents(bus)
 	api.POST("/products", ph.Create)
 	api.GET("/products", ph.List)
 	api.GET("/products/:id", ph.Get)
 	api.PUT("/products/:id", ph.Update)
 	api.DELETE("/products/:id", ph.Delete)
+	api.POST("/products/:id/restore", ph.Restore)
 
-	dh := deployments.NewHandler(cfg, productStore, instanceStore)
+	sshUserStore := storage.NewSSHUserStore(kv)
+	dh := deployments.NewHandler(cfg, productStore, instanceStore).WithDomainStore(domainStore).WithLogArchive(logArchive).
+		WithSSHUserStore(sshUserStore).WithIdentityResolver(identities).WithEvents(bus).WithMetrics(proxyMetrics)
 	api.GET("/deployments", dh.List)
 	api.POST("/deployments", dh.Create)
 	api.GET("/deployments/:id/logs", dh.GetLogs)
+	api.GET("/deployments/:id/health", dh.Health)
+	api.GET("/deployments/:id/artifacts", dh.Artifacts)
+	api.GET("/deployments/:id/artifacts/:job/:build/*path", dh.DownloadArtifact)
 	api.DELETE("/deployments/:id", dh.Delete)
+	api.POST("/deployments/:id/restore", dh.Restore)
 
 	api.GET("/deployments/pending", dh.PendingJobs)
 	api.GET("/deployments/job/:job/build/:build/status", dh.BuildStatus)
 	api.GET("/deployments/job/:job/build/:build/logs", dh.BuildLogs)
 
-	tsClient := tailscale.NewClient(cfg.TailscaleAPIKey, cfg.TailscaleTailnet)
+	lh := logarchive.NewHandler(logArchive)
+	api.GET("/logs/search", lh.Search)
+
 	tsHandler := tailscale.NewHandler(tsClient)
 	api.GET("/tailscale/devices", tsHandler.ListDevices)
 	api.GET("/tailscale/current", tsHandler.CurrentDevice)
 	api.GET("/tailscale/devices/:id", tsHandler.GetDevice)
 
-	sshUserHandler := sshusers.NewHandler(storage.NewSSHUserStore())
+	sshUserHandler := sshusers.NewHandler(sshUserStore)
 	api.GET("/ssh-users", sshUserHandler.List)
 	api.PUT("/ssh-users/:host", sshUserHandler.Upsert)
 	api.DELETE("/ssh-users/:host", sshUserHandler.Delete)
+
+	trashHandler := trash.NewHandler(storage.NewTrashStore(kv))
+	api.GET("/trash", trashHandler.List)
+
+	eventsHandler := events.NewHandler(bus, events.NewFeed(bus, time.Second))
+	api.GET("/events/stream", eventsHandler.Stream)
+
+	wh := webhooks.NewHandler(storage.NewWebhookStore(kv), dispatcher)
+	api.GET("/webhooks", wh.List)
+	api.POST("/webhooks", wh.Create)
+	api.GET("/webhooks/:id", wh.Get)
+	api.PUT("/webhooks/:id", wh.Update)
+	api.DELETE("/webhooks/:id", wh.Delete)
+	api.GET("/webhooks/:id/deliveries", wh.Deliveries)
+	api.POST("/webhooks/:id/deliveries/:delivery/redeliver", wh.Redeliver)
+
+	auditHandler := audit.NewHandler(auditStore)
+	api.GET("/audit", auditHandler.List)
+	api.GET("/audit/export", auditHandler.Export)
+
+	bh := backup.NewHandler(kv)
+	// El export lleva los secretos de los webhooks.
+	api.GET("/admin/export", adminGuard, bh.Export)
+	api.POST("/admin/import", adminGuard, bh.Import)
+
+	return ih
+}
+
+// instanceLabelsTTL es cuanto se reusan las etiquetas entre scrapes.
+const instanceLabelsTTL = 30 * time.Second
+
+// instanceLabels resuelve product/environment de cada instancia para las series
+// de Prometheus. Se cachean para no leer todas las instancias en cada scrape.
+func instanceLabels(instanceStore *storage.InstanceStore) func() map[string]metrics.Labels {
+	var (
+		mu        sync.Mutex
+		cached    map[string]metrics.Labels
+		fetchedAt time.Time
+	)
+	return func() map[string]metrics.Labels {
+		mu.Lock()
+		defer mu.Unlock()
+		if cached != nil && time.Since(fetchedAt) < instanceLabelsTTL {
+			return cached
+		}
+		out := make(map[string]metrics.Labels)
+		for _, inst := range instanceStore.GetAll() {
+			out[inst.ID] = metrics.Labels{Product: inst.ProductID, Environment: inst.Environment}
+		}
+		cached, fetchedAt = out, time.Now()
+		return cached
+	}
 }
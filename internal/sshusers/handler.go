@@ -6,6 +6,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 
+	"ark_deploy/internal/audit"
 	"ark_deploy/internal/storage"
 )
 
@@ -51,10 +52,12 @@ func (h *Handler) Upsert(c *gin.Context) {
 		return
 	}
 
+	prev, _, _ := h.store.Get(host)
 	if err := h.store.Set(host, user); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
 		return
 	}
+	audit.Record(c, host, sshUserFields(prev), sshUserFields(user))
 
 	c.JSON(http.StatusOK, gin.H{"status": "ok", "host": host, "ssh_user": user})
 }
@@ -65,10 +68,19 @@ func (h *Handler) Delete(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"detail": "host is required"})
 		return
 	}
+	prev, _, _ := h.store.Get(host)
 	if err := h.store.Delete(host); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
 		return
 	}
+	audit.Record(c, host, sshUserFields(prev), nil)
 	c.JSON(http.StatusOK, gin.H{"status": "ok", "host": host})
 }
 
+// sshUserFields arma el registro auditado; nil si no habia usuario.
+func sshUserFields(user string) any {
+	if user == "" {
+		return nil
+	}
+	return gin.H{"ssh_user": user}
+}
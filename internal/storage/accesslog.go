@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Access log del proxy: un stream acotado por instancia (accesslog:<id>).
+
+const DefaultAccessLogMaxEntries = 1000
+
+type AccessLogEntry struct {
+	ID         string    `json:"id,omitempty"`
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Host       string    `json:"host"`
+	Path       string    `json:"path"`
+	Query      string    `json:"query,omitempty"`
+	Status     int       `json:"status"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+	DurationMs float64   `json:"duration_ms"`
+	ClientIP   string    `json:"client_ip"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	Referer    string    `json:"referer,omitempty"`
+}
+
+type AccessLogStore struct {
+	kv         KV
+	maxEntries int64
+}
+
+func NewAccessLogStore(kv KV, maxEntries int) *AccessLogStore {
+	if maxEntries <= 0 {
+		maxEntries = DefaultAccessLogMaxEntries
+	}
+	return &AccessLogStore{kv: kv, maxEntries: int64(maxEntries)}
+}
+
+func accessLogKey(instanceID string) string {
+	return "accesslog:" + strings.TrimSpace(instanceID)
+}
+
+func (s *AccessLogStore) Append(instanceID string, e AccessLogEntry) error {
+	e.ID = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.kv.XAdd(accessLogKey(instanceID), string(data), s.maxEntries)
+	return err
+}
+
+// List devuelve las entradas mas recientes primero. before (un id del stream,
+// exclusivo) permite paginar hacia atras.
+func (s *AccessLogStore) List(instanceID string, limit int, before string) ([]AccessLogEntry, error) {
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	msgs, err := s.kv.XRevRange(accessLogKey(instanceID), before, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]AccessLogEntry, 0, len(msgs))
+	for _, m := range msgs {
+		var e AccessLogEntry
+		if err := json.Unmarshal([]byte(m.Value), &e); err != nil {
+			continue
+		}
+		e.ID = m.ID
+		out = append(out, e)
+	}
+
+	return out, nil
+}
+
+func (s *AccessLogStore) Delete(instanceID string) error {
+	_, err := s.kv.Del(accessLogKey(instanceID))
+	return err
+}
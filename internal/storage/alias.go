@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Aliases de servicio: alias:<name> -> JSON con las instancias destino y sus pesos.
+// Todo el alias vive en una sola clave, asi cambiar los pesos es atomico.
+// El set aliases permite listarlos.
+
+var (
+	ErrAliasNotFound = errors.New("alias not found")
+	ErrAliasExists   = errors.New("alias already exists")
+)
+
+const aliasesKey = "aliases"
+
+// AliasTarget es una instancia del alias con su peso relativo.
+type AliasTarget struct {
+	InstanceID string `json:"instance_id"`
+	Weight     int    `json:"weight"`
+}
+
+type Alias struct {
+	Name      string        `json:"name"`
+	Targets   []AliasTarget `json:"targets"`
+	Sticky    bool          `json:"sticky"`
+	CreatedAt time.Time     `json:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+	// SchemaVersion es la version del formato del registro (ver migrate.go).
+	SchemaVersion int `json:"schema_version"`
+}
+
+type AliasStore struct {
+	kv KV
+}
+
+func NewAliasStore(kv KV) *AliasStore {
+	return &AliasStore{kv: kv}
+}
+
+func aliasKey(name string) string {
+	return "alias:" + strings.ToLower(strings.TrimSpace(name))
+}
+
+func (s *AliasStore) Get(name string) (Alias, bool, error) {
+	raw, ok, err := s.kv.Get(aliasKey(name))
+	if err != nil || !ok {
+		return Alias{}, false, err
+	}
+
+	var a Alias
+	if err := json.Unmarshal([]byte(raw), &a); err != nil {
+		return Alias{}, false, err
+	}
+	return a, true, nil
+}
+
+func (s *AliasStore) List() ([]Alias, error) {
+	names, err := s.kv.SMembers(aliasesKey)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	out := make([]Alias, 0, len(names))
+	for _, name := range names {
+		a, ok, err := s.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			out = append(out, a)
+		}
+	}
+	return out, nil
+}
+
+// Create guarda un alias nuevo; ErrAliasExists si el nombre ya esta en uso.
+func (s *AliasStore) Create(a Alias) error {
+	a.SchemaVersion = aliasSchemaVersion
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	ok, err := s.kv.SetNX(aliasKey(a.Name), string(data))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrAliasExists
+	}
+	return s.kv.SAdd(aliasesKey, a.Name)
+}
+
+// Update reemplaza destinos y pesos en una sola escritura.
+func (s *AliasStore) Update(a Alias) error {
+	a.SchemaVersion = aliasSchemaVersion
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	ok, err := s.kv.SetXX(aliasKey(a.Name), string(data))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrAliasNotFound
+	}
+	return nil
+}
+
+func (s *AliasStore) Delete(name string) error {
+	found, err := s.kv.Del(aliasKey(name))
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrAliasNotFound
+	}
+	return s.kv.SRem(aliasesKey, strings.ToLower(strings.TrimSpace(name)))
+}
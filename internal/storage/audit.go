@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Auditoria de la API: un stream unico (audit) de solo agregado, acotado a
+// maxEntries. Cada entrada es una llamada que cambio (o intento cambiar) estado.
+
+const (
+	auditKey               = "audit"
+	DefaultAuditMaxEntries = 100000
+	auditScanBatch         = 500
+)
+
+// AuditChange es el valor de un campo antes y despues; nil si no existia.
+type AuditChange struct {
+	Before any `json:"before,omitempty"`
+	After  any `json:"after,omitempty"`
+}
+
+type AuditEntry struct {
+	ID              string                 `json:"id,omitempty"`
+	Time            time.Time              `json:"time"`
+	Actor           string                 `json:"actor"`
+	ClientIP        string                 `json:"client_ip"`
+	ForwardedFor    string                 `json:"forwarded_for,omitempty"`
+	TailscaleUser   string                 `json:"tailscale_user,omitempty"`
+	TailscaleDevice string                 `json:"tailscale_device,omitempty"`
+	Action          string                 `json:"action"`
+	Target          string                 `json:"target,omitempty"`
+	Method          string                 `json:"method"`
+	Path            string                 `json:"path"`
+	Status          int                    `json:"status"`
+	Changes         map[string]AuditChange `json:"changes,omitempty"`
+}
+
+// AuditQuery filtra la auditoria; los campos vacios no filtran. Action acepta
+// un prefijo terminado en "." (p.ej. "product."). Before es un id del stream
+// (exclusivo) para paginar hacia atras; Limit 0 devuelve todo.
+type AuditQuery struct {
+	Actor  string
+	Action string
+	Target string
+	Since  time.Time
+	Until  time.Time
+	Before string
+	Limit  int
+}
+
+func (q AuditQuery) matches(e AuditEntry) bool {
+	if q.Actor != "" && !strings.EqualFold(e.Actor, q.Actor) && !strings.EqualFold(e.TailscaleUser, q.Actor) {
+		return false
+	}
+	if q.Action != "" {
+		if strings.HasSuffix(q.Action, ".") {
+			if !strings.HasPrefix(e.Action, q.Action) {
+				return false
+			}
+		} else if e.Action != q.Action {
+			return false
+		}
+	}
+	if q.Target != "" && e.Target != q.Target {
+		return false
+	}
+	if !q.Until.IsZero() && e.Time.After(q.Until) {
+		return false
+	}
+	return true
+}
+
+type AuditLogStore struct {
+	kv         KV
+	maxEntries int64
+}
+
+func NewAuditLogStore(kv KV, maxEntries int) *AuditLogStore {
+	if maxEntries <= 0 {
+		maxEntries = DefaultAuditMaxEntries
+	}
+	return &AuditLogStore{kv: kv, maxEntries: int64(maxEntries)}
+}
+
+func (s *AuditLogStore) Append(e AuditEntry) (string, error) {
+	e.ID = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	return s.kv.XAdd(auditKey, string(data), s.maxEntries)
+}
+
+// List recorre el stream de lo mas nuevo a lo mas viejo y devuelve las entradas
+// que cumplen la consulta. next es el cursor para la pagina siguiente ("" = fin).
+func (s *AuditLogStore) List(q AuditQuery) (entries []AuditEntry, next string, err error) {
+	entries = []AuditEntry{}
+	before := q.Before
+
+	for {
+		msgs, err := s.kv.XRevRange(auditKey, before, auditScanBatch)
+		if err != nil {
+			return nil, "", err
+		}
+
+		for _, m := range msgs {
+			before = m.ID
+
+			var e AuditEntry
+			if err := json.Unmarshal([]byte(m.Value), &e); err != nil {
+				continue
+			}
+			e.ID = m.ID
+
+			// El stream esta ordenado por tiempo: pasado Since no hay mas.
+			if !q.Since.IsZero() && e.Time.Before(q.Since) {
+				return entries, "", nil
+			}
+			if !q.matches(e) {
+				continue
+			}
+			entries = append(entries, e)
+			if q.Limit > 0 && len(entries) == q.Limit {
+				return entries, e.ID, nil
+			}
+		}
+
+		if len(msgs) < auditScanBatch {
+			return entries, "", nil
+		}
+	}
+}
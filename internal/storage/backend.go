@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Modos de balanceo entre los backends de una instancia.
+const (
+	BalanceRoundRobin = "round_robin"
+	BalanceLeastConn  = "least_conn"
+)
+
+// Backend es una replica de la instancia (mismo producto en otra maquina).
+// Con lease debe volver a registrarse antes de ExpiresAt o se descarta.
+type Backend struct {
+	Host         string         `json:"host"`
+	Port         int            `json:"port"`
+	Services     map[string]int `json:"services,omitempty"`
+	RegisteredAt time.Time      `json:"registered_at"`
+	LastSeenAt   time.Time      `json:"last_seen_at"`
+	ExpiresAt    *time.Time     `json:"expires_at,omitempty"`
+}
+
+// Key identifica el backend dentro de la instancia (host:port).
+func (b Backend) Key() string {
+	return net.JoinHostPort(b.Host, strconv.Itoa(b.Port))
+}
+
+// Expired indica si el lease vencio; sin lease nunca vence.
+func (b Backend) Expired(now time.Time) bool {
+	return b.ExpiresAt != nil && !now.Before(*b.ExpiresAt)
+}
+
+// ServicePort devuelve el puerto del servicio en este backend; "" o el
+// servicio por defecto usan Port.
+func (b Backend) ServicePort(name string, defaultService string) (int, bool) {
+	if name == "" || name == defaultService {
+		return b.Port, true
+	}
+	port, ok := b.Services[name]
+	return port, ok
+}
+
+// LiveBackends devuelve los backends con lease vigente. Las rutas registradas
+// antes de soportar replicas se tratan como un unico backend sin lease.
+func (r Route) LiveBackends(now time.Time) []Backend {
+	if len(r.Backends) == 0 {
+		if r.TargetHost == "" {
+			return nil
+		}
+		return []Backend{{Host: r.TargetHost, Port: r.TargetPort, Services: r.Services}}
+	}
+
+	out := make([]Backend, 0, len(r.Backends))
+	for _, b := range r.Backends {
+		if !b.Expired(now) {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// DropExpired quita los backends vencidos. Devuelve true si hubo cambios.
+func (r *Route) DropExpired(now time.Time) bool {
+	return r.removeBackends(func(b Backend) bool { return b.Expired(now) })
+}
+
+// RemoveBackend quita el backend host:port. Devuelve false si no existia.
+func (r *Route) RemoveBackend(key string) bool {
+	return r.removeBackends(func(b Backend) bool { return b.Key() == key })
+}
+
+// removeBackends quita los backends indicados y mueve el destino principal al
+// backend restante visto mas recientemente.
+func (r *Route) removeBackends(drop func(Backend) bool) bool {
+	kept := make([]Backend, 0, len(r.Backends))
+	for _, b := range r.Backends {
+		if !drop(b) {
+			kept = append(kept, b)
+		}
+	}
+	if len(kept) == len(r.Backends) {
+		return false
+	}
+
+	r.Backends = kept
+	r.TargetHost, r.TargetPort, r.Services = "", 0, nil
+	var latest *Backend
+	for i := range kept {
+		if latest == nil || kept[i].LastSeenAt.After(latest.LastSeenAt) {
+			latest = &kept[i]
+		}
+	}
+	if latest != nil {
+		r.TargetHost, r.TargetPort, r.Services = latest.Host, latest.Port, latest.Services
+	}
+	return true
+}
+
+// UpsertBackend agrega o refresca el backend (lease 0 = sin vencimiento) y lo
+// deja como destino principal. Los backends vencidos se descartan. Sin lease es
+// el callback de siempre: reemplaza a los demas backends sin lease, asi un
+// redeploy en otro puerto no deja el anterior como backend para siempre.
+func (r *Route) UpsertBackend(b Backend, lease time.Duration, now time.Time) {
+	// Ruta registrada antes de las replicas: su destino pasa a ser un backend mas.
+	if len(r.Backends) == 0 && r.TargetHost != "" {
+		r.Backends = []Backend{{
+			Host:         r.TargetHost,
+			Port:         r.TargetPort,
+			Services:     r.Services,
+			RegisteredAt: r.UpdatedAt,
+			LastSeenAt:   r.UpdatedAt,
+		}}
+	}
+	r.DropExpired(now)
+
+	b.Host = strings.TrimSpace(b.Host)
+	if lease <= 0 {
+		kept := r.Backends[:0:0]
+		for _, existing := range r.Backends {
+			if existing.ExpiresAt != nil || existing.Key() == b.Key() {
+				kept = append(kept, existing)
+			}
+		}
+		r.Backends = kept
+	}
+	b.RegisteredAt = now
+	b.LastSeenAt = now
+	b.ExpiresAt = nil
+	if lease > 0 {
+		exp := now.Add(lease)
+		b.ExpiresAt = &exp
+	}
+
+	replaced := false
+	for i, existing := range r.Backends {
+		if existing.Key() == b.Key() {
+			b.RegisteredAt = existing.RegisteredAt
+			r.Backends[i] = b
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		r.Backends = append(r.Backends, b)
+	}
+
+	r.TargetHost, r.TargetPort, r.Services = b.Host, b.Port, b.Services
+}
+
+// RegisterBackend agrega o refresca un backend de la instancia (ver UpsertBackend).
+// Dos registros concurrentes no se pisan: se confirma con compare-and-swap.
+func (s *RouteStore) RegisterBackend(instanceID string, b Backend, defaultService string, lease time.Duration) (Route, error) {
+	return s.update(instanceID, true, func(record *Route) error {
+		record.InstanceID = strings.TrimSpace(instanceID)
+		record.DefaultService = defaultService
+		record.UpsertBackend(b, lease, time.Now().UTC())
+		return nil
+	})
+}
+
+// RemoveBackend quita un backend (host:port) de la instancia.
+func (s *RouteStore) RemoveBackend(instanceID string, key string) error {
+	_, err := s.update(instanceID, false, func(record *Route) error {
+		if !record.RemoveBackend(key) {
+			return ErrBackendNotFound
+		}
+		return nil
+	})
+	return err
+}
+
+// SetBalancing cambia el modo de balanceo y la afinidad por cookie.
+func (s *RouteStore) SetBalancing(instanceID string, mode string, sticky bool) error {
+	_, err := s.update(instanceID, false, func(record *Route) error {
+		record.Balancing = mode
+		record.Sticky = sticky
+		return nil
+	})
+	return err
+}
+
+// PruneExpiredBackends descarta los backends que dejaron de renovar su lease.
+func (s *RouteStore) PruneExpiredBackends() (int, error) {
+	routes, err := s.ListRoutes()
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	pruned := 0
+	for _, r := range routes {
+		if !r.DropExpired(now) {
+			continue
+		}
+		dropped := 0
+		_, err := s.update(r.InstanceID, false, func(record *Route) error {
+			before := len(record.Backends)
+			if !record.DropExpired(now) {
+				return errNoChange
+			}
+			dropped = before - len(record.Backends)
+			return nil
+		})
+		if err != nil && !errors.Is(err, errNoChange) && !errors.Is(err, ErrRouteNotFound) {
+			return pruned, err
+		}
+		if err == nil {
+			pruned += dropped
+		}
+	}
+	return pruned, nil
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRoute_UpsertBackendAndLeases(t *testing.T) {
+	now := time.Unix(1000, 0).UTC()
+	r := Route{InstanceID: "i-1", TargetHost: "10.0.0.1", TargetPort: 8080, UpdatedAt: now.Add(-time.Hour)}
+
+	// La ruta previa a las replicas se conserva como backend sin lease.
+	r.UpsertBackend(Backend{Host: "10.0.0.2", Port: 9090}, time.Minute, now)
+	if len(r.Backends) != 2 || r.Backends[0].Key() != "10.0.0.1:8080" || r.Backends[0].ExpiresAt != nil {
+		t.Fatalf("expected legacy target kept as first backend, got %+v", r.Backends)
+	}
+	if r.TargetHost != "10.0.0.2" || r.TargetPort != 9090 {
+		t.Fatalf("latest backend must become the primary, got %s:%d", r.TargetHost, r.TargetPort)
+	}
+
+	// Heartbeat: refresca el lease sin duplicar ni perder registered_at.
+	registered := r.Backends[1].RegisteredAt
+	r.UpsertBackend(Backend{Host: "10.0.0.2", Port: 9090}, time.Minute, now.Add(30*time.Second))
+	if len(r.Backends) != 2 || !r.Backends[1].RegisteredAt.Equal(registered) || !r.Backends[1].ExpiresAt.Equal(now.Add(90*time.Second)) {
+		t.Fatalf("expected lease refreshed in place, got %+v", r.Backends[1])
+	}
+
+	if live := r.LiveBackends(now.Add(2 * time.Minute)); len(live) != 1 || live[0].Key() != "10.0.0.1:8080" {
+		t.Fatalf("expired backend must not be live, got %+v", live)
+	}
+
+	if !r.DropExpired(now.Add(2 * time.Minute)) {
+		t.Fatalf("expected expired backend dropped")
+	}
+	if len(r.Backends) != 1 || r.TargetHost != "10.0.0.1" || r.TargetPort != 8080 {
+		t.Fatalf("primary must move to the remaining backend, got %+v", r)
+	}
+
+	if !r.RemoveBackend("10.0.0.1:8080") || len(r.LiveBackends(now)) != 0 || r.TargetHost != "" {
+		t.Fatalf("removing the last backend must leave the route without targets, got %+v", r)
+	}
+	if r.RemoveBackend("10.0.0.1:8080") {
+		t.Fatalf("removing twice must report not found")
+	}
+}
+
+func TestRoute_LeaselessRegistrationReplacesPreviousTarget(t *testing.T) {
+	now := time.Unix(1000, 0).UTC()
+	r := Route{InstanceID: "i-1"}
+
+	r.UpsertBackend(Backend{Host: "10.0.0.1", Port: 8080}, 0, now)
+	r.UpsertBackend(Backend{Host: "10.0.0.3", Port: 7070}, time.Minute, now)
+
+	// Redeploy por callback en otro puerto: el puerto viejo no queda como backend.
+	r.UpsertBackend(Backend{Host: "10.0.0.1", Port: 8081}, 0, now.Add(time.Second))
+	keys := []string{}
+	for _, b := range r.Backends {
+		keys = append(keys, b.Key())
+	}
+	if fmt.Sprint(keys) != "[10.0.0.3:7070 10.0.0.1:8081]" {
+		t.Fatalf("expected the old lease-less backend replaced and the leased one kept, got %v", keys)
+	}
+}
+
+func TestRouteStore_ConcurrentRegistrationsKeepAllBackends(t *testing.T) {
+	store := NewRouteStore(openTestKV(t, filepath.Join(t.TempDir(), "ark.db")))
+
+	const replicas = 8
+	var wg sync.WaitGroup
+	for i := 0; i < replicas; i++ {
+		wg.Add(1)
+		go func(port int) {
+			defer wg.Done()
+			if _, err := store.RegisterBackend("i-1", Backend{Host: "10.0.0.1", Port: port}, "", time.Minute); err != nil {
+				t.Errorf("register %d: %v", port, err)
+			}
+		}(9000 + i)
+	}
+	wg.Wait()
+
+	route, _, err := store.GetRouteRecord("i-1")
+	if err != nil || len(route.Backends) != replicas {
+		t.Fatalf("expected %d backends, got %d (%v)", replicas, len(route.Backends), err)
+	}
+
+	if err := store.RemoveBackend("i-1", "10.0.0.1:9000"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if err := store.RemoveBackend("i-1", "10.0.0.1:9000"); err != ErrBackendNotFound {
+		t.Fatalf("expected ErrBackendNotFound, got %v", err)
+	}
+	if err := store.RemoveBackend("missing", "10.0.0.1:9000"); err != ErrRouteNotFound {
+		t.Fatalf("expected ErrRouteNotFound, got %v", err)
+	}
+}
+
+func TestRouteStore_SettersDoNotDropConcurrentBackends(t *testing.T) {
+	store := NewRouteStore(openTestKV(t, filepath.Join(t.TempDir(), "ark.db")))
+	if _, err := store.RegisterBackend("i-1", Backend{Host: "10.0.0.1", Port: 8999}, "", time.Minute); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	// Un PUT de limites a la vez que registran replicas no debe pisar la lista.
+	const replicas = 4
+	var wg sync.WaitGroup
+	for i := 0; i < replicas; i++ {
+		wg.Add(2)
+		go func(port int) {
+			defer wg.Done()
+			if _, err := store.RegisterBackend("i-1", Backend{Host: "10.0.0.1", Port: port}, "", time.Minute); err != nil {
+				t.Errorf("register %d: %v", port, err)
+			}
+		}(9000 + i)
+		go func(n int) {
+			defer wg.Done()
+			if err := store.SetLimits("i-1", &RateLimit{RequestsPerSecond: float64(10 + n)}); err != nil {
+				t.Errorf("set limits: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	route, _, err := store.GetRouteRecord("i-1")
+	if err != nil || len(route.Backends) != replicas+1 {
+		t.Fatalf("expected %d backends, got %d (%v)", replicas+1, len(route.Backends), err)
+	}
+	if route.Limits == nil {
+		t.Fatalf("expected limits kept")
+	}
+}
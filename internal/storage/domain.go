@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Dominios propios por instancia: domain:<host> -> instance_id.
+// El set instance_domains:<id> permite listarlos y liberarlos al borrar la instancia.
+
+var ErrDomainTaken = errors.New("domain already claimed by another instance")
+
+type DomainStore struct {
+	kv KV
+}
+
+func NewDomainStore(kv KV) *DomainStore {
+	return &DomainStore{kv: kv}
+}
+
+func domainKey(host string) string {
+	return "domain:" + strings.ToLower(strings.TrimSpace(host))
+}
+
+func instanceDomainsKey(instanceID string) string {
+	return "instance_domains:" + strings.TrimSpace(instanceID)
+}
+
+// Claim asocia el host a la instancia. Es idempotente para el mismo dueño y
+// devuelve ErrDomainTaken si otra instancia ya lo tiene.
+func (s *DomainStore) Claim(host string, instanceID string) error {
+	h := strings.ToLower(strings.TrimSpace(host))
+	id := strings.TrimSpace(instanceID)
+	if h == "" || id == "" {
+		return errors.New("host and instance id are required")
+	}
+
+	ok, err := s.kv.SetNX(domainKey(h), id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		owner, _, err := s.kv.Get(domainKey(h))
+		if err != nil {
+			return err
+		}
+		if owner != id {
+			return ErrDomainTaken
+		}
+	}
+
+	return s.kv.SAdd(instanceDomainsKey(id), h)
+}
+
+func (s *DomainStore) Resolve(host string) (string, bool, error) {
+	h := strings.ToLower(strings.TrimSpace(host))
+	if h == "" {
+		return "", false, nil
+	}
+
+	return s.kv.Get(domainKey(h))
+}
+
+func (s *DomainStore) ListByInstance(instanceID string) ([]string, error) {
+	hosts, err := s.kv.SMembers(instanceDomainsKey(instanceID))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(hosts)
+	return hosts, nil
+}
+
+// Release libera el host solo si pertenece a la instancia indicada.
+func (s *DomainStore) Release(host string, instanceID string) error {
+	h := strings.ToLower(strings.TrimSpace(host))
+	id := strings.TrimSpace(instanceID)
+
+	owner, ok, err := s.Resolve(h)
+	if err != nil {
+		return err
+	}
+	if !ok || owner != id {
+		return errors.New("domain not found")
+	}
+
+	if _, err := s.kv.Del(domainKey(h)); err != nil {
+		return err
+	}
+	return s.kv.SRem(instanceDomainsKey(id), h)
+}
+
+func (s *DomainStore) ReleaseAll(instanceID string) error {
+	hosts, err := s.ListByInstance(instanceID)
+	if err != nil {
+		return err
+	}
+
+	for _, h := range hosts {
+		if owner, ok, err := s.Resolve(h); err == nil && ok && owner == instanceID {
+			if _, err := s.kv.Del(domainKey(h)); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = s.kv.Del(instanceDomainsKey(instanceID))
+	return err
+}
@@ -0,0 +1,354 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Indices secundarios, se mantienen en cada escritura de los stores:
+//
+//	idx:instances:created             sorted set id -> created_at (ms)
+//	idx:instances:<campo>:<valor>     set de ids por product, device, env y status
+//	idx:products                      set de ids de productos
+//	idx:routes:short:<short>          set de instance ids con ruta (short = 8 primeros caracteres)
+//	idx:version                       version de los indices armados
+//
+// RebuildIndexes los regenera desde los registros; EnsureIndexes lo hace al
+// arrancar solo si faltan o cambio indexVersion.
+
+const (
+	indexPrefix         = "idx:"
+	instancesCreatedKey = "idx:instances:created"
+	productsIndexKey    = "idx:products"
+	indexVersionKey     = "idx:version"
+	shortIDLen          = 8
+
+	// indexVersion se sube cuando cambia el formato de los indices.
+	indexVersion = "1"
+
+	// listBatch es cuantos miembros del sorted set lee List por vuelta.
+	listBatch = 200
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+type instanceIndexField struct {
+	name  string
+	value func(Instance) string
+}
+
+var instanceIndexFields = []instanceIndexField{
+	{"product", func(i Instance) string { return i.ProductID }},
+	{"device", func(i Instance) string { return i.DeviceID }},
+	{"env", func(i Instance) string { return i.Environment }},
+	{"status", func(i Instance) string { return i.Status }},
+}
+
+func instanceIndexKey(field, value string) string {
+	return indexPrefix + "instances:" + field + ":" + strings.ToLower(strings.TrimSpace(value))
+}
+
+func shortIndexKey(id string) string {
+	short := strings.ToLower(strings.TrimSpace(id))
+	if len(short) > shortIDLen {
+		short = short[:shortIDLen]
+	}
+	return indexPrefix + "routes:short:" + short
+}
+
+func createdScore(i Instance) float64 {
+	return float64(i.CreatedAt.UnixMilli())
+}
+
+// indexInstance actualiza los indices; prev es la version guardada antes (nil al crear).
+// Solo toca los indices de los campos que cambiaron.
+func indexInstance(kv KV, prev *Instance, i Instance) error {
+	for _, f := range instanceIndexFields {
+		value := strings.TrimSpace(f.value(i))
+		if prev != nil {
+			old := strings.TrimSpace(f.value(*prev))
+			if strings.EqualFold(old, value) {
+				continue
+			}
+			if old != "" {
+				if err := kv.SRem(instanceIndexKey(f.name, old), i.ID); err != nil {
+					return err
+				}
+			}
+		}
+		if value != "" {
+			if err := kv.SAdd(instanceIndexKey(f.name, value), i.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	if prev == nil || !prev.CreatedAt.Equal(i.CreatedAt) {
+		return kv.ZAdd(instancesCreatedKey, i.ID, createdScore(i))
+	}
+	return nil
+}
+
+func unindexInstance(kv KV, i Instance) error {
+	for _, f := range instanceIndexFields {
+		if value := strings.TrimSpace(f.value(i)); value != "" {
+			if err := kv.SRem(instanceIndexKey(f.name, value), i.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return kv.ZRem(instancesCreatedKey, i.ID)
+}
+
+// InstanceQuery filtra por los campos indexados (vacio = sin filtro) y pagina por
+// fecha de creacion. Limit 0 devuelve todas.
+type InstanceQuery struct {
+	ProductID   string
+	DeviceID    string
+	Environment string
+	Status      string
+	Ascending   bool
+	Cursor      string
+	Limit       int
+}
+
+type InstancePage struct {
+	Instances  []Instance
+	Total      int
+	NextCursor string
+}
+
+// List resuelve la consulta con los indices: recorre el sorted set desde el
+// cursor por tandas y solo lee los registros de la pagina.
+func (s *InstanceStore) List(q InstanceQuery) (InstancePage, error) {
+	var after *ZMember
+	if strings.TrimSpace(q.Cursor) != "" {
+		c, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return InstancePage{}, err
+		}
+		after = &c
+	}
+
+	// Interseccion de los sets de los filtros pedidos.
+	var allowed map[string]bool
+	filters := q.filters()
+	for _, f := range filters {
+		ids, err := s.kv.SMembers(instanceIndexKey(f.field, f.value))
+		if err != nil {
+			return InstancePage{}, err
+		}
+		next := make(map[string]bool, len(ids))
+		for _, id := range ids {
+			if allowed == nil || allowed[id] {
+				next[id] = true
+			}
+		}
+		allowed = next
+	}
+
+	page := InstancePage{Instances: []Instance{}}
+	if allowed != nil {
+		page.Total = len(allowed)
+	} else {
+		total, err := s.kv.ZCard(instancesCreatedKey)
+		if err != nil {
+			return InstancePage{}, err
+		}
+		page.Total = total
+	}
+
+	// El cursor acota el rango de scores; los empates con el cursor se
+	// descartan con zAfter.
+	min, max := math.Inf(-1), math.Inf(1)
+	if after != nil {
+		if q.Ascending {
+			min = after.Score
+		} else {
+			max = after.Score
+		}
+	}
+
+	var last ZMember
+	for offset := 0; ; offset += listBatch {
+		entries, err := s.kv.ZRangeByScore(instancesCreatedKey, min, max, !q.Ascending, offset, listBatch)
+		if err != nil {
+			return InstancePage{}, err
+		}
+		for _, e := range entries {
+			if allowed != nil && !allowed[e.Member] {
+				continue
+			}
+			if after != nil && !zAfter(e, *after, q.Ascending) {
+				continue
+			}
+			if q.Limit > 0 && len(page.Instances) == q.Limit {
+				page.NextCursor = encodeCursor(last)
+				return page, nil
+			}
+
+			i, err := s.GetByID(e.Member)
+			if err != nil {
+				continue
+			}
+			if !s.matches(i, filters) {
+				continue
+			}
+			page.Instances = append(page.Instances, i)
+			last = e
+		}
+		if len(entries) < listBatch {
+			return page, nil
+		}
+	}
+}
+
+type indexFilter struct {
+	field string
+	value string
+}
+
+// filters devuelve los filtros pedidos, con el nombre del campo del indice.
+func (q InstanceQuery) filters() []indexFilter {
+	var out []indexFilter
+	for _, f := range []indexFilter{
+		{"product", q.ProductID},
+		{"device", q.DeviceID},
+		{"env", q.Environment},
+		{"status", q.Status},
+	} {
+		if strings.TrimSpace(f.value) != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// matches vuelve a comparar el registro con los filtros: los sets se actualizan
+// despues del compare-and-swap y dos escrituras concurrentes pueden dejar un
+// miembro viejo. Ese miembro se saca del set; si el registro cambio entre
+// tanto y vuelve a coincidir, se lo repone.
+func (s *InstanceStore) matches(i Instance, filters []indexFilter) bool {
+	ok := true
+	for _, f := range filters {
+		for _, field := range instanceIndexFields {
+			if field.name != f.field || strings.EqualFold(strings.TrimSpace(field.value(i)), strings.TrimSpace(f.value)) {
+				continue
+			}
+			ok = false
+			key := instanceIndexKey(f.field, f.value)
+			if err := s.kv.SRem(key, i.ID); err != nil {
+				continue
+			}
+			if current, err := s.GetByID(i.ID); err == nil && strings.EqualFold(strings.TrimSpace(field.value(current)), strings.TrimSpace(f.value)) {
+				_ = s.kv.SAdd(key, i.ID)
+			}
+		}
+	}
+	return ok
+}
+
+// zAfter indica si e viene despues del cursor en el orden pedido.
+func zAfter(e, cursor ZMember, ascending bool) bool {
+	if e.Score != cursor.Score {
+		return (e.Score > cursor.Score) == ascending
+	}
+	if e.Member == cursor.Member {
+		return false
+	}
+	return (e.Member > cursor.Member) == ascending
+}
+
+func encodeCursor(z ZMember) string {
+	raw := strconv.FormatInt(int64(z.Score), 10) + ":" + z.Member
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(cursor string) (ZMember, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(cursor))
+	if err != nil {
+		return ZMember{}, ErrInvalidCursor
+	}
+	scorePart, member, ok := strings.Cut(string(raw), ":")
+	score, err := strconv.ParseInt(scorePart, 10, 64)
+	if !ok || err != nil || member == "" {
+		return ZMember{}, ErrInvalidCursor
+	}
+	return ZMember{Member: member, Score: float64(score)}, nil
+}
+
+// EnsureIndexes reconstruye los indices si faltan, si son de otra version o si
+// force. Con Redis compartido evita que cada arranque los borre mientras otras
+// replicas los usan. Devuelve si reconstruyo.
+func EnsureIndexes(kv KV, force bool) (bool, error) {
+	if !force {
+		version, ok, err := kv.Get(indexVersionKey)
+		if err != nil {
+			return false, err
+		}
+		if ok && version == indexVersion {
+			return false, nil
+		}
+	}
+	return true, RebuildIndexes(kv)
+}
+
+// RebuildIndexes borra los indices y los vuelve a armar recorriendo los registros.
+// Al terminar marca la version, asi EnsureIndexes no los vuelve a armar.
+func RebuildIndexes(kv KV) error {
+	stale, err := kv.Keys(indexPrefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range stale {
+		if _, err := kv.Del(key); err != nil {
+			return err
+		}
+	}
+
+	keys, err := kv.Keys("instance:")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		data, ok, err := kv.Get(key)
+		if err != nil || !ok {
+			continue
+		}
+		var i Instance
+		if err := json.Unmarshal([]byte(data), &i); err != nil {
+			continue
+		}
+		if err := indexInstance(kv, nil, i); err != nil {
+			return fmt.Errorf("index %s: %w", key, err)
+		}
+	}
+
+	keys, err = kv.Keys("product:")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := kv.SAdd(productsIndexKey, strings.TrimPrefix(key, "product:")); err != nil {
+			return err
+		}
+	}
+
+	keys, err = kv.Keys("route:")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		id := strings.TrimPrefix(key, "route:")
+		if err := kv.SAdd(shortIndexKey(id), id); err != nil {
+			return err
+		}
+	}
+
+	return kv.Set(indexVersionKey, indexVersion)
+}
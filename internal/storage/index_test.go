@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIndexes_FollowWritesAndRebuild(t *testing.T) {
+	kv := openTestKV(t, filepath.Join(t.TempDir(), "ark.db"))
+	instances := NewInstanceStore(kv)
+	routes := NewRouteStore(kv)
+
+	_ = instances.Create(Instance{ID: "0a1b2c3d-1111", ProductID: "shop", Status: "provisioning", CreatedAt: time.Unix(100, 0)})
+	_ = instances.Create(Instance{ID: "9f8e7d6c-2222", ProductID: "shop", Status: "running", CreatedAt: time.Unix(200, 0)})
+	_ = instances.UpdateStatus("0a1b2c3d-1111", "running")
+
+	if ids, _ := kv.SMembers(instanceIndexKey("status", "provisioning")); len(ids) != 0 {
+		t.Fatalf("status change must leave the old index, got %v", ids)
+	}
+	page, err := instances.List(InstanceQuery{Status: "running", ProductID: "SHOP"})
+	if err != nil || page.Total != 2 || page.Instances[0].ID != "9f8e7d6c-2222" {
+		t.Fatalf("unexpected page: %+v %v", page, err)
+	}
+
+	_ = routes.PutRoute("0a1b2c3d-1111", "10.0.0.1", 80)
+	if id, _, _, ok, _ := routes.GetRouteByShortID("0A1B2C3D"); !ok || id != "0a1b2c3d-1111" {
+		t.Fatalf("short id must resolve from the index, got %q ok=%v", id, ok)
+	}
+
+	// Un indice perdido (datos previos a los indices) se recupera al reconstruir.
+	_, _ = kv.Del(instancesCreatedKey)
+	_, _ = kv.Del(shortIndexKey("0a1b2c3d"))
+	if all := instances.GetAll(); len(all) != 0 {
+		t.Fatalf("expected GetAll to read the index, got %d", len(all))
+	}
+	if err := RebuildIndexes(kv); err != nil {
+		t.Fatalf("rebuild: %v", err)
+	}
+	if all := instances.GetAll(); len(all) != 2 || all[0].ID != "0a1b2c3d-1111" {
+		t.Fatalf("unexpected instances after rebuild: %+v", all)
+	}
+	if _, _, _, ok, _ := routes.GetRouteByShortID("0a1b2c3d"); !ok {
+		t.Fatalf("expected short index rebuilt")
+	}
+
+	_ = instances.Delete("9f8e7d6c-2222", "test")
+	_ = routes.DeleteRoute("0a1b2c3d-1111")
+	if page, _ := instances.List(InstanceQuery{ProductID: "shop"}); page.Total != 1 {
+		t.Fatalf("deleted instance must leave the indexes, got %+v", page)
+	}
+	if _, _, _, ok, _ := routes.GetRouteByShortID("0a1b2c3d"); ok {
+		t.Fatalf("deleted route must not resolve")
+	}
+}
+
+func TestIndexes_ListPagesAcrossBatches(t *testing.T) {
+	kv := openTestKV(t, filepath.Join(t.TempDir(), "ark.db"))
+	instances := NewInstanceStore(kv)
+
+	// Mas de dos tandas, con empates de fecha que cruzan las paginas.
+	n := 2*listBatch + 5
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("inst-%04d", i)
+		if err := instances.Create(Instance{ID: id, ProductID: "shop", CreatedAt: time.Unix(int64(1000+i/3), 0)}); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+
+	for _, asc := range []bool{true, false} {
+		var got []string
+		cursor := ""
+		for {
+			page, err := instances.List(InstanceQuery{ProductID: "shop", Ascending: asc, Cursor: cursor, Limit: 7})
+			if err != nil {
+				t.Fatalf("list: %v", err)
+			}
+			if page.Total != n {
+				t.Fatalf("expected total %d, got %d", n, page.Total)
+			}
+			for _, i := range page.Instances {
+				got = append(got, i.ID)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			cursor = page.NextCursor
+		}
+		if len(got) != n {
+			t.Fatalf("asc=%v: expected %d instances, got %d", asc, n, len(got))
+		}
+		for i := 1; i < len(got); i++ {
+			if (got[i-1] < got[i]) != asc {
+				t.Fatalf("asc=%v: out of order at %d: %s then %s", asc, i, got[i-1], got[i])
+			}
+		}
+	}
+}
+
+func TestIndexes_EnsureOnlyRebuildsWhenMissing(t *testing.T) {
+	kv := openTestKV(t, filepath.Join(t.TempDir(), "ark.db"))
+	instances := NewInstanceStore(kv)
+	_ = instances.Create(Instance{ID: "i-1", ProductID: "shop", CreatedAt: time.Unix(100, 0)})
+
+	if rebuilt, err := EnsureIndexes(kv, false); err != nil || !rebuilt {
+		t.Fatalf("expected a first rebuild, got %v %v", rebuilt, err)
+	}
+
+	// Con la version marcada no se tocan: una clave extra sobrevive.
+	_ = kv.SAdd(instanceIndexKey("env", "prod"), "ghost")
+	if rebuilt, err := EnsureIndexes(kv, false); err != nil || rebuilt {
+		t.Fatalf("expected no rebuild, got %v %v", rebuilt, err)
+	}
+	if ids, _ := kv.SMembers(instanceIndexKey("env", "prod")); len(ids) != 1 {
+		t.Fatalf("indexes must be left alone, got %v", ids)
+	}
+
+	if rebuilt, err := EnsureIndexes(kv, true); err != nil || !rebuilt {
+		t.Fatalf("expected a forced rebuild, got %v %v", rebuilt, err)
+	}
+	if ids, _ := kv.SMembers(instanceIndexKey("env", "prod")); len(ids) != 0 {
+		t.Fatalf("forced rebuild must drop stale entries, got %v", ids)
+	}
+}
+
+func TestIndexes_ListSkipsStaleMembers(t *testing.T) {
+	kv := openTestKV(t, filepath.Join(t.TempDir(), "ark.db"))
+	instances := NewInstanceStore(kv)
+
+	_ = instances.Create(Instance{ID: "i-1", ProductID: "shop", Status: "running", CreatedAt: time.Unix(100, 0)})
+	_ = instances.Create(Instance{ID: "i-2", ProductID: "shop", Status: "failed", CreatedAt: time.Unix(200, 0)})
+	// Como si dos updates concurrentes hubieran dejado i-2 en el set viejo.
+	_ = kv.SAdd(instanceIndexKey("status", "running"), "i-2")
+
+	page, err := instances.List(InstanceQuery{Status: "running"})
+	if err != nil || len(page.Instances) != 1 || page.Instances[0].ID != "i-1" {
+		t.Fatalf("a failed instance must not be listed as running: %+v %v", page, err)
+	}
+	if ids, _ := kv.SMembers(instanceIndexKey("status", "running")); len(ids) != 1 || ids[0] != "i-1" {
+		t.Fatalf("expected the stale member removed from the index, got %v", ids)
+	}
+	if page, _ := instances.List(InstanceQuery{Status: "failed", ProductID: "shop"}); len(page.Instances) != 1 {
+		t.Fatalf("the current index must keep working, got %+v", page)
+	}
+}
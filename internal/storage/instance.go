@@ -1,14 +1,11 @@
 package storage
 
 import (
-	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
 	"time"
-
-	"ark_deploy/internal/redis"
 )
 
 type Instance struct {
@@ -22,12 +19,48 @@ type Instance struct {
 	FriendlyURL string            `json:"friendly_url,omitempty"`
 	Builds      map[string]string `json:"builds"`
 	CreatedAt   time.Time         `json:"created_at"`
+	Health      *InstanceHealth   `json:"health,omitempty"`
+	Version     int64             `json:"version"`
+	// SchemaVersion es la version del formato del registro (ver migrate.go).
+	SchemaVersion int `json:"schema_version"`
+}
+
+// HealthHistoryLimit es la cantidad de chequeos que se guardan por instancia.
+const HealthHistoryLimit = 20
+
+type HealthCheck struct {
+	CheckedAt  time.Time `json:"checked_at"`
+	Healthy    bool      `json:"healthy"`
+	StatusCode int       `json:"status_code,omitempty"`
+	LatencyMs  int64     `json:"latency_ms"`
+	Error      string    `json:"error,omitempty"`
+
+	// Backends es el resultado de cada replica cuando hay mas de una.
+	Backends []BackendCheck `json:"backends,omitempty"`
 }
 
-type InstanceStore struct{}
+// BackendCheck es el sondeo de un backend (host:port) de la instancia.
+type BackendCheck struct {
+	Backend    string `json:"backend"`
+	Healthy    bool   `json:"healthy"`
+	StatusCode int    `json:"status_code,omitempty"`
+	LatencyMs  int64  `json:"latency_ms"`
+	Error      string `json:"error,omitempty"`
+}
 
-func NewInstanceStore() *InstanceStore {
-	return &InstanceStore{}
+type InstanceHealth struct {
+	Healthy             bool          `json:"healthy"`
+	LastCheckedAt       time.Time     `json:"last_checked_at"`
+	ConsecutiveFailures int           `json:"consecutive_failures"`
+	History             []HealthCheck `json:"history"`
+}
+
+type InstanceStore struct {
+	kv KV
+}
+
+func NewInstanceStore(kv KV) *InstanceStore {
+	return &InstanceStore{kv: kv}
 }
 
 func instanceKey(id string) string {
@@ -35,70 +68,38 @@ func instanceKey(id string) string {
 }
 
 func (s *InstanceStore) Create(i Instance) error {
-	ctx := context.Background()
-	key := instanceKey(i.ID)
-
-	exists, err := redis.Client.Exists(ctx, key).Result()
-	if err != nil {
-		return err
-	}
-	if exists > 0 {
-		return errors.New("instance already exists")
-	}
-
 	if i.CreatedAt.IsZero() {
 		i.CreatedAt = time.Now().UTC()
 	}
+	i.Version = 1
+	i.SchemaVersion = instanceSchemaVersion
 
 	data, err := json.Marshal(i)
 	if err != nil {
 		return err
 	}
 
-	return redis.Client.Set(ctx, key, data, 0).Err()
+	ok, err := s.kv.SetNX(instanceKey(i.ID), string(data))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("instance already exists")
+	}
+	return indexInstance(s.kv, nil, i)
 }
 
 func (s *InstanceStore) GetAll() []Instance {
-	ctx := context.Background()
-
-	var cursor uint64
-	result := make([]Instance, 0)
-
-	for {
-		keys, next, err := redis.Client.Scan(ctx, cursor, "instance:*", 100).Result()
-		if err != nil {
-			return []Instance{}
-		}
-
-		for _, key := range keys {
-			data, err := redis.Client.Get(ctx, key).Result()
-			if err != nil {
-				continue
-			}
-
-			var i Instance
-			if err := json.Unmarshal([]byte(data), &i); err != nil {
-				continue
-			}
-
-			result = append(result, i)
-		}
-
-		cursor = next
-		if cursor == 0 {
-			break
-		}
+	page, err := s.List(InstanceQuery{Ascending: true})
+	if err != nil {
+		return []Instance{}
 	}
-
-	return result
+	return page.Instances
 }
 
 func (s *InstanceStore) GetByID(id string) (Instance, error) {
-	ctx := context.Background()
-	key := instanceKey(id)
-
-	data, err := redis.Client.Get(ctx, key).Result()
-	if err != nil {
+	data, ok, err := s.kv.Get(instanceKey(id))
+	if err != nil || !ok {
 		return Instance{}, errors.New("instance not found")
 	}
 
@@ -110,69 +111,134 @@ func (s *InstanceStore) GetByID(id string) (Instance, error) {
 	return i, nil
 }
 
-func (s *InstanceStore) UpdateStatus(id string, status string) error {
-	ctx := context.Background()
+// update aplica fn sobre la instancia guardada y sube su version. Si otra
+// escritura gana la carrera se vuelve a leer y aplicar fn.
+func (s *InstanceStore) update(id string, fn func(*Instance)) error {
 	key := instanceKey(id)
 
-	data, err := redis.Client.Get(ctx, key).Result()
-	if err != nil {
-		return errors.New("instance not found")
-	}
+	for attempt := 0; attempt < casRetries; attempt++ {
+		raw, ok, err := s.kv.Get(key)
+		if err != nil || !ok {
+			return errors.New("instance not found")
+		}
 
-	var instance Instance
-	if err := json.Unmarshal([]byte(data), &instance); err != nil {
-		return err
-	}
+		var instance Instance
+		if err := json.Unmarshal([]byte(raw), &instance); err != nil {
+			return err
+		}
+		prev := instance
 
-	instance.Status = status
+		fn(&instance)
+		instance.Version = prev.Version + 1
+		instance.SchemaVersion = instanceSchemaVersion
 
-	newData, err := json.Marshal(instance)
-	if err != nil {
-		return err
+		data, err := json.Marshal(instance)
+		if err != nil {
+			return err
+		}
+
+		swapped, err := s.kv.CompareAndSwap(key, raw, string(data))
+		if err != nil {
+			return err
+		}
+		if swapped {
+			return indexInstance(s.kv, &prev, instance)
+		}
 	}
 
-	return redis.Client.Set(ctx, key, newData, 0).Err()
+	return ErrVersionConflict
+}
+
+func (s *InstanceStore) UpdateStatus(id string, status string) error {
+	return s.update(id, func(instance *Instance) {
+		instance.Status = status
+	})
 }
 
 func (s *InstanceStore) UpdateAccessURLs(id string, localURL string, friendlyURL string, status string) error {
-	ctx := context.Background()
-	key := instanceKey(id)
+	return s.update(id, func(instance *Instance) {
+		instance.LocalURL = localURL
+		instance.FriendlyURL = friendlyURL
+		if strings.TrimSpace(status) != "" {
+			instance.Status = status
+		}
+	})
+}
 
-	data, err := redis.Client.Get(ctx, key).Result()
+// RecordHealth agrega el chequeo al historial de la instancia y le pide a next
+// el estado nuevo a partir del guardado y los fallos seguidos; "" no lo cambia.
+// Corre dentro del compare-and-swap, asi no pisa un cambio de estado
+// concurrente. Devuelve el estado que se aplico.
+func (s *InstanceStore) RecordHealth(id string, check HealthCheck, next func(status string, failures int) string) (string, error) {
+	var applied string
+	err := s.update(id, func(instance *Instance) {
+		instance.Health = applyHealthCheck(instance.Health, check)
+		applied = strings.TrimSpace(next(instance.Status, instance.Health.ConsecutiveFailures))
+		if applied != "" {
+			instance.Status = applied
+		}
+	})
 	if err != nil {
-		return errors.New("instance not found")
+		return "", err
 	}
+	return applied, nil
+}
 
-	var instance Instance
-	if err := json.Unmarshal([]byte(data), &instance); err != nil {
-		return err
+func applyHealthCheck(h *InstanceHealth, check HealthCheck) *InstanceHealth {
+	if h == nil {
+		h = &InstanceHealth{}
 	}
 
-	instance.LocalURL = localURL
-	instance.FriendlyURL = friendlyURL
-	if strings.TrimSpace(status) != "" {
-		instance.Status = status
+	h.Healthy = check.Healthy
+	h.LastCheckedAt = check.CheckedAt
+	if check.Healthy {
+		h.ConsecutiveFailures = 0
+	} else {
+		h.ConsecutiveFailures++
 	}
 
-	newData, err := json.Marshal(instance)
-	if err != nil {
-		return err
+	h.History = append(h.History, check)
+	if len(h.History) > HealthHistoryLimit {
+		h.History = h.History[len(h.History)-HealthHistoryLimit:]
 	}
 
-	return redis.Client.Set(ctx, key, newData, 0).Err()
+	return h
 }
 
-func (s *InstanceStore) Delete(id string) error {
-	ctx := context.Background()
-	key := instanceKey(id)
+// Delete manda la instancia a la papelera; actor queda registrado como quien la borro.
+func (s *InstanceStore) Delete(id string, actor string) error {
+	instance, err := s.GetByID(id)
+	if err != nil {
+		return err
+	}
 
-	exists, err := redis.Client.Exists(ctx, key).Result()
+	found, err := moveToTrash(s.kv, TrashInstance, instanceKey(id), id, actor)
 	if err != nil {
 		return err
 	}
-	if exists == 0 {
+	if !found {
 		return errors.New("instance not found")
 	}
+	return unindexInstance(s.kv, instance)
+}
+
+// Restore saca la instancia de la papelera y la vuelve a indexar.
+func (s *InstanceStore) Restore(id string) (Instance, error) {
+	exists, err := takeFromTrash(s.kv, TrashInstance, instanceKey(id), id)
+	if err != nil {
+		return Instance{}, err
+	}
+	if exists {
+		return Instance{}, ErrRestoreConflict
+	}
 
-	return redis.Client.Del(ctx, key).Err()
+	// El registro puede ser de un esquema anterior si se borro antes de migrar.
+	if _, err := migrateRecord(s.kv, instanceKey(id), instanceMigrations, false); err != nil {
+		return Instance{}, err
+	}
+	i, err := s.GetByID(id)
+	if err != nil {
+		return Instance{}, err
+	}
+	return i, indexInstance(s.kv, nil, i)
 }
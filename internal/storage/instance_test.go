@@ -1,85 +1,18 @@
 package storage
 
 import (
-	"errors"
-	"sync"
+	"path/filepath"
 	"testing"
 	"time"
 )
 
-type MockInstanceStore struct {
-	mu        sync.RWMutex
-	instances map[string]Instance
-}
-
-func NewMockInstanceStore() *MockInstanceStore {
-	return &MockInstanceStore{
-		instances: make(map[string]Instance),
-	}
-}
-
-func (s *MockInstanceStore) Create(i Instance) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	if _, exists := s.instances[i.ID]; exists {
-		return errors.New("instance already exists")
-	}
-
-	s.instances[i.ID] = i
-	return nil
-}
-
-func (s *MockInstanceStore) GetByID(id string) (Instance, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	i, exists := s.instances[id]
-	if !exists {
-		return Instance{}, errors.New("instance not found")
-	}
-	return i, nil
-}
-
-func (s *MockInstanceStore) GetAll() []Instance {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	result := make([]Instance, 0, len(s.instances))
-	for _, i := range s.instances {
-		result = append(result, i)
-	}
-	return result
-}
-
-func (s *MockInstanceStore) UpdateStatus(id string, status string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	instance, exists := s.instances[id]
-	if !exists {
-		return errors.New("instance not found")
-	}
-
-	instance.Status = status
-	s.instances[id] = instance
-	return nil
-}
-
-func (s *MockInstanceStore) Delete(id string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	if _, exists := s.instances[id]; !exists {
-		return errors.New("instance not found")
-	}
-
-	delete(s.instances, id)
-	return nil
+func newTestInstanceStore(t *testing.T) *InstanceStore {
+	t.Helper()
+	return NewInstanceStore(openTestKV(t, filepath.Join(t.TempDir(), "ark.db")))
 }
 
 func TestInstanceStore_CRUD(t *testing.T) {
-	store := NewMockInstanceStore()
+	store := newTestInstanceStore(t)
 
 	instance := Instance{
 		ID:          "test-instance-1",
@@ -101,13 +34,16 @@ func TestInstanceStore_CRUD(t *testing.T) {
 		t.Fatalf("Failed to get instance: %v", err)
 	}
 
-	if retrieved.ID != instance.ID || retrieved.ProductID != instance.ProductID {
+	if retrieved.ID != instance.ID || retrieved.ProductID != instance.ProductID || retrieved.Builds["frontend"] != "124" {
 		t.Errorf("Retrieved instance data mismatch")
 	}
+	if retrieved.Version != 1 || retrieved.SchemaVersion != instanceSchemaVersion {
+		t.Errorf("Expected version 1 and current schema, got %d/%d", retrieved.Version, retrieved.SchemaVersion)
+	}
 
 	all := store.GetAll()
-	if len(all) < 1 {
-		t.Errorf("Expected at least 1 instance, got %d", len(all))
+	if len(all) != 1 {
+		t.Errorf("Expected 1 instance, got %d", len(all))
 	}
 
 	if err := store.UpdateStatus("test-instance-1", "stopped"); err != nil {
@@ -115,11 +51,14 @@ func TestInstanceStore_CRUD(t *testing.T) {
 	}
 
 	updated, _ := store.GetByID("test-instance-1")
-	if updated.Status != "stopped" {
-		t.Errorf("Status not updated, got %s", updated.Status)
+	if updated.Status != "stopped" || updated.Version != 2 {
+		t.Errorf("Status not updated, got %s (version %d)", updated.Status, updated.Version)
+	}
+	if page, err := store.List(InstanceQuery{Status: "stopped"}); err != nil || page.Total != 1 {
+		t.Errorf("Expected the status index updated, got %+v (%v)", page, err)
 	}
 
-	if err := store.Delete("test-instance-1"); err != nil {
+	if err := store.Delete("test-instance-1", "tester"); err != nil {
 		t.Fatalf("Failed to delete instance: %v", err)
 	}
 
@@ -127,10 +66,16 @@ func TestInstanceStore_CRUD(t *testing.T) {
 	if err == nil {
 		t.Errorf("Instance should be deleted")
 	}
+	if len(store.GetAll()) != 0 {
+		t.Errorf("Deleted instance must leave the index")
+	}
+	if err := store.UpdateStatus("test-instance-1", "running"); err == nil {
+		t.Errorf("Expected error updating a deleted instance")
+	}
 }
 
 func TestInstanceStore_DuplicateCreate(t *testing.T) {
-	store := NewMockInstanceStore()
+	store := newTestInstanceStore(t)
 
 	instance := Instance{
 		ID:        "dup-test",
@@ -139,7 +84,9 @@ func TestInstanceStore_DuplicateCreate(t *testing.T) {
 		CreatedAt: time.Now(),
 	}
 
-	store.Create(instance)
+	if err := store.Create(instance); err != nil {
+		t.Fatalf("Failed to create instance: %v", err)
+	}
 
 	if err := store.Create(instance); err == nil {
 		t.Errorf("Expected error for duplicate instance, got nil")
@@ -0,0 +1,384 @@
+package storage
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	arkredis "ark_deploy/internal/redis"
+)
+
+// KV es el almacenamiento clave-valor sobre el que se construyen los stores.
+// Hay dos implementaciones: Redis (RedisKV) y un archivo local (FileKV) para
+// instalaciones de un solo nodo y tests sin Redis.
+type KV interface {
+	// Get devuelve ok=false si la clave no existe.
+	Get(key string) (value string, ok bool, err error)
+	Set(key, value string) error
+	// SetNX escribe solo si la clave no existe; SetXX solo si existe.
+	SetNX(key, value string) (bool, error)
+	SetXX(key, value string) (bool, error)
+	// CompareAndSwap escribe next solo si el valor actual es exactamente prev.
+	CompareAndSwap(key, prev, next string) (bool, error)
+	// Del borra la clave (string, set, sorted set o stream) e indica si existia.
+	Del(key string) (bool, error)
+	Exists(key string) (bool, error)
+	// Keys devuelve las claves que empiezan con prefix, sin orden.
+	Keys(prefix string) ([]string, error)
+
+	SAdd(key, member string) error
+	SRem(key, member string) error
+	SMembers(key string) ([]string, error)
+
+	// Sorted sets: ZRange devuelve todos los miembros por score ascendente
+	// (a igual score, por miembro).
+	ZAdd(key, member string, score float64) error
+	ZRem(key, member string) error
+	ZRange(key string) ([]ZMember, error)
+	// ZRangeByScore devuelve hasta count miembros (0 = todos) con score entre
+	// min y max inclusive, salteando offset; rev los da de mayor a menor.
+	ZRangeByScore(key string, min, max float64, rev bool, offset, count int) ([]ZMember, error)
+	ZCard(key string) (int, error)
+
+	// XAdd agrega al stream y lo recorta a maxLen entradas (aproximado en Redis).
+	XAdd(key, value string, maxLen int64) (id string, err error)
+	// XRevRange devuelve hasta limit entradas, las mas nuevas primero; before
+	// (un id, exclusivo) permite paginar hacia atras.
+	XRevRange(key, before string, limit int) ([]StreamEntry, error)
+	// XRange devuelve hasta limit entradas posteriores a after (exclusivo, ""
+	// desde el principio), las mas viejas primero.
+	XRange(key, after string, limit int) ([]StreamEntry, error)
+
+	// XReadGroup entrega a consumer hasta count entradas del stream para el
+	// grupo: primero las que ya se le entregaron y no confirmo, y si no hay,
+	// las nuevas. El grupo se crea la primera vez y arranca por las entradas
+	// que lleguen desde ahi. No bloquea.
+	XReadGroup(key, group, consumer string, count int) ([]StreamEntry, error)
+	// XAck confirma entradas entregadas al grupo.
+	XAck(key, group string, ids ...string) error
+	// XClaimIdle pasa a consumer las entradas pendientes del grupo que llevan
+	// al menos minIdle sin confirmar (p.ej. de un consumidor que ya no existe);
+	// las lee con el proximo XReadGroup. Devuelve cuantas tomo.
+	XClaimIdle(key, group, consumer string, minIdle time.Duration) (int, error)
+}
+
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+type StreamEntry struct {
+	ID    string
+	Value string
+}
+
+// streamField es el campo donde RedisKV guarda el valor de cada entrada.
+const streamField = "entry"
+
+// RedisKV usa el cliente global de internal/redis (InitRedis debe haber corrido).
+type RedisKV struct{}
+
+func NewRedisKV() *RedisKV {
+	return &RedisKV{}
+}
+
+func (RedisKV) Get(key string) (string, bool, error) {
+	v, err := arkredis.Client.Get(context.Background(), key).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return v, true, nil
+}
+
+func (RedisKV) Set(key, value string) error {
+	return arkredis.Client.Set(context.Background(), key, value, 0).Err()
+}
+
+func (RedisKV) SetNX(key, value string) (bool, error) {
+	return arkredis.Client.SetNX(context.Background(), key, value, 0).Result()
+}
+
+func (RedisKV) SetXX(key, value string) (bool, error) {
+	return arkredis.Client.SetXX(context.Background(), key, value, 0).Result()
+}
+
+// casScript hace el GET y el SET en una sola operacion atomica del servidor.
+var casScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('SET', KEYS[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+func (RedisKV) CompareAndSwap(key, prev, next string) (bool, error) {
+	n, err := casScript.Run(context.Background(), arkredis.Client, []string{key}, prev, next).Int()
+	return n == 1, err
+}
+
+func (RedisKV) Del(key string) (bool, error) {
+	n, err := arkredis.Client.Del(context.Background(), key).Result()
+	return n > 0, err
+}
+
+func (RedisKV) Exists(key string) (bool, error) {
+	n, err := arkredis.Client.Exists(context.Background(), key).Result()
+	return n > 0, err
+}
+
+func (RedisKV) Keys(prefix string) ([]string, error) {
+	ctx := context.Background()
+	out := make([]string, 0)
+
+	var cursor uint64
+	for {
+		keys, next, err := arkredis.Client.Scan(ctx, cursor, escapeGlob(prefix)+"*", 100).Result()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, keys...)
+
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+	return out, nil
+}
+
+func (RedisKV) SAdd(key, member string) error {
+	return arkredis.Client.SAdd(context.Background(), key, member).Err()
+}
+
+func (RedisKV) SRem(key, member string) error {
+	return arkredis.Client.SRem(context.Background(), key, member).Err()
+}
+
+func (RedisKV) SMembers(key string) ([]string, error) {
+	return arkredis.Client.SMembers(context.Background(), key).Result()
+}
+
+func (RedisKV) ZAdd(key, member string, score float64) error {
+	return arkredis.Client.ZAdd(context.Background(), key, redis.Z{Score: score, Member: member}).Err()
+}
+
+func (RedisKV) ZRem(key, member string) error {
+	return arkredis.Client.ZRem(context.Background(), key, member).Err()
+}
+
+func (RedisKV) ZRange(key string) ([]ZMember, error) {
+	zs, err := arkredis.Client.ZRangeWithScores(context.Background(), key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]ZMember, 0, len(zs))
+	for _, z := range zs {
+		if m, ok := z.Member.(string); ok {
+			out = append(out, ZMember{Member: m, Score: z.Score})
+		}
+	}
+	return out, nil
+}
+
+func (RedisKV) ZRangeByScore(key string, min, max float64, rev bool, offset, count int) ([]ZMember, error) {
+	args := redis.ZRangeArgs{
+		Key:     key,
+		Start:   scoreBound(min),
+		Stop:    scoreBound(max),
+		ByScore: true,
+		Rev:     rev,
+		Offset:  int64(offset),
+		Count:   int64(count),
+	}
+	if count <= 0 {
+		// LIMIT con count negativo devuelve todo desde offset.
+		args.Count = -1
+	}
+	zs, err := arkredis.Client.ZRangeArgsWithScores(context.Background(), args).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]ZMember, 0, len(zs))
+	for _, z := range zs {
+		if m, ok := z.Member.(string); ok {
+			out = append(out, ZMember{Member: m, Score: z.Score})
+		}
+	}
+	return out, nil
+}
+
+func (RedisKV) ZCard(key string) (int, error) {
+	n, err := arkredis.Client.ZCard(context.Background(), key).Result()
+	return int(n), err
+}
+
+// scoreBound formatea un limite de score para ZRANGE BYSCORE.
+func scoreBound(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func (RedisKV) XAdd(key, value string, maxLen int64) (string, error) {
+	return arkredis.Client.XAdd(context.Background(), &redis.XAddArgs{
+		Stream: key,
+		MaxLen: maxLen,
+		Approx: true,
+		Values: map[string]any{streamField: value},
+	}).Result()
+}
+
+func (RedisKV) XRevRange(key, before string, limit int) ([]StreamEntry, error) {
+	end := "+"
+	if b := strings.TrimSpace(before); b != "" {
+		end = "(" + b
+	}
+
+	msgs, err := arkredis.Client.XRevRangeN(context.Background(), key, end, "-", int64(limit)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]StreamEntry, 0, len(msgs))
+	for _, m := range msgs {
+		if v, ok := m.Values[streamField].(string); ok {
+			out = append(out, StreamEntry{ID: m.ID, Value: v})
+		}
+	}
+	return out, nil
+}
+
+func (RedisKV) XRange(key, after string, limit int) ([]StreamEntry, error) {
+	start := "-"
+	if a := strings.TrimSpace(after); a != "" {
+		start = "(" + a
+	}
+
+	msgs, err := arkredis.Client.XRangeN(context.Background(), key, start, "+", int64(limit)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]StreamEntry, 0, len(msgs))
+	for _, m := range msgs {
+		if v, ok := m.Values[streamField].(string); ok {
+			out = append(out, StreamEntry{ID: m.ID, Value: v})
+		}
+	}
+	return out, nil
+}
+
+func (RedisKV) XReadGroup(key, group, consumer string, count int) ([]StreamEntry, error) {
+	ctx := context.Background()
+
+	pending, err := xReadGroup(ctx, key, group, consumer, "0", count)
+	if err != nil && strings.HasPrefix(err.Error(), "NOGROUP") {
+		err = arkredis.Client.XGroupCreateMkStream(ctx, key, group, "$").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return nil, err
+		}
+		pending, err = xReadGroup(ctx, key, group, consumer, "0", count)
+	}
+	if err != nil || len(pending) > 0 {
+		return pending, err
+	}
+	return xReadGroup(ctx, key, group, consumer, ">", count)
+}
+
+func xReadGroup(ctx context.Context, key, group, consumer, start string, count int) ([]StreamEntry, error) {
+	streams, err := arkredis.Client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    group,
+		Consumer: consumer,
+		Streams:  []string{key, start},
+		Count:    int64(count),
+		Block:    -1,
+	}).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	out := make([]StreamEntry, 0)
+	var trimmed []string
+	for _, s := range streams {
+		for _, m := range s.Messages {
+			v, ok := m.Values[streamField].(string)
+			if !ok {
+				// Pendiente cuya entrada ya se recorto del stream.
+				trimmed = append(trimmed, m.ID)
+				continue
+			}
+			out = append(out, StreamEntry{ID: m.ID, Value: v})
+		}
+	}
+	if len(trimmed) > 0 {
+		if err := arkredis.Client.XAck(ctx, key, group, trimmed...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (RedisKV) XClaimIdle(key, group, consumer string, minIdle time.Duration) (int, error) {
+	ctx := context.Background()
+
+	claimed := 0
+	start := "0-0"
+	for {
+		ids, next, err := arkredis.Client.XAutoClaimJustID(ctx, &redis.XAutoClaimArgs{
+			Stream:   key,
+			Group:    group,
+			Consumer: consumer,
+			MinIdle:  minIdle,
+			Start:    start,
+			Count:    100,
+		}).Result()
+		if err != nil {
+			// Sin grupo no hay nada pendiente.
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				return claimed, nil
+			}
+			return claimed, err
+		}
+		claimed += len(ids)
+		if next == "" || next == "0-0" {
+			return claimed, nil
+		}
+		start = next
+	}
+}
+
+func (RedisKV) XAck(key, group string, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return arkredis.Client.XAck(context.Background(), key, group, ids...).Err()
+}
+
+// escapeGlob escapa los comodines de SCAN MATCH para buscar un prefijo literal.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
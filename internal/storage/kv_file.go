@@ -0,0 +1,792 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileKV guarda todo en memoria y persiste cada cambio en un log de operaciones
+// (una linea JSON por operacion) que se reproduce al abrir. Cuando el log crece
+// mucho mas que los datos vivos se reescribe compacto. Cada escritura hace
+// fsync antes de aplicarse en memoria. Pensado para un solo proceso: no hay
+// bloqueo entre procesos.
+
+// compactMinRecords evita compactar logs chicos.
+const compactMinRecords = 10000
+
+type fileOp struct {
+	Op     string  `json:"op"`
+	Key    string  `json:"k"`
+	Value  string  `json:"v,omitempty"`
+	ID     string  `json:"id,omitempty"`
+	MaxLen int64   `json:"max,omitempty"`
+	Score  float64 `json:"s,omitempty"`
+
+	Group    string `json:"g,omitempty"`
+	Consumer string `json:"c,omitempty"`
+}
+
+// fileGroup es un grupo de consumidores de un stream: la ultima entrada
+// entregada y las entregadas sin confirmar (id -> consumidor). deliveredAt
+// solo vive en memoria: al reabrir, lo pendiente cuenta como inactivo.
+type fileGroup struct {
+	last        streamID
+	pending     map[string]string
+	deliveredAt map[string]time.Time
+}
+
+type FileKV struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	strings map[string]string
+	sets    map[string]map[string]struct{}
+	zsets   map[string]map[string]float64
+	streams map[string][]StreamEntry
+	groups  map[string]map[string]*fileGroup
+	lastID  streamID
+	records int
+
+	// compactAt posterga el proximo intento despues de una compactacion fallida.
+	compactAt int
+}
+
+// OpenFileKV abre (o crea) el archivo de datos en path.
+func OpenFileKV(path string) (*FileKV, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	kv := &FileKV{
+		path:    path,
+		strings: make(map[string]string),
+		sets:    make(map[string]map[string]struct{}),
+		zsets:   make(map[string]map[string]float64),
+		streams: make(map[string][]StreamEntry),
+		groups:  make(map[string]map[string]*fileGroup),
+	}
+	if err := kv.load(); err != nil {
+		return nil, err
+	}
+
+	if kv.records > compactMinRecords && kv.records > 2*kv.liveRecords() {
+		if err := kv.compactLocked(); err != nil {
+			return nil, err
+		}
+		return kv, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	kv.f = f
+	return kv, nil
+}
+
+func (kv *FileKV) load() error {
+	f, err := os.Open(kv.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 64<<20)
+	line := 0
+	var good int64
+	for sc.Scan() {
+		line++
+		var op fileOp
+		if err := json.Unmarshal(sc.Bytes(), &op); err != nil {
+			// Una ultima linea cortada (caida a mitad de escritura) se descarta
+			// para que las escrituras siguientes no queden pegadas a ella.
+			if !sc.Scan() {
+				f.Close()
+				return os.Truncate(kv.path, good)
+			}
+			return fmt.Errorf("%s:%d: %w", kv.path, line, err)
+		}
+		kv.apply(op)
+		kv.records++
+		good += int64(len(sc.Bytes())) + 1
+	}
+	return sc.Err()
+}
+
+// apply aplica la operacion en memoria; es lo que se reproduce al abrir.
+func (kv *FileKV) apply(op fileOp) {
+	switch op.Op {
+	case "set":
+		kv.strings[op.Key] = op.Value
+	case "del":
+		delete(kv.strings, op.Key)
+		delete(kv.sets, op.Key)
+		delete(kv.zsets, op.Key)
+		delete(kv.streams, op.Key)
+		delete(kv.groups, op.Key)
+	case "sadd":
+		set, ok := kv.sets[op.Key]
+		if !ok {
+			set = make(map[string]struct{})
+			kv.sets[op.Key] = set
+		}
+		set[op.Value] = struct{}{}
+	case "srem":
+		if set, ok := kv.sets[op.Key]; ok {
+			delete(set, op.Value)
+			if len(set) == 0 {
+				delete(kv.sets, op.Key)
+			}
+		}
+	case "zadd":
+		z, ok := kv.zsets[op.Key]
+		if !ok {
+			z = make(map[string]float64)
+			kv.zsets[op.Key] = z
+		}
+		z[op.Value] = op.Score
+	case "zrem":
+		if z, ok := kv.zsets[op.Key]; ok {
+			delete(z, op.Value)
+			if len(z) == 0 {
+				delete(kv.zsets, op.Key)
+			}
+		}
+	case "xadd":
+		entries := append(kv.streams[op.Key], StreamEntry{ID: op.ID, Value: op.Value})
+		if op.MaxLen > 0 && int64(len(entries)) > op.MaxLen {
+			entries = append([]StreamEntry(nil), entries[int64(len(entries))-op.MaxLen:]...)
+		}
+		kv.streams[op.Key] = entries
+		if id, ok := parseStreamID(op.ID); ok && kv.lastID.less(id) {
+			kv.lastID = id
+		}
+	case "xgroup":
+		last, _ := parseStreamID(op.ID)
+		kv.groupLocked(op.Key, op.Group).last = last
+	case "xdeliver":
+		g := kv.groupLocked(op.Key, op.Group)
+		g.pending[op.ID] = op.Consumer
+		if id, ok := parseStreamID(op.ID); ok && g.last.less(id) {
+			g.last = id
+		}
+	case "xack":
+		if g, ok := kv.groups[op.Key][op.Group]; ok {
+			delete(g.pending, op.ID)
+			delete(g.deliveredAt, op.ID)
+		}
+	}
+}
+
+// groupLocked devuelve el grupo y lo crea vacio si no existe.
+func (kv *FileKV) groupLocked(key, group string) *fileGroup {
+	groups, ok := kv.groups[key]
+	if !ok {
+		groups = make(map[string]*fileGroup)
+		kv.groups[key] = groups
+	}
+	g, ok := groups[group]
+	if !ok {
+		g = &fileGroup{pending: make(map[string]string), deliveredAt: make(map[string]time.Time)}
+		groups[group] = g
+	}
+	return g
+}
+
+// write persiste la operacion y la aplica; se llama con mu tomado.
+func (kv *FileKV) write(op fileOp) error {
+	if kv.f == nil {
+		return errors.New("file kv is closed")
+	}
+	data, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	if _, err := kv.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := kv.f.Sync(); err != nil {
+		return err
+	}
+	kv.apply(op)
+	kv.records++
+
+	// La operacion ya quedo escrita: una compactacion fallida no la deshace,
+	// solo se registra y se reintenta mas adelante.
+	if kv.records > compactMinRecords && kv.records > kv.compactAt && kv.records > 4*kv.liveRecords() {
+		if err := kv.compactLocked(); err != nil {
+			log.Printf("file kv: compaction failed: %v", err)
+			kv.compactAt = kv.records + compactMinRecords
+		}
+	}
+	return nil
+}
+
+func (kv *FileKV) liveRecords() int {
+	n := len(kv.strings)
+	for _, set := range kv.sets {
+		n += len(set)
+	}
+	for _, z := range kv.zsets {
+		n += len(z)
+	}
+	for _, entries := range kv.streams {
+		n += len(entries)
+	}
+	for _, groups := range kv.groups {
+		for _, g := range groups {
+			n += 1 + len(g.pending)
+		}
+	}
+	return n
+}
+
+// compactLocked reescribe el log con solo los datos vivos (tmp + rename). Si
+// algo falla el archivo abierto sigue siendo el original.
+func (kv *FileKV) compactLocked() error {
+	tmp := kv.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	records := 0
+	emit := func(op fileOp) {
+		if err == nil {
+			err = enc.Encode(op)
+			records++
+		}
+	}
+	for k, v := range kv.strings {
+		emit(fileOp{Op: "set", Key: k, Value: v})
+	}
+	for k, set := range kv.sets {
+		for m := range set {
+			emit(fileOp{Op: "sadd", Key: k, Value: m})
+		}
+	}
+	for k, z := range kv.zsets {
+		for m, score := range z {
+			emit(fileOp{Op: "zadd", Key: k, Value: m, Score: score})
+		}
+	}
+	for k, entries := range kv.streams {
+		for _, e := range entries {
+			emit(fileOp{Op: "xadd", Key: k, ID: e.ID, Value: e.Value})
+		}
+	}
+	for k, groups := range kv.groups {
+		for name, g := range groups {
+			emit(fileOp{Op: "xgroup", Key: k, Group: name, ID: g.last.String()})
+			for id, consumer := range g.pending {
+				emit(fileOp{Op: "xdeliver", Key: k, Group: name, Consumer: consumer, ID: id})
+			}
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Se abre antes del rename: el descriptor sigue al archivo nuevo y, si el
+	// rename falla, el viejo queda intacto.
+	nf, err := os.OpenFile(tmp, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, kv.path); err != nil {
+		nf.Close()
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(filepath.Dir(kv.path))
+
+	if kv.f != nil {
+		kv.f.Close()
+	}
+	kv.f = nf
+	kv.records = records
+	kv.compactAt = 0
+	return nil
+}
+
+// syncDir persiste el rename; si falla el log sigue siendo valido.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+}
+
+// Close sincroniza el archivo y lo cierra.
+func (kv *FileKV) Close() error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.f == nil {
+		return nil
+	}
+	err := kv.f.Sync()
+	if cerr := kv.f.Close(); err == nil {
+		err = cerr
+	}
+	kv.f = nil
+	return err
+}
+
+func (kv *FileKV) Get(key string) (string, bool, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	v, ok := kv.strings[key]
+	return v, ok, nil
+}
+
+func (kv *FileKV) Set(key, value string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.write(fileOp{Op: "set", Key: key, Value: value})
+}
+
+func (kv *FileKV) SetNX(key, value string) (bool, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if _, ok := kv.strings[key]; ok {
+		return false, nil
+	}
+	return true, kv.write(fileOp{Op: "set", Key: key, Value: value})
+}
+
+func (kv *FileKV) SetXX(key, value string) (bool, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if _, ok := kv.strings[key]; !ok {
+		return false, nil
+	}
+	return true, kv.write(fileOp{Op: "set", Key: key, Value: value})
+}
+
+func (kv *FileKV) CompareAndSwap(key, prev, next string) (bool, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if cur, ok := kv.strings[key]; !ok || cur != prev {
+		return false, nil
+	}
+	return true, kv.write(fileOp{Op: "set", Key: key, Value: next})
+}
+
+func (kv *FileKV) Del(key string) (bool, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if !kv.existsLocked(key) {
+		return false, nil
+	}
+	return true, kv.write(fileOp{Op: "del", Key: key})
+}
+
+func (kv *FileKV) Exists(key string) (bool, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.existsLocked(key), nil
+}
+
+func (kv *FileKV) existsLocked(key string) bool {
+	if _, ok := kv.strings[key]; ok {
+		return true
+	}
+	if _, ok := kv.sets[key]; ok {
+		return true
+	}
+	if _, ok := kv.zsets[key]; ok {
+		return true
+	}
+	_, ok := kv.streams[key]
+	return ok
+}
+
+func (kv *FileKV) Keys(prefix string) ([]string, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	out := make([]string, 0)
+	for k := range kv.strings {
+		if strings.HasPrefix(k, prefix) {
+			out = append(out, k)
+		}
+	}
+	for k := range kv.sets {
+		if strings.HasPrefix(k, prefix) {
+			out = append(out, k)
+		}
+	}
+	for k := range kv.zsets {
+		if strings.HasPrefix(k, prefix) {
+			out = append(out, k)
+		}
+	}
+	for k := range kv.streams {
+		if strings.HasPrefix(k, prefix) {
+			out = append(out, k)
+		}
+	}
+	return out, nil
+}
+
+func (kv *FileKV) SAdd(key, member string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if _, ok := kv.sets[key][member]; ok {
+		return nil
+	}
+	return kv.write(fileOp{Op: "sadd", Key: key, Value: member})
+}
+
+func (kv *FileKV) SRem(key, member string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if _, ok := kv.sets[key][member]; !ok {
+		return nil
+	}
+	return kv.write(fileOp{Op: "srem", Key: key, Value: member})
+}
+
+func (kv *FileKV) SMembers(key string) ([]string, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	out := make([]string, 0, len(kv.sets[key]))
+	for m := range kv.sets[key] {
+		out = append(out, m)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func (kv *FileKV) ZAdd(key, member string, score float64) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if cur, ok := kv.zsets[key][member]; ok && cur == score {
+		return nil
+	}
+	return kv.write(fileOp{Op: "zadd", Key: key, Value: member, Score: score})
+}
+
+func (kv *FileKV) ZRem(key, member string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if _, ok := kv.zsets[key][member]; !ok {
+		return nil
+	}
+	return kv.write(fileOp{Op: "zrem", Key: key, Value: member})
+}
+
+func (kv *FileKV) ZRange(key string) ([]ZMember, error) {
+	kv.mu.Lock()
+	out := make([]ZMember, 0, len(kv.zsets[key]))
+	for m, score := range kv.zsets[key] {
+		out = append(out, ZMember{Member: m, Score: score})
+	}
+	kv.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Score != out[j].Score {
+			return out[i].Score < out[j].Score
+		}
+		return out[i].Member < out[j].Member
+	})
+	return out, nil
+}
+
+func (kv *FileKV) ZRangeByScore(key string, min, max float64, rev bool, offset, count int) ([]ZMember, error) {
+	kv.mu.Lock()
+	out := make([]ZMember, 0)
+	for m, score := range kv.zsets[key] {
+		if score >= min && score <= max {
+			out = append(out, ZMember{Member: m, Score: score})
+		}
+	}
+	kv.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Score != out[j].Score {
+			return (out[i].Score < out[j].Score) != rev
+		}
+		return (out[i].Member < out[j].Member) != rev
+	})
+	if offset >= len(out) {
+		return []ZMember{}, nil
+	}
+	out = out[offset:]
+	if count > 0 && count < len(out) {
+		out = out[:count]
+	}
+	return out, nil
+}
+
+func (kv *FileKV) ZCard(key string) (int, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return len(kv.zsets[key]), nil
+}
+
+func (kv *FileKV) XAdd(key, value string, maxLen int64) (string, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	id := kv.lastID.next(time.Now())
+	op := fileOp{Op: "xadd", Key: key, ID: id.String(), Value: value, MaxLen: maxLen}
+	if err := kv.write(op); err != nil {
+		return "", err
+	}
+	return op.ID, nil
+}
+
+func (kv *FileKV) XRevRange(key, before string, limit int) ([]StreamEntry, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	var end streamID
+	hasEnd := false
+	if b := strings.TrimSpace(before); b != "" {
+		id, ok := parseStreamID(b)
+		if !ok {
+			return nil, fmt.Errorf("invalid stream id: %q", before)
+		}
+		end, hasEnd = id, true
+	}
+
+	entries := kv.streams[key]
+	out := make([]StreamEntry, 0)
+	for i := len(entries) - 1; i >= 0 && len(out) < limit; i-- {
+		if hasEnd {
+			id, _ := parseStreamID(entries[i].ID)
+			if !id.less(end) {
+				continue
+			}
+		}
+		out = append(out, entries[i])
+	}
+	return out, nil
+}
+
+func (kv *FileKV) XRange(key, after string, limit int) ([]StreamEntry, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	var start streamID
+	hasStart := false
+	if a := strings.TrimSpace(after); a != "" {
+		id, ok := parseStreamID(a)
+		if !ok {
+			return nil, fmt.Errorf("invalid stream id: %q", after)
+		}
+		start, hasStart = id, true
+	}
+
+	out := make([]StreamEntry, 0)
+	for _, e := range kv.streams[key] {
+		if len(out) == limit {
+			break
+		}
+		if hasStart {
+			id, _ := parseStreamID(e.ID)
+			if !start.less(id) {
+				continue
+			}
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+func (kv *FileKV) XReadGroup(key, group, consumer string, count int) ([]StreamEntry, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	entries := kv.streams[key]
+	g, ok := kv.groups[key][group]
+	if !ok {
+		var last streamID
+		if n := len(entries); n > 0 {
+			last, _ = parseStreamID(entries[n-1].ID)
+		}
+		if err := kv.write(fileOp{Op: "xgroup", Key: key, Group: group, ID: last.String()}); err != nil {
+			return nil, err
+		}
+		g = kv.groups[key][group]
+	}
+
+	// Primero lo pendiente de este consumidor, en orden del stream; lo que ya
+	// se recorto del stream se confirma solo.
+	out := make([]StreamEntry, 0)
+	if len(g.pending) > 0 {
+		found := make(map[string]bool)
+		for _, e := range entries {
+			if g.pending[e.ID] != consumer {
+				continue
+			}
+			found[e.ID] = true
+			if len(out) < count {
+				// Como en redis, releer lo pendiente reinicia su inactividad.
+				g.deliveredAt[e.ID] = time.Now()
+				out = append(out, e)
+			}
+		}
+		for id, c := range g.pending {
+			if c == consumer && !found[id] {
+				if err := kv.write(fileOp{Op: "xack", Key: key, Group: group, ID: id}); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if len(out) > 0 {
+			return out, nil
+		}
+	}
+
+	for _, e := range entries {
+		if len(out) == count {
+			break
+		}
+		id, _ := parseStreamID(e.ID)
+		if !g.last.less(id) {
+			continue
+		}
+		if err := kv.write(fileOp{Op: "xdeliver", Key: key, Group: group, Consumer: consumer, ID: e.ID}); err != nil {
+			return nil, err
+		}
+		g.deliveredAt[e.ID] = time.Now()
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+func (kv *FileKV) XClaimIdle(key, group, consumer string, minIdle time.Duration) (int, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	g, ok := kv.groups[key][group]
+	if !ok {
+		return 0, nil
+	}
+
+	now := time.Now()
+	var idle []string
+	for id, c := range g.pending {
+		if c == consumer {
+			continue
+		}
+		if at, ok := g.deliveredAt[id]; ok && now.Sub(at) < minIdle {
+			continue
+		}
+		idle = append(idle, id)
+	}
+	for _, id := range idle {
+		if err := kv.write(fileOp{Op: "xdeliver", Key: key, Group: group, Consumer: consumer, ID: id}); err != nil {
+			return 0, err
+		}
+		g.deliveredAt[id] = now
+	}
+	return len(idle), nil
+}
+
+func (kv *FileKV) XAck(key, group string, ids ...string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	g, ok := kv.groups[key][group]
+	if !ok {
+		return nil
+	}
+	for _, id := range ids {
+		if _, ok := g.pending[id]; !ok {
+			continue
+		}
+		if err := kv.write(fileOp{Op: "xack", Key: key, Group: group, ID: id}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamID sigue el formato de Redis (<ms>-<seq>) para que los ids de paginacion
+// sean intercambiables entre backends.
+type streamID struct {
+	ms  int64
+	seq int64
+}
+
+func parseStreamID(s string) (streamID, bool) {
+	msPart, seqPart, found := strings.Cut(s, "-")
+	ms, err := strconv.ParseInt(msPart, 10, 64)
+	if err != nil {
+		return streamID{}, false
+	}
+	var seq int64
+	if found {
+		if seq, err = strconv.ParseInt(seqPart, 10, 64); err != nil {
+			return streamID{}, false
+		}
+	}
+	return streamID{ms: ms, seq: seq}, true
+}
+
+func (id streamID) less(o streamID) bool {
+	return id.ms < o.ms || (id.ms == o.ms && id.seq < o.seq)
+}
+
+// ValidStreamID indica si s tiene el formato de id de stream (<ms>-<seq>).
+func ValidStreamID(s string) bool {
+	_, ok := parseStreamID(s)
+	return ok
+}
+
+// StreamIDLess compara dos ids de stream; uno invalido va antes que cualquiera valido.
+func StreamIDLess(a, b string) bool {
+	ia, okA := parseStreamID(a)
+	ib, okB := parseStreamID(b)
+	if !okA || !okB {
+		return !okA && okB
+	}
+	return ia.less(ib)
+}
+
+func (id streamID) String() string {
+	return strconv.FormatInt(id.ms, 10) + "-" + strconv.FormatInt(id.seq, 10)
+}
+
+// next genera un id mayor que el ultimo aunque el reloj retroceda.
+func (id *streamID) next(now time.Time) streamID {
+	ms := now.UnixMilli()
+	if ms > id.ms {
+		*id = streamID{ms: ms}
+	} else {
+		id.seq++
+	}
+	return *id
+}
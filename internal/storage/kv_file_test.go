@@ -0,0 +1,271 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func openTestKV(t *testing.T, path string) *FileKV {
+	t.Helper()
+	kv, err := OpenFileKV(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { kv.Close() })
+	return kv
+}
+
+func TestFileKV_PersistsAcrossReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ark.db")
+	kv := openTestKV(t, path)
+
+	_ = kv.Set("a", "1")
+	if ok, _ := kv.SetNX("a", "2"); ok {
+		t.Fatalf("SetNX must not overwrite")
+	}
+	if ok, _ := kv.SetXX("missing", "x"); ok {
+		t.Fatalf("SetXX must not create")
+	}
+	_ = kv.Set("gone", "x")
+	if found, _ := kv.Del("gone"); !found {
+		t.Fatalf("expected Del to report the key")
+	}
+	_ = kv.SAdd("s", "x")
+	_ = kv.SAdd("s", "y")
+	_ = kv.SRem("s", "x")
+	for i := 0; i < 5; i++ {
+		if _, err := kv.XAdd("log", string(rune('a'+i)), 3); err != nil {
+			t.Fatalf("xadd: %v", err)
+		}
+	}
+	kv.Close()
+
+	// Una escritura cortada al final del archivo se descarta al abrir.
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	f.WriteString(`{"op":"set","k":"half`)
+	f.Close()
+
+	kv = openTestKV(t, path)
+	if v, ok, _ := kv.Get("a"); !ok || v != "1" {
+		t.Fatalf("expected a=1 after reopen, got %q ok=%v", v, ok)
+	}
+	if ok, _ := kv.Exists("gone"); ok {
+		t.Fatalf("deleted key came back")
+	}
+	if m, _ := kv.SMembers("s"); len(m) != 1 || m[0] != "y" {
+		t.Fatalf("unexpected set members: %v", m)
+	}
+
+	entries, _ := kv.XRevRange("log", "", 10)
+	if len(entries) != 3 || entries[0].Value != "e" || entries[2].Value != "c" {
+		t.Fatalf("expected stream trimmed to the newest 3, got %+v", entries)
+	}
+	page, _ := kv.XRevRange("log", entries[0].ID, 10)
+	if len(page) != 2 || page[0].Value != "d" {
+		t.Fatalf("before must be exclusive, got %+v", page)
+	}
+	fwd, _ := kv.XRange("log", entries[2].ID, 10)
+	if len(fwd) != 2 || fwd[0].Value != "d" || fwd[1].Value != "e" {
+		t.Fatalf("after must be exclusive and oldest first, got %+v", fwd)
+	}
+
+	_ = kv.Set("b", "2")
+	keys, _ := kv.Keys("")
+	sort.Strings(keys)
+	if len(keys) != 4 || keys[0] != "a" || keys[1] != "b" {
+		t.Fatalf("unexpected keys after write on repaired file: %v", keys)
+	}
+}
+
+func TestFileKV_ConsumerGroups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ark.db")
+	kv := openTestKV(t, path)
+
+	_, _ = kv.XAdd("ev", "old", 0)
+	// El grupo arranca por lo que llega despues de crearlo.
+	if got, _ := kv.XReadGroup("ev", "g", "c1", 10); len(got) != 0 {
+		t.Fatalf("new group must skip existing entries, got %+v", got)
+	}
+	_, _ = kv.XAdd("ev", "a", 0)
+	_, _ = kv.XAdd("ev", "b", 0)
+
+	got, _ := kv.XReadGroup("ev", "g", "c1", 1)
+	if len(got) != 1 || got[0].Value != "a" {
+		t.Fatalf("expected a, got %+v", got)
+	}
+	// Sin confirmar, se vuelve a entregar al mismo consumidor.
+	again, _ := kv.XReadGroup("ev", "g", "c1", 10)
+	if len(again) != 1 || again[0].ID != got[0].ID {
+		t.Fatalf("expected pending a again, got %+v", again)
+	}
+	// Otro consumidor del grupo recibe lo siguiente.
+	other, _ := kv.XReadGroup("ev", "g", "c2", 10)
+	if len(other) != 1 || other[0].Value != "b" {
+		t.Fatalf("expected b for c2, got %+v", other)
+	}
+	_ = kv.XAck("ev", "g", got[0].ID)
+	kv.Close()
+
+	kv = openTestKV(t, path)
+	if got, _ := kv.XReadGroup("ev", "g", "c1", 10); len(got) != 0 {
+		t.Fatalf("acked entry must not come back, got %+v", got)
+	}
+	if got, _ := kv.XReadGroup("ev", "g", "c2", 10); len(got) != 1 || got[0].Value != "b" {
+		t.Fatalf("expected b still pending for c2 after reopen, got %+v", got)
+	}
+	// Cada grupo lleva su propia posicion.
+	if got, _ := kv.XReadGroup("ev", "other", "c1", 10); len(got) != 0 {
+		t.Fatalf("expected empty for a fresh group, got %+v", got)
+	}
+}
+
+func TestFileKV_ClaimsIdlePending(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ark.db")
+	kv := openTestKV(t, path)
+
+	_, _ = kv.XReadGroup("ev", "g", "gone", 10)
+	_, _ = kv.XAdd("ev", "a", 0)
+	if got, _ := kv.XReadGroup("ev", "g", "gone", 10); len(got) != 1 {
+		t.Fatalf("expected a delivered to gone, got %+v", got)
+	}
+
+	// Recien entregado no esta inactivo.
+	if n, err := kv.XClaimIdle("ev", "g", "new", time.Minute); err != nil || n != 0 {
+		t.Fatalf("expected nothing to claim yet, got %d (%v)", n, err)
+	}
+	kv.Close()
+
+	// Al reabrir no hay hora de entrega: lo pendiente cuenta como inactivo.
+	kv = openTestKV(t, path)
+	if n, err := kv.XClaimIdle("ev", "g", "new", time.Minute); err != nil || n != 1 {
+		t.Fatalf("expected 1 claimed, got %d (%v)", n, err)
+	}
+	got, _ := kv.XReadGroup("ev", "g", "new", 10)
+	if len(got) != 1 || got[0].Value != "a" {
+		t.Fatalf("expected a pending for new, got %+v", got)
+	}
+	if again, _ := kv.XReadGroup("ev", "g", "gone", 10); len(again) != 0 {
+		t.Fatalf("claimed entry must leave the old consumer, got %+v", again)
+	}
+	// Grupo inexistente: nada que tomar.
+	if n, err := kv.XClaimIdle("ev", "missing", "new", 0); err != nil || n != 0 {
+		t.Fatalf("expected 0 for a missing group, got %d (%v)", n, err)
+	}
+}
+
+func TestFileKV_CompactsLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ark.db")
+	kv := openTestKV(t, path)
+
+	for i := 0; i < compactMinRecords*2; i++ {
+		if err := kv.Set("counter", time.Duration(i).String()); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+	if kv.records > compactMinRecords {
+		t.Fatalf("expected log compacted, got %d records", kv.records)
+	}
+
+	kv.Close()
+	kv = openTestKV(t, path)
+	if v, _, _ := kv.Get("counter"); v != time.Duration(compactMinRecords*2-1).String() {
+		t.Fatalf("unexpected value after compaction: %q", v)
+	}
+}
+
+func TestFileKV_FailedCompactionKeepsWriting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ark.db")
+	kv := openTestKV(t, path)
+
+	// Un directorio en lugar del temporal hace fallar la compactacion.
+	if err := os.Mkdir(path+".tmp", 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	kv.records = compactMinRecords * 10
+	if err := kv.Set("a", "1"); err != nil {
+		t.Fatalf("a failed compaction must not fail the write: %v", err)
+	}
+	if err := kv.Set("b", "2"); err != nil {
+		t.Fatalf("expected later writes to keep working: %v", err)
+	}
+
+	kv.Close()
+	kv = openTestKV(t, path)
+	if a, _, _ := kv.Get("a"); a != "1" {
+		t.Fatalf("expected a persisted, got %q", a)
+	}
+	if b, _, _ := kv.Get("b"); b != "2" {
+		t.Fatalf("expected b persisted, got %q", b)
+	}
+}
+
+func TestStores_RunOnFileKV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ark.db")
+	kv := openTestKV(t, path)
+
+	products := NewProductStore(kv)
+	if err := products.Create(Product{ID: "shop", Name: " Shop "}); err != nil {
+		t.Fatalf("create product: %v", err)
+	}
+	if err := products.Create(Product{ID: "shop"}); err == nil {
+		t.Fatalf("expected duplicate product error")
+	}
+
+	instances := NewInstanceStore(kv)
+	if err := instances.Create(Instance{ID: "abc123", ProductID: "shop", Status: "provisioning"}); err != nil {
+		t.Fatalf("create instance: %v", err)
+	}
+	if err := instances.UpdateStatus("abc123", "running"); err != nil {
+		t.Fatalf("update status: %v", err)
+	}
+
+	routes := NewRouteStore(kv)
+	if err := routes.PutRoute("abc123", "10.0.0.5", 8080); err != nil {
+		t.Fatalf("put route: %v", err)
+	}
+
+	domains := NewDomainStore(kv)
+	if err := domains.Claim("shop.example.com", "abc123"); err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	if err := domains.Claim("shop.example.com", "other"); err != ErrDomainTaken {
+		t.Fatalf("expected ErrDomainTaken, got %v", err)
+	}
+
+	logs := NewAccessLogStore(kv, 10)
+	_ = logs.Append("abc123", AccessLogEntry{Method: "GET", Path: "/", Status: 200})
+
+	_ = NewSSHUserStore(kv).Set("host-1", "deploy")
+	kv.Close()
+
+	// Todo debe sobrevivir a reabrir el archivo, sin Redis.
+	kv = openTestKV(t, path)
+	if p, err := NewProductStore(kv).GetByID("shop"); err != nil || p.Name != "Shop" {
+		t.Fatalf("unexpected product: %+v %v", p, err)
+	}
+	if all := NewInstanceStore(kv).GetAll(); len(all) != 1 || all[0].Status != "running" {
+		t.Fatalf("unexpected instances: %+v", all)
+	}
+	if id, host, port, ok, _ := NewRouteStore(kv).GetRouteByShortID("ABC"); !ok || id != "abc123" || host != "10.0.0.5" || port != 8080 {
+		t.Fatalf("unexpected short id lookup: %s %s:%d ok=%v", id, host, port, ok)
+	}
+	if id, ok, _ := NewDomainStore(kv).Resolve("Shop.Example.com"); !ok || id != "abc123" {
+		t.Fatalf("unexpected domain owner: %q ok=%v", id, ok)
+	}
+	if entries, _ := NewAccessLogStore(kv, 10).List("abc123", 10, ""); len(entries) != 1 || entries[0].ID == "" || entries[0].Status != 200 {
+		t.Fatalf("unexpected access log: %+v", entries)
+	}
+	if users, _ := NewSSHUserStore(kv).List(); users["host-1"] != "deploy" {
+		t.Fatalf("unexpected ssh users: %v", users)
+	}
+
+	if err := NewInstanceStore(kv).Delete("abc123", "test"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := NewInstanceStore(kv).Delete("abc123", "test"); err == nil {
+		t.Fatalf("expected not found on second delete")
+	}
+}
@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Migraciones de esquema. Cada registro JSON guarda schema_version y al
+// arrancar (o con `ark-deploy migrate`) los registros viejos se actualizan en
+// el lugar aplicando en orden las migraciones pendientes de su tipo. Trabajan
+// sobre el JSON crudo para poder leer campos que ya no existen en los structs,
+// asi la compatibilidad con datos viejos no queda en el camino de lectura.
+
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(rec map[string]any) error
+}
+
+var productMigrations = []Migration{
+	{1, "jobs -> deploy_jobs; defaults de web_service, web_port y version", func(rec map[string]any) error {
+		if jobs, ok := rec["jobs"].(map[string]any); ok {
+			if deploy, _ := rec["deploy_jobs"].(map[string]any); len(deploy) == 0 {
+				normalized := make(map[string]any, len(jobs))
+				for k, v := range jobs {
+					normalized[strings.ToLower(strings.TrimSpace(k))] = v
+				}
+				rec["deploy_jobs"] = normalized
+			}
+		}
+		delete(rec, "jobs")
+
+		if s, _ := rec["web_service"].(string); strings.TrimSpace(s) == "" {
+			rec["web_service"] = "web"
+		}
+		if n, _ := rec["web_port"].(float64); n == 0 {
+			rec["web_port"] = 80
+		}
+		setDefaultVersion(rec)
+		return nil
+	}},
+}
+
+var instanceMigrations = []Migration{
+	{1, "schema_version inicial y version", func(rec map[string]any) error {
+		setDefaultVersion(rec)
+		return nil
+	}},
+}
+
+var routeMigrations = []Migration{
+	{1, "schema_version inicial", func(rec map[string]any) error { return nil }},
+}
+
+var aliasMigrations = []Migration{
+	{1, "schema_version inicial", func(rec map[string]any) error { return nil }},
+}
+
+var webhookMigrations = []Migration{
+	{1, "schema_version inicial", func(rec map[string]any) error { return nil }},
+}
+
+// Version de esquema que escribe este codigo para cada tipo de registro.
+var (
+	productSchemaVersion  = latestVersion(productMigrations)
+	instanceSchemaVersion = latestVersion(instanceMigrations)
+	routeSchemaVersion    = latestVersion(routeMigrations)
+	aliasSchemaVersion    = latestVersion(aliasMigrations)
+	webhookSchemaVersion  = latestVersion(webhookMigrations)
+)
+
+type recordKind struct {
+	name       string
+	prefix     string
+	migrations []Migration
+}
+
+var recordKinds = []recordKind{
+	{"product", "product:", productMigrations},
+	{"instance", "instance:", instanceMigrations},
+	{"route", "route:", routeMigrations},
+	{"alias", "alias:", aliasMigrations},
+	{"webhook", "webhook:", webhookMigrations},
+}
+
+func latestVersion(ms []Migration) int {
+	return ms[len(ms)-1].Version
+}
+
+func setDefaultVersion(rec map[string]any) {
+	if n, _ := rec["version"].(float64); n == 0 {
+		rec["version"] = 1
+	}
+}
+
+// errInvalidRecord marca registros que no son un objeto JSON; se cuentan y se saltean.
+var errInvalidRecord = errors.New("invalid record")
+
+type MigrationReport struct {
+	Kind          string `json:"kind"`
+	SchemaVersion int    `json:"schema_version"`
+	Scanned       int    `json:"scanned"`
+	Migrated      int    `json:"migrated"`
+	Invalid       int    `json:"invalid"`
+}
+
+// Migrate lleva todos los registros a la version de esquema actual. Con dryRun
+// solo cuenta los pendientes. Un registro con una version mayor a la conocida
+// (escrito por un ARK mas nuevo) corta la migracion con error.
+func Migrate(kv KV, dryRun bool) ([]MigrationReport, error) {
+	reports := make([]MigrationReport, 0, len(recordKinds))
+
+	for _, kind := range recordKinds {
+		report := MigrationReport{Kind: kind.name, SchemaVersion: latestVersion(kind.migrations)}
+
+		keys, err := kv.Keys(kind.prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			report.Scanned++
+			migrated, err := migrateRecord(kv, key, kind.migrations, dryRun)
+			if err != nil {
+				if errors.Is(err, errInvalidRecord) {
+					report.Invalid++
+					continue
+				}
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			if migrated {
+				report.Migrated++
+			}
+		}
+
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
+
+func migrateRecord(kv KV, key string, migrations []Migration, dryRun bool) (bool, error) {
+	latest := latestVersion(migrations)
+
+	for attempt := 0; attempt < casRetries; attempt++ {
+		raw, ok, err := kv.Get(key)
+		if err != nil || !ok {
+			return false, err
+		}
+
+		var rec map[string]any
+		if err := json.Unmarshal([]byte(raw), &rec); err != nil || rec == nil {
+			return false, errInvalidRecord
+		}
+
+		current, _ := rec["schema_version"].(float64)
+		if int(current) > latest {
+			return false, fmt.Errorf("schema_version %d is newer than supported %d", int(current), latest)
+		}
+		if int(current) == latest {
+			return false, nil
+		}
+		if dryRun {
+			return true, nil
+		}
+
+		for _, m := range migrations {
+			if m.Version <= int(current) {
+				continue
+			}
+			if err := m.Up(rec); err != nil {
+				return false, fmt.Errorf("migration %d (%s): %w", m.Version, m.Description, err)
+			}
+			rec["schema_version"] = m.Version
+		}
+
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return false, err
+		}
+		swapped, err := kv.CompareAndSwap(key, raw, string(data))
+		if err != nil {
+			return false, err
+		}
+		if swapped {
+			return true, nil
+		}
+	}
+
+	return false, ErrVersionConflict
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrate_UpgradesLegacyRecordsInPlace(t *testing.T) {
+	kv := openTestKV(t, filepath.Join(t.TempDir(), "ark.db"))
+
+	_ = kv.Set(productKey("shop"), `{"id":"shop","name":"Shop","jobs":{"Prod":"deploy-shop"},"delete_job":"rm-shop"}`)
+	_ = kv.Set(instanceKey("i-1"), `{"id":"i-1","product_id":"shop","status":"running"}`)
+	_ = kv.Set(instanceKey("broken"), `not json`)
+	_ = NewRouteStore(kv).PutRoute("i-1", "10.0.0.1", 8080)
+
+	reports, err := Migrate(kv, true)
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if reports[0].Kind != "product" || reports[0].Migrated != 1 || reports[1].Migrated != 1 || reports[1].Invalid != 1 {
+		t.Fatalf("unexpected dry run report: %+v", reports)
+	}
+	if raw, _, _ := kv.Get(productKey("shop")); !strings.Contains(raw, `"jobs"`) {
+		t.Fatalf("dry run must not write, got %s", raw)
+	}
+
+	if _, err := Migrate(kv, false); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	p, err := NewProductStore(kv).GetByID("shop")
+	if err != nil {
+		t.Fatalf("get product: %v", err)
+	}
+	if p.DeployJobs["prod"] != "deploy-shop" || p.WebService != "web" || p.WebPort != 80 || p.Version != 1 || p.SchemaVersion != productSchemaVersion {
+		t.Fatalf("unexpected migrated product: %+v", p)
+	}
+	if raw, _, _ := kv.Get(productKey("shop")); strings.Contains(raw, `"jobs"`) {
+		t.Fatalf("legacy field must be dropped, got %s", raw)
+	}
+
+	// La ruta ya se escribio con el esquema actual: no hay nada que migrar.
+	reports, _ = Migrate(kv, false)
+	for _, r := range reports {
+		if r.Migrated != 0 {
+			t.Fatalf("second run must be a no-op, got %+v", reports)
+		}
+	}
+
+	_ = kv.Set(productKey("future"), `{"id":"future","schema_version":99}`)
+	if _, err := Migrate(kv, false); err == nil || !strings.Contains(err.Error(), "newer than supported") {
+		t.Fatalf("expected error for records from a newer schema, got %v", err)
+	}
+}
@@ -1,13 +1,10 @@
 package storage
 
 import (
-	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
-
-	"ark_deploy/internal/redis"
 )
 
 type Product struct {
@@ -19,13 +16,51 @@ type Product struct {
 	DeleteJob   string            `json:"delete_job"`
 	WebService  string            `json:"web_service,omitempty"`
 	WebPort     int               `json:"web_port,omitempty"`
-	Jobs        map[string]string `json:"jobs,omitempty"`
+
+	// Services son los servicios del compose expuestos por ARK; vacio = solo WebService:WebPort.
+	Services []ExposedService `json:"services,omitempty"`
+
+	HealthPath            string `json:"health_path,omitempty"`
+	HealthExpectedStatus  int    `json:"health_expected_status,omitempty"`
+	HealthIntervalSeconds int    `json:"health_interval_seconds,omitempty"`
+
+	// RateLimit son los limites por defecto de las instancias del producto.
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+
+	// Version sube en cada escritura.
+	Version int64 `json:"version"`
+	// SchemaVersion es la version del formato del registro (ver migrate.go).
+	SchemaVersion int `json:"schema_version"`
 }
 
-type ProductStore struct{}
+// ExposedService es un servicio del compose que ARK publica (nombre y puerto interno).
+type ExposedService struct {
+	Name string `json:"name"`
+	Port int    `json:"port"`
+}
 
-func NewProductStore() *ProductStore {
-	return &ProductStore{}
+// ExposedServices devuelve los servicios publicados; sin Services se usa WebService:WebPort.
+func (p Product) ExposedServices() []ExposedService {
+	if len(p.Services) > 0 {
+		return p.Services
+	}
+	name := strings.TrimSpace(p.WebService)
+	if name == "" {
+		name = "web"
+	}
+	port := p.WebPort
+	if port == 0 {
+		port = 80
+	}
+	return []ExposedService{{Name: name, Port: port}}
+}
+
+type ProductStore struct {
+	kv KV
+}
+
+func NewProductStore(kv KV) *ProductStore {
+	return &ProductStore{kv: kv}
 }
 
 func productKey(id string) string {
@@ -33,37 +68,34 @@ func productKey(id string) string {
 }
 
 func (s *ProductStore) Create(p Product) error {
-	ctx := context.Background()
 	key := productKey(p.ID)
 
-	exists, err := redis.Client.Exists(ctx, key).Result()
+	p = normalizeProduct(p)
+	data, err := json.Marshal(p)
 	if err != nil {
 		return err
 	}
-	if exists > 0 {
-		return errors.New("product already exists")
-	}
 
-	p = normalizeProduct(p)
-	data, err := json.Marshal(p)
+	ok, err := s.kv.SetNX(key, string(data))
 	if err != nil {
 		return err
 	}
-
-	return redis.Client.Set(ctx, key, data, 0).Err()
+	if !ok {
+		return errors.New("product already exists")
+	}
+	return s.kv.SAdd(productsIndexKey, p.ID)
 }
 
 func (s *ProductStore) GetAll() []Product {
-	ctx := context.Background()
-	keys, err := redis.Client.Keys(ctx, "product:*").Result()
+	ids, err := s.kv.SMembers(productsIndexKey)
 	if err != nil {
 		return []Product{}
 	}
 
-	result := make([]Product, 0, len(keys))
-	for _, key := range keys {
-		data, err := redis.Client.Get(ctx, key).Result()
-		if err != nil {
+	result := make([]Product, 0, len(ids))
+	for _, id := range ids {
+		data, ok, err := s.kv.Get(productKey(id))
+		if err != nil || !ok {
 			continue
 		}
 
@@ -71,7 +103,6 @@ func (s *ProductStore) GetAll() []Product {
 		if err := json.Unmarshal([]byte(data), &p); err != nil {
 			continue
 		}
-		p = normalizeProduct(p)
 		result = append(result, p)
 	}
 
@@ -79,11 +110,8 @@ func (s *ProductStore) GetAll() []Product {
 }
 
 func (s *ProductStore) GetByID(id string) (Product, error) {
-	ctx := context.Background()
-	key := productKey(id)
-
-	data, err := redis.Client.Get(ctx, key).Result()
-	if err != nil {
+	data, ok, err := s.kv.Get(productKey(id))
+	if err != nil || !ok {
 		return Product{}, errors.New("product not found")
 	}
 
@@ -92,52 +120,86 @@ func (s *ProductStore) GetByID(id string) (Product, error) {
 		return Product{}, err
 	}
 
-	return normalizeProduct(p), nil
+	return p, nil
 }
 
-func (s *ProductStore) Update(id string, p Product) error {
-	ctx := context.Background()
+// Update reemplaza el producto y devuelve la version guardada. Si p.Version no
+// es 0 tiene que coincidir con la actual; si no, ErrVersionConflict.
+func (s *ProductStore) Update(id string, p Product) (Product, error) {
 	key := productKey(id)
-
-	exists, err := redis.Client.Exists(ctx, key).Result()
-	if err != nil {
-		return err
-	}
-	if exists == 0 {
-		return errors.New("product not found")
-	}
+	expected := p.Version
 
 	p.ID = id
 	p = normalizeProduct(p)
 
-	data, err := json.Marshal(p)
-	if err != nil {
-		return err
+	for attempt := 0; attempt < casRetries; attempt++ {
+		raw, ok, err := s.kv.Get(key)
+		if err != nil {
+			return Product{}, err
+		}
+		if !ok {
+			return Product{}, errors.New("product not found")
+		}
+
+		var current Product
+		if err := json.Unmarshal([]byte(raw), &current); err != nil {
+			return Product{}, err
+		}
+		if expected != 0 && current.Version != expected {
+			return Product{}, ErrVersionConflict
+		}
+
+		p.Version = current.Version + 1
+		data, err := json.Marshal(p)
+		if err != nil {
+			return Product{}, err
+		}
+
+		swapped, err := s.kv.CompareAndSwap(key, raw, string(data))
+		if err != nil {
+			return Product{}, err
+		}
+		if swapped {
+			return p, nil
+		}
 	}
 
-	return redis.Client.Set(ctx, key, data, 0).Err()
+	return Product{}, ErrVersionConflict
 }
 
-func (s *ProductStore) Delete(id string) error {
-	ctx := context.Background()
-	key := productKey(id)
-
-	exists, err := redis.Client.Exists(ctx, key).Result()
+// Delete manda el producto a la papelera; actor queda registrado como quien lo borro.
+func (s *ProductStore) Delete(id string, actor string) error {
+	found, err := moveToTrash(s.kv, TrashProduct, productKey(id), id, actor)
 	if err != nil {
 		return err
 	}
-	if exists == 0 {
+	if !found {
 		return errors.New("product not found")
 	}
-
-	return redis.Client.Del(ctx, key).Err()
+	return s.kv.SRem(productsIndexKey, id)
 }
 
-func normalizeProduct(p Product) Product {
-	if len(p.DeployJobs) == 0 && len(p.Jobs) > 0 {
-		p.DeployJobs = p.Jobs
+// Restore saca el producto de la papelera. Falla si ya existe otro con el mismo id.
+func (s *ProductStore) Restore(id string) (Product, error) {
+	exists, err := takeFromTrash(s.kv, TrashProduct, productKey(id), id)
+	if err != nil {
+		return Product{}, err
+	}
+	if exists {
+		return Product{}, ErrRestoreConflict
+	}
+
+	// El registro puede ser de un esquema anterior si se borro antes de migrar.
+	if _, err := migrateRecord(s.kv, productKey(id), productMigrations, false); err != nil {
+		return Product{}, err
 	}
+	if err := s.kv.SAdd(productsIndexKey, strings.TrimSpace(id)); err != nil {
+		return Product{}, err
+	}
+	return s.GetByID(id)
+}
 
+func normalizeProduct(p Product) Product {
 	if p.DeployJobs != nil {
 		n := make(map[string]string, len(p.DeployJobs))
 		for k, v := range p.DeployJobs {
@@ -146,12 +208,18 @@ func normalizeProduct(p Product) Product {
 		p.DeployJobs = n
 	}
 
+	if p.Version == 0 {
+		p.Version = 1
+	}
+	p.SchemaVersion = productSchemaVersion
+
 	p.ID = strings.TrimSpace(p.ID)
 	p.Name = strings.TrimSpace(p.Name)
 	p.Description = strings.TrimSpace(p.Description)
 	p.ReleaseTag = strings.TrimSpace(p.ReleaseTag)
 	p.DeleteJob = strings.TrimSpace(p.DeleteJob)
 	p.WebService = strings.TrimSpace(p.WebService)
+	p.HealthPath = strings.TrimSpace(p.HealthPath)
 
 	if p.WebService == "" {
 		p.WebService = "web"
@@ -160,5 +228,9 @@ func normalizeProduct(p Product) Product {
 		p.WebPort = 80
 	}
 
+	for i := range p.Services {
+		p.Services[i].Name = strings.ToLower(strings.TrimSpace(p.Services[i].Name))
+	}
+
 	return p
 }
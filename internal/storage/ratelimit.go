@@ -0,0 +1,67 @@
+package storage
+
+import "errors"
+
+// RateLimit limita el trafico que el proxy deja pasar hacia una instancia.
+// El producto define los defaults y la ruta puede sobreescribirlos; 0 = sin limite.
+type RateLimit struct {
+	RequestsPerSecond      float64 `json:"requests_per_second,omitempty"`
+	Burst                  int     `json:"burst,omitempty"`
+	PerIPRequestsPerSecond float64 `json:"per_ip_requests_per_second,omitempty"`
+	PerIPBurst             int     `json:"per_ip_burst,omitempty"`
+	MaxBodyBytes           int64   `json:"max_body_bytes,omitempty"`
+	MaxConcurrent          int     `json:"max_concurrent,omitempty"`
+}
+
+// Validate rechaza valores negativos y bursts sin tasa.
+func (l *RateLimit) Validate() error {
+	if l == nil {
+		return nil
+	}
+	if l.RequestsPerSecond < 0 || l.PerIPRequestsPerSecond < 0 {
+		return errors.New("requests_per_second must be >= 0")
+	}
+	if l.Burst < 0 || l.PerIPBurst < 0 {
+		return errors.New("burst must be >= 0")
+	}
+	if l.Burst > 0 && l.RequestsPerSecond == 0 {
+		return errors.New("burst requires requests_per_second")
+	}
+	if l.PerIPBurst > 0 && l.PerIPRequestsPerSecond == 0 {
+		return errors.New("per_ip_burst requires per_ip_requests_per_second")
+	}
+	if l.MaxBodyBytes < 0 {
+		return errors.New("max_body_bytes must be >= 0")
+	}
+	if l.MaxConcurrent < 0 {
+		return errors.New("max_concurrent must be >= 0")
+	}
+	return nil
+}
+
+// IsZero indica que no hay ningun limite configurado.
+func (l *RateLimit) IsZero() bool {
+	return l == nil || *l == RateLimit{}
+}
+
+// Merge aplica sobre l los campos no vacios de override (burst va con su tasa).
+func (l RateLimit) Merge(override *RateLimit) RateLimit {
+	if override == nil {
+		return l
+	}
+	if override.RequestsPerSecond > 0 {
+		l.RequestsPerSecond = override.RequestsPerSecond
+		l.Burst = override.Burst
+	}
+	if override.PerIPRequestsPerSecond > 0 {
+		l.PerIPRequestsPerSecond = override.PerIPRequestsPerSecond
+		l.PerIPBurst = override.PerIPBurst
+	}
+	if override.MaxBodyBytes > 0 {
+		l.MaxBodyBytes = override.MaxBodyBytes
+	}
+	if override.MaxConcurrent > 0 {
+		l.MaxConcurrent = override.MaxConcurrent
+	}
+	return l
+}
@@ -1,112 +1,292 @@
 package storage
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
+)
+
+type Route struct {
+	InstanceID  string        `json:"instance_id"`
+	TargetHost  string        `json:"target_host"`
+	TargetPort  int           `json:"target_port"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+	Maintenance *Maintenance  `json:"maintenance,omitempty"`
+	Access      *AccessPolicy `json:"access,omitempty"`
+	Limits      *RateLimit    `json:"limits,omitempty"`
+
+	// Services mapea cada servicio expuesto a su puerto publicado en el host;
+	// DefaultService es el que atiende TargetPort.
+	Services       map[string]int `json:"services,omitempty"`
+	DefaultService string         `json:"default_service,omitempty"`
+
+	// Backends son las replicas registradas; TargetHost/TargetPort/Services
+	// reflejan la ultima registrada. Balancing y Sticky eligen entre ellas.
+	Backends  []Backend `json:"backends,omitempty"`
+	Balancing string    `json:"balancing,omitempty"`
+	Sticky    bool      `json:"sticky,omitempty"`
 
-	"github.com/redis/go-redis/v9"
+	Mirror *MirrorRule `json:"mirror,omitempty"`
+
+	// SchemaVersion es la version del formato del registro (ver migrate.go).
+	SchemaVersion int `json:"schema_version"`
+}
+
+// MirrorRule copia un porcentaje de las requests a otra instancia (shadow) y
+// descarta sus respuestas; sirve para comparar un release antes de promoverlo.
+// Sin MirrorWrites solo se copian GET, HEAD y OPTIONS.
+type MirrorRule struct {
+	TargetInstanceID string    `json:"target_instance_id"`
+	Percent          float64   `json:"percent"`
+	MaxBodyBytes     int64     `json:"max_body_bytes"`
+	MirrorWrites     bool      `json:"mirror_writes"`
+	CreatedAt        time.Time `json:"created_at"`
+}
 
-	arkredis "ark_deploy/internal/redis"
+// Modos de acceso que el proxy aplica antes de reenviar.
+const (
+	AccessPublic    = "public"
+	AccessBasicAuth = "basic_auth"
+	AccessLinkToken = "link_token"
+	AccessTailscale = "tailscale"
 )
 
-type Route struct {
-	InstanceID string    `json:"instance_id"`
-	TargetHost string    `json:"target_host"`
-	TargetPort int       `json:"target_port"`
-	UpdatedAt  time.Time `json:"updated_at"`
+// AccessPolicy restringe quien puede llegar a la instancia por el proxy publico.
+// Los secretos se guardan hasheados.
+type AccessPolicy struct {
+	Mode         string    `json:"mode"`
+	Username     string    `json:"username,omitempty"`
+	PasswordHash string    `json:"password_hash,omitempty"`
+	TokenHash    string    `json:"token_hash,omitempty"`
+	AllowUsers   []string  `json:"allow_users,omitempty"`
+	AllowTags    []string  `json:"allow_tags,omitempty"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// Maintenance deja la instancia fuera de linea sin borrarla; solo las IPs o
+// usuarios de Tailscale permitidos llegan al upstream.
+type Maintenance struct {
+	Message    string     `json:"message,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	Until      *time.Time `json:"until,omitempty"`
+	AllowIPs   []string   `json:"allow_ips,omitempty"`
+	AllowUsers []string   `json:"allow_users,omitempty"`
 }
 
-type RouteStore struct{}
+// Active indica si la ventana de mantenimiento sigue vigente en el instante dado.
+func (m *Maintenance) Active(now time.Time) bool {
+	if m == nil {
+		return false
+	}
+	return m.Until == nil || now.Before(*m.Until)
+}
+
+var ErrRouteNotFound = errors.New("route not found")
+
+var ErrBackendNotFound = errors.New("backend not found")
+
+type RouteStore struct {
+	kv KV
+}
 
-func NewRouteStore() *RouteStore {
-	return &RouteStore{}
+func NewRouteStore(kv KV) *RouteStore {
+	return &RouteStore{kv: kv}
 }
 
 func routeKey(instanceID string) string {
 	return fmt.Sprintf("route:%s", instanceID)
 }
 
+// PutRoute registra o actualiza el destino conservando la configuracion
+// guardada junto a la ruta (mantenimiento, etc.).
 func (s *RouteStore) PutRoute(instanceID string, host string, port int) error {
-	ctx := context.Background()
+	_, err := s.update(instanceID, true, func(record *Route) error {
+		record.InstanceID = strings.TrimSpace(instanceID)
+		record.TargetHost = strings.TrimSpace(host)
+		record.TargetPort = port
+		return nil
+	})
+	return err
+}
 
-	record := Route{
-		InstanceID: strings.TrimSpace(instanceID),
-		TargetHost: strings.TrimSpace(host),
-		TargetPort: port,
-		UpdatedAt:  time.Now(),
-	}
+// errNoChange corta update sin escribir.
+var errNoChange = errors.New("no change")
 
-	data, err := json.Marshal(record)
-	if err != nil {
-		return err
+// update aplica fn sobre la ruta guardada y la confirma con compare-and-swap
+// sobre el valor leido; si otra escritura gano la carrera se vuelve a leer y
+// aplicar fn. create permite partir de una ruta vacia si no existe.
+func (s *RouteStore) update(instanceID string, create bool, fn func(*Route) error) (Route, error) {
+	key := routeKey(strings.TrimSpace(instanceID))
+
+	for attempt := 0; attempt < casRetries; attempt++ {
+		raw, found, err := s.kv.Get(key)
+		if err != nil {
+			return Route{}, err
+		}
+		if !found && !create {
+			return Route{}, ErrRouteNotFound
+		}
+
+		var record Route
+		if found {
+			if err := json.Unmarshal([]byte(raw), &record); err != nil {
+				return Route{}, err
+			}
+		}
+		if err := fn(&record); err != nil {
+			return Route{}, err
+		}
+		record.UpdatedAt = time.Now()
+		record.SchemaVersion = routeSchemaVersion
+
+		data, err := json.Marshal(record)
+		if err != nil {
+			return Route{}, err
+		}
+
+		var swapped bool
+		if found {
+			swapped, err = s.kv.CompareAndSwap(key, raw, string(data))
+		} else {
+			swapped, err = s.kv.SetNX(key, string(data))
+		}
+		if err != nil {
+			return Route{}, err
+		}
+		if swapped {
+			return record, s.kv.SAdd(shortIndexKey(record.InstanceID), record.InstanceID)
+		}
 	}
 
-	return arkredis.Client.Set(ctx, routeKey(record.InstanceID), data, 0).Err()
+	return Route{}, ErrVersionConflict
 }
 
 func (s *RouteStore) GetRoute(instanceID string) (host string, port int, ok bool, err error) {
-	ctx := context.Background()
-
-	data, err := arkredis.Client.Get(ctx, routeKey(strings.TrimSpace(instanceID))).Result()
-	if err != nil {
-		if err == redis.Nil {
-			return "", 0, false, nil
-		}
+	record, ok, err := s.GetRouteRecord(instanceID)
+	if err != nil || !ok {
 		return "", 0, false, err
 	}
+	return record.TargetHost, record.TargetPort, true, nil
+}
+
+func (s *RouteStore) GetRouteRecord(instanceID string) (Route, bool, error) {
+	data, ok, err := s.kv.Get(routeKey(strings.TrimSpace(instanceID)))
+	if err != nil || !ok {
+		return Route{}, false, err
+	}
 
 	var record Route
 	if err := json.Unmarshal([]byte(data), &record); err != nil {
-		return "", 0, false, err
+		return Route{}, false, err
 	}
 
-	return record.TargetHost, record.TargetPort, true, nil
+	return record, true, nil
+}
+
+// SetMaintenance activa (m != nil) o quita (m == nil) el modo mantenimiento.
+func (s *RouteStore) SetMaintenance(instanceID string, m *Maintenance) error {
+	_, err := s.update(instanceID, false, func(record *Route) error {
+		record.Maintenance = m
+		return nil
+	})
+	return err
+}
+
+// SetAccessPolicy guarda la politica de acceso; nil la deja publica.
+func (s *RouteStore) SetAccessPolicy(instanceID string, p *AccessPolicy) error {
+	_, err := s.update(instanceID, false, func(record *Route) error {
+		record.Access = p
+		return nil
+	})
+	return err
+}
+
+// SetMirror activa (m != nil) o quita (m == nil) el mirroring de la instancia.
+func (s *RouteStore) SetMirror(instanceID string, m *MirrorRule) error {
+	_, err := s.update(instanceID, false, func(record *Route) error {
+		record.Mirror = m
+		return nil
+	})
+	return err
+}
+
+// SetLimits guarda los limites propios de la instancia; nil vuelve a los del producto.
+func (s *RouteStore) SetLimits(instanceID string, l *RateLimit) error {
+	_, err := s.update(instanceID, false, func(record *Route) error {
+		record.Limits = l
+		return nil
+	})
+	return err
 }
 
 func (s *RouteStore) GetRouteByShortID(shortID string) (instanceID string, host string, port int, ok bool, err error) {
-	ctx := context.Background()
 	short := strings.TrimSpace(strings.ToLower(shortID))
 	if short == "" {
 		return "", "", 0, false, nil
 	}
 
-	var cursor uint64
-	for {
-		keys, next, scanErr := arkredis.Client.Scan(ctx, cursor, routeKey(short+"*"), 100).Result()
-		if scanErr != nil {
-			return "", "", 0, false, scanErr
+	// El short id de 8 caracteres sale del indice; otros largos recorren las rutas.
+	var routes []Route
+	if len(short) == shortIDLen {
+		ids, err := s.kv.SMembers(shortIndexKey(short))
+		if err != nil {
+			return "", "", 0, false, err
 		}
-
-		for _, key := range keys {
-			data, getErr := arkredis.Client.Get(ctx, key).Result()
-			if getErr != nil {
-				continue
+		for _, id := range ids {
+			if record, found, err := s.GetRouteRecord(id); err == nil && found {
+				routes = append(routes, record)
 			}
+		}
+	} else {
+		routes, err = s.listRoutes(routeKey(short))
+		if err != nil {
+			return "", "", 0, false, err
+		}
+	}
 
-			var record Route
-			if unmarshalErr := json.Unmarshal([]byte(data), &record); unmarshalErr != nil {
-				continue
-			}
+	for _, record := range routes {
+		id := strings.TrimSpace(record.InstanceID)
+		if strings.HasPrefix(strings.ToLower(id), short) {
+			return id, record.TargetHost, record.TargetPort, true, nil
+		}
+	}
 
-			id := strings.TrimSpace(record.InstanceID)
-			if strings.HasPrefix(strings.ToLower(id), short) {
-				return id, record.TargetHost, record.TargetPort, true, nil
-			}
+	return "", "", 0, false, nil
+}
+
+func (s *RouteStore) ListRoutes() ([]Route, error) {
+	return s.listRoutes("route:")
+}
+
+func (s *RouteStore) listRoutes(prefix string) ([]Route, error) {
+	keys, err := s.kv.Keys(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Route, 0, len(keys))
+	for _, key := range keys {
+		data, ok, err := s.kv.Get(key)
+		if err != nil || !ok {
+			continue
 		}
 
-		cursor = next
-		if cursor == 0 {
-			break
+		var record Route
+		if err := json.Unmarshal([]byte(data), &record); err != nil {
+			continue
 		}
+		result = append(result, record)
 	}
 
-	return "", "", 0, false, nil
+	return result, nil
 }
 
 func (s *RouteStore) DeleteRoute(instanceID string) error {
-	ctx := context.Background()
-	return arkredis.Client.Del(ctx, routeKey(strings.TrimSpace(instanceID))).Err()
+	id := strings.TrimSpace(instanceID)
+	if _, err := s.kv.Del(routeKey(id)); err != nil {
+		return err
+	}
+	return s.kv.SRem(shortIndexKey(id), id)
 }
@@ -0,0 +1,373 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Snapshot es el backup versionado de todo el estado persistente de ARK:
+// productos, instancias, rutas, aliases, dominios propios, usuarios SSH y
+// webhooks (con su secreto). El access log y el historial de entregas de los
+// webhooks no se incluyen (son historiales acotados).
+
+const SnapshotFormat = 1
+
+type Snapshot struct {
+	Format     int               `json:"format"`
+	ExportedAt time.Time         `json:"exported_at"`
+	Schema     map[string]int    `json:"schema"`
+	Products   []Product         `json:"products"`
+	Instances  []Instance        `json:"instances"`
+	Routes     []Route           `json:"routes"`
+	Aliases    []Alias           `json:"aliases"`
+	Domains    map[string]string `json:"domains"`
+	SSHUsers   map[string]string `json:"ssh_users"`
+	Webhooks   []Webhook         `json:"webhooks"`
+}
+
+func currentSchema() map[string]int {
+	return map[string]int{
+		"product":  productSchemaVersion,
+		"instance": instanceSchemaVersion,
+		"route":    routeSchemaVersion,
+		"alias":    aliasSchemaVersion,
+		"webhook":  webhookSchemaVersion,
+	}
+}
+
+// Export lee todos los registros. Los que no se pueden decodificar se omiten.
+func Export(kv KV) (Snapshot, error) {
+	snap := Snapshot{
+		Format:     SnapshotFormat,
+		ExportedAt: time.Now().UTC(),
+		Schema:     currentSchema(),
+		Products:   []Product{},
+		Instances:  []Instance{},
+		Routes:     []Route{},
+		Aliases:    []Alias{},
+		Domains:    map[string]string{},
+		SSHUsers:   map[string]string{},
+		Webhooks:   []Webhook{},
+	}
+
+	if err := exportRecords(kv, "product:", &snap.Products); err != nil {
+		return Snapshot{}, err
+	}
+	if err := exportRecords(kv, "instance:", &snap.Instances); err != nil {
+		return Snapshot{}, err
+	}
+	if err := exportRecords(kv, "route:", &snap.Routes); err != nil {
+		return Snapshot{}, err
+	}
+	if err := exportRecords(kv, "alias:", &snap.Aliases); err != nil {
+		return Snapshot{}, err
+	}
+	if err := exportStrings(kv, "domain:", snap.Domains); err != nil {
+		return Snapshot{}, err
+	}
+	if err := exportStrings(kv, "sshuser:", snap.SSHUsers); err != nil {
+		return Snapshot{}, err
+	}
+	if err := exportRecords(kv, "webhook:", &snap.Webhooks); err != nil {
+		return Snapshot{}, err
+	}
+
+	return snap, nil
+}
+
+func exportRecords[T any](kv KV, prefix string, out *[]T) error {
+	keys, err := kv.Keys(prefix)
+	if err != nil {
+		return err
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		raw, ok, err := kv.Get(key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		var rec T
+		if err := json.Unmarshal([]byte(raw), &rec); err != nil {
+			continue
+		}
+		*out = append(*out, rec)
+	}
+	return nil
+}
+
+func exportStrings(kv KV, prefix string, out map[string]string) error {
+	keys, err := kv.Keys(prefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		v, ok, err := kv.Get(key)
+		if err != nil {
+			return err
+		}
+		if ok {
+			out[strings.TrimPrefix(key, prefix)] = v
+		}
+	}
+	return nil
+}
+
+type RestoreMode string
+
+const (
+	// RestoreMerge agrega o reemplaza los registros del backup y deja el resto.
+	RestoreMerge RestoreMode = "merge"
+	// RestoreReplace ademas borra los registros que no estan en el backup.
+	RestoreReplace RestoreMode = "replace"
+)
+
+type RestoreCount struct {
+	Kind    string `json:"kind"`
+	Created int    `json:"created"`
+	Updated int    `json:"updated"`
+	Deleted int    `json:"deleted"`
+}
+
+type RestoreReport struct {
+	Mode   RestoreMode    `json:"mode"`
+	DryRun bool           `json:"dry_run"`
+	Counts []RestoreCount `json:"counts"`
+}
+
+// CheckSnapshot valida el formato y que el esquema no sea mas nuevo que el soportado.
+func CheckSnapshot(snap Snapshot) error {
+	if snap.Format != SnapshotFormat {
+		return fmt.Errorf("unsupported backup format %d (expected %d)", snap.Format, SnapshotFormat)
+	}
+	current := currentSchema()
+	for kind, v := range snap.Schema {
+		if max, ok := current[kind]; ok && v > max {
+			return fmt.Errorf("backup %s schema %d is newer than supported %d", kind, v, max)
+		}
+	}
+	return nil
+}
+
+// Restore escribe el snapshot (ya validado). No es atomico: conviene hacerlo
+// sin deploys en curso. Al terminar corre las migraciones y reconstruye los
+// indices. Con dryRun solo calcula el reporte.
+func Restore(kv KV, snap Snapshot, mode RestoreMode, dryRun bool) (RestoreReport, error) {
+	if mode != RestoreMerge && mode != RestoreReplace {
+		return RestoreReport{}, fmt.Errorf("invalid restore mode %q", mode)
+	}
+	if err := CheckSnapshot(snap); err != nil {
+		return RestoreReport{}, err
+	}
+
+	r := &restorer{kv: kv, mode: mode, dryRun: dryRun}
+	steps := []func() error{
+		func() error {
+			return restoreRecords(r, "product", "product:", snap.Products, func(p Product) string { return strings.TrimSpace(p.ID) }, bumpProductVersion)
+		},
+		func() error {
+			return restoreRecords(r, "instance", "instance:", snap.Instances, func(i Instance) string { return strings.TrimSpace(i.ID) }, bumpInstanceVersion)
+		},
+		func() error {
+			return restoreRecords(r, "route", "route:", snap.Routes, func(rt Route) string { return strings.TrimSpace(rt.InstanceID) }, nil)
+		},
+		func() error {
+			return restoreRecords(r, "alias", "alias:", snap.Aliases, func(a Alias) string { return strings.ToLower(strings.TrimSpace(a.Name)) }, nil)
+		},
+		func() error { return r.restoreStrings("domain", "domain:", snap.Domains, domainKey) },
+		func() error { return r.restoreStrings("ssh_user", "sshuser:", snap.SSHUsers, sshUserKey) },
+		func() error {
+			return restoreRecords(r, "webhook", "webhook:", snap.Webhooks, func(w Webhook) string { return strings.TrimSpace(w.ID) }, nil)
+		},
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return RestoreReport{}, err
+		}
+	}
+
+	report := RestoreReport{Mode: mode, DryRun: dryRun, Counts: r.counts}
+	if dryRun {
+		return report, nil
+	}
+
+	if err := r.rebuildSets(snap); err != nil {
+		return RestoreReport{}, err
+	}
+	if _, err := Migrate(kv, false); err != nil {
+		return RestoreReport{}, err
+	}
+	if err := RebuildIndexes(kv); err != nil {
+		return RestoreReport{}, err
+	}
+	return report, nil
+}
+
+type restorer struct {
+	kv     KV
+	mode   RestoreMode
+	dryRun bool
+	counts []RestoreCount
+}
+
+// bumpProductVersion hace que el registro restaurado quede por encima de la
+// version guardada, asi un If-Match viejo no lo pisa.
+func bumpProductVersion(p *Product, existing string) {
+	var cur Product
+	if json.Unmarshal([]byte(existing), &cur) == nil && cur.Version >= p.Version {
+		p.Version = cur.Version + 1
+	}
+}
+
+func bumpInstanceVersion(i *Instance, existing string) {
+	var cur Instance
+	if json.Unmarshal([]byte(existing), &cur) == nil && cur.Version >= i.Version {
+		i.Version = cur.Version + 1
+	}
+}
+
+func restoreRecords[T any](r *restorer, kind, prefix string, records []T, id func(T) string, bump func(*T, string)) error {
+	count := RestoreCount{Kind: kind}
+	keep := make(map[string]bool, len(records))
+
+	for _, rec := range records {
+		key := prefix + id(rec)
+		keep[key] = true
+
+		existing, found, err := r.kv.Get(key)
+		if err != nil {
+			return err
+		}
+		if found {
+			count.Updated++
+			if bump != nil {
+				bump(&rec, existing)
+			}
+		} else {
+			count.Created++
+		}
+		if r.dryRun {
+			continue
+		}
+
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		if err := r.kv.Set(key, string(data)); err != nil {
+			return err
+		}
+	}
+
+	deleted, err := r.deleteMissing(prefix, keep)
+	if err != nil {
+		return err
+	}
+	count.Deleted = deleted
+	r.counts = append(r.counts, count)
+	return nil
+}
+
+func (r *restorer) restoreStrings(kind, prefix string, values map[string]string, keyOf func(string) string) error {
+	count := RestoreCount{Kind: kind}
+	keep := make(map[string]bool, len(values))
+
+	for name, value := range values {
+		key := keyOf(name)
+		value = strings.TrimSpace(value)
+		keep[key] = true
+
+		old, found, err := r.kv.Get(key)
+		if err != nil {
+			return err
+		}
+		if found {
+			count.Updated++
+		} else {
+			count.Created++
+		}
+		if r.dryRun {
+			continue
+		}
+		if err := r.kv.Set(key, value); err != nil {
+			return err
+		}
+		// Un dominio que cambia de dueño sale del set de la instancia anterior.
+		if prefix == "domain:" && found && old != value {
+			if err := r.kv.SRem(instanceDomainsKey(old), strings.TrimPrefix(key, prefix)); err != nil {
+				return err
+			}
+		}
+	}
+
+	deleted, err := r.deleteMissing(prefix, keep)
+	if err != nil {
+		return err
+	}
+	count.Deleted = deleted
+	r.counts = append(r.counts, count)
+	return nil
+}
+
+// deleteMissing borra, en modo replace, las claves del prefijo que no estan en keep.
+func (r *restorer) deleteMissing(prefix string, keep map[string]bool) (int, error) {
+	if r.mode != RestoreReplace {
+		return 0, nil
+	}
+	keys, err := r.kv.Keys(prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, key := range keys {
+		if keep[key] {
+			continue
+		}
+		deleted++
+		if r.dryRun {
+			continue
+		}
+		if _, err := r.kv.Del(key); err != nil {
+			return 0, err
+		}
+	}
+	return deleted, nil
+}
+
+// rebuildSets regenera los sets auxiliares que no son indices: aliases y
+// instance_domains:<id>.
+func (r *restorer) rebuildSets(snap Snapshot) error {
+	if r.mode == RestoreReplace {
+		if _, err := r.kv.Del(aliasesKey); err != nil {
+			return err
+		}
+		keys, err := r.kv.Keys("instance_domains:")
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if _, err := r.kv.Del(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, a := range snap.Aliases {
+		if err := r.kv.SAdd(aliasesKey, strings.ToLower(strings.TrimSpace(a.Name))); err != nil {
+			return err
+		}
+	}
+	for host, id := range snap.Domains {
+		if err := r.kv.SAdd(instanceDomainsKey(id), strings.ToLower(strings.TrimSpace(host))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
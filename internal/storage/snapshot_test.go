@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRestore_MergeKeepsOtherRecordsAndBumpsVersion(t *testing.T) {
+	kv := openTestKV(t, filepath.Join(t.TempDir(), "ark.db"))
+	products := NewProductStore(kv)
+	_ = products.Create(Product{ID: "shop", Name: "Shop", Version: 1})
+	_ = products.Create(Product{ID: "blog", Name: "Blog", Version: 1})
+	if _, err := products.Update("shop", Product{Name: "Shop v2"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	_ = NewDomainStore(kv).Claim("shop.example.com", "old-instance")
+
+	snap, err := Export(kv)
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	snap.Products = []Product{{ID: "shop", Name: "Restored", Version: 1}}
+	snap.Domains = map[string]string{"Shop.Example.com": "new-instance"}
+
+	report, err := Restore(kv, snap, RestoreMerge, false)
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if report.Counts[0] != (RestoreCount{Kind: "product", Updated: 1}) {
+		t.Fatalf("unexpected product counts: %+v", report.Counts[0])
+	}
+
+	p, err := products.GetByID("shop")
+	if err != nil || p.Name != "Restored" {
+		t.Fatalf("unexpected product: %+v %v", p, err)
+	}
+	// La version restaurada queda por encima de la guardada (2).
+	if p.Version != 3 {
+		t.Fatalf("expected version 3, got %d", p.Version)
+	}
+	if _, err := products.GetByID("blog"); err != nil {
+		t.Fatalf("merge must keep records missing from the backup: %v", err)
+	}
+
+	domains := NewDomainStore(kv)
+	if id, ok, _ := domains.Resolve("shop.example.com"); !ok || id != "new-instance" {
+		t.Fatalf("unexpected domain owner: %q", id)
+	}
+	if hosts, _ := kv.SMembers(instanceDomainsKey("old-instance")); len(hosts) != 0 {
+		t.Fatalf("domain must leave the previous owner set, got %v", hosts)
+	}
+}
+
+func TestRestore_RejectsNewerSchema(t *testing.T) {
+	kv := openTestKV(t, filepath.Join(t.TempDir(), "ark.db"))
+	snap, _ := Export(kv)
+	snap.Schema["product"] = productSchemaVersion + 1
+
+	if _, err := Restore(kv, snap, RestoreReplace, false); err == nil {
+		t.Fatalf("expected error for a backup from a newer schema")
+	}
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Papelera: al borrar un producto o una instancia el registro pasa a
+// trash:<kind>:<id> junto con la fecha y quien lo borro. Restore lo devuelve
+// a su clave y TrashStore.Purge descarta los que superan la retencion.
+
+const (
+	TrashProduct  = "product"
+	TrashInstance = "instance"
+)
+
+var (
+	ErrNotInTrash = errors.New("not found in trash")
+	// ErrRestoreConflict: ya hay un registro vivo con el mismo id.
+	ErrRestoreConflict = errors.New("a record with the same id already exists")
+)
+
+type Tombstone struct {
+	Kind      string          `json:"kind"`
+	ID        string          `json:"id"`
+	DeletedAt time.Time       `json:"deleted_at"`
+	DeletedBy string          `json:"deleted_by"`
+	Record    json.RawMessage `json:"record"`
+}
+
+func trashKey(kind, id string) string {
+	return "trash:" + kind + ":" + strings.TrimSpace(id)
+}
+
+// moveToTrash guarda el registro en la papelera y borra la clave original;
+// found=false si no existia.
+func moveToTrash(kv KV, kind, key, id, actor string) (bool, error) {
+	raw, ok, err := kv.Get(key)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	data, err := json.Marshal(Tombstone{
+		Kind:      kind,
+		ID:        strings.TrimSpace(id),
+		DeletedAt: time.Now().UTC(),
+		DeletedBy: strings.TrimSpace(actor),
+		Record:    json.RawMessage(raw),
+	})
+	if err != nil {
+		return false, err
+	}
+	if err := kv.Set(trashKey(kind, id), string(data)); err != nil {
+		return false, err
+	}
+
+	return kv.Del(key)
+}
+
+// takeFromTrash vuelve a escribir el registro en key (solo si esta libre) y lo
+// saca de la papelera. exists=true si ya hay un registro vivo con ese id.
+func takeFromTrash(kv KV, kind, key, id string) (exists bool, err error) {
+	raw, ok, err := kv.Get(trashKey(kind, id))
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, ErrNotInTrash
+	}
+
+	var t Tombstone
+	if err := json.Unmarshal([]byte(raw), &t); err != nil {
+		return false, err
+	}
+
+	written, err := kv.SetNX(key, string(t.Record))
+	if err != nil {
+		return false, err
+	}
+	if !written {
+		return true, nil
+	}
+	_, err = kv.Del(trashKey(kind, id))
+	return false, err
+}
+
+type TrashStore struct {
+	kv KV
+}
+
+func NewTrashStore(kv KV) *TrashStore {
+	return &TrashStore{kv: kv}
+}
+
+// List devuelve lo que hay en la papelera (kind vacio = todo), lo mas nuevo primero.
+func (s *TrashStore) List(kind string) ([]Tombstone, error) {
+	prefix := "trash:"
+	if kind != "" {
+		prefix += kind + ":"
+	}
+	keys, err := s.kv.Keys(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]Tombstone, 0, len(keys))
+	for _, key := range keys {
+		raw, ok, err := s.kv.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		var t Tombstone
+		if err := json.Unmarshal([]byte(raw), &t); err != nil {
+			continue
+		}
+		out = append(out, t)
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].DeletedAt.After(out[j].DeletedAt) })
+	return out, nil
+}
+
+// Purge descarta definitivamente lo borrado antes de before.
+func (s *TrashStore) Purge(before time.Time) (int, error) {
+	all, err := s.List("")
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, t := range all {
+		if !t.DeletedAt.Before(before) {
+			continue
+		}
+		found, err := s.kv.Del(trashKey(t.Kind, t.ID))
+		if err != nil {
+			return purged, err
+		}
+		if found {
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// RunPurger purga cada every lo que supera la retencion, hasta que ctx se cancele.
+func (s *TrashStore) RunPurger(ctx context.Context, retention, every time.Duration) {
+	if retention <= 0 || every <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		if n, err := s.Purge(time.Now().Add(-retention)); err != nil {
+			log.Printf("trash: purge failed: %v", err)
+		} else if n > 0 {
+			log.Printf("trash: purged %d records", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
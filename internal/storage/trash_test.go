@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInstanceStore_DeleteGoesToTrash(t *testing.T) {
+	kv := openTestKV(t, filepath.Join(t.TempDir(), "ark.db"))
+	instances := NewInstanceStore(kv)
+	trash := NewTrashStore(kv)
+
+	_ = instances.Create(Instance{ID: "abc123", ProductID: "shop", Status: "running"})
+	if err := instances.Delete("abc123", "alice@example.com"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if page, _ := instances.List(InstanceQuery{ProductID: "shop"}); page.Total != 0 {
+		t.Fatalf("deleted instance still listed: %+v", page)
+	}
+
+	items, err := trash.List(TrashInstance)
+	if err != nil || len(items) != 1 || items[0].DeletedBy != "alice@example.com" || items[0].DeletedAt.IsZero() {
+		t.Fatalf("unexpected trash: %+v %v", items, err)
+	}
+
+	// Un registro vivo con el mismo id impide restaurar.
+	_ = instances.Create(Instance{ID: "abc123", ProductID: "other"})
+	if _, err := instances.Restore("abc123"); !errors.Is(err, ErrRestoreConflict) {
+		t.Fatalf("expected ErrRestoreConflict, got %v", err)
+	}
+	_ = instances.Delete("abc123", "bob")
+
+	// La papelera guarda el ultimo borrado con ese id.
+	i, err := instances.Restore("abc123")
+	if err != nil || i.ProductID != "other" {
+		t.Fatalf("unexpected restore: %+v %v", i, err)
+	}
+	if page, _ := instances.List(InstanceQuery{ProductID: "other"}); page.Total != 1 {
+		t.Fatalf("restored instance must be indexed again: %+v", page)
+	}
+	if _, err := instances.Restore("abc123"); !errors.Is(err, ErrNotInTrash) {
+		t.Fatalf("expected ErrNotInTrash, got %v", err)
+	}
+}
+
+func TestTrashStore_Purge(t *testing.T) {
+	kv := openTestKV(t, filepath.Join(t.TempDir(), "ark.db"))
+	products := NewProductStore(kv)
+	_ = products.Create(Product{ID: "old"})
+	_ = products.Create(Product{ID: "new"})
+	_ = products.Delete("old", "admin")
+	_ = products.Delete("new", "admin")
+
+	// Envejece el primero para que supere la retencion.
+	items, _ := NewTrashStore(kv).List(TrashProduct)
+	for _, item := range items {
+		if item.ID == "old" {
+			item.DeletedAt = time.Now().Add(-48 * time.Hour)
+			data, _ := json.Marshal(item)
+			_ = kv.Set(trashKey(item.Kind, item.ID), string(data))
+		}
+	}
+
+	n, err := NewTrashStore(kv).Purge(time.Now().Add(-24 * time.Hour))
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 purged, got %d %v", n, err)
+	}
+	if _, err := products.Restore("old"); !errors.Is(err, ErrNotInTrash) {
+		t.Fatalf("purged product must not be restorable: %v", err)
+	}
+	if _, err := products.Restore("new"); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+}
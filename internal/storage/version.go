@@ -0,0 +1,12 @@
+package storage
+
+import "errors"
+
+// Control de concurrencia optimista: productos e instancias llevan Version y
+// las escrituras de lectura-modificacion-escritura se confirman con
+// CompareAndSwap sobre el valor leido. Si otro proceso escribio en el medio se
+// vuelve a leer y aplicar el cambio, hasta casRetries veces.
+
+var ErrVersionConflict = errors.New("version conflict")
+
+const casRetries = 10
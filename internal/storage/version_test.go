@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestInstanceStore_ConcurrentUpdatesKeepBothFields(t *testing.T) {
+	kv := openTestKV(t, filepath.Join(t.TempDir(), "ark.db"))
+	store := NewInstanceStore(kv)
+	if err := store.Create(Instance{ID: "i-1", Status: "provisioning"}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	// Un callback cambia el estado mientras otro proceso actualiza las URLs.
+	const rounds = 50
+	var wg sync.WaitGroup
+	var lastStatus, lastURL string
+	var okStatus, okURL int
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			status := fmt.Sprintf("s%d", i)
+			if store.UpdateStatus("i-1", status) == nil {
+				lastStatus = status
+				okStatus++
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			url := fmt.Sprintf("http://u%d", i)
+			if store.UpdateAccessURLs("i-1", url, "", "") == nil {
+				lastURL = url
+				okURL++
+			}
+		}
+	}()
+	wg.Wait()
+
+	got, _ := store.GetByID("i-1")
+	if got.Status != lastStatus || got.LocalURL != lastURL {
+		t.Fatalf("lost update: status=%q (want %q) url=%q (want %q)", got.Status, lastStatus, got.LocalURL, lastURL)
+	}
+	if got.Version != int64(1+okStatus+okURL) {
+		t.Fatalf("expected version %d, got %d", 1+okStatus+okURL, got.Version)
+	}
+}
+
+func TestProductStore_UpdateChecksVersion(t *testing.T) {
+	kv := openTestKV(t, filepath.Join(t.TempDir(), "ark.db"))
+	store := NewProductStore(kv)
+	_ = store.Create(Product{ID: "shop", Name: "Shop"})
+
+	updated, err := store.Update("shop", Product{Name: "Shop 2", Version: 1})
+	if err != nil || updated.Version != 2 {
+		t.Fatalf("unexpected update: %+v %v", updated, err)
+	}
+	if _, err := store.Update("shop", Product{Name: "stale", Version: 1}); err != ErrVersionConflict {
+		t.Fatalf("expected ErrVersionConflict, got %v", err)
+	}
+
+	// Los registros anteriores al versionado quedan en la version 1 al migrar.
+	_ = kv.Set(productKey("legacy"), `{"id":"legacy","name":"Old"}`)
+	if _, err := Migrate(kv, false); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if p, _ := store.GetByID("legacy"); p.Version != 1 {
+		t.Fatalf("expected legacy product at version 1, got %d", p.Version)
+	}
+	if p, err := store.Update("legacy", Product{Name: "New", Version: 1}); err != nil || p.Version != 2 {
+		t.Fatalf("unexpected legacy update: %+v %v", p, err)
+	}
+}
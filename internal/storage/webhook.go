@@ -0,0 +1,355 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Webhooks salientes: webhook:<id> -> JSON con la URL, los eventos que le
+// interesan y el secreto para firmar. Cada envio es una entrega
+// (webhook_delivery:<id>); webhook_deliveries:<webhook> las ordena por creacion
+// para el historial y webhook_due es la cola de pendientes (score = proximo
+// intento, en ms).
+
+var (
+	ErrWebhookNotFound  = errors.New("webhook not found")
+	ErrDeliveryNotFound = errors.New("delivery not found")
+)
+
+const (
+	webhookDueKey = "webhook_due"
+	// MaxWebhookDeliveries es cuantas entregas se guardan por webhook; las mas
+	// viejas ya terminadas se descartan (las pendientes nunca).
+	MaxWebhookDeliveries = 100
+)
+
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+type Webhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Events son tipos exactos o prefijos terminados en "." ("*" o vacio = todos).
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// SchemaVersion es la version del formato del registro (ver migrate.go).
+	SchemaVersion int `json:"schema_version"`
+}
+
+type WebhookDelivery struct {
+	ID        string          `json:"id"`
+	WebhookID string          `json:"webhook_id"`
+	EventID   string          `json:"event_id"`
+	EventType string          `json:"event_type"`
+	Payload   json.RawMessage `json:"payload"`
+	Status    string          `json:"status"`
+	Attempts  int             `json:"attempts"`
+	// ResponseStatus y Error son del ultimo intento.
+	ResponseStatus int        `json:"response_status,omitempty"`
+	Error          string     `json:"error,omitempty"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty"`
+	RedeliveryOf   string     `json:"redelivery_of,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+type WebhookStore struct {
+	kv KV
+}
+
+func NewWebhookStore(kv KV) *WebhookStore {
+	return &WebhookStore{kv: kv}
+}
+
+func webhookKey(id string) string {
+	return "webhook:" + strings.TrimSpace(id)
+}
+
+func deliveryKey(id string) string {
+	return "webhook_delivery:" + id
+}
+
+func webhookDeliveriesKey(webhookID string) string {
+	return "webhook_deliveries:" + webhookID
+}
+
+func (s *WebhookStore) Get(id string) (Webhook, bool, error) {
+	raw, ok, err := s.kv.Get(webhookKey(id))
+	if err != nil || !ok {
+		return Webhook{}, false, err
+	}
+	var w Webhook
+	if err := json.Unmarshal([]byte(raw), &w); err != nil {
+		return Webhook{}, false, err
+	}
+	return w, true, nil
+}
+
+// List devuelve los webhooks por fecha de creacion.
+func (s *WebhookStore) List() ([]Webhook, error) {
+	keys, err := s.kv.Keys("webhook:")
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]Webhook, 0, len(keys))
+	for _, key := range keys {
+		w, ok, err := s.Get(strings.TrimPrefix(key, "webhook:"))
+		if err != nil {
+			continue
+		}
+		if ok {
+			out = append(out, w)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].CreatedAt.Before(out[j].CreatedAt)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out, nil
+}
+
+func (s *WebhookStore) Create(w Webhook) error {
+	w.SchemaVersion = webhookSchemaVersion
+	data, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	ok, err := s.kv.SetNX(webhookKey(w.ID), string(data))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("webhook already exists")
+	}
+	return nil
+}
+
+func (s *WebhookStore) Update(w Webhook) error {
+	w.SchemaVersion = webhookSchemaVersion
+	data, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	ok, err := s.kv.SetXX(webhookKey(w.ID), string(data))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// Delete borra el webhook junto con su historial de entregas.
+func (s *WebhookStore) Delete(id string) error {
+	found, err := s.kv.Del(webhookKey(id))
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrWebhookNotFound
+	}
+
+	members, err := s.kv.ZRange(webhookDeliveriesKey(id))
+	if err != nil {
+		return err
+	}
+	for _, m := range members {
+		if err := s.dropDelivery(id, m.Member); err != nil {
+			return err
+		}
+	}
+	_, err = s.kv.Del(webhookDeliveriesKey(id))
+	return err
+}
+
+// AddDelivery guarda una entrega nueva, la encola si esta pendiente y recorta
+// el historial del webhook con trimDeliveries. Se crea con SetNX: si el id ya existe (un Enqueue
+// reintentado tras fallar a mitad) no se duplica, solo se completan el
+// historial y la cola con lo guardado.
+func (s *WebhookStore) AddDelivery(d WebhookDelivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	created, err := s.kv.SetNX(deliveryKey(d.ID), string(data))
+	if err != nil {
+		return err
+	}
+	if !created {
+		if d, _, err = s.getDelivery(d.ID); err != nil {
+			return err
+		}
+	}
+	if d.Status == DeliveryPending && d.NextAttemptAt != nil {
+		if err := s.kv.ZAdd(webhookDueKey, d.ID, float64(d.NextAttemptAt.UnixMilli())); err != nil {
+			return err
+		}
+	}
+	if err := s.kv.ZAdd(webhookDeliveriesKey(d.WebhookID), d.ID, float64(d.CreatedAt.UnixMilli())); err != nil {
+		return err
+	}
+
+	return s.trimDeliveries(d.WebhookID)
+}
+
+// trimDeliveries descarta las entregas terminadas mas viejas hasta dejar
+// MaxWebhookDeliveries. Las pendientes se saltean aunque sean viejas: siguen
+// en la cola y se borrarian sin enviarse. Si no hay terminadas para descartar
+// el historial se pasa del maximo.
+func (s *WebhookStore) trimDeliveries(webhookID string) error {
+	members, err := s.kv.ZRange(webhookDeliveriesKey(webhookID))
+	if err != nil {
+		return err
+	}
+
+	excess := len(members) - MaxWebhookDeliveries
+	for i := 0; i < len(members) && excess > 0; i++ {
+		d, err := s.GetDelivery(members[i].Member)
+		if err != nil && !errors.Is(err, ErrDeliveryNotFound) {
+			return err
+		}
+		if err == nil && d.Status == DeliveryPending {
+			continue
+		}
+		if err := s.dropDelivery(webhookID, members[i].Member); err != nil {
+			return err
+		}
+		excess--
+	}
+	return nil
+}
+
+func (s *WebhookStore) dropDelivery(webhookID, id string) error {
+	if _, err := s.kv.Del(deliveryKey(id)); err != nil {
+		return err
+	}
+	if err := s.kv.ZRem(webhookDueKey, id); err != nil {
+		return err
+	}
+	return s.kv.ZRem(webhookDeliveriesKey(webhookID), id)
+}
+
+// saveDelivery escribe la entrega y la deja en la cola solo si esta pendiente.
+func (s *WebhookStore) saveDelivery(d WebhookDelivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	if err := s.kv.Set(deliveryKey(d.ID), string(data)); err != nil {
+		return err
+	}
+	if d.Status == DeliveryPending && d.NextAttemptAt != nil {
+		return s.kv.ZAdd(webhookDueKey, d.ID, float64(d.NextAttemptAt.UnixMilli()))
+	}
+	return s.kv.ZRem(webhookDueKey, d.ID)
+}
+
+// SaveDelivery guarda el resultado de un intento.
+func (s *WebhookStore) SaveDelivery(d WebhookDelivery) error {
+	return s.saveDelivery(d)
+}
+
+func (s *WebhookStore) GetDelivery(id string) (WebhookDelivery, error) {
+	d, _, err := s.getDelivery(id)
+	return d, err
+}
+
+func (s *WebhookStore) getDelivery(id string) (WebhookDelivery, string, error) {
+	raw, ok, err := s.kv.Get(deliveryKey(id))
+	if err != nil {
+		return WebhookDelivery{}, "", err
+	}
+	if !ok {
+		return WebhookDelivery{}, "", ErrDeliveryNotFound
+	}
+	var d WebhookDelivery
+	if err := json.Unmarshal([]byte(raw), &d); err != nil {
+		return WebhookDelivery{}, "", err
+	}
+	return d, raw, nil
+}
+
+// ListDeliveries devuelve hasta limit entregas del webhook, las mas nuevas primero.
+func (s *WebhookStore) ListDeliveries(webhookID string, limit int) ([]WebhookDelivery, error) {
+	members, err := s.kv.ZRange(webhookDeliveriesKey(webhookID))
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]WebhookDelivery, 0)
+	for i := len(members) - 1; i >= 0 && (limit <= 0 || len(out) < limit); i-- {
+		d, err := s.GetDelivery(members[i].Member)
+		if err != nil {
+			continue
+		}
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+// DueDeliveries devuelve los ids de las entregas pendientes cuyo proximo
+// intento ya vencio, las mas atrasadas primero.
+func (s *WebhookStore) DueDeliveries(now time.Time, limit int) ([]string, error) {
+	if limit < 0 {
+		limit = 0
+	}
+	members, err := s.kv.ZRangeByScore(webhookDueKey, math.Inf(-1), float64(now.UnixMilli()), false, 0, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]string, 0, len(members))
+	for _, m := range members {
+		out = append(out, m.Member)
+	}
+	return out, nil
+}
+
+// ClaimDelivery toma una entrega vencida para intentarla: suma el intento y
+// corre el proximo a now+lease para que otra replica no la tome a la vez.
+// ok=false si ya no esta pendiente, no vencio o la tomo otro.
+func (s *WebhookStore) ClaimDelivery(id string, now time.Time, lease time.Duration) (WebhookDelivery, bool, error) {
+	d, raw, err := s.getDelivery(id)
+	if err != nil {
+		if errors.Is(err, ErrDeliveryNotFound) {
+			_ = s.kv.ZRem(webhookDueKey, id)
+			return WebhookDelivery{}, false, nil
+		}
+		return WebhookDelivery{}, false, err
+	}
+	if d.Status != DeliveryPending || d.NextAttemptAt == nil || d.NextAttemptAt.After(now) {
+		return WebhookDelivery{}, false, nil
+	}
+
+	d.Attempts++
+	next := now.Add(lease)
+	d.NextAttemptAt = &next
+	d.UpdatedAt = now
+
+	data, err := json.Marshal(d)
+	if err != nil {
+		return WebhookDelivery{}, false, err
+	}
+	swapped, err := s.kv.CompareAndSwap(deliveryKey(id), raw, string(data))
+	if err != nil || !swapped {
+		return WebhookDelivery{}, false, err
+	}
+	if err := s.kv.ZAdd(webhookDueKey, id, float64(next.UnixMilli())); err != nil {
+		return WebhookDelivery{}, false, err
+	}
+	return d, true, nil
+}
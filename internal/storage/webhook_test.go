@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWebhookStore_TrimKeepsPendingDeliveries(t *testing.T) {
+	store := NewWebhookStore(openTestKV(t, filepath.Join(t.TempDir(), "ark.db")))
+
+	base := time.Now().Add(-time.Hour)
+	due := base
+	// La mas vieja sigue pendiente (p.ej. el endpoint esta caido).
+	if err := store.AddDelivery(WebhookDelivery{ID: "old", WebhookID: "w1", Status: DeliveryPending, NextAttemptAt: &due, CreatedAt: base}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	for i := 1; i <= MaxWebhookDeliveries+5; i++ {
+		d := WebhookDelivery{ID: fmt.Sprintf("d%03d", i), WebhookID: "w1", Status: DeliverySucceeded, CreatedAt: base.Add(time.Duration(i) * time.Second)}
+		if err := store.AddDelivery(d); err != nil {
+			t.Fatalf("add %s: %v", d.ID, err)
+		}
+	}
+
+	if _, err := store.GetDelivery("old"); err != nil {
+		t.Fatalf("pending delivery must survive the trim: %v", err)
+	}
+	ids, err := store.DueDeliveries(time.Now(), 10)
+	if err != nil || len(ids) != 1 || ids[0] != "old" {
+		t.Fatalf("pending delivery must stay queued, got %v (%v)", ids, err)
+	}
+	list, _ := store.ListDeliveries("w1", 0)
+	if len(list) != MaxWebhookDeliveries {
+		t.Fatalf("expected %d deliveries kept, got %d", MaxWebhookDeliveries, len(list))
+	}
+	// Se recortan las terminadas en su lugar.
+	if _, err := store.GetDelivery("d006"); err == nil {
+		t.Fatalf("expected the oldest finished deliveries trimmed")
+	}
+	if _, err := store.GetDelivery("d007"); err != nil {
+		t.Fatalf("expected d007 kept: %v", err)
+	}
+}
+
+func TestWebhookStore_DueDeliveriesOnlyReturnsDue(t *testing.T) {
+	store := NewWebhookStore(openTestKV(t, filepath.Join(t.TempDir(), "ark.db")))
+
+	now := time.Now()
+	for i, offset := range []time.Duration{-2 * time.Minute, -time.Minute, time.Minute} {
+		next := now.Add(offset)
+		d := WebhookDelivery{ID: fmt.Sprintf("d%d", i), WebhookID: "w1", Status: DeliveryPending, NextAttemptAt: &next, CreatedAt: now}
+		if err := store.AddDelivery(d); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	if ids, err := store.DueDeliveries(now, 0); err != nil || len(ids) != 2 || ids[0] != "d0" || ids[1] != "d1" {
+		t.Fatalf("expected d0 and d1 due, got %v (%v)", ids, err)
+	}
+	if ids, _ := store.DueDeliveries(now, 1); len(ids) != 1 || ids[0] != "d0" {
+		t.Fatalf("expected only the most overdue with limit 1, got %v", ids)
+	}
+}
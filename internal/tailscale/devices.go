@@ -21,6 +21,7 @@ type Device struct {
 	ClientVersion   string    `json:"clientVersion,omitempty"`
 	UpdateAvailable bool      `json:"updateAvailable"`
 	BlocksInbound   bool      `json:"blocksIncomingConnections"`
+	Tags            []string  `json:"tags,omitempty"`
 }
 
 type DevicesResponse struct {
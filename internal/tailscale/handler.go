@@ -66,9 +66,7 @@ func (h *Handler) CurrentDevice(c *gin.Context) {
 	}
 
 	clientIP := strings.TrimSpace(c.ClientIP())
-	normalize := func(v string) string {
-		return strings.TrimSpace(strings.Split(strings.TrimSpace(v), "/")[0])
-	}
+	normalize := normalizeAddress
 
 	match := func(d Device) bool {
 		for _, a := range d.Addresses {
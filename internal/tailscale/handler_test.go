@@ -162,4 +162,76 @@ func TestGetDevice(t *testing.T) {
 
 		assert.Equal(t, http.StatusNotFound, w.Code)
 	})
-}
\ No newline at end of file
+}
+func TestIdentityResolver_MatchesAddressAndCaches(t *testing.T) {
+	client := &MockClient{devices: []Device{
+		{
+			ID:        "dev001",
+			Name:      "laptop-ana",
+			Addresses: []string{"100.64.0.7/32", "fd7a:115c:a1e0::7"},
+			User:      map[string]any{"loginName": "ana@example.com"},
+			Tags:      []string{"tag:ops"},
+		},
+	}}
+
+	r := NewIdentityResolver(client, time.Minute)
+
+	id, ok := r.Identify("100.64.0.7")
+	assert.True(t, ok)
+	assert.Equal(t, "ana@example.com", id.User)
+	assert.Equal(t, []string{"tag:ops"}, id.Tags)
+
+	_, ok = r.Identify("100.64.0.99")
+	assert.False(t, ok)
+
+	client.shouldError = true
+	id, ok = r.Identify("fd7a:115c:a1e0::7")
+	assert.True(t, ok, "cached devices must be used within the TTL")
+	assert.Equal(t, "dev001", id.DeviceID)
+}
+
+// blockingClient no responde hasta que se cierre release.
+type blockingClient struct {
+	MockClient
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingClient) ListDevices() ([]Device, error) {
+	b.started <- struct{}{}
+	<-b.release
+	return b.MockClient.ListDevices()
+}
+
+func TestIdentityResolver_RefreshDoesNotBlockLookups(t *testing.T) {
+	client := &blockingClient{
+		MockClient: MockClient{devices: []Device{{ID: "dev001", Addresses: []string{"100.64.0.7"}, User: map[string]any{"loginName": "ana@example.com"}}}},
+		started:    make(chan struct{}, 1),
+		release:    make(chan struct{}),
+	}
+	r := NewIdentityResolver(client, time.Minute)
+	clock := time.Now()
+	r.now = func() time.Time { return clock }
+
+	close(client.release)
+	_, ok := r.Identify("100.64.0.7")
+	assert.True(t, ok)
+	<-client.started
+
+	// Vence el cache: una request recarga y las demas siguen con el indice anterior.
+	client.release = make(chan struct{})
+	clock = clock.Add(2 * time.Minute)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.Identify("100.64.0.7")
+	}()
+	<-client.started
+
+	id, ok := r.Identify("100.64.0.7")
+	assert.True(t, ok, "lookups must not wait for the device list")
+	assert.Equal(t, "ana@example.com", id.User)
+
+	close(client.release)
+	<-done
+}
@@ -0,0 +1,131 @@
+package tailscale
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Identity es el usuario/tags de Tailscale detras de una IP de la malla.
+type Identity struct {
+	User     string   `json:"user"`
+	Tags     []string `json:"tags,omitempty"`
+	DeviceID string   `json:"device_id"`
+	Device   string   `json:"device"`
+}
+
+// IdentityResolver resuelve la IP del cliente contra Device.Addresses.
+// Cachea el listado de dispositivos para no consultar la API en cada request.
+type IdentityResolver struct {
+	client ClientAPI
+	ttl    time.Duration
+	now    func() time.Time
+
+	// fetching serializa las consultas a la API; mu solo protege el indice.
+	fetching  sync.Mutex
+	mu        sync.Mutex
+	byIP      map[string]Identity
+	fetchedAt time.Time
+}
+
+func NewIdentityResolver(client ClientAPI, ttl time.Duration) *IdentityResolver {
+	if ttl <= 0 {
+		ttl = time.Minute
+	}
+	return &IdentityResolver{
+		client: client,
+		ttl:    ttl,
+		now:    time.Now,
+		byIP:   make(map[string]Identity),
+	}
+}
+
+// Identify devuelve la identidad del dispositivo con esa IP, si existe.
+func (r *IdentityResolver) Identify(ip string) (Identity, bool) {
+	ip = normalizeAddress(ip)
+	if ip == "" {
+		return Identity{}, false
+	}
+
+	if loaded, stale := r.state(); stale {
+		r.refresh(loaded)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id, ok := r.byIP[ip]
+	return id, ok
+}
+
+func (r *IdentityResolver) state() (loaded bool, stale bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	loaded = !r.fetchedAt.IsZero()
+	return loaded, !loaded || r.now().Sub(r.fetchedAt) >= r.ttl
+}
+
+// refresh recarga el indice IP -> identidad. La API se consulta fuera del lock:
+// mientras tanto las demas requests usan el indice anterior (o esperan si
+// todavia no hay ninguno). Si la API falla se conserva el anterior.
+func (r *IdentityResolver) refresh(loaded bool) {
+	if !r.fetching.TryLock() {
+		if !loaded {
+			r.fetching.Lock()
+			r.fetching.Unlock()
+		}
+		return
+	}
+	defer r.fetching.Unlock()
+
+	// Otra request pudo haberlo recargado mientras se esperaba el turno.
+	if _, stale := r.state(); !stale {
+		return
+	}
+
+	devices, err := r.client.ListDevices()
+
+	var byIP map[string]Identity
+	if err == nil {
+		byIP = make(map[string]Identity, len(devices))
+		for _, d := range devices {
+			id := Identity{
+				User:     resolveDeviceUser(d),
+				Tags:     d.Tags,
+				DeviceID: d.ID,
+				Device:   d.Name,
+			}
+			for _, a := range d.Addresses {
+				if n := normalizeAddress(a); n != "" {
+					byIP[n] = id
+				}
+			}
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fetchedAt = r.now()
+	if byIP != nil {
+		r.byIP = byIP
+	}
+}
+
+func normalizeAddress(v string) string {
+	return strings.TrimSpace(strings.Split(strings.TrimSpace(v), "/")[0])
+}
+
+// Identifier resuelve una IP a su identidad; lo cumple IdentityResolver.
+type Identifier interface {
+	Identify(ip string) (Identity, bool)
+}
+
+// Actor nombra a quien hace un request para registrarlo: el usuario de
+// Tailscale si la IP es de la malla y, si no, la IP.
+func Actor(r Identifier, ip string) string {
+	if r != nil {
+		if id, ok := r.Identify(ip); ok && id.User != "" {
+			return id.User
+		}
+	}
+	return ip
+}
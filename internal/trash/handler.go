@@ -0,0 +1,37 @@
+package trash
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"ark_deploy/internal/storage"
+)
+
+type Handler struct {
+	store *storage.TrashStore
+}
+
+func NewHandler(store *storage.TrashStore) *Handler {
+	return &Handler{store: store}
+}
+
+// List muestra la papelera; ?kind=product|instance filtra por tipo.
+func (h *Handler) List(c *gin.Context) {
+	kind := strings.ToLower(strings.TrimSpace(c.Query("kind")))
+	if kind != "" && kind != storage.TrashProduct && kind != storage.TrashInstance {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "kind must be product or instance"})
+		return
+	}
+
+	items, err := h.store.List(kind)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"total": len(items),
+		"items": items,
+	})
+}
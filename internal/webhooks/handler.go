@@ -0,0 +1,287 @@
+package webhooks
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"ark_deploy/internal/audit"
+	"ark_deploy/internal/events"
+	"ark_deploy/internal/storage"
+)
+
+type Handler struct {
+	store      *storage.WebhookStore
+	dispatcher *Dispatcher
+}
+
+func NewHandler(store *storage.WebhookStore, dispatcher *Dispatcher) *Handler {
+	return &Handler{store: store, dispatcher: dispatcher}
+}
+
+type webhookReq struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	// Secret vacio genera uno al crear y conserva el actual al actualizar.
+	Secret string `json:"secret"`
+	Active *bool  `json:"active"`
+}
+
+// Validate revisa la URL y el filtro de eventos. La usa tambien la importacion de backups.
+func Validate(w storage.Webhook) error {
+	u, err := url.Parse(strings.TrimSpace(w.URL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	for _, f := range w.Events {
+		if !knownFilter(f) {
+			return errors.New("unknown event type: " + f)
+		}
+	}
+	return nil
+}
+
+// validate suma a Validate el rechazo de las IPs internas escritas en la URL;
+// los nombres se revisan al conectar.
+func (h *Handler) validate(w storage.Webhook) error {
+	if err := Validate(w); err != nil {
+		return err
+	}
+	u, _ := url.Parse(strings.TrimSpace(w.URL))
+	if ip := net.ParseIP(u.Hostname()); ip != nil && h.dispatcher != nil && !h.dispatcher.Allowed(ip) {
+		return errors.New("url points to an internal address; add it to ARK_WEBHOOK_ALLOWED_NETWORKS to allow it")
+	}
+	return nil
+}
+
+// knownFilter acepta "*", un tipo publicado o un prefijo de alguno terminado en ".".
+func knownFilter(f string) bool {
+	if f == "*" {
+		return true
+	}
+	for _, t := range events.Types {
+		if f == t || (strings.HasSuffix(f, ".") && strings.HasPrefix(t, f)) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeEvents(in []string) []string {
+	out := make([]string, 0, len(in))
+	seen := make(map[string]bool, len(in))
+	for _, raw := range in {
+		f := strings.ToLower(strings.TrimSpace(raw))
+		if f == "" || seen[f] {
+			continue
+		}
+		seen[f] = true
+		out = append(out, f)
+	}
+	return out
+}
+
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// view oculta el secreto; solo se devuelve al crear el webhook.
+func view(w storage.Webhook) storage.Webhook {
+	w.Secret = ""
+	return w
+}
+
+// auditFields es lo que se audita de un webhook, sin el secreto.
+func auditFields(w storage.Webhook) gin.H {
+	return gin.H{"url": w.URL, "events": w.Events, "active": w.Active}
+}
+
+func (h *Handler) List(c *gin.Context) {
+	hooks, err := h.store.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+	out := make([]storage.Webhook, 0, len(hooks))
+	for _, w := range hooks {
+		out = append(out, view(w))
+	}
+	c.JSON(http.StatusOK, gin.H{"total": len(out), "webhooks": out})
+}
+
+func (h *Handler) Get(c *gin.Context) {
+	w, ok := h.find(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, view(w))
+}
+
+func (h *Handler) find(c *gin.Context) (storage.Webhook, bool) {
+	w, found, err := h.store.Get(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return storage.Webhook{}, false
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "webhook not found"})
+		return storage.Webhook{}, false
+	}
+	return w, true
+}
+
+func (h *Handler) Create(c *gin.Context) {
+	var req webhookReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+
+	now := time.Now().UTC()
+	w := storage.Webhook{
+		ID:        uuid.New().String(),
+		URL:       strings.TrimSpace(req.URL),
+		Events:    normalizeEvents(req.Events),
+		Secret:    strings.TrimSpace(req.Secret),
+		Active:    req.Active == nil || *req.Active,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := h.validate(w); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+	if w.Secret == "" {
+		secret, err := newSecret()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+			return
+		}
+		w.Secret = secret
+	}
+
+	if err := h.store.Create(w); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+	audit.Record(c, w.ID, nil, auditFields(w))
+
+	c.JSON(http.StatusCreated, w)
+}
+
+func (h *Handler) Update(c *gin.Context) {
+	existing, ok := h.find(c)
+	if !ok {
+		return
+	}
+
+	var req webhookReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+
+	w := existing
+	w.URL = strings.TrimSpace(req.URL)
+	w.Events = normalizeEvents(req.Events)
+	if secret := strings.TrimSpace(req.Secret); secret != "" {
+		w.Secret = secret
+	}
+	if req.Active != nil {
+		w.Active = *req.Active
+	}
+	w.UpdatedAt = time.Now().UTC()
+	if err := h.validate(w); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+
+	if err := h.store.Update(w); err != nil {
+		if errors.Is(err, storage.ErrWebhookNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"detail": "webhook not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+	audit.Record(c, w.ID, auditFields(existing), auditFields(w))
+
+	c.JSON(http.StatusOK, view(w))
+}
+
+func (h *Handler) Delete(c *gin.Context) {
+	existing, ok := h.find(c)
+	if !ok {
+		return
+	}
+	if err := h.store.Delete(existing.ID); err != nil {
+		if errors.Is(err, storage.ErrWebhookNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"detail": "webhook not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+	audit.Record(c, existing.ID, auditFields(existing), nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "webhook deleted", "id": existing.ID})
+}
+
+// Deliveries devuelve el historial de entregas, lo mas nuevo primero; ?limit (1-100).
+func (h *Handler) Deliveries(c *gin.Context) {
+	w, ok := h.find(c)
+	if !ok {
+		return
+	}
+
+	limit := storage.MaxWebhookDeliveries
+	if raw := strings.TrimSpace(c.Query("limit")); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > storage.MaxWebhookDeliveries {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": "limit must be between 1 and 100"})
+			return
+		}
+		limit = n
+	}
+
+	deliveries, err := h.store.ListDeliveries(w.ID, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"webhook_id": w.ID, "deliveries": deliveries})
+}
+
+// Redeliver vuelve a encolar el payload de una entrega como una entrega nueva.
+func (h *Handler) Redeliver(c *gin.Context) {
+	w, ok := h.find(c)
+	if !ok {
+		return
+	}
+
+	delivery, err := h.dispatcher.Redeliver(w.ID, c.Param("delivery"))
+	if err != nil {
+		if errors.Is(err, storage.ErrDeliveryNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"detail": "delivery not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": err.Error()})
+		return
+	}
+	audit.Record(c, "", nil, gin.H{"delivery": delivery.ID})
+
+	c.JSON(http.StatusAccepted, delivery)
+}
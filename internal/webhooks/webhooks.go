@@ -0,0 +1,370 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+
+	"ark_deploy/internal/events"
+	"ark_deploy/internal/storage"
+)
+
+// Webhooks salientes: el dispatcher se suscribe al bus de eventos, crea una
+// entrega por cada webhook activo al que le interesa el evento y las envia
+// firmadas (HMAC-SHA256). Las que fallan se reintentan con backoff exponencial
+// hasta agotar los intentos; el historial permite reenviarlas a mano.
+
+const (
+	DefaultMaxAttempts = 6
+	defaultBaseDelay   = 30 * time.Second
+	defaultMaxDelay    = time.Hour
+	deliveryTimeout    = 10 * time.Second
+	// claimLease es lo que una replica se reserva una entrega mientras la envia.
+	claimLease     = time.Minute
+	dueBatch       = 100
+	maxErrorLength = 300
+)
+
+// Headers de cada entrega. La firma es HMAC-SHA256 de "<timestamp>.<body>"
+// con el secreto del webhook.
+const (
+	HeaderEvent     = "X-Ark-Event"
+	HeaderDelivery  = "X-Ark-Delivery"
+	HeaderTimestamp = "X-Ark-Timestamp"
+	HeaderSignature = "X-Ark-Signature"
+)
+
+// Sign devuelve el valor de X-Ark-Signature ("sha256=<hex>").
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// ErrBlockedDestination es el error de una entrega a una direccion interna
+// que no esta en la allowlist.
+var ErrBlockedDestination = errors.New("destination address is not allowed")
+
+// tailnet es el rango de la malla de Tailscale (CGNAT); como las redes privadas
+// solo se alcanza si esta en la allowlist.
+var tailnet = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// internalIP indica si ip es loopback, privada, link-local, de la malla u otra
+// direccion que no deberia recibir webhooks.
+func internalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || tailnet.Contains(ip)
+}
+
+// Matches indica si al webhook le interesa el tipo de evento.
+func Matches(w storage.Webhook, eventType string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, f := range w.Events {
+		switch {
+		case f == "*", f == eventType:
+			return true
+		case strings.HasSuffix(f, ".") && strings.HasPrefix(eventType, f):
+			return true
+		}
+	}
+	return false
+}
+
+type Dispatcher struct {
+	store       *storage.WebhookStore
+	httpc       *http.Client
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	now         func() time.Time
+	// allowed son las redes internas a las que si se puede entregar.
+	allowed []*net.IPNet
+}
+
+func NewDispatcher(store *storage.WebhookStore) *Dispatcher {
+	d := &Dispatcher{
+		store:       store,
+		maxAttempts: DefaultMaxAttempts,
+		baseDelay:   defaultBaseDelay,
+		maxDelay:    defaultMaxDelay,
+		now:         time.Now,
+	}
+
+	// La IP se revisa al conectar, ya resuelta, asi un DNS que cambia despues de
+	// validar no sirve para llegar a la red interna. Sin proxy del entorno y sin
+	// seguir redirecciones por el mismo motivo.
+	dialer := &net.Dialer{Timeout: deliveryTimeout, Control: d.checkDial}
+	d.httpc = &http.Client{
+		Timeout: deliveryTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			TLSHandshakeTimeout: deliveryTimeout,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return d
+}
+
+// WithAllowedNetworks permite entregar a estas redes aunque sean internas
+// (loopback, privadas, link-local o la malla de Tailscale).
+func (d *Dispatcher) WithAllowedNetworks(nets []*net.IPNet) *Dispatcher {
+	d.allowed = nets
+	return d
+}
+
+// Allowed indica si se puede entregar a ip.
+func (d *Dispatcher) Allowed(ip net.IP) bool {
+	if !internalIP(ip) {
+		return true
+	}
+	for _, n := range d.allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Dispatcher) checkDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !d.Allowed(ip) {
+		return fmt.Errorf("%w: %s", ErrBlockedDestination, host)
+	}
+	return nil
+}
+
+// WithRetry fija los intentos por entrega y el backoff: el intento n espera
+// base*2^(n-1), como mucho max. Los valores <= 0 no cambian.
+func (d *Dispatcher) WithRetry(maxAttempts int, base, max time.Duration) *Dispatcher {
+	if maxAttempts > 0 {
+		d.maxAttempts = maxAttempts
+	}
+	if base > 0 {
+		d.baseDelay = base
+	}
+	if max > 0 {
+		d.maxDelay = max
+	}
+	return d
+}
+
+// Enqueue crea las entregas del evento; es el handler de la suscripcion al bus.
+// Si falla a mitad el bus lo reintenta y las entregas ya creadas no se repiten.
+func (d *Dispatcher) Enqueue(e events.Event) error {
+	hooks, err := d.store.List()
+	if err != nil {
+		return err
+	}
+
+	var payload []byte
+	for _, w := range hooks {
+		if !w.Active || !Matches(w, e.Type) {
+			continue
+		}
+		if payload == nil {
+			if payload, err = json.Marshal(e); err != nil {
+				return err
+			}
+		}
+		next := d.newDelivery(w.ID, e.ID, e.Type, payload)
+		if e.ID != "" {
+			next.ID = eventDeliveryID(e.ID, w.ID)
+		}
+		if err := d.store.AddDelivery(next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eventDeliveryID es el id de la entrega de un evento a un webhook. Es fijo
+// para que reprocesar el evento despues de un error a mitad del loop no
+// duplique las entregas ya creadas.
+func eventDeliveryID(eventID, webhookID string) string {
+	return eventID + "." + webhookID
+}
+
+func (d *Dispatcher) newDelivery(webhookID, eventID, eventType string, payload []byte) storage.WebhookDelivery {
+	now := d.now().UTC()
+	return storage.WebhookDelivery{
+		ID:            uuid.New().String(),
+		WebhookID:     webhookID,
+		EventID:       eventID,
+		EventType:     eventType,
+		Payload:       payload,
+		Status:        storage.DeliveryPending,
+		NextAttemptAt: &now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+}
+
+// Redeliver encola de nuevo el payload de una entrega, como una entrega nueva.
+func (d *Dispatcher) Redeliver(webhookID, deliveryID string) (storage.WebhookDelivery, error) {
+	prev, err := d.store.GetDelivery(deliveryID)
+	if err != nil {
+		return storage.WebhookDelivery{}, err
+	}
+	if prev.WebhookID != webhookID {
+		return storage.WebhookDelivery{}, storage.ErrDeliveryNotFound
+	}
+
+	next := d.newDelivery(webhookID, prev.EventID, prev.EventType, prev.Payload)
+	next.RedeliveryOf = prev.ID
+	if err := d.store.AddDelivery(next); err != nil {
+		return storage.WebhookDelivery{}, err
+	}
+	return next, nil
+}
+
+// Run envia las entregas vencidas cada every hasta que se cancela el contexto.
+func (d *Dispatcher) Run(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		d.DeliverDue(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DeliverDue intenta las entregas vencidas y devuelve cuantas intento.
+func (d *Dispatcher) DeliverDue(ctx context.Context) int {
+	ids, err := d.store.DueDeliveries(d.now(), dueBatch)
+	if err != nil {
+		log.Printf("webhooks: list due deliveries: %v", err)
+		return 0
+	}
+
+	attempted := 0
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			break
+		}
+		delivery, ok, err := d.store.ClaimDelivery(id, d.now(), claimLease)
+		if err != nil {
+			log.Printf("webhooks: claim %s: %v", id, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		d.attempt(ctx, delivery)
+		attempted++
+	}
+	return attempted
+}
+
+func (d *Dispatcher) attempt(ctx context.Context, delivery storage.WebhookDelivery) {
+	// Si el webhook se borro o se desactivo la entrega falla sin reintentos.
+	w, found, err := d.store.Get(delivery.WebhookID)
+	gone := false
+	switch {
+	case err != nil:
+	case !found:
+		err, gone = storage.ErrWebhookNotFound, true
+	case !w.Active:
+		err, gone = errors.New("webhook is disabled"), true
+	}
+
+	status := 0
+	if err == nil {
+		status, err = d.send(ctx, w, delivery)
+	}
+
+	now := d.now().UTC()
+	delivery.ResponseStatus = status
+	delivery.UpdatedAt = now
+	delivery.Error = ""
+	delivery.NextAttemptAt = nil
+
+	switch {
+	case err == nil:
+		delivery.Status = storage.DeliverySucceeded
+	case delivery.Attempts >= d.maxAttempts || gone:
+		delivery.Status = storage.DeliveryFailed
+		delivery.Error = truncate(err.Error())
+	default:
+		delivery.Error = truncate(err.Error())
+		next := now.Add(d.backoff(delivery.Attempts))
+		delivery.NextAttemptAt = &next
+	}
+
+	if err := d.store.SaveDelivery(delivery); err != nil {
+		log.Printf("webhooks: save delivery %s: %v", delivery.ID, err)
+	}
+}
+
+func (d *Dispatcher) send(ctx context.Context, w storage.Webhook, delivery storage.WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	ts := d.now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ark-webhooks")
+	req.Header.Set(HeaderEvent, delivery.EventType)
+	req.Header.Set(HeaderDelivery, delivery.ID)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(ts, 10))
+	req.Header.Set(HeaderSignature, Sign(w.Secret, ts, delivery.Payload))
+
+	resp, err := d.httpc.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// backoff es la espera antes del intento siguiente a attempts.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.baseDelay
+	for i := 1; i < attempts && delay < d.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > d.maxDelay {
+		delay = d.maxDelay
+	}
+	return delay
+}
+
+func truncate(s string) string {
+	if len(s) > maxErrorLength {
+		return s[:maxErrorLength]
+	}
+	return s
+}
@@ -0,0 +1,348 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"ark_deploy/internal/events"
+	"ark_deploy/internal/storage"
+)
+
+// receiver es un endpoint local que verifica la firma y responde con los
+// status que se le indiquen (200 cuando se acaban).
+type receiver struct {
+	t       *testing.T
+	secret  string
+	mu      sync.Mutex
+	replies []int
+	got     []events.Event
+	srv     *httptest.Server
+}
+
+func newReceiver(t *testing.T, replies ...int) *receiver {
+	r := &receiver{t: t, replies: replies}
+	r.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		ts, _ := strconv.ParseInt(req.Header.Get(HeaderTimestamp), 10, 64)
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if req.Header.Get(HeaderSignature) != Sign(r.secret, ts, body) {
+			r.t.Errorf("bad signature %q", req.Header.Get(HeaderSignature))
+		}
+		var e events.Event
+		_ = json.Unmarshal(body, &e)
+		if req.Header.Get(HeaderEvent) != e.Type || req.Header.Get(HeaderDelivery) == "" {
+			r.t.Errorf("unexpected headers: %v", req.Header)
+		}
+		r.got = append(r.got, e)
+
+		status := http.StatusOK
+		if len(r.replies) > 0 {
+			status, r.replies = r.replies[0], r.replies[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.srv.Close)
+	return r
+}
+
+func (r *receiver) received() []events.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]events.Event(nil), r.got...)
+}
+
+type fixture struct {
+	store      *storage.WebhookStore
+	dispatcher *Dispatcher
+	router     *gin.Engine
+	clock      time.Time
+}
+
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	kv, err := storage.OpenFileKV(filepath.Join(t.TempDir(), "ark.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { kv.Close() })
+
+	f := &fixture{store: storage.NewWebhookStore(kv), clock: time.Now()}
+	// El receptor de los tests escucha en loopback.
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	f.dispatcher = NewDispatcher(f.store).
+		WithRetry(3, time.Second, 10*time.Second).
+		WithAllowedNetworks([]*net.IPNet{loopback})
+	f.dispatcher.now = func() time.Time { return f.clock }
+
+	h := NewHandler(f.store, f.dispatcher)
+	f.router = gin.New()
+	f.router.GET("/api/webhooks", h.List)
+	f.router.POST("/api/webhooks", h.Create)
+	f.router.PUT("/api/webhooks/:id", h.Update)
+	f.router.DELETE("/api/webhooks/:id", h.Delete)
+	f.router.GET("/api/webhooks/:id/deliveries", h.Deliveries)
+	f.router.POST("/api/webhooks/:id/deliveries/:delivery/redeliver", h.Redeliver)
+	return f
+}
+
+func (f *fixture) do(t *testing.T, method, path, body string, out any) int {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	f.router.ServeHTTP(w, req)
+	if out != nil {
+		_ = json.Unmarshal(w.Body.Bytes(), out)
+	}
+	return w.Code
+}
+
+func (f *fixture) create(t *testing.T, r *receiver, events string) storage.Webhook {
+	t.Helper()
+	var w storage.Webhook
+	code := f.do(t, http.MethodPost, "/api/webhooks", `{"url":"`+r.srv.URL+`","events":`+events+`}`, &w)
+	if code != http.StatusCreated || w.Secret == "" {
+		t.Fatalf("create: %d %+v", code, w)
+	}
+	r.secret = w.Secret
+	return w
+}
+
+func (f *fixture) deliveries(t *testing.T, id string) []storage.WebhookDelivery {
+	t.Helper()
+	var resp struct {
+		Deliveries []storage.WebhookDelivery `json:"deliveries"`
+	}
+	if code := f.do(t, http.MethodGet, "/api/webhooks/"+id+"/deliveries", "", &resp); code != http.StatusOK {
+		t.Fatalf("deliveries: %d", code)
+	}
+	return resp.Deliveries
+}
+
+func TestWebhooks_SignedDeliveryAndFilter(t *testing.T) {
+	f := newFixture(t)
+	r := newReceiver(t)
+	w := f.create(t, r, `["instance.","build.finished"]`)
+
+	var list struct {
+		Webhooks []storage.Webhook `json:"webhooks"`
+	}
+	f.do(t, http.MethodGet, "/api/webhooks", "", &list)
+	if len(list.Webhooks) != 1 || list.Webhooks[0].Secret != "" {
+		t.Fatalf("list must hide the secret: %+v", list.Webhooks)
+	}
+
+	_ = f.dispatcher.Enqueue(events.Event{ID: "1-0", Type: events.InstanceFailed, InstanceID: "i1"})
+	_ = f.dispatcher.Enqueue(events.Event{ID: "2-0", Type: events.ProductUpdated, ProductID: "shop"})
+	_ = f.dispatcher.Enqueue(events.Event{ID: "3-0", Type: events.BuildFinished, InstanceID: "i1"})
+
+	if n := f.dispatcher.DeliverDue(context.Background()); n != 2 {
+		t.Fatalf("expected 2 deliveries attempted, got %d", n)
+	}
+	// Vencen en el mismo instante, asi que el orden entre ellas no importa.
+	got := map[string]bool{}
+	for _, e := range r.received() {
+		got[e.Type] = true
+	}
+	if len(got) != 2 || !got[events.InstanceFailed] || !got[events.BuildFinished] {
+		t.Fatalf("unexpected deliveries: %+v", r.received())
+	}
+	for _, d := range f.deliveries(t, w.ID) {
+		if d.Status != storage.DeliverySucceeded || d.Attempts != 1 || d.ResponseStatus != http.StatusOK {
+			t.Fatalf("unexpected delivery log entry: %+v", d)
+		}
+	}
+}
+
+func TestWebhooks_RetriesWithBackoff(t *testing.T) {
+	f := newFixture(t)
+	r := newReceiver(t, http.StatusInternalServerError, http.StatusBadGateway)
+	w := f.create(t, r, `[]`)
+
+	_ = f.dispatcher.Enqueue(events.Event{ID: "1-0", Type: events.DeploymentCreated})
+	ctx := context.Background()
+
+	f.dispatcher.DeliverDue(ctx)
+	d := f.deliveries(t, w.ID)[0]
+	if d.Status != storage.DeliveryPending || d.Attempts != 1 || d.ResponseStatus != http.StatusInternalServerError {
+		t.Fatalf("expected pending after first failure, got %+v", d)
+	}
+	if wait := d.NextAttemptAt.Sub(f.clock); wait != time.Second {
+		t.Fatalf("expected 1s backoff, got %s", wait)
+	}
+
+	// Antes de que venza no se reintenta.
+	if n := f.dispatcher.DeliverDue(ctx); n != 0 {
+		t.Fatalf("retried before backoff elapsed")
+	}
+
+	f.clock = f.clock.Add(time.Second)
+	f.dispatcher.DeliverDue(ctx)
+	d = f.deliveries(t, w.ID)[0]
+	if wait := d.NextAttemptAt.Sub(f.clock); d.Attempts != 2 || wait != 2*time.Second {
+		t.Fatalf("expected second backoff of 2s, got %+v (%s)", d, wait)
+	}
+
+	f.clock = f.clock.Add(2 * time.Second)
+	f.dispatcher.DeliverDue(ctx)
+	d = f.deliveries(t, w.ID)[0]
+	if d.Status != storage.DeliverySucceeded || d.Attempts != 3 || d.NextAttemptAt != nil {
+		t.Fatalf("expected success on third attempt, got %+v", d)
+	}
+	if len(r.received()) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(r.received()))
+	}
+}
+
+func TestWebhooks_GivesUpAndRedelivers(t *testing.T) {
+	f := newFixture(t)
+	r := newReceiver(t, 500, 500, 500)
+	w := f.create(t, r, `["deployment.created"]`)
+
+	_ = f.dispatcher.Enqueue(events.Event{ID: "1-0", Type: events.DeploymentCreated, InstanceID: "i1"})
+	for i := 0; i < 5; i++ {
+		f.dispatcher.DeliverDue(context.Background())
+		f.clock = f.clock.Add(time.Minute)
+	}
+
+	failed := f.deliveries(t, w.ID)[0]
+	if failed.Status != storage.DeliveryFailed || failed.Attempts != 3 || failed.Error == "" {
+		t.Fatalf("expected failed after 3 attempts, got %+v", failed)
+	}
+
+	var redelivery storage.WebhookDelivery
+	path := "/api/webhooks/" + w.ID + "/deliveries/" + failed.ID + "/redeliver"
+	if code := f.do(t, http.MethodPost, path, "", &redelivery); code != http.StatusAccepted {
+		t.Fatalf("redeliver: %d", code)
+	}
+	if redelivery.RedeliveryOf != failed.ID || redelivery.EventID != "1-0" {
+		t.Fatalf("unexpected redelivery: %+v", redelivery)
+	}
+
+	f.dispatcher.DeliverDue(context.Background())
+	log := f.deliveries(t, w.ID)
+	if len(log) != 2 || log[0].ID != redelivery.ID || log[0].Status != storage.DeliverySucceeded {
+		t.Fatalf("expected redelivery to succeed, got %+v", log)
+	}
+	if got := r.received(); got[len(got)-1].InstanceID != "i1" {
+		t.Fatalf("redelivery must resend the original payload, got %+v", got[len(got)-1])
+	}
+
+	if code := f.do(t, http.MethodPost, "/api/webhooks/"+w.ID+"/deliveries/missing/redeliver", "", nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown delivery, got %d", code)
+	}
+}
+
+func TestWebhooks_Validation(t *testing.T) {
+	f := newFixture(t)
+
+	for _, body := range []string{
+		`{"url":"ftp://example.com/hook"}`,
+		`{"url":"/relative"}`,
+		`{"url":"https://example.com/hook","events":["deployment.finished"]}`,
+	} {
+		if code := f.do(t, http.MethodPost, "/api/webhooks", body, nil); code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %s, got %d", body, code)
+		}
+	}
+
+	var w storage.Webhook
+	f.do(t, http.MethodPost, "/api/webhooks", `{"url":"https://example.com/hook","secret":"s3cret","events":["*"]}`, &w)
+	if w.Secret != "s3cret" {
+		t.Fatalf("expected the given secret to be kept, got %+v", w)
+	}
+
+	var updated storage.Webhook
+	code := f.do(t, http.MethodPut, "/api/webhooks/"+w.ID, `{"url":"https://example.com/other","active":false}`, &updated)
+	if code != http.StatusOK || updated.Active || updated.URL != "https://example.com/other" || updated.Secret != "" {
+		t.Fatalf("unexpected update: %d %+v", code, updated)
+	}
+	stored, _, _ := f.store.Get(w.ID)
+	if stored.Secret != "s3cret" {
+		t.Fatalf("update without secret must keep it, got %q", stored.Secret)
+	}
+
+	if code := f.do(t, http.MethodDelete, "/api/webhooks/"+w.ID, "", nil); code != http.StatusOK {
+		t.Fatalf("delete: %d", code)
+	}
+	if code := f.do(t, http.MethodDelete, "/api/webhooks/"+w.ID, "", nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404 after delete, got %d", code)
+	}
+}
+
+func TestWebhooks_EnqueueIsIdempotentPerEvent(t *testing.T) {
+	f := newFixture(t)
+	r := newReceiver(t)
+	w := f.create(t, r, `[]`)
+
+	// El bus reintenta el evento si Enqueue fallo a mitad: no se duplica.
+	e := events.Event{ID: "7-0", Type: events.DeploymentCreated}
+	_ = f.dispatcher.Enqueue(e)
+	_ = f.dispatcher.Enqueue(e)
+
+	log := f.deliveries(t, w.ID)
+	if len(log) != 1 || log[0].ID != eventDeliveryID("7-0", w.ID) {
+		t.Fatalf("expected a single deterministic delivery, got %+v", log)
+	}
+	if n := f.dispatcher.DeliverDue(context.Background()); n != 1 || len(r.received()) != 1 {
+		t.Fatalf("expected one request, got %d attempts and %d requests", n, len(r.received()))
+	}
+}
+
+func TestWebhooks_RefusesInternalDestinationsAndRedirects(t *testing.T) {
+	f := newFixture(t)
+	r := newReceiver(t)
+	w := f.create(t, r, `[]`)
+
+	// Sin allowlist el mismo receptor en loopback se rechaza al conectar.
+	strict := NewDispatcher(f.store)
+	strict.now = f.dispatcher.now
+	_ = strict.Enqueue(events.Event{ID: "1-0", Type: events.DeploymentCreated})
+	strict.DeliverDue(context.Background())
+	d := f.deliveries(t, w.ID)[0]
+	if d.Status != storage.DeliveryPending || !strings.Contains(d.Error, ErrBlockedDestination.Error()) || len(r.received()) != 0 {
+		t.Fatalf("expected delivery to loopback refused, got %+v (%d requests)", d, len(r.received()))
+	}
+
+	// Una IP interna escrita en la URL se rechaza al crear.
+	h := NewHandler(f.store, strict)
+	router := gin.New()
+	router.POST("/api/webhooks", h.Create)
+	for _, u := range []string{"http://127.0.0.1:9/hook", "http://10.0.0.5/hook", "http://169.254.169.254/latest", "http://100.100.1.2/hook", "http://[::1]/hook"} {
+		req := httptest.NewRequest(http.MethodPost, "/api/webhooks", strings.NewReader(`{"url":"`+u+`"}`))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %s, got %d", u, rec.Code)
+		}
+	}
+	if !strict.Allowed(net.ParseIP("93.184.216.34")) {
+		t.Fatalf("public addresses must be allowed")
+	}
+
+	// Las redirecciones no se siguen: cuentan como fallo.
+	target := newReceiver(t)
+	redirect := httptest.NewServer(http.RedirectHandler(target.srv.URL, http.StatusFound))
+	t.Cleanup(redirect.Close)
+	hook := storage.Webhook{ID: "redirect", URL: redirect.URL, Active: true, Secret: "s"}
+	status, err := f.dispatcher.send(context.Background(), hook, storage.WebhookDelivery{ID: "d", EventType: events.DeploymentCreated, Payload: []byte(`{}`)})
+	if status != http.StatusFound || err == nil || len(target.received()) != 0 {
+		t.Fatalf("expected redirect refused, got %d %v (%d requests)", status, err, len(target.received()))
+	}
+}